@@ -0,0 +1,459 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// adminSocket is the path of the Unix socket the admin API is served on,
+	// it's disabled when empty
+	adminSocket string
+	// adminToken is the bearer token the admin API requests must have, from
+	// --admin-token-file. It's only empty with --admin-insecure-no-token, the
+	// socket's permissions are then the only protection.
+	adminToken           string
+	adminTokenFile       string
+	adminInsecureNoToken bool
+)
+
+const defaultAdminSocket = "/var/run/k8s-pvc-tagger/admin.sock"
+
+// pausedNamespaceStore keeps the namespaces whose volumes aren't tagged
+// until they're resumed with the admin API
+type pausedNamespaceStore struct {
+	sync.Mutex
+	namespaces map[string]bool
+}
+
+var pausedNamespaces = newPausedNamespaceStore()
+
+func newPausedNamespaceStore() *pausedNamespaceStore {
+	return &pausedNamespaceStore{namespaces: map[string]bool{}}
+}
+
+func (s *pausedNamespaceStore) pause(namespace string) {
+	s.Lock()
+	defer s.Unlock()
+	s.namespaces[namespace] = true
+	promPausedNamespaces.Set(float64(len(s.namespaces)))
+}
+
+// resume returns whether the namespace was paused
+func (s *pausedNamespaceStore) resume(namespace string) bool {
+	s.Lock()
+	defer s.Unlock()
+	paused := s.namespaces[namespace]
+	delete(s.namespaces, namespace)
+	promPausedNamespaces.Set(float64(len(s.namespaces)))
+	return paused
+}
+
+func (s *pausedNamespaceStore) isPaused(namespace string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.namespaces[namespace]
+}
+
+// list returns the paused namespaces, sorted
+func (s *pausedNamespaceStore) list() []string {
+	s.Lock()
+	defer s.Unlock()
+	namespaces := []string{}
+	for namespace := range s.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// pvcInformer is the store of a running PVC informer and the clients its
+// PVCs are tagged with
+type pvcInformer struct {
+	store     cache.Store
+	efsClient *EFSClient
+	ec2Client *EBSClient
+}
+
+// pvcInformerRegistry keeps the running PVC informers, so that the admin API
+// can resync their PVCs from their stores without an API server call
+type pvcInformerRegistry struct {
+	sync.Mutex
+	informers map[int]pvcInformer
+	next      int
+}
+
+var pvcInformers = newPVCInformerRegistry()
+
+func newPVCInformerRegistry() *pvcInformerRegistry {
+	return &pvcInformerRegistry{informers: map[int]pvcInformer{}}
+}
+
+// add registers the informer until ch is closed
+func (r *pvcInformerRegistry) add(ch chan struct{}, informer pvcInformer) {
+	r.Lock()
+	id := r.next
+	r.next++
+	r.informers[id] = informer
+	r.Unlock()
+	go func() {
+		<-ch
+		r.Lock()
+		defer r.Unlock()
+		delete(r.informers, id)
+	}()
+}
+
+// resync reconciles the PVCs of the namespace, or all the PVCs when it's
+// empty, or only the named PVC, even if their tags haven't changed. The
+// trigger is traced and logged. It returns the number of PVCs reconciled.
+func (r *pvcInformerRegistry) resync(namespace string, name string, trigger string) int {
+	r.Lock()
+	informers := make([]pvcInformer, 0, len(r.informers))
+	for _, informer := range r.informers {
+		informers = append(informers, informer)
+	}
+	r.Unlock()
+
+	count := 0
+	for _, informer := range informers {
+		for _, obj := range informer.store.List() {
+			pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+			if !ok || (namespace != "" && pvc.GetNamespace() != namespace) || (name != "" && pvc.GetName() != name) {
+				continue
+			}
+			if !isSupportedProvisioner(pvc) || getProvider(pvc) == "" || pvc.Spec.VolumeName == "" || pvc.GetDeletionTimestamp() != nil {
+				continue
+			}
+			forceResync(pvc, trigger, informer.efsClient, informer.ec2Client)
+			count++
+		}
+	}
+	return count
+}
+
+// list returns the PVCs of the namespace, or all the PVCs when it's empty,
+// from the stores of the running informers. It returns false when no informer
+// is running, e.g. on a replica that isn't the leader.
+func (r *pvcInformerRegistry) list(namespace string) ([]*corev1.PersistentVolumeClaim, bool) {
+	r.Lock()
+	informers := make([]pvcInformer, 0, len(r.informers))
+	for _, informer := range r.informers {
+		informers = append(informers, informer)
+	}
+	r.Unlock()
+	if len(informers) == 0 {
+		return nil, false
+	}
+
+	var pvcs []*corev1.PersistentVolumeClaim
+	for _, informer := range informers {
+		for _, obj := range informer.store.List() {
+			pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+			if !ok || (namespace != "" && pvc.GetNamespace() != namespace) {
+				continue
+			}
+			pvcs = append(pvcs, pvc)
+		}
+	}
+	return pvcs, true
+}
+
+// forceResync tags the PVC's volume with its current tags, like a change of
+// its sync-at annotation
+func forceResync(pvc *corev1.PersistentVolumeClaim, trigger string, efsClient *EFSClient, ec2Client *EBSClient) {
+	reconcileTraces.start(pvc, trigger)
+	volumeID, tags, err := processPersistentVolumeClaim(pvc)
+	tracePVC(pvc, log.Fields{"volumeID": volumeID, "tags": tags, "error": err}, "Computed the tags")
+	if err != nil {
+		return
+	}
+	removedTags := withDeletionProtectionRemoval(pvc, volumeID, tags, buildRemovedTags(pvc))
+	if len(tags) == 0 && len(removedTags) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "trigger": trigger}).Infoln("Resync requested, forcing reconcile")
+	deferredResyncs.delete(pvc.GetNamespace(), pvc.GetName())
+	backfills.delete(pvc.GetNamespace(), pvc.GetName())
+	tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+}
+
+// flushCaches empties the caches of the data the tags are computed from, so
+// that a change is picked up without waiting for their TTL. It returns the
+// names of the caches.
+func flushCaches() []string {
+	flushed := []string{"rendered-tags", "lookup-documents"}
+	renderedTags.flush()
+	lookupDocuments.flush()
+	if volumeAttributes != nil {
+		volumeAttributes.flush()
+		flushed = append(flushed, "ebs-volume-attributes")
+	}
+	if drSnapshotSources != nil {
+		drSnapshotSources.flush()
+		flushed = append(flushed, "dr-snapshot-sources")
+	}
+	return flushed
+}
+
+// adminHandler serves the admin API, checking the bearer token if one is set
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/resync", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		namespace, name := r.URL.Query().Get("namespace"), r.URL.Query().Get("pvc")
+		if namespace == "" && r.URL.Query().Get("all") != "true" {
+			writeAdminError(w, http.StatusBadRequest, errors.New("the namespace is required, or all=true to resync every PVC"))
+			return
+		}
+		if name != "" && namespace == "" {
+			writeAdminError(w, http.StatusBadRequest, errors.New("the namespace of the PVC is required"))
+			return
+		}
+		writeAdminResponse(w, map[string]int{"resynced": pvcInformers.resync(namespace, name, "admin-resync")})
+	}))
+	mux.HandleFunc("/v1/pause", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		namespace := r.URL.Query().Get("namespace")
+		if namespace == "" {
+			writeAdminError(w, http.StatusBadRequest, errors.New("the namespace is required"))
+			return
+		}
+		pausedNamespaces.pause(namespace)
+		log.WithFields(log.Fields{"namespace": namespace}).Warnln("Tagging paused with the admin API")
+		writeAdminResponse(w, map[string][]string{"paused": pausedNamespaces.list()})
+	}))
+	mux.HandleFunc("/v1/resume", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		namespace := r.URL.Query().Get("namespace")
+		if namespace == "" {
+			writeAdminError(w, http.StatusBadRequest, errors.New("the namespace is required"))
+			return
+		}
+		resynced := 0
+		if pausedNamespaces.resume(namespace) {
+			log.WithFields(log.Fields{"namespace": namespace}).Infoln("Tagging resumed with the admin API")
+			// The changes made while the namespace was paused are caught up
+			resynced = pvcInformers.resync(namespace, "", "admin-resync")
+		}
+		writeAdminResponse(w, map[string]interface{}{"paused": pausedNamespaces.list(), "resynced": resynced})
+	}))
+	mux.HandleFunc("/v1/flush-cache", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		flushed := flushCaches()
+		log.WithFields(log.Fields{"caches": flushed}).Infoln("Caches flushed with the admin API")
+		writeAdminResponse(w, map[string][]string{"flushed": flushed})
+	}))
+	mux.HandleFunc("/v1/state", adminMethod("GET", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminResponse(w, buildControllerState())
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed, use %s", r.Method, method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAdminResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorln("Cannot write the admin API response:", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}); err != nil {
+		log.Errorln("Cannot write the admin API response:", err)
+	}
+}
+
+// listenAdminSocket listens on the Unix socket, replacing a stale socket of
+// a previous run. Only the user running the tagger can connect to it.
+func listenAdminSocket(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveAdminAPI serves the admin API on the Unix socket until ctx is done
+func serveAdminAPI(ctx context.Context, path string) error {
+	listener, err := listenAdminSocket(path)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: adminHandler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.WithFields(log.Fields{"socket": path, "token": adminToken != ""}).Infoln("Serving the admin API")
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// validateAdminToken returns an error if the admin API is served without a
+// token and it hasn't been explicitly opted out of
+func validateAdminToken(socket string, tokenFile string, insecureNoToken bool) error {
+	if socket == "" || tokenFile != "" || insecureNoToken {
+		return nil
+	}
+	return errors.New("admin-token-file is required with admin-socket, set admin-insecure-no-token to only rely on the permissions of the socket")
+}
+
+// readAdminToken reads the bearer token of the admin API from the file
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// adminRequests are the admin subcommand's operations, their method, path
+// and whether they take a namespace
+var adminRequests = map[string]struct {
+	method    string
+	path      string
+	namespace bool
+}{
+	"resync":           {method: "POST", path: "/v1/resync", namespace: true},
+	"pause-namespace":  {method: "POST", path: "/v1/pause", namespace: true},
+	"resume-namespace": {method: "POST", path: "/v1/resume", namespace: true},
+	"flush-cache":      {method: "POST", path: "/v1/flush-cache"},
+	"dump-state":       {method: "GET", path: "/v1/state"},
+}
+
+// runAdminCommand sends an operation to the admin API of a running tagger,
+// e.g. from `kubectl exec`, and writes its response to w
+func runAdminCommand(args []string, w io.Writer, errW io.Writer) int {
+	fs := newCommandFlagSet("admin", errW)
+	socket := fs.String("socket", defaultAdminSocket, "The Unix socket of the admin API")
+	tokenFile := fs.String("token-file", "", "A file with the bearer token of the admin API")
+	all := fs.Bool("all", false, "Resync every PVC")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	operation, ok := adminRequests[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(errW, "unknown operation %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	query := []string{}
+	if operation.namespace {
+		switch {
+		case fs.Arg(0) == "resync" && (*all || fs.Arg(1) == "--all"):
+			query = append(query, "all=true")
+		case fs.NArg() == 2:
+			namespace, name, _ := strings.Cut(fs.Arg(1), "/")
+			query = append(query, "namespace="+namespace)
+			if name != "" {
+				query = append(query, "pvc="+name)
+			}
+		default:
+			fmt.Fprintf(errW, "%s needs a namespace\n", fs.Arg(0))
+			return 2
+		}
+	}
+	token, err := readAdminToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot read the token:", err)
+		return 2
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+		},
+	}}
+	req, err := http.NewRequest(operation.method, "http://admin"+operation.path+"?"+strings.Join(query, "&"), nil)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot build the request:", err)
+		return 1
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot reach the admin API:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	out := w
+	if resp.StatusCode != http.StatusOK {
+		out = errW
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintln(errW, "Cannot read the response:", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,239 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_adminHandler(t *testing.T) {
+	origToken := adminToken
+	defer func() {
+		adminToken = origToken
+		pausedNamespaces = newPausedNamespaceStore()
+	}()
+	adminToken = "secret"
+	pausedNamespaces = newPausedNamespaceStore()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "missing token", method: "POST", path: "/v1/pause?namespace=payments", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", path: "/v1/pause?namespace=payments", token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "pause", method: "POST", path: "/v1/pause?namespace=payments", token: "secret", wantStatus: http.StatusOK, wantBody: `{"paused":["payments"]}`},
+		{name: "pause without namespace", method: "POST", path: "/v1/pause", token: "secret", wantStatus: http.StatusBadRequest},
+		{name: "pause with GET", method: "GET", path: "/v1/pause?namespace=payments", token: "secret", wantStatus: http.StatusMethodNotAllowed},
+		{name: "resync without namespace", method: "POST", path: "/v1/resync", token: "secret", wantStatus: http.StatusBadRequest},
+		{name: "resync PVC without namespace", method: "POST", path: "/v1/resync?pvc=data&all=true", token: "secret", wantStatus: http.StatusBadRequest},
+		{name: "resync all", method: "POST", path: "/v1/resync?all=true", token: "secret", wantStatus: http.StatusOK, wantBody: `{"resynced":0}`},
+		{name: "resume", method: "POST", path: "/v1/resume?namespace=payments", token: "secret", wantStatus: http.StatusOK, wantBody: `{"paused":[],"resynced":0}`},
+		{name: "unknown path", method: "GET", path: "/v1/unknown", token: "secret", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			adminHandler().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %v", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("response = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_pausedNamespaces(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	pausedNamespaces = newPausedNamespaceStore()
+	pvcInformers = newPVCInformerRegistry()
+	defer func() {
+		pausedNamespaces = newPausedNamespaceStore()
+		pvcInformers = newPVCInformerRegistry()
+	}()
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-1"},
+		}},
+	})
+	fakeStore := newFakeTagStore()
+	efsClient, ec2Client := &EFSClient{&fakeEFS{store: fakeStore}}, &EBSClient{&fakeEC2{store: fakeStore}}
+	storageClass := "gp3"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "data", Annotations: map[string]string{
+			"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+			"k8s-pvc-tagger/tags":                           `{"team": "a"}`,
+		}},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1", StorageClassName: &storageClass},
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := store.Add(pvc); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan struct{})
+	defer close(ch)
+	pvcInformers.add(ch, pvcInformer{store: store, efsClient: efsClient, ec2Client: ec2Client})
+
+	pausedNamespaces.pause("payments")
+	if got := getIgnoreReason(pvc, time.Now()); got != ignoreReasonPaused {
+		t.Errorf("getIgnoreReason() = %v, want %v", got, ignoreReasonPaused)
+	}
+	if got := pvcInformers.resync("payments", "", "admin-resync"); got != 1 {
+		t.Errorf("resync() = %v, want 1", got)
+	}
+	if tags := fakeStore.get("vol-1"); len(tags) != 0 {
+		t.Errorf("resync() tagged the volume of a paused namespace: %v", tags)
+	}
+	// e.g. a tag operation coalesced before the namespace was paused
+	applyTags(pvc, "vol-1", map[string]string{"team": "a"}, nil, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); len(tags) != 0 {
+		t.Errorf("applyTags() tagged the volume of a paused namespace: %v", tags)
+	}
+
+	if !pausedNamespaces.resume("payments") {
+		t.Errorf("resume() = false, want true")
+	}
+	if got := pvcInformers.resync("other", "", "admin-resync"); got != 0 {
+		t.Errorf("resync() of another namespace = %v, want 0", got)
+	}
+	if got := pvcInformers.resync("payments", "data", "admin-resync"); got != 1 {
+		t.Errorf("resync() = %v, want 1", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !isSyncedWith("vol-1", "a") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tags := fakeStore.get("vol-1"); tags["team"] != "a" {
+		t.Errorf("resync() tags = %v, want the PVC's tags", tags)
+	}
+}
+
+func Test_validateAdminToken(t *testing.T) {
+	tests := []struct {
+		name            string
+		socket          string
+		tokenFile       string
+		insecureNoToken bool
+		wantErr         bool
+	}{
+		{name: "admin API disabled", wantErr: false},
+		{name: "token", socket: defaultAdminSocket, tokenFile: "/etc/k8s-pvc-tagger/admin/token", wantErr: false},
+		{name: "no token", socket: defaultAdminSocket, wantErr: true},
+		{name: "no token opted out", socket: defaultAdminSocket, insecureNoToken: true, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAdminToken(tt.socket, tt.tokenFile, tt.insecureNoToken); (err != nil) != tt.wantErr {
+				t.Errorf("validateAdminToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_flushCaches(t *testing.T) {
+	renderedTags = newTagCache(10)
+	renderedTags.add("key", map[string]string{"team": "a"})
+
+	flushCaches()
+	if _, ok := renderedTags.get("key"); ok {
+		t.Errorf("flushCaches() kept the rendered tags")
+	}
+}
+
+func Test_runAdminCommand(t *testing.T) {
+	origToken := adminToken
+	defer func() {
+		adminToken = origToken
+		pausedNamespaces = newPausedNamespaceStore()
+	}()
+	adminToken = "secret"
+	pausedNamespaces = newPausedNamespaceStore()
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "admin.sock")
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := serveAdminAPI(ctx, socket); err != nil {
+			t.Error(err)
+		}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket = %v, %v, want mode 0600", info, err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{name: "pause", args: []string{"--socket", socket, "--token-file", tokenFile, "pause-namespace", "payments"}, wantCode: 0, wantOut: `{"paused":["payments"]}`},
+		{name: "no token", args: []string{"--socket", socket, "pause-namespace", "payments"}, wantCode: 1},
+		{name: "no namespace", args: []string{"--socket", socket, "--token-file", tokenFile, "resync"}, wantCode: 2},
+		{name: "resync all", args: []string{"--socket", socket, "--token-file", tokenFile, "resync", "--all"}, wantCode: 0, wantOut: `{"resynced":0}`},
+		{name: "unknown operation", args: []string{"--socket", socket, "restart"}, wantCode: 2},
+		{name: "no operation", args: []string{"--socket", socket}, wantCode: 2},
+		{name: "no socket", args: []string{"--socket", filepath.Join(dir, "missing.sock"), "dump-state"}, wantCode: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			if got := runAdminCommand(tt.args, &out, &errOut); got != tt.wantCode {
+				t.Fatalf("runAdminCommand() = %v, want %v: %v", got, tt.wantCode, errOut.String())
+			}
+			if tt.wantOut != "" && strings.TrimSpace(out.String()) != tt.wantOut {
+				t.Errorf("runAdminCommand() output = %v, want %v", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
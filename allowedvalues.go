@@ -0,0 +1,137 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const allowedValuesConfigMapPrefix = "configmap:"
+
+// allowedValuesStore keeps the allowed values of the tag keys that are
+// validated against an external source, e.g. the list of cost centers
+type allowedValuesStore struct {
+	sync.RWMutex
+	values map[string][]string
+}
+
+var allowedTagValues = &allowedValuesStore{}
+
+func (s *allowedValuesStore) set(values map[string][]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.values = values
+}
+
+// isAllowed returns true if the value is allowed for the tag key. Keys that
+// aren't in the source can have any value.
+func (s *allowedValuesStore) isAllowed(key string, value string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	allowed, ok := s.values[key]
+	return !ok || containsString(allowed, value)
+}
+
+// loadAllowedValues fetches the allowed values from either a URL returning a
+// json encoded map of tag keys to lists of values, or a ConfigMap, given as
+// configmap:<namespace>/<name>, whose keys are tag keys and values are comma
+// or newline separated lists of values
+func loadAllowedValues(source string) (map[string][]string, error) {
+	if strings.HasPrefix(source, allowedValuesConfigMapPrefix) {
+		ref := strings.SplitN(strings.TrimPrefix(source, allowedValuesConfigMapPrefix), "/", 2)
+		if len(ref) != 2 {
+			return nil, fmt.Errorf("%q is not in the configmap:<namespace>/<name> format", source)
+		}
+		cm, err := k8sClient.CoreV1().ConfigMaps(ref[0]).Get(context.TODO(), ref[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		values := map[string][]string{}
+		for key, list := range cm.Data {
+			values[key] = []string{}
+			for _, v := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+				if v = strings.TrimSpace(v); v != "" {
+					values[key] = append(values[key], v)
+				}
+			}
+		}
+		return values, nil
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+	}
+	values := map[string][]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// refreshAllowedValues reloads the allowed values, keeping the previous ones if it fails
+func refreshAllowedValues(source string) {
+	values, err := loadAllowedValues(source)
+	if err != nil {
+		log.Errorln("Could not load the allowed tag values:", err)
+		return
+	}
+	allowedTagValues.set(values)
+	log.WithFields(log.Fields{"keys": len(values)}).Debugln("Loaded the allowed tag values")
+}
+
+func runAllowedValuesRefresh(ctx context.Context, source string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshAllowedValues(source)
+		}
+	}
+}
+
+// filterAllowedValues removes, and reports, the tags whose values are not allowed
+func filterAllowedValues(pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	var errs []error
+	for k, v := range tags {
+		if !allowedTagValues.isAllowed(k, v) {
+			errs = append(errs, fmt.Errorf("value %q of tag %q is not an allowed value", v, k))
+			delete(tags, k)
+		}
+	}
+	reportInvalidTags(pvc, errs)
+}
@@ -0,0 +1,110 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_loadAllowedValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cost-centers.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"cost-center": ["1234", "5678"]}`))
+	}))
+	defer server.Close()
+
+	k8sClient = fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "allowed-values", Namespace: "k8s-pvc-tagger"},
+		Data:       map[string]string{"cost-center": "1234,\n5678\n", "team": "payments"},
+	})
+
+	tests := []struct {
+		name    string
+		source  string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:   "url",
+			source: server.URL + "/cost-centers.json",
+			want:   map[string][]string{"cost-center": {"1234", "5678"}},
+		},
+		{
+			name:    "url not found",
+			source:  server.URL + "/missing.json",
+			wantErr: true,
+		},
+		{
+			name:   "configmap",
+			source: "configmap:k8s-pvc-tagger/allowed-values",
+			want:   map[string][]string{"cost-center": {"1234", "5678"}, "team": {"payments"}},
+		},
+		{
+			name:    "configmap not found",
+			source:  "configmap:k8s-pvc-tagger/missing",
+			wantErr: true,
+		},
+		{
+			name:    "invalid configmap reference",
+			source:  "configmap:allowed-values",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadAllowedValues(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadAllowedValues() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadAllowedValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filterAllowedValues(t *testing.T) {
+	allowedTagValues.set(map[string][]string{"cost-center": {"1234", "5678"}})
+	defer allowedTagValues.set(nil)
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/tags": `{"cost-center": "9999", "team": "payments"}`})
+	want := map[string]string{"team": "payments"}
+	if got := buildTags(pvc); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/tags": `{"cost-center": "1234"}`})
+	want = map[string]string{"cost-center": "1234"}
+	if got := buildTags(pvc); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+}
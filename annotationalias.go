@@ -0,0 +1,73 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// tagAnnotationAliases are the tag keys that can be set with their own
+// <prefix>/<key> annotation, e.g. k8s-pvc-tagger/team: payments, as a
+// shorthand for a tags annotation with a single tag
+var tagAnnotationAliases []string
+
+// reservedAnnotationNames are the <prefix>/<name> annotations read or written
+// by the tagger, which can't be used as aliases
+var reservedAnnotationNames = []string{
+	"backup-plan", "debug-reconciles", "deletion-protection", "dr-region", "dr-replicate", "exempt-until", "ignore", "name", "remove", "replace",
+	"skip-reason", "sync-at", "tags", "targets", "ttl-tags", "wait-for-consumer",
+}
+
+// parseTagAnnotationAliases parses the comma separated list of --tag-annotation-aliases
+func parseTagAnnotationAliases(value string) ([]string, error) {
+	var aliases []string
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if containsString(reservedAnnotationNames, key) {
+			return nil, fmt.Errorf("%q is the name of one of the tagger's annotations", key)
+		}
+		if err := validateTag(key, ""); err != nil {
+			return nil, err
+		}
+		if strings.Contains(key, "/") {
+			return nil, fmt.Errorf("%q can't be an annotation name, it contains a /", key)
+		}
+		if !containsString(aliases, key) {
+			aliases = append(aliases, key)
+		}
+	}
+	return aliases, nil
+}
+
+// buildAliasAnnotationTags returns the tags set with the alias annotations of the PVC
+func buildAliasAnnotationTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	tags := map[string]string{}
+	for _, key := range tagAnnotationAliases {
+		if value, ok := getPVCAnnotation(pvc, key); ok {
+			tags[key] = value
+		}
+	}
+	return tags
+}
@@ -0,0 +1,88 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseTagAnnotationAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "aliases", value: "team, cost-center,team", want: []string{"team", "cost-center"}},
+		{name: "reserved annotation", value: "team,tags", wantErr: true},
+		{name: "reserved tag prefix", value: "aws:team", wantErr: true},
+		{name: "not an annotation name", value: "team/name", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTagAnnotationAliases(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTagAnnotationAliases() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagAnnotationAliases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildAnnotationTags_aliases(t *testing.T) {
+	tagAnnotationAliases = []string{"team", "cost-center"}
+	defer func() { tagAnnotationAliases = nil }()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "alias only",
+			annotations: map[string]string{"k8s-pvc-tagger/team": "payments", "k8s-pvc-tagger/owner": "alice"},
+			want:        map[string]string{"team": "payments"},
+		},
+		{
+			name:        "tags annotation takes precedence",
+			annotations: map[string]string{"k8s-pvc-tagger/team": "payments", "k8s-pvc-tagger/cost-center": "123", "k8s-pvc-tagger/tags": `{"team": "storage", "env": "prod"}`},
+			want:        map[string]string{"team": "storage", "cost-center": "123", "env": "prod"},
+		},
+		{
+			name:        "legacy prefix",
+			annotations: map[string]string{"aws-ebs-tagger/team": "payments"},
+			want:        map[string]string{"team": "payments"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", Annotations: tt.annotations}}
+			if got := buildAnnotationTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildAnnotationTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// enableDesiredTagsAPI serves the desired tags of the managed volumes on the
+// status port so that compliance scanners can compare them with the cloud
+var enableDesiredTagsAPI bool
+
+// desiredTags is the response of the desired tags API
+type desiredTags struct {
+	VolumeID  string            `json:"volumeID"`
+	Provider  string            `json:"provider"`
+	Namespace string            `json:"namespace"`
+	PVC       string            `json:"pvc"`
+	Tags      map[string]string `json:"tags"`
+	// Synced is true once the tags have been applied to the volume
+	Synced bool `json:"synced"`
+}
+
+func newDesiredTags(v managedVolume) desiredTags {
+	tags := v.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	return desiredTags{
+		VolumeID:  v.VolumeID,
+		Provider:  v.Provider,
+		Namespace: v.Namespace,
+		PVC:       v.PVC,
+		Tags:      tags,
+		Synced:    v.Synced,
+	}
+}
+
+// volumeDesiredTagsHandler serves GET /v1/volumes/{id}/desired-tags
+func volumeDesiredTagsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/volumes/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "desired-tags" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusNotImplemented, "method is not implemented")
+		return
+	}
+	v, ok := managedVolumes.get(parts[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "volume is not managed by the tagger")
+		return
+	}
+	writeAPIResponse(w, newDesiredTags(v))
+}
+
+// pvcDesiredTagsHandler serves GET /v1/pvcs/{namespace}/{name}
+func pvcDesiredTagsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/pvcs/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusNotImplemented, "method is not implemented")
+		return
+	}
+	v, ok := managedVolumes.getByPVC(parts[0], parts[1])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "pvc is not managed by the tagger")
+		return
+	}
+	writeAPIResponse(w, newDesiredTags(v))
+}
+
+// desiredTagHash is the hash of the desired tags of a volume, see hashTags,
+// and the keys it's computed over, so that a verifier without access to the
+// cluster can hash the same keys of the volume's tags and compare
+type desiredTagHash struct {
+	Hash string   `json:"hash"`
+	Keys []string `json:"keys"`
+}
+
+// newDesiredTagHash hashes the desired tags without the tags hash tag, so the
+// hash is the value of the tags hash tag when --tags-hash-key is set
+func newDesiredTagHash(tags map[string]string) desiredTagHash {
+	hashed := map[string]string{}
+	keys := []string{}
+	for k, v := range tags {
+		if tagsHashKey != "" && k == tagsHashKey {
+			continue
+		}
+		hashed[k] = v
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return desiredTagHash{Hash: hashTags(hashed), Keys: keys}
+}
+
+// desiredTagHashesHandler serves GET /v1/desired-tag-hashes, the hash of the
+// desired tags of every managed volume keyed by volumeID
+func desiredTagHashesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusNotImplemented, "method is not implemented")
+		return
+	}
+	hashes := map[string]desiredTagHash{}
+	for _, v := range managedVolumes.list("") {
+		hashes[v.VolumeID] = newDesiredTagHash(v.Tags)
+	}
+	writeAPIResponse(w, hashes)
+}
+
+func writeAPIResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Errorln("Cannot write desired tags:", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]string{"error": message})
+	if err != nil {
+		log.Errorln("Cannot write status message:", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_desiredTagsHandlers(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	defer func() { managedVolumes = newVolumeStore() }()
+	managedVolumes.claim("vol-1", "default", "foo", map[string]string{"team": "a"})
+	managedVolumes.claim("vol-1", "default", "bar", map[string]string{"team": "b"})
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "bar", Tags: map[string]string{"team": "b"}, Synced: true})
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		path       string
+		wantStatus int
+		want       desiredTags
+	}{
+		{
+			name:       "volume",
+			handler:    volumeDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/volumes/vol-1/desired-tags",
+			wantStatus: http.StatusOK,
+			want:       desiredTags{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "bar", Tags: map[string]string{"team": "b"}, Synced: true},
+		},
+		{
+			name:       "unknown volume",
+			handler:    volumeDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/volumes/vol-2/desired-tags",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown volume path",
+			handler:    volumeDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/volumes/vol-1/tags",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "volume POST",
+			handler:    volumeDesiredTagsHandler,
+			method:     "POST",
+			path:       "/v1/volumes/vol-1/desired-tags",
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "pvc owning the volume",
+			handler:    pvcDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/pvcs/default/bar",
+			wantStatus: http.StatusOK,
+			want:       desiredTags{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "bar", Tags: map[string]string{"team": "b"}, Synced: true},
+		},
+		{
+			name:       "pvc sharing a multi-attach volume",
+			handler:    pvcDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/pvcs/default/foo",
+			wantStatus: http.StatusOK,
+			want:       desiredTags{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "foo", Tags: map[string]string{"team": "a"}, Synced: false},
+		},
+		{
+			name:       "unknown pvc",
+			handler:    pvcDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/pvcs/default/baz",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "pvc without a name",
+			handler:    pvcDesiredTagsHandler,
+			method:     "GET",
+			path:       "/v1/pvcs/default",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %v", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got desiredTags
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("cannot decode the response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_desiredTagHashesHandler(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	tagsHashKey = "tags-hash"
+	defer func() {
+		managedVolumes = newVolumeStore()
+		tagsHashKey = ""
+	}()
+	tags := map[string]string{"team": "a", "env": "prod"}
+	hashed := map[string]string{"team": "a", "env": "prod", "tags-hash": hashTags(tags)}
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "foo", Tags: hashed, Synced: true})
+	managedVolumes.set(managedVolume{VolumeID: "vol-2", Provider: providerAWSEBS, Namespace: "default", PVC: "bar"})
+
+	w := httptest.NewRecorder()
+	desiredTagHashesHandler(w, httptest.NewRequest("GET", "/v1/desired-tag-hashes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %v", w.Code, http.StatusOK, w.Body.String())
+	}
+	var got map[string]desiredTagHash
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("cannot decode the response: %v", err)
+	}
+	want := map[string]desiredTagHash{
+		"vol-1": {Hash: hashed["tags-hash"], Keys: []string{"env", "team"}},
+		"vol-2": {Hash: hashTags(nil), Keys: []string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("response = %+v, want %+v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	desiredTagHashesHandler(w, httptest.NewRequest("POST", "/v1/desired-tag-hashes", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("POST status = %v, want %v", w.Code, http.StatusNotImplemented)
+	}
+}
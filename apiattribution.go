@@ -0,0 +1,164 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiCallOwner is the namespace the API calls on a resource are made for
+type apiCallOwner struct {
+	namespace string
+	// refs is the number of operations attributing calls on the resource
+	refs int
+}
+
+// apiCallOwnerStore maps the IDs of the volumes, file systems and snapshots the
+// API calls are made on to the namespace of the PVC they are made for, so that
+// the calls can be attributed to the tenant whose PVC churn triggered them
+type apiCallOwnerStore struct {
+	sync.Mutex
+	owners map[string]*apiCallOwner
+}
+
+var apiCallOwners = newAPICallOwnerStore()
+
+func newAPICallOwnerStore() *apiCallOwnerStore {
+	return &apiCallOwnerStore{owners: map[string]*apiCallOwner{}}
+}
+
+// attribute attributes the API calls on the resources to the namespace until
+// the returned func is called
+func (s *apiCallOwnerStore) attribute(namespace string, ids ...string) func() {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range ids {
+		owner, ok := s.owners[id]
+		if !ok {
+			owner = &apiCallOwner{}
+			s.owners[id] = owner
+		}
+		owner.namespace = namespace
+		owner.refs++
+	}
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		for _, id := range ids {
+			if owner, ok := s.owners[id]; ok {
+				if owner.refs--; owner.refs <= 0 {
+					delete(s.owners, id)
+				}
+			}
+		}
+	}
+}
+
+// attributeLike attributes the API calls on the resources to the namespace the
+// calls on the parent resource are attributed to, e.g. a volume's snapshots
+func (s *apiCallOwnerStore) attributeLike(parentID string, ids ...string) func() {
+	namespace, ok := s.namespace(parentID)
+	if !ok {
+		return func() {}
+	}
+	return s.attribute(namespace, ids...)
+}
+
+func (s *apiCallOwnerStore) namespace(id string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if owner, ok := s.owners[id]; ok {
+		return owner.namespace, true
+	}
+	return "", false
+}
+
+// requestNamespace returns the namespace the request is attributed to, the
+// one of the first of its resources that is attributed
+func (s *apiCallOwnerStore) requestNamespace(r *request.Request) (string, bool) {
+	for _, id := range requestResourceIDs(r.Params) {
+		if namespace, ok := s.namespace(id); ok {
+			return namespace, true
+		}
+	}
+	return "", false
+}
+
+// requestResourceIDs returns the IDs of the resources of the EC2, EFS and
+// Tagging API calls made by the tagger
+func requestResourceIDs(params interface{}) []string {
+	switch input := params.(type) {
+	case *ec2.CreateTagsInput:
+		return aws.StringValueSlice(input.Resources)
+	case *ec2.DeleteTagsInput:
+		return aws.StringValueSlice(input.Resources)
+	case *ec2.DescribeTagsInput:
+		return ec2FilterValues(input.Filters, "resource-id")
+	case *ec2.DescribeSnapshotsInput:
+		return append(aws.StringValueSlice(input.SnapshotIds), ec2FilterValues(input.Filters, "volume-id")...)
+	case *ec2.DescribeVolumesInput:
+		return aws.StringValueSlice(input.VolumeIds)
+	case *efs.TagResourceInput:
+		return []string{aws.StringValue(input.ResourceId)}
+	case *efs.UntagResourceInput:
+		return []string{aws.StringValue(input.ResourceId)}
+	case *efs.ListTagsForResourceInput:
+		return []string{aws.StringValue(input.ResourceId)}
+	case *resourcegroupstaggingapi.TagResourcesInput:
+		return arnResourceIDs(input.ResourceARNList)
+	case *resourcegroupstaggingapi.UntagResourcesInput:
+		return arnResourceIDs(input.ResourceARNList)
+	}
+	return nil
+}
+
+func ec2FilterValues(filters []*ec2.Filter, name string) []string {
+	for _, filter := range filters {
+		if aws.StringValue(filter.Name) == name {
+			return aws.StringValueSlice(filter.Values)
+		}
+	}
+	return nil
+}
+
+// arnResourceIDs returns the resource IDs of ARNs like arn:aws:ec2:<region>:<account>:volume/<volumeID>
+func arnResourceIDs(arns []*string) []string {
+	ids := make([]string, 0, len(arns))
+	for _, arn := range aws.StringValueSlice(arns) {
+		ids = append(ids, arn[strings.LastIndex(arn, "/")+1:])
+	}
+	return ids
+}
+
+// recordNamespaceAPICall counts the API call against the namespace it's
+// attributed to. The calls that aren't made for a PVC, e.g. the periodic
+// snapshot sync or the health checks, are only counted by k8s_pvc_tagger_api_calls_total.
+func recordNamespaceAPICall(r *request.Request) {
+	if namespace, ok := apiCallOwners.requestNamespace(r); ok {
+		promNamespaceAPICallsTotal.With(prometheus.Labels{"namespace": namespace, "service": r.ClientInfo.ServiceName}).Inc()
+	}
+}
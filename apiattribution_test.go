@@ -0,0 +1,118 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_requestResourceIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		params interface{}
+		want   []string
+	}{
+		{
+			name:   "CreateTags",
+			params: &ec2.CreateTagsInput{Resources: aws.StringSlice([]string{"snap-1", "snap-2"})},
+			want:   []string{"snap-1", "snap-2"},
+		},
+		{
+			name: "DescribeTags",
+			params: &ec2.DescribeTagsInput{Filters: []*ec2.Filter{
+				{Name: aws.String("key"), Values: aws.StringSlice([]string{"managed-by"})},
+				{Name: aws.String("resource-id"), Values: aws.StringSlice([]string{"vol-1"})},
+			}},
+			want: []string{"vol-1"},
+		},
+		{
+			name:   "DescribeSnapshots",
+			params: &ec2.DescribeSnapshotsInput{Filters: []*ec2.Filter{{Name: aws.String("volume-id"), Values: aws.StringSlice([]string{"vol-1"})}}},
+			want:   []string{"vol-1"},
+		},
+		{
+			name:   "TagResource",
+			params: &efs.TagResourceInput{ResourceId: aws.String("fsap-1")},
+			want:   []string{"fsap-1"},
+		},
+		{
+			name:   "TagResources",
+			params: &resourcegroupstaggingapi.TagResourcesInput{ResourceARNList: aws.StringSlice([]string{"arn:aws:ec2:us-east-1:123456789012:volume/vol-1"})},
+			want:   []string{"vol-1"},
+		},
+		{
+			name:   "unknown call",
+			params: &ec2.DescribeInstancesInput{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestResourceIDs(tt.params); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestResourceIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_apiCallOwnerStore(t *testing.T) {
+	s := newAPICallOwnerStore()
+	releaseFirst := s.attribute("team-a", "vol-1")
+	releaseSecond := s.attribute("team-a", "vol-1")
+	releaseSnapshots := s.attributeLike("vol-1", "snap-1")
+	if ns, ok := s.namespace("snap-1"); !ok || ns != "team-a" {
+		t.Errorf("namespace(snap-1) = %v, %v, want team-a", ns, ok)
+	}
+	s.attributeLike("vol-2", "snap-2")()
+
+	releaseFirst()
+	if ns, ok := s.namespace("vol-1"); !ok || ns != "team-a" {
+		t.Errorf("namespace(vol-1) = %v, %v, want team-a until every operation released it", ns, ok)
+	}
+	releaseSecond()
+	releaseSnapshots()
+	if len(s.owners) != 0 {
+		t.Errorf("owners = %v, want none once released", s.owners)
+	}
+}
+
+func Test_recordNamespaceAPICall(t *testing.T) {
+	release := apiCallOwners.attribute("team-a", "vol-attributed")
+	defer release()
+	newRequest := func(volumeID string) *request.Request {
+		return request.New(aws.Config{}, metadata.ClientInfo{ServiceName: "ec2"}, request.Handlers{}, nil, &request.Operation{Name: "CreateTags"},
+			&ec2.CreateTagsInput{Resources: aws.StringSlice([]string{volumeID})}, nil)
+	}
+	counter := promNamespaceAPICallsTotal.With(prometheus.Labels{"namespace": "team-a", "service": "ec2"})
+	before := testutil.ToFloat64(counter)
+	recordNamespaceAPICall(newRequest("vol-attributed"))
+	recordNamespaceAPICall(newRequest("vol-other"))
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("recordNamespaceAPICall() counted %v calls for team-a, want 1", got)
+	}
+}
@@ -0,0 +1,129 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+)
+
+// apiServerDegradedAfter is how long the API server has to be unreachable
+// before the tagger is degraded and stops writing to the cloud provider
+var apiServerDegradedAfter = 30 * time.Second
+
+// apiServerWaitInterval is how often the paused tag operations check whether they can resume
+var apiServerWaitInterval = time.Second
+
+// apiServerHealthCheck tracks how long the API server has been unreachable
+type apiServerHealthCheck struct {
+	sync.RWMutex
+	failingSince time.Time
+	err          error
+	degraded     bool
+}
+
+var apiServerHealth = &apiServerHealthCheck{}
+
+// failed records an API server connection error. Only the first error and
+// becoming degraded are logged, so an outage doesn't flood the logs.
+func (h *apiServerHealthCheck) failed(err error, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	h.err = err
+	if h.failingSince.IsZero() {
+		h.failingSince = now
+		log.Warnln("Kubernetes API server connection error:", err)
+		return
+	}
+	if !h.degraded && now.Sub(h.failingSince) >= apiServerDegradedAfter {
+		h.degraded = true
+		promAPIServerDegraded.Set(1)
+		log.WithFields(log.Fields{"since": h.failingSince}).Errorln("Kubernetes API server unavailable, pausing cloud writes:", err)
+	}
+}
+
+func (h *apiServerHealthCheck) succeeded() {
+	h.Lock()
+	defer h.Unlock()
+	if h.degraded {
+		log.WithFields(log.Fields{"since": h.failingSince}).Infoln("Kubernetes API server available again, resuming cloud writes")
+	}
+	h.failingSince = time.Time{}
+	h.err = nil
+	h.degraded = false
+	promAPIServerDegraded.Set(0)
+}
+
+// get returns the last error if the tagger is degraded
+func (h *apiServerHealthCheck) get() error {
+	h.RLock()
+	defer h.RUnlock()
+	if !h.degraded {
+		return nil
+	}
+	return h.err
+}
+
+// watchErrorHandler replaces the informer's default handler, which logs every
+// failed list and watch
+func watchErrorHandler(r *cache.Reflector, err error) {
+	log.Debugln("PVC watch error:", err)
+	apiServerHealth.failed(err, time.Now())
+}
+
+// guardTagOperation holds the tag operation while the API server is
+// unavailable, since the PVC may have been changed or deleted in the meantime,
+// and runs it once the API server is reachable again
+func guardTagOperation(op func() error) func() error {
+	return func() error {
+		for apiServerHealth.get() != nil {
+			time.Sleep(apiServerWaitInterval)
+		}
+		return op()
+	}
+}
+
+// probeAPIServer checks that the API server can be reached
+func probeAPIServer() error {
+	_, err := k8sClient.Discovery().ServerVersion()
+	return err
+}
+
+// runAPIServerHealthCheck periodically probes the API server so the tagger
+// resumes once it is reachable again, even without a watch event
+func runAPIServerHealthCheck(ctx context.Context, interval time.Duration, probe func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := probe(); err != nil {
+				apiServerHealth.failed(err, time.Now())
+			} else {
+				apiServerHealth.succeeded()
+			}
+		}
+	}
+}
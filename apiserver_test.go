@@ -0,0 +1,111 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_apiServerHealthCheck(t *testing.T) {
+	h := &apiServerHealthCheck{}
+	start := time.Now()
+	err := errors.New("connection refused")
+
+	h.failed(err, start)
+	if h.get() != nil {
+		t.Errorf("get() = %v right after the first error, want nil", h.get())
+	}
+	h.failed(err, start.Add(apiServerDegradedAfter/2))
+	if h.get() != nil {
+		t.Errorf("get() = %v before api-server-degraded-after, want nil", h.get())
+	}
+	h.failed(err, start.Add(apiServerDegradedAfter))
+	if h.get() != err {
+		t.Errorf("get() = %v after api-server-degraded-after, want %v", h.get(), err)
+	}
+	if got := testutil.ToFloat64(promAPIServerDegraded); got != 1 {
+		t.Errorf("k8s_pvc_tagger_api_server_degraded = %v, want 1", got)
+	}
+
+	h.succeeded()
+	if h.get() != nil {
+		t.Errorf("get() = %v after a success, want nil", h.get())
+	}
+	if got := testutil.ToFloat64(promAPIServerDegraded); got != 0 {
+		t.Errorf("k8s_pvc_tagger_api_server_degraded = %v, want 0", got)
+	}
+	// a new outage starts counting again
+	h.failed(err, start.Add(2*apiServerDegradedAfter))
+	if h.get() != nil {
+		t.Errorf("get() = %v right after a new error, want nil", h.get())
+	}
+}
+
+func Test_guardTagOperation(t *testing.T) {
+	apiServerWaitInterval = time.Millisecond
+	start := time.Now()
+	apiServerHealth.failed(errors.New("connection refused"), start)
+	apiServerHealth.failed(errors.New("connection refused"), start.Add(apiServerDegradedAfter))
+	defer func() {
+		apiServerWaitInterval = time.Second
+		apiServerHealth.succeeded()
+	}()
+
+	var ran int32
+	done := make(chan error)
+	go func() {
+		done <- guardTagOperation(func() error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Errorf("guardTagOperation() ran the operation while the API server was unavailable")
+	}
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "degraded") {
+		t.Errorf("statusHandler() = %v %v, want 200 degraded", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyHandler() status = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	apiServerHealth.succeeded()
+	select {
+	case err := <-done:
+		if err != nil || atomic.LoadInt32(&ran) != 1 {
+			t.Errorf("guardTagOperation() = %v, ran %v times, want the operation to run once", err, ran)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("guardTagOperation() did not resume")
+	}
+}
@@ -19,12 +19,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -37,11 +42,19 @@ import (
 var (
 	// awsSession the AWS Session
 	awsSession *session.Session
+	// providerEndpoint overrides the AWS API endpoint, e.g. for LocalStack or a VPC endpoint
+	providerEndpoint string
+	// localstack uses static test credentials with the providerEndpoint, which
+	// LocalStack accepts
+	localstack bool
 )
 
 const (
 	// Matching strings for region
 	regexpAWSRegion = `^[\w]{2}[-][\w]{4,9}[-][\d]$`
+
+	providerAWSEBS = "aws-ebs"
+	providerAWSEFS = "aws-efs"
 )
 
 // Client efs interface
@@ -73,18 +86,54 @@ func createAWSSession(awsRegion string) *session.Session {
 		MinThrottleDelay: minDelay,
 		MaxThrottleDelay: maxDelay,
 	}}
+	if providerEndpoint != "" {
+		log.WithFields(log.Fields{"endpoint": providerEndpoint, "localstack": localstack}).Infoln("Using custom AWS endpoint")
+		awsConfig.Endpoint = aws.String(providerEndpoint)
+		// LocalStack accepts any credentials, the other endpoints use the credentials chain
+		if localstack && os.Getenv("AWS_ACCESS_KEY_ID") == "" && os.Getenv("AWS_PROFILE") == "" {
+			awsConfig.Credentials = credentials.NewStaticCredentials("test", "test", "")
+		}
+	}
 
-	return session.Must(session.NewSession(awsConfig))
+	// The SDK reads the role session name when the session is created
+	setAWSRoleSessionName()
+	sess := session.Must(session.NewSession(awsConfig))
+	sess.Handlers.Build.PushBack(addAWSUserAgent)
+	sess.Handlers.Complete.PushBack(recordMissingPermission)
+	// The injected faults replace the response once the call has waited for
+	// the budget and its in-flight slot, the send stops at the fault
+	if faults != nil {
+		sess.Handlers.Send.PushFront(faults.inject)
+		sess.Handlers.Send.AfterEachFn = request.HandlerListStopOnError
+	}
+	// Every API call, including the SDK's own retries, waits for the budget
+	// and then for an in-flight slot, so slots aren't held waiting for the budget
+	sess.Handlers.Send.PushFront(inFlightAPICalls.acquire)
+	sess.Handlers.CompleteAttempt.PushBack(inFlightAPICalls.release)
+	sess.Handlers.Send.PushFront(func(r *request.Request) {
+		if apiBudget != nil {
+			apiBudget.Accept()
+		}
+		promAPICallsTotal.With(prometheus.Labels{"service": r.ClientInfo.ServiceName}).Inc()
+		recordNamespaceAPICall(r)
+	})
+	return sess
 }
 
 // newEFSClient initializes an EFS client
 func newEFSClient() (*EFSClient, error) {
+	if cloudProvider == cloudProviderFake {
+		return &EFSClient{&fakeEFS{store: fakeVolumes}}, nil
+	}
 	svc := efs.New(awsSession)
 	return &EFSClient{svc}, nil
 }
 
 // newEC2Client initializes an EC2 client
 func newEC2Client() (*EBSClient, error) {
+	if cloudProvider == cloudProviderFake {
+		return &EBSClient{&fakeEC2{store: fakeVolumes}}, nil
+	}
 	svc := ec2.New(awsSession)
 	return &EBSClient{svc}, nil
 }
@@ -102,90 +151,255 @@ func getMetadataRegion() (string, error) {
 	return doc.Region, nil
 }
 
-func (client *EBSClient) addEBSVolumeTags(volumeID string, tags map[string]string, storageclass string) {
+func getMetadataInstanceID() (string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{}))
+	svc := ec2metadata.New(sess)
+	doc, err := svc.GetInstanceIdentityDocument()
+	if err != nil {
+		return "", fmt.Errorf("could not get EC2 instance identity metadata")
+	}
+	if len(doc.InstanceID) == 0 {
+		return "", fmt.Errorf("could not get valid EC2 instance ID")
+	}
+	return doc.InstanceID, nil
+}
+
+func (client *EBSClient) addEBSVolumeTags(volumeID string, tags map[string]string, storageclass string) error {
 	var ec2Tags []*ec2.Tag
 	for k, v := range tags {
 		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
 	}
 
 	// Add tags to the volume
-	_, err := client.CreateTags(&ec2.CreateTagsInput{
-		Resources: []*string{aws.String(volumeID)},
-		Tags:      ec2Tags,
-	})
+	var err error
+	if resourceGroupsTagger != nil {
+		err = resourceGroupsTagger.tagResource(volumeID, tags)
+	} else {
+		_, err = client.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{aws.String(volumeID)},
+			Tags:      ec2Tags,
+		})
+	}
 	if err != nil {
-		log.Errorln("Could not create tags for volumeID:", volumeID, err)
-		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		logAWSError(err, "Could not create tags for volumeID:", volumeID)
+		recordAction("error", storageclass)
+		return err
 	}
 
-	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
-	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	recordAction("success", storageclass)
+	return nil
 }
 
-func (client *EBSClient) deleteEBSVolumeTags(volumeID string, tags []string, storageclass string) {
+func (client *EBSClient) deleteEBSVolumeTags(volumeID string, tags []string, storageclass string) error {
 	var ec2Tags []*ec2.Tag
 	for _, k := range tags {
 		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
 	}
 
 	// Add tags to the volume
-	_, err := client.DeleteTags(&ec2.DeleteTagsInput{
-		Resources: []*string{aws.String(volumeID)},
-		Tags:      ec2Tags,
-	})
+	var err error
+	if resourceGroupsTagger != nil {
+		err = resourceGroupsTagger.untagResource(volumeID, tags)
+	} else {
+		_, err = client.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: []*string{aws.String(volumeID)},
+			Tags:      ec2Tags,
+		})
+	}
 	if err != nil {
-		log.Errorln("Could not EBS delete tags for volumeID:", volumeID, err)
-		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		logAWSError(err, "Could not EBS delete tags for volumeID:", volumeID)
+		recordAction("error", storageclass)
+		return err
 	}
 
-	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
-	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	recordAction("success", storageclass)
+	return nil
 }
 
-func (client *EFSClient) addEFSVolumeTags(volumeID string, tags map[string]string, storageclass string) {
+func (client *EFSClient) addEFSVolumeTags(volumeID string, tags map[string]string, storageclass string) error {
 	var efsTags []*efs.Tag
 	for k, v := range tags {
 		efsTags = append(efsTags, &efs.Tag{Key: aws.String(k), Value: aws.String(v)})
 	}
 
 	// Add tags to the volume
-	_, err := client.TagResource(&efs.TagResourceInput{
-		ResourceId: aws.String(volumeID),
-		Tags:       efsTags,
-	})
+	var err error
+	if resourceGroupsTagger != nil {
+		err = resourceGroupsTagger.tagResource(volumeID, tags)
+	} else {
+		_, err = client.TagResource(&efs.TagResourceInput{
+			ResourceId: aws.String(volumeID),
+			Tags:       efsTags,
+		})
+	}
 	if err != nil {
-		log.Errorln("Could not EFS create tags for volumeID:", volumeID, err)
-		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		logAWSError(err, "Could not EFS create tags for volumeID:", volumeID)
+		recordAction("error", storageclass)
+		return err
 	}
 
-	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
-	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	recordAction("success", storageclass)
+	return nil
 }
 
-func (client *EFSClient) deleteEFSVolumeTags(volumeID string, tags []string, storageclass string) {
+func (client *EFSClient) deleteEFSVolumeTags(volumeID string, tags []string, storageclass string) error {
 	var efsTags []*string
 	for _, k := range tags {
 		efsTags = append(efsTags, aws.String(k))
 	}
 
 	// Add tags to the volume
-	_, err := client.UntagResource(&efs.UntagResourceInput{
-		ResourceId: aws.String(volumeID),
-		TagKeys:    efsTags,
+	var err error
+	if resourceGroupsTagger != nil {
+		err = resourceGroupsTagger.untagResource(volumeID, tags)
+	} else {
+		_, err = client.UntagResource(&efs.UntagResourceInput{
+			ResourceId: aws.String(volumeID),
+			TagKeys:    efsTags,
+		})
+	}
+	if err != nil {
+		logAWSError(err, "Could not EFS delete tags for volumeID:", volumeID)
+		recordAction("error", storageclass)
+		return err
+	}
+
+	recordAction("success", storageclass)
+	return nil
+}
+
+// syncSnapshotTags copies the volume's tags onto any of its snapshots, such as
+// those created by DLM or AWS Backup, that are missing them, and deletes the
+// removedTags from the snapshots that have them
+func (client *EBSClient) syncSnapshotTags(volumeID string, tags map[string]string, removedTags []string) error {
+	var snapshotIDs, untaggedSnapshotIDs []*string
+	err := client.DescribeSnapshotsPages(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{Name: aws.String("volume-id"), Values: []*string{aws.String(volumeID)}},
+		},
+	}, func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range page.Snapshots {
+			if len(tags) > 0 && !hasEC2Tags(snapshot.Tags, tags) {
+				snapshotIDs = append(snapshotIDs, snapshot.SnapshotId)
+			}
+			if hasAnyEC2TagKey(snapshot.Tags, removedTags) {
+				untaggedSnapshotIDs = append(untaggedSnapshotIDs, snapshot.SnapshotId)
+			}
+		}
+		return true
 	})
 	if err != nil {
-		log.Errorln("Could not EFS delete tags for volumeID:", volumeID, err)
-		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		logAWSError(err, "Could not describe snapshots for volumeID:", volumeID)
+		promSnapshotActionsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+	defer apiCallOwners.attributeLike(volumeID, append(aws.StringValueSlice(snapshotIDs), aws.StringValueSlice(untaggedSnapshotIDs)...)...)()
+
+	if len(snapshotIDs) > 0 {
+		var ec2Tags []*ec2.Tag
+		for k, v := range tags {
+			ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		_, err = client.CreateTags(&ec2.CreateTagsInput{
+			Resources: snapshotIDs,
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			logAWSError(err, "Could not create snapshot tags for volumeID:", volumeID)
+			promSnapshotActionsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+			return err
+		}
+		log.WithFields(log.Fields{"volumeID": volumeID, "snapshots": len(snapshotIDs)}).Infoln("Tagged snapshots")
+		promSnapshotActionsTotal.With(prometheus.Labels{"status": "success"}).Add(float64(len(snapshotIDs)))
+	}
+
+	if len(untaggedSnapshotIDs) > 0 {
+		var ec2Tags []*ec2.Tag
+		for _, k := range removedTags {
+			ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
+		}
+		_, err = client.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: untaggedSnapshotIDs,
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			logAWSError(err, "Could not delete snapshot tags for volumeID:", volumeID)
+			promSnapshotActionsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+			return err
+		}
+		log.WithFields(log.Fields{"volumeID": volumeID, "snapshots": len(untaggedSnapshotIDs)}).Infoln("Deleted snapshot tags")
+		promSnapshotActionsTotal.With(prometheus.Labels{"status": "success"}).Add(float64(len(untaggedSnapshotIDs)))
+	}
+	return nil
+}
+
+// awsErrorClasses maps the EC2 and EFS error codes to their error class
+var awsErrorClasses = map[string]string{
+	"Throttling":                        errorClassThrottled,
+	"ThrottlingException":               errorClassThrottled,
+	"RequestLimitExceeded":              errorClassThrottled,
+	"TooManyRequestsException":          errorClassThrottled,
+	"UnauthorizedOperation":             errorClassPermissionDenied,
+	"AccessDenied":                      errorClassPermissionDenied,
+	"AccessDeniedException":             errorClassPermissionDenied,
+	"AuthFailure":                       errorClassPermissionDenied,
+	"InvalidVolume.NotFound":            errorClassNotFound,
+	"InvalidSnapshot.NotFound":          errorClassNotFound,
+	"FileSystemNotFound":                errorClassNotFound,
+	"AccessPointNotFound":               errorClassNotFound,
+	"InvalidParameterValue":             errorClassInvalidTag,
+	"InvalidParameterException":         errorClassInvalidTag,
+	"TagLimitExceeded":                  errorClassInvalidTag,
+	"TagPolicyViolation":                errorClassInvalidTag,
+	"ValidationException":               errorClassInvalidTag,
+	"BadRequest":                        errorClassInvalidTag,
+	"InternalError":                     errorClassTransient,
+	"InternalServerError":               errorClassTransient,
+	"InternalServiceException":          errorClassTransient,
+	"ServiceUnavailable":                errorClassTransient,
+	"Unavailable":                       errorClassTransient,
+	"RequestCanceled":                   errorClassTransient,
+	"RequestError":                      errorClassTransient,
+	"SerializationError":                errorClassTransient,
+	"IncorrectFileSystemLifeCycleState": errorClassTransient,
+}
+
+// classifyAWSError returns the error class of an AWS API error
+func classifyAWSError(err error) (string, bool) {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return "", false
+	}
+	if class, ok := awsErrorClasses[aerr.Code()]; ok {
+		return class, true
 	}
+	if request.IsErrorThrottle(err) {
+		return errorClassThrottled, true
+	}
+	return errorClassTransient, true
+}
 
-	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
-	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+// hasAnyEC2TagKey returns true if any of the keys is set on the resource
+func hasAnyEC2TagKey(existing []*ec2.Tag, keys []string) bool {
+	for _, t := range existing {
+		if containsString(keys, aws.StringValue(t.Key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEC2Tags returns true if all of the tags are already set on the resource
+func hasEC2Tags(existing []*ec2.Tag, tags map[string]string) bool {
+	current := make(map[string]string, len(existing))
+	for _, t := range existing {
+		current[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for k, v := range tags {
+		if cv, ok := current[k]; !ok || cv != v {
+			return false
+		}
+	}
+	return true
 }
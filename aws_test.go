@@ -0,0 +1,272 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// snapshotsEC2 is the fake EC2 API with the snapshots of the volumes
+type snapshotsEC2 struct {
+	*fakeEC2
+	// snapshots are the IDs of the snapshots by volume ID
+	snapshots map[string][]string
+	err       error
+}
+
+func (f *snapshotsEC2) DescribeSnapshotsPages(input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	output := &ec2.DescribeSnapshotsOutput{}
+	for _, filter := range input.Filters {
+		for _, volumeID := range filter.Values {
+			for _, id := range f.snapshots[aws.StringValue(volumeID)] {
+				snapshot := &ec2.Snapshot{SnapshotId: aws.String(id), VolumeId: volumeID}
+				for k, v := range f.store.get(id) {
+					snapshot.Tags = append(snapshot.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+				}
+				output.Snapshots = append(output.Snapshots, snapshot)
+			}
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func Test_hasEC2Tags(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []*ec2.Tag
+		tags     map[string]string
+		want     bool
+	}{
+		{
+			name:     "no existing tags",
+			existing: nil,
+			tags:     map[string]string{"foo": "bar"},
+			want:     false,
+		},
+		{
+			name:     "all tags set",
+			existing: []*ec2.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}, {Key: aws.String("other"), Value: aws.String("tag")}},
+			tags:     map[string]string{"foo": "bar"},
+			want:     true,
+		},
+		{
+			name:     "tag with different value",
+			existing: []*ec2.Tag{{Key: aws.String("foo"), Value: aws.String("baz")}},
+			tags:     map[string]string{"foo": "bar"},
+			want:     false,
+		},
+		{
+			name:     "missing one tag",
+			existing: []*ec2.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}},
+			tags:     map[string]string{"foo": "bar", "something": "else"},
+			want:     false,
+		},
+		{
+			name:     "no tags wanted",
+			existing: nil,
+			tags:     map[string]string{},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasEC2Tags(tt.existing, tt.tags); got != tt.want {
+				t.Errorf("hasEC2Tags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_createAWSSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		endpoint     string
+		localstack   bool
+		wantEndpoint string
+		wantStatic   bool
+	}{
+		{
+			name:         "default endpoint",
+			endpoint:     "",
+			wantEndpoint: "",
+			wantStatic:   false,
+		},
+		{
+			name:         "localstack endpoint",
+			endpoint:     "http://localhost:4566",
+			localstack:   true,
+			wantEndpoint: "http://localhost:4566",
+			wantStatic:   true,
+		},
+		{
+			name:         "vpc endpoint",
+			endpoint:     "https://vpce-0123456789abcdef0-abcdefgh.ec2.us-east-1.vpce.amazonaws.com",
+			wantEndpoint: "https://vpce-0123456789abcdef0-abcdefgh.ec2.us-east-1.vpce.amazonaws.com",
+			wantStatic:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "")
+			t.Setenv("AWS_PROFILE", "")
+			providerEndpoint = tt.endpoint
+			localstack = tt.localstack
+			defer func() {
+				providerEndpoint = ""
+				localstack = false
+			}()
+
+			sess := createAWSSession("us-east-1")
+			if got := aws.StringValue(sess.Config.Endpoint); got != tt.wantEndpoint {
+				t.Errorf("createAWSSession() endpoint = %v, want %v", got, tt.wantEndpoint)
+			}
+			if tt.wantStatic {
+				creds, err := sess.Config.Credentials.Get()
+				if err != nil {
+					t.Fatalf("createAWSSession() credentials err = %v", err)
+				}
+				if creds.ProviderName != "StaticProvider" {
+					t.Errorf("createAWSSession() credentials provider = %v, want StaticProvider", creds.ProviderName)
+				}
+			} else if creds, err := sess.Config.Credentials.Get(); err == nil && creds.ProviderName == "StaticProvider" {
+				t.Errorf("createAWSSession() credentials provider = %v, want the credentials chain", creds.ProviderName)
+			}
+			if aws.BoolValue(sess.Config.S3ForcePathStyle) {
+				t.Errorf("createAWSSession() S3ForcePathStyle = true, want false")
+			}
+		})
+	}
+}
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "ec2 throttling",
+			err:  awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil),
+			want: errorClassThrottled,
+		},
+		{
+			name: "ec2 unauthorized",
+			err:  awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+			want: errorClassPermissionDenied,
+		},
+		{
+			name: "efs access denied",
+			err:  awserr.New("AccessDeniedException", "User is not authorized", nil),
+			want: errorClassPermissionDenied,
+		},
+		{
+			name: "ec2 volume not found",
+			err:  awserr.New("InvalidVolume.NotFound", "The volume 'vol-12345' does not exist.", nil),
+			want: errorClassNotFound,
+		},
+		{
+			name: "ec2 invalid tag",
+			err:  awserr.New("InvalidParameterValue", "Tag value exceeds the maximum length", nil),
+			want: errorClassInvalidTag,
+		},
+		{
+			name: "unknown aws error",
+			err:  awserr.New("SomethingNew", "", nil),
+			want: errorClassTransient,
+		},
+		{
+			name: "wrapped aws error",
+			err:  fmt.Errorf("tagging failed: %w", awserr.New("AccessDenied", "", nil)),
+			want: errorClassPermissionDenied,
+		},
+		{
+			name: "not an aws error",
+			err:  errors.New("connection reset"),
+			want: errorClassTransient,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncSnapshotTags(t *testing.T) {
+	store := newFakeTagStore()
+	store.addTags("snap-1", map[string]string{"team": "a", "old": "x"})
+	store.addTags("snap-2", map[string]string{"backup": "daily"})
+	client := &EBSClient{&snapshotsEC2{fakeEC2: &fakeEC2{store: store}, snapshots: map[string][]string{"vol-1": {"snap-1", "snap-2"}}}}
+
+	if err := client.syncSnapshotTags("vol-1", map[string]string{"team": "a"}, []string{"old"}); err != nil {
+		t.Fatalf("syncSnapshotTags() error = %v", err)
+	}
+	if got := store.get("snap-1"); !reflect.DeepEqual(got, map[string]string{"team": "a"}) {
+		t.Errorf("snap-1 tags = %v, want the removed tag deleted", got)
+	}
+	if got := store.get("snap-2"); !reflect.DeepEqual(got, map[string]string{"team": "a", "backup": "daily"}) {
+		t.Errorf("snap-2 tags = %v, want the missing tag added", got)
+	}
+
+	client = &EBSClient{&snapshotsEC2{fakeEC2: &fakeEC2{store: store}, err: awserr.New("UnauthorizedOperation", "denied", nil)}}
+	if err := client.syncSnapshotTags("vol-1", map[string]string{"team": "b"}, nil); err == nil {
+		t.Error("syncSnapshotTags() error = nil, want the describe error")
+	}
+}
+
+func Test_applyTagsSnapshotsOnly(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	defer func() { managedVolumes = newVolumeStore() }()
+	store := newFakeTagStore()
+	store.addTags("vol-1", map[string]string{"owner": "iac"})
+	store.addTags("snap-1", map[string]string{"old": "x"})
+	ec2Client := &EBSClient{&snapshotsEC2{fakeEC2: &fakeEC2{store: store}, snapshots: map[string][]string{"vol-1": {"snap-1"}}}}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", Annotations: map[string]string{
+		"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+		"k8s-pvc-tagger/targets":                        "snapshots",
+	}}}
+	tags := map[string]string{"team": "a"}
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "data", Tags: tags})
+
+	applyTags(pvc, "vol-1", tags, []string{"old"}, &EFSClient{&fakeEFS{store: store}}, ec2Client)
+	if got := store.get("vol-1"); !reflect.DeepEqual(got, map[string]string{"owner": "iac"}) {
+		t.Errorf("volume tags = %v, want the volume untouched", got)
+	}
+	if got := store.get("snap-1"); !reflect.DeepEqual(got, map[string]string{"team": "a"}) {
+		t.Errorf("snapshot tags = %v, want the tags of the PVC", got)
+	}
+	if v, _ := managedVolumes.get("vol-1"); !v.Synced {
+		t.Error("applyTags() didn't mark the volume as synced")
+	}
+}
@@ -0,0 +1,92 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	awsUserAgentName = "k8s-pvc-tagger"
+	// IAM role session names are at most 64 characters of [\w+=,.@-]
+	maxRoleSessionNameLength = 64
+)
+
+var regexpInvalidRoleSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// awsVersion is the controller version reported to AWS, dev for local builds
+func awsVersion() string {
+	if buildVersion == "" {
+		return "dev"
+	}
+	return buildVersion
+}
+
+// awsUserAgent is appended to the user agent of every AWS call, e.g.
+// k8s-pvc-tagger/v1.2.3 (cluster/prod-east), so CloudTrail events can be
+// attributed to the controller and its cluster
+func awsUserAgent() string {
+	userAgent := awsUserAgentName + "/" + awsVersion()
+	if clusterName != "" {
+		userAgent += " (cluster/" + clusterName + ")"
+	}
+	return userAgent
+}
+
+// addAWSUserAgent is a request handler adding awsUserAgent to the user agent.
+// The cluster name is read on each request since it can be discovered after
+// the session is created.
+func addAWSUserAgent(r *request.Request) {
+	request.AddToUserAgent(r, awsUserAgent())
+}
+
+// awsRoleSessionName is the role session name of the web identity (IRSA)
+// credentials, e.g. k8s-pvc-tagger@prod-east@v1.2.3, which is what CloudTrail
+// shows as the caller
+func awsRoleSessionName() string {
+	name := awsUserAgentName
+	if clusterName != "" {
+		name += "@" + clusterName
+	}
+	// Long cluster names are truncated rather than the version
+	version := "@" + awsVersion()
+	if len(name)+len(version) > maxRoleSessionNameLength && len(version) < maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength-len(version)]
+	}
+	name = regexpInvalidRoleSessionNameChars.ReplaceAllString(name+version, "-")
+	if len(name) > maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength]
+	}
+	return name
+}
+
+// setAWSRoleSessionName sets the role session name used by the SDK for the web
+// identity credentials, unless AWS_ROLE_SESSION_NAME is already set
+func setAWSRoleSessionName() {
+	if os.Getenv("AWS_ROLE_SESSION_NAME") != "" {
+		return
+	}
+	if err := os.Setenv("AWS_ROLE_SESSION_NAME", awsRoleSessionName()); err != nil {
+		log.Warnln("Could not set the AWS role session name:", err)
+	}
+}
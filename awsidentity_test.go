@@ -0,0 +1,95 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func Test_awsIdentity(t *testing.T) {
+	tests := []struct {
+		name            string
+		version         string
+		clusterName     string
+		wantUserAgent   string
+		wantSessionName string
+	}{
+		{
+			name:            "release",
+			version:         "v1.2.3",
+			clusterName:     "prod-east",
+			wantUserAgent:   "k8s-pvc-tagger/v1.2.3 (cluster/prod-east)",
+			wantSessionName: "k8s-pvc-tagger@prod-east@v1.2.3",
+		},
+		{
+			name:            "local build without a cluster name",
+			wantUserAgent:   "k8s-pvc-tagger/dev",
+			wantSessionName: "k8s-pvc-tagger@dev",
+		},
+		{
+			name:            "invalid characters",
+			version:         "v1.2.3",
+			clusterName:     "arn:aws:eks:us-east-1:123456789012:cluster/prod",
+			wantUserAgent:   "k8s-pvc-tagger/v1.2.3 (cluster/arn:aws:eks:us-east-1:123456789012:cluster/prod)",
+			wantSessionName: "k8s-pvc-tagger@arn-aws-eks-us-east-1-123456789012-cluster@v1.2.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildVersion, clusterName = tt.version, tt.clusterName
+			defer func() { buildVersion, clusterName = "", "" }()
+			if got := awsUserAgent(); got != tt.wantUserAgent {
+				t.Errorf("awsUserAgent() = %q, want %q", got, tt.wantUserAgent)
+			}
+			if got := awsRoleSessionName(); got != tt.wantSessionName {
+				t.Errorf("awsRoleSessionName() = %q, want %q", got, tt.wantSessionName)
+			}
+		})
+	}
+}
+
+func Test_addAWSUserAgent(t *testing.T) {
+	clusterName = "prod-east"
+	defer func() { clusterName = "" }()
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "CreateTags"}, nil, nil)
+	addAWSUserAgent(r)
+	if got := r.HTTPRequest.Header.Get("User-Agent"); !strings.HasSuffix(got, "k8s-pvc-tagger/dev (cluster/prod-east)") {
+		t.Errorf("User-Agent = %q, want the controller and its cluster", got)
+	}
+}
+
+func Test_setAWSRoleSessionName(t *testing.T) {
+	t.Setenv("AWS_ROLE_SESSION_NAME", "")
+	setAWSRoleSessionName()
+	if got := os.Getenv("AWS_ROLE_SESSION_NAME"); got != "k8s-pvc-tagger@dev" {
+		t.Errorf("AWS_ROLE_SESSION_NAME = %q, want k8s-pvc-tagger@dev", got)
+	}
+
+	t.Setenv("AWS_ROLE_SESSION_NAME", "custom")
+	setAWSRoleSessionName()
+	if got := os.Getenv("AWS_ROLE_SESSION_NAME"); got != "custom" {
+		t.Errorf("AWS_ROLE_SESSION_NAME = %q, want it unchanged", got)
+	}
+}
@@ -0,0 +1,116 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	backfillAll         = "all"
+	backfillMissingOnly = "missing-only"
+)
+
+// backfillMode is whether the startup resync tags every volume or only the
+// volumes that are missing their tags
+var backfillMode = backfillAll
+
+func validateBackfillMode(mode string) error {
+	switch mode {
+	case backfillAll:
+		return nil
+	case backfillMissingOnly:
+		if clusterName == "" {
+			return fmt.Errorf("%s needs --cluster-name to be set", backfillMissingOnly)
+		}
+		return nil
+	}
+	return fmt.Errorf("%q is not one of %s, %s", mode, backfillAll, backfillMissingOnly)
+}
+
+// isBackfilled returns true if the startup resync can skip the volume because
+// it already has the managed-by tag of this cluster and all of the tags.
+// Only the tags are described, which is much cheaper than writing them again.
+func isBackfilled(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, efsClient *EFSClient, ec2Client *EBSClient) bool {
+	if backfillMode != backfillMissingOnly || !isBulkResync(pvc) {
+		return false
+	}
+	efsClient, ec2Client = regionalClients(getPVCRegion(pvc), efsClient, ec2Client)
+	targets := getTargets(pvc)
+	// The snapshots can't be checked without describing all of them
+	if containsString(targets, targetSnapshots) {
+		return false
+	}
+
+	ids := []string{}
+	if containsString(targets, targetVolume) {
+		ids = append(ids, volumeID)
+	}
+	if containsString(targets, targetFileSystem) {
+		fileSystemID, err := getEFSFileSystemID(pvc)
+		if err != nil {
+			return false
+		}
+		ids = append(ids, fileSystemID)
+	}
+
+	defer apiCallOwners.attribute(pvc.GetNamespace(), ids...)()
+	for _, id := range ids {
+		var existing map[string]string
+		var err error
+		switch getProvider(pvc) {
+		case providerAWSEBS:
+			existing, err = ec2Client.getEBSVolumeTags(id)
+		case providerAWSEFS:
+			existing, err = efsClient.getEFSVolumeTags(id)
+		default:
+			return false
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": id, "error": err}).Warnln("Could not get the volume tags, tagging it")
+			return false
+		}
+		if !hasTags(existing, tags) || hasClearedDeletionProtection(existing, tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTags returns true if the existing tags have the managed-by tag of this
+// cluster and the same hash as the tags for the same keys. With --tags-hash-key
+// only the hash tags are compared.
+func hasTags(existing map[string]string, tags map[string]string) bool {
+	if existing[managedByTagKey] != managedByTagValue() {
+		return false
+	}
+	if tagsHashKey != "" {
+		return isTagsHashCurrent(existing, tags)
+	}
+	matching := map[string]string{}
+	for k := range tags {
+		if v, ok := existing[k]; ok {
+			matching[k] = v
+		}
+	}
+	return hashTags(matching) == hashTags(tags)
+}
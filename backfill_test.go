@@ -0,0 +1,137 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_hasTags(t *testing.T) {
+	clusterName = "prod"
+	defer func() { clusterName = "" }()
+
+	tests := []struct {
+		name     string
+		existing map[string]string
+		tags     map[string]string
+		want     bool
+	}{
+		{
+			name:     "all tags",
+			existing: map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod", "other": "tag"},
+			tags:     map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"},
+			want:     true,
+		},
+		{
+			name:     "no managed-by tag",
+			existing: map[string]string{"foo": "bar"},
+			tags:     map[string]string{"foo": "bar"},
+			want:     false,
+		},
+		{
+			name:     "managed by another cluster",
+			existing: map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/staging"},
+			tags:     map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"},
+			want:     false,
+		},
+		{
+			name:     "missing tag",
+			existing: map[string]string{"managed-by": "k8s-pvc-tagger/prod"},
+			tags:     map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"},
+			want:     false,
+		},
+		{
+			name:     "changed tag",
+			existing: map[string]string{"foo": "baz", "managed-by": "k8s-pvc-tagger/prod"},
+			tags:     map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasTags(tt.existing, tt.tags); got != tt.want {
+				t.Errorf("hasTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateBackfillMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		clusterName string
+		wantErr     bool
+	}{
+		{name: "all", mode: "all", wantErr: false},
+		{name: "missing-only", mode: "missing-only", clusterName: "prod", wantErr: false},
+		{name: "missing-only without cluster name", mode: "missing-only", wantErr: true},
+		{name: "unknown", mode: "some", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterName = tt.clusterName
+			defer func() { clusterName = "" }()
+			if err := validateBackfillMode(tt.mode); (err != nil) != tt.wantErr {
+				t.Errorf("validateBackfillMode() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_isBackfilled(t *testing.T) {
+	cloudProvider = cloudProviderFake
+	fakeVolumes = newFakeTagStore()
+	clusterName = "prod"
+	backfillMode = backfillMissingOnly
+	controllerStartTime = time.Now()
+	defer func() {
+		cloudProvider = cloudProviderAWS
+		fakeVolumes = newFakeTagStore()
+		clusterName = ""
+		backfillMode = backfillAll
+		controllerStartTime = time.Now()
+	}()
+	efsClient, _ := newEFSClient()
+	ec2Client, _ := newEC2Client()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("default")
+	pvc.SetCreationTimestamp(metav1.NewTime(controllerStartTime.Add(-time.Hour)))
+	pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"})
+	tags := map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"}
+
+	if isBackfilled(pvc, "vol-12345", tags, efsClient, ec2Client) {
+		t.Errorf("isBackfilled() = true for an untagged volume")
+	}
+	fakeVolumes.addTags("vol-12345", tags)
+	if !isBackfilled(pvc, "vol-12345", tags, efsClient, ec2Client) {
+		t.Errorf("isBackfilled() = false for a tagged volume")
+	}
+
+	pvc.SetCreationTimestamp(metav1.NewTime(controllerStartTime.Add(time.Minute)))
+	if isBackfilled(pvc, "vol-12345", tags, efsClient, ec2Client) {
+		t.Errorf("isBackfilled() = true for a new PVC")
+	}
+}
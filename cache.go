@@ -0,0 +1,104 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// tagCacheSize is the maximum number of rendered tag sets that are cached
+var tagCacheSize = 10000
+
+// tagCache caches the rendered tags keyed by a hash of the tags before
+// rendering and of the template data, so the resyncs of thousands of PVCs
+// don't execute the same templates again
+type tagCache struct {
+	sync.Mutex
+	size int
+	tags map[string]map[string]string
+}
+
+var renderedTags = newTagCache(tagCacheSize)
+
+func newTagCache(size int) *tagCache {
+	return &tagCache{size: size, tags: map[string]map[string]string{}}
+}
+
+// tagCacheKey returns the hash of everything the rendered tags depend on
+func tagCacheKey(data TagTemplate, tags map[string]string) string {
+	b, err := json.Marshal(struct {
+		Data TagTemplate
+		Tags map[string]string
+	}{data, tags})
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// flush empties the cache
+func (c *tagCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.tags = map[string]map[string]string{}
+	promTagCacheEntries.Set(0)
+}
+
+// get returns a copy of the cached tags, since the callers modify them
+func (c *tagCache) get(key string) (map[string]string, bool) {
+	if c.size <= 0 || key == "" {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	tags, ok := c.tags[key]
+	if !ok {
+		promTagCacheMisses.Inc()
+		return nil, false
+	}
+	promTagCacheHits.Inc()
+	return copyTags(tags), true
+}
+
+// add caches a copy of the tags. The cache is emptied when it is full, the
+// rendered tags of the PVCs that are still there are cached again on the next resync
+func (c *tagCache) add(key string, tags map[string]string) {
+	if c.size <= 0 || key == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.tags) >= c.size {
+		c.tags = map[string]map[string]string{}
+	}
+	c.tags[key] = copyTags(tags)
+	promTagCacheEntries.Set(float64(len(c.tags)))
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,114 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_tagCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		adds     []string
+		get      string
+		wantTags map[string]string
+		wantOk   bool
+	}{
+		{name: "hit", size: 10, adds: []string{"a"}, get: "a", wantTags: map[string]string{"foo": "a"}, wantOk: true},
+		{name: "miss", size: 10, adds: []string{"a"}, get: "b", wantOk: false},
+		{name: "disabled", size: 0, adds: []string{"a"}, get: "a", wantOk: false},
+		{name: "emptied when full", size: 2, adds: []string{"a", "b", "c"}, get: "a", wantOk: false},
+		{name: "added after emptied", size: 2, adds: []string{"a", "b", "c"}, get: "c", wantTags: map[string]string{"foo": "c"}, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTagCache(tt.size)
+			for _, key := range tt.adds {
+				c.add(key, map[string]string{"foo": key})
+			}
+			got, ok := c.get(tt.get)
+			if ok != tt.wantOk {
+				t.Errorf("get() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.wantTags) {
+				t.Errorf("get() = %v, want %v", got, tt.wantTags)
+			}
+		})
+	}
+}
+
+func Test_tagCacheCopies(t *testing.T) {
+	c := newTagCache(10)
+	tags := map[string]string{"foo": "bar"}
+	c.add("a", tags)
+	tags["foo"] = "changed"
+	got, _ := c.get("a")
+	got["foo"] = "changed too"
+	if got, _ := c.get("a"); got["foo"] != "bar" {
+		t.Errorf("get() = %v, want the tags as they were added", got)
+	}
+}
+
+func Test_tagCacheFlush(t *testing.T) {
+	c := newTagCache(10)
+	c.add("a", map[string]string{"foo": "a"})
+	c.add("b", map[string]string{"foo": "b"})
+	if got := testutil.ToFloat64(promTagCacheEntries); got != 2 {
+		t.Errorf("entries = %v, want 2", got)
+	}
+	c.flush()
+	if _, ok := c.get("a"); ok {
+		t.Errorf("flush() kept the tags")
+	}
+	if got := testutil.ToFloat64(promTagCacheEntries); got != 0 {
+		t.Errorf("entries = %v after flush(), want 0", got)
+	}
+}
+
+func Test_renderTagTemplatesCache(t *testing.T) {
+	renderedTags = newTagCache(10)
+	defer func() { renderedTags = newTagCache(tagCacheSize) }()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("my-namespace")
+
+	hits := testutil.ToFloat64(promTagCacheHits)
+	want := map[string]string{"name": "my-pvc"}
+	if got := renderTagTemplates(pvc, map[string]string{"name": "{{ .Name }}"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() = %v, want %v", got, want)
+	}
+	if got := renderTagTemplates(pvc, map[string]string{"name": "{{ .Name }}"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() cached = %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(promTagCacheHits) - hits; got != 1 {
+		t.Errorf("renderTagTemplates() cache hits = %v, want 1", got)
+	}
+
+	pvc.SetName("other-pvc")
+	want = map[string]string{"name": "other-pvc"}
+	if got := renderTagTemplates(pvc, map[string]string{"name": "{{ .Name }}"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() other PVC = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// coalesceWindow is how long to wait for more changes to a PVC before tagging its volume
+var coalesceWindow time.Duration
+
+type coalescedTagOperation struct {
+	pvc         *corev1.PersistentVolumeClaim
+	tags        map[string]string
+	removedTags []string
+}
+
+// tagOperationCoalescer merges the tag operations of a volume made within the
+// coalesce window into a single operation with the final desired tags
+type tagOperationCoalescer struct {
+	sync.Mutex
+	pending map[string]*coalescedTagOperation
+}
+
+var pendingTagOperations = newTagOperationCoalescer()
+
+func newTagOperationCoalescer() *tagOperationCoalescer {
+	return &tagOperationCoalescer{pending: map[string]*coalescedTagOperation{}}
+}
+
+// add schedules the tag operation of the volume to run at the end of the
+// coalesce window. If one is already scheduled, it is replaced by this one and
+// the keys removed by both are deleted unless they are set again.
+func (c *tagOperationCoalescer) add(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string, run func(*corev1.PersistentVolumeClaim, map[string]string, []string)) {
+	c.Lock()
+	defer c.Unlock()
+
+	if op, ok := c.pending[volumeID]; ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Coalescing tag operation")
+		promCoalescedTotal.Inc()
+		removed := []string{}
+		for _, k := range append(op.removedTags, removedTags...) {
+			if _, ok := tags[k]; !ok && !containsString(removed, k) {
+				removed = append(removed, k)
+			}
+		}
+		op.pvc = pvc
+		op.tags = tags
+		op.removedTags = removed
+		return
+	}
+
+	c.pending[volumeID] = &coalescedTagOperation{pvc: pvc, tags: tags, removedTags: removedTags}
+	time.AfterFunc(coalesceWindow, func() {
+		c.Lock()
+		op := c.pending[volumeID]
+		delete(c.pending, volumeID)
+		c.Unlock()
+		run(op.pvc, op.tags, op.removedTags)
+	})
+}
@@ -0,0 +1,76 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_tagOperationCoalescer(t *testing.T) {
+	coalesceWindow = 50 * time.Millisecond
+	defer func() { coalesceWindow = 0 }()
+
+	var mu sync.Mutex
+	calls := 0
+	var gotTags map[string]string
+	var gotRemoved []string
+	run := func(pvc *corev1.PersistentVolumeClaim, tags map[string]string, removedTags []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		gotTags = tags
+		gotRemoved = removedTags
+	}
+
+	c := newTagOperationCoalescer()
+	pvc := &corev1.PersistentVolumeClaim{}
+	c.add(pvc, "vol-12345", map[string]string{"foo": "bar"}, []string{"old"}, run)
+	c.add(pvc, "vol-12345", map[string]string{"foo": "baz", "old": "back"}, []string{"other"}, run)
+	c.add(pvc, "vol-12345", map[string]string{"foo": "final", "old": "back"}, nil, run)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := calls > 0
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// wait past another window to catch any extra calls
+	time.Sleep(2 * coalesceWindow)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("tagOperationCoalescer calls = %v, want 1", calls)
+	}
+	if want := map[string]string{"foo": "final", "old": "back"}; !reflect.DeepEqual(gotTags, want) {
+		t.Errorf("tagOperationCoalescer tags = %v, want %v", gotTags, want)
+	}
+	if want := []string{"other"}; !reflect.DeepEqual(gotRemoved, want) {
+		t.Errorf("tagOperationCoalescer removedTags = %v, want %v", gotRemoved, want)
+	}
+}
@@ -0,0 +1,126 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// command is a subcommand of the tagger. Without one, the controller runs.
+type command struct {
+	name string
+	// args are the arguments of the command in its usage
+	args    string
+	summary string
+}
+
+var commands = []command{
+	{name: "version", args: "[--output=text|json]", summary: "Print the version of the tagger"},
+	{name: "gc", args: "--cluster-name=<name> [flags]", summary: "Report the volumes tagged by the cluster whose PV is gone, or untag them with --delete"},
+	{name: "validate", args: "[flags]", summary: "Check a configuration, or how it would change the tags of the volumes with --against-cluster"},
+	{name: "import", args: "[flags]", summary: "Write the current tags of the volumes to the tags annotation of their PVCs"},
+	{name: "admin", args: "[flags] resync <namespace>[/<pvc>]|--all, pause-namespace <namespace>, resume-namespace <namespace>, flush-cache or dump-state", summary: "Call the admin API of the running controller"},
+	{name: "help", args: "[command]", summary: "Print the usage of the tagger or of a command"},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// runCommand runs the subcommand named by the first argument and returns its
+// exit code. It returns false when there's no subcommand, only the flags of
+// the controller.
+func runCommand(args []string, w io.Writer, errW io.Writer) (int, bool) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return 0, false
+	}
+	switch args[0] {
+	case "version":
+		return runVersionCommand(args[1:], w, errW), true
+	case "gc":
+		return runGCCommand(args[1:], w, errW), true
+	case "validate":
+		return runValidateCommand(args[1:], w, errW), true
+	case "import":
+		return runImportCommand(args[1:], w, errW), true
+	case "admin":
+		return runAdminCommand(args[1:], w, errW), true
+	case "help":
+		return runHelpCommand(args[1:], w, errW), true
+	}
+	fmt.Fprintf(errW, "unknown command %q\n\n", args[0])
+	printUsage(errW, nil)
+	return 2, true
+}
+
+// runHelpCommand runs `k8s-pvc-tagger help [command]` and returns the exit code
+func runHelpCommand(args []string, w io.Writer, errW io.Writer) int {
+	if len(args) == 0 || args[0] == "help" {
+		printUsage(w, nil)
+		return 0
+	}
+	if _, ok := findCommand(args[0]); !ok {
+		fmt.Fprintf(errW, "unknown command %q\n\n", args[0])
+		printUsage(errW, nil)
+		return 2
+	}
+	// The flag set of the command prints its usage on -h
+	runCommand([]string{args[0], "-h"}, w, w)
+	return 0
+}
+
+// printUsage prints the usage of the tagger, with the flags of the
+// controller when they're given
+func printUsage(w io.Writer, controllerFlags *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: k8s-pvc-tagger [flags]")
+	fmt.Fprintln(w, "       k8s-pvc-tagger <command> [arguments]")
+	fmt.Fprintln(w, "\nWithout a command, the controller runs and tags the volumes of the PVCs.")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nRun `k8s-pvc-tagger help <command>` for the usage of a command.")
+	if controllerFlags == nil {
+		fmt.Fprintln(w, "Run `k8s-pvc-tagger -h` for the flags of the controller.")
+		return
+	}
+	fmt.Fprintln(w, "\nFlags of the controller:")
+	controllerFlags.PrintDefaults()
+}
+
+// newCommandFlagSet returns the flag set of the subcommand, whose usage is
+// printed to errW on -h or a flag error
+func newCommandFlagSet(name string, errW io.Writer) *flag.FlagSet {
+	c, _ := findCommand(name)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(errW)
+	fs.Usage = func() {
+		fmt.Fprintf(errW, "Usage: k8s-pvc-tagger %s %s\n\n%s.\n\nFlags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,60 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_runCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantOk     bool
+		wantCode   int
+		wantOut    string
+		wantErrOut string
+	}{
+		{name: "no arguments"},
+		{name: "controller flags", args: []string{"--watch-namespace=default"}},
+		{name: "version", args: []string{"version", "--output=json"}, wantOk: true, wantOut: `"version"`},
+		{name: "help", args: []string{"help"}, wantOk: true, wantOut: "  gc         Report the volumes"},
+		{name: "help of a command", args: []string{"help", "gc"}, wantOk: true, wantOut: "Usage: k8s-pvc-tagger gc --cluster-name=<name> [flags]"},
+		{name: "help of an unknown command", args: []string{"help", "foo"}, wantOk: true, wantCode: 2, wantErrOut: `unknown command "foo"`},
+		{name: "command usage", args: []string{"admin", "-h"}, wantOk: true, wantCode: 2, wantErrOut: "Call the admin API of the running controller."},
+		{name: "unknown command", args: []string{"foo"}, wantOk: true, wantCode: 2, wantErrOut: "Commands:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			code, ok := runCommand(tt.args, &out, &errOut)
+			if ok != tt.wantOk || code != tt.wantCode {
+				t.Fatalf("runCommand() = %v, %v, want %v, %v: %s", code, ok, tt.wantCode, tt.wantOk, errOut.String())
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("runCommand() output = %q, want it to contain %q", out.String(), tt.wantOut)
+			}
+			if !strings.Contains(errOut.String(), tt.wantErrOut) {
+				t.Errorf("runCommand() error output = %q, want it to contain %q", errOut.String(), tt.wantErrOut)
+			}
+		})
+	}
+}
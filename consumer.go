@@ -0,0 +1,241 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// waitForConsumer delays tagging until a pod uses the PVC, so that the
+	// workload derived template variables are known, for all PVCs. It can be
+	// set per PVC with the wait-for-consumer annotation.
+	waitForConsumer        bool
+	waitForConsumerTimeout = 10 * time.Minute
+	// consumerPollInterval is how often the pods are checked while waiting
+	consumerPollInterval = 30 * time.Second
+)
+
+var consumerWaits = newPVCTimers(promWaitingForConsumerPVCs)
+
+// isWaitingForConsumer returns whether tagging the PVC's volume is delayed
+// until a pod uses it. The volume is tagged with whatever is known once the
+// PVC is older than the timeout.
+func isWaitingForConsumer(pvc *corev1.PersistentVolumeClaim, now time.Time) bool {
+	if !isWaitForConsumerEnabled(pvc) {
+		return false
+	}
+	if now.Sub(pvc.GetCreationTimestamp().Time) >= waitForConsumerTimeout {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Timed out waiting for a pod to use the PVC")
+		return false
+	}
+	return !isConsumed(pvc)
+}
+
+// isWaitForConsumerEnabled returns whether to wait for a pod to use the PVC,
+// from its wait-for-consumer annotation or else --wait-for-consumer
+func isWaitForConsumerEnabled(pvc *corev1.PersistentVolumeClaim) bool {
+	if value, ok := getPVCAnnotation(pvc, "wait-for-consumer"); ok {
+		return value == "true"
+	}
+	return waitForConsumer
+}
+
+// isConsumed returns whether a pod scheduled on a node uses the PVC
+func isConsumed(pvc *corev1.PersistentVolumeClaim) bool {
+	if pvc.GetAnnotations()[selectedNodeAnnotation] != "" || getOwningPod(pvc) != "" {
+		return true
+	}
+	pod, err := consumers.get(pvc)
+	if err != nil {
+		// Tag straight away rather than waiting on an error, e.g. a missing permission
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Could not list the pods using the PVC:", err)
+		return true
+	}
+	return pod != nil
+}
+
+// podsByPVCIndex is the index of the pods by the namespace/name of the PVCs they use
+const podsByPVCIndex = "pvc"
+
+func podPVCKeys(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	var keys []string
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim != nil {
+			keys = append(keys, pod.GetNamespace()+"/"+v.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	return keys, nil
+}
+
+// isConsumingPod returns whether the pod is scheduled on a node, and not
+// completed, and uses the PVC
+func isConsumingPod(pod *corev1.Pod, claimName string) bool {
+	if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == claimName {
+			return true
+		}
+	}
+	return false
+}
+
+// consumerStore resolves the pod using each PVC, from the pods indexed by PVC
+// of the pod informers when they're running or else by listing the pods of the
+// namespace, and keeps it once found, since the node of a pod doesn't change
+type consumerStore struct {
+	sync.Mutex
+	indexers []cache.Indexer
+	pods     map[string]*corev1.Pod
+}
+
+var consumers = newConsumerStore()
+
+func newConsumerStore() *consumerStore {
+	return &consumerStore{pods: map[string]*corev1.Pod{}}
+}
+
+func (s *consumerStore) addIndexer(indexer cache.Indexer) {
+	s.Lock()
+	defer s.Unlock()
+	s.indexers = append(s.indexers, indexer)
+}
+
+// get returns the pod using the PVC, or nil if no pod scheduled on a node uses it
+func (s *consumerStore) get(pvc *corev1.PersistentVolumeClaim) (*corev1.Pod, error) {
+	key := pvc.GetNamespace() + "/" + pvc.GetName()
+	s.Lock()
+	pod, ok := s.pods[key]
+	indexers := s.indexers
+	s.Unlock()
+	if ok {
+		return pod, nil
+	}
+
+	var pods []*corev1.Pod
+	if len(indexers) > 0 {
+		for _, indexer := range indexers {
+			objs, err := indexer.ByIndex(podsByPVCIndex, key)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range objs {
+				pods = append(pods, obj.(*corev1.Pod))
+			}
+		}
+	} else {
+		list, err := k8sClient.CoreV1().Pods(pvc.GetNamespace()).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			pods = append(pods, &list.Items[i])
+		}
+	}
+	for _, pod := range pods {
+		if isConsumingPod(pod, pvc.GetName()) {
+			s.Lock()
+			s.pods[key] = pod
+			s.Unlock()
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *consumerStore) delete(namespace string, name string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pods, namespace+"/"+name)
+}
+
+// watchPods runs a pod informer of the namespace, all of them if empty, with
+// the pods indexed by the PVCs they use, so that finding the pod using a PVC
+// costs no API server call
+func watchPods(ch <-chan struct{}, namespace string) {
+	informer := newPodInformer(namespace)
+	consumers.addIndexer(informer.GetIndexer())
+	informer.Run(ch)
+}
+
+func newPodInformer(namespace string) cache.SharedIndexInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0, informers.WithNamespace(namespace))
+	informer := factory.Core().V1().Pods().Informer()
+	if err := informer.SetWatchErrorHandler(watchErrorHandler); err != nil {
+		log.Warnln("Could not set the watch error handler:", err)
+	}
+	// Only the fields used to find the pod using a PVC, and its node, are kept
+	if err := informer.SetTransform(func(obj interface{}) (interface{}, error) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return obj, nil
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            pod.GetName(),
+				Namespace:       pod.GetNamespace(),
+				ResourceVersion: pod.GetResourceVersion(),
+				Labels:          map[string]string{"pod-template-hash": pod.GetLabels()["pod-template-hash"]},
+				OwnerReferences: pod.GetOwnerReferences(),
+			},
+			Spec:   corev1.PodSpec{NodeName: pod.Spec.NodeName, Volumes: pod.Spec.Volumes},
+			Status: corev1.PodStatus{Phase: pod.Status.Phase},
+		}, nil
+	}); err != nil {
+		log.Warnln("Could not set the pod transform:", err)
+	}
+	if err := informer.AddIndexers(cache.Indexers{podsByPVCIndex: podPVCKeys}); err != nil {
+		log.Warnln("Could not index the pods by PVC:", err)
+	}
+	return informer
+}
+
+// resyncPVC gets the PVC again and tags its volume with its current tags
+func resyncPVC(namespace string, name string, efsClient *EFSClient, ec2Client *EBSClient) {
+	pvc, err := k8sClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		log.WithFields(log.Fields{"namespace": namespace, "pvc": name}).Errorln("Could not get the PVC:", err)
+		return
+	}
+	reconcileTraces.start(pvc, "resync")
+	updateSkipReason(pvc)
+	volumeID, tags, err := processPersistentVolumeClaim(pvc)
+	removedTags := buildRemovedTags(pvc)
+	if err != nil || (len(tags) == 0 && len(removedTags) == 0) {
+		return
+	}
+	tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+}
@@ -0,0 +1,199 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_isWaitingForConsumer(t *testing.T) {
+	now := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	podUsing := func(name string, claim string, node string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.PodSpec{
+				NodeName: node,
+				Volumes: []corev1.Volume{{
+					Name:         "data",
+					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim}},
+				}},
+			},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+	controller := true
+
+	tests := []struct {
+		name            string
+		waitForConsumer bool
+		pvcName         string
+		annotations     map[string]string
+		owners          []metav1.OwnerReference
+		age             time.Duration
+		want            bool
+	}{
+		{
+			name:    "disabled",
+			pvcName: "unused",
+			want:    false,
+		},
+		{
+			name:            "unused PVC",
+			waitForConsumer: true,
+			pvcName:         "unused",
+			want:            true,
+		},
+		{
+			name:        "unused PVC with the annotation",
+			pvcName:     "unused",
+			annotations: map[string]string{"k8s-pvc-tagger/wait-for-consumer": "true"},
+			want:        true,
+		},
+		{
+			name:            "annotation opting out",
+			waitForConsumer: true,
+			pvcName:         "unused",
+			annotations:     map[string]string{"k8s-pvc-tagger/wait-for-consumer": "false"},
+			want:            false,
+		},
+		{
+			name:            "timed out",
+			waitForConsumer: true,
+			pvcName:         "unused",
+			age:             time.Hour,
+			want:            false,
+		},
+		{
+			name:            "used by a running pod",
+			waitForConsumer: true,
+			pvcName:         "used",
+			want:            false,
+		},
+		{
+			name:            "used by a pending pod",
+			waitForConsumer: true,
+			pvcName:         "pending",
+			want:            true,
+		},
+		{
+			name:            "used by a completed pod",
+			waitForConsumer: true,
+			pvcName:         "completed",
+			want:            true,
+		},
+		{
+			name:            "selected node",
+			waitForConsumer: true,
+			pvcName:         "unused",
+			annotations:     map[string]string{"volume.kubernetes.io/selected-node": "node-1"},
+			want:            false,
+		},
+		{
+			name:            "ephemeral volume",
+			waitForConsumer: true,
+			pvcName:         "unused",
+			owners:          []metav1.OwnerReference{{Kind: "Pod", Name: "my-pod", Controller: &controller}},
+			want:            false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waitForConsumer = tt.waitForConsumer
+			consumers = newConsumerStore()
+			defer func() {
+				waitForConsumer = false
+				consumers = newConsumerStore()
+			}()
+			k8sClient = fake.NewSimpleClientset(
+				podUsing("running", "used", "node-1", corev1.PodRunning),
+				podUsing("pending", "pending", "", corev1.PodPending),
+				podUsing("completed", "completed", "node-1", corev1.PodSucceeded),
+			)
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName(tt.pvcName)
+			pvc.SetNamespace("default")
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetOwnerReferences(tt.owners)
+			pvc.SetCreationTimestamp(metav1.NewTime(now.Add(-tt.age)))
+
+			if got := isWaitingForConsumer(pvc, now); got != tt.want {
+				t.Errorf("isWaitingForConsumer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_consumerStore(t *testing.T) {
+	consumers = newConsumerStore()
+	defer func() { consumers = newConsumerStore() }()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Volumes: []corev1.Volume{{
+				Name:         "data",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"}},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	client := fake.NewSimpleClientset(pod)
+	k8sClient = client
+
+	ch := make(chan struct{})
+	defer close(ch)
+	informer := newPodInformer("")
+	go informer.Run(ch)
+	if !cache.WaitForCacheSync(ch, informer.HasSynced) {
+		t.Fatal("the pod informer did not sync")
+	}
+	consumers.addIndexer(informer.GetIndexer())
+	client.ClearActions()
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "default"}}
+	got, err := consumers.get(pvc)
+	if err != nil || got == nil || got.GetName() != "web-0" || got.Spec.NodeName != "node-1" {
+		t.Fatalf("get() = %v, %v, want the pod web-0", got, err)
+	}
+	unused := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "unused", Namespace: "default"}}
+	if got, err := consumers.get(unused); err != nil || got != nil {
+		t.Errorf("get() of an unused PVC = %v, %v, want nil", got, err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("get() made the API calls %v, want none", actions)
+	}
+
+	// The pod is kept once found
+	if err := informer.GetIndexer().Delete(pod); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := consumers.get(pvc); got == nil {
+		t.Errorf("get() after the pod is gone = nil, want the pod found before")
+	}
+	consumers.delete("default", "data-web-0")
+	if got, _ := consumers.get(pvc); got != nil {
+		t.Errorf("get() after delete() = %v, want nil", got)
+	}
+}
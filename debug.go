@@ -0,0 +1,163 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// leaderIdentity and providerRegion are only used to describe the controller in its state dump
+	leaderIdentity string
+	providerRegion string
+)
+
+// controllerState is a point in time dump of the controller's internal state
+type controllerState struct {
+	Time     time.Time     `json:"time"`
+	Version  string        `json:"version"`
+	Identity string        `json:"identity"`
+	Leader   string        `json:"leader"`
+	Provider providerState `json:"provider"`
+	Policy   policyState   `json:"policy"`
+	// Pending are the volumes whose desired tags have not been applied yet
+	Pending            []pendingVolume     `json:"pending"`
+	Namespaces         map[string]int      `json:"namespaces"`
+	DeadLetters        []deadLetter        `json:"deadLetters"`
+	MissingPermissions []missingPermission `json:"missingPermissions"`
+	PausedNamespaces   []string            `json:"pausedNamespaces"`
+}
+
+type providerState struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+}
+
+// policyState describes the tagging configuration. DefaultTags is a hash so
+// that two replicas can be compared without leaking tag values.
+type policyState struct {
+	AnnotationPrefix   string   `json:"annotationPrefix"`
+	TagFormat          string   `json:"tagFormat"`
+	TagSources         []string `json:"tagSources"`
+	DefaultTags        string   `json:"defaultTags"`
+	AllowAllTags       bool     `json:"allowAllTags"`
+	AllowedBackupPlans []string `json:"allowedBackupPlans"`
+	WatchNamespace     string   `json:"watchNamespace"`
+	LabelSelector      string   `json:"labelSelector"`
+	FieldSelector      string   `json:"fieldSelector"`
+}
+
+type pendingVolume struct {
+	VolumeID  string `json:"volumeID"`
+	Provider  string `json:"provider"`
+	Namespace string `json:"namespace"`
+	PVC       string `json:"pvc"`
+}
+
+func buildControllerState() controllerState {
+	state := controllerState{
+		Time:     time.Now(),
+		Version:  buildVersion,
+		Identity: leaderIdentity,
+		Leader:   currentLeader.get(),
+		Provider: providerState{
+			Name:   cloudProvider,
+			Region: providerRegion,
+		},
+		Policy: policyState{
+			AnnotationPrefix:   annotationPrefix,
+			TagFormat:          tagFormat,
+			TagSources:         tagSources,
+			DefaultTags:        hashTags(defaultTags),
+			AllowAllTags:       allowAllTags,
+			AllowedBackupPlans: allowedBackupPlans,
+			WatchNamespace:     watchNamespace,
+			LabelSelector:      pvcLabelSelector,
+			FieldSelector:      pvcFieldSelector,
+		},
+		Pending:            []pendingVolume{},
+		Namespaces:         map[string]int{},
+		DeadLetters:        deadLetters.list(),
+		MissingPermissions: missingPermissions.list(),
+		PausedNamespaces:   pausedNamespaces.list(),
+	}
+
+	for _, v := range managedVolumes.list("") {
+		state.Namespaces[v.Namespace]++
+		if !v.Synced {
+			state.Pending = append(state.Pending, pendingVolume{
+				VolumeID:  v.VolumeID,
+				Provider:  v.Provider,
+				Namespace: v.Namespace,
+				PVC:       v.PVC,
+			})
+		}
+	}
+	sort.Slice(state.Pending, func(i, j int) bool {
+		if state.Pending[i].Namespace != state.Pending[j].Namespace {
+			return state.Pending[i].Namespace < state.Pending[j].Namespace
+		}
+		return state.Pending[i].PVC < state.Pending[j].PVC
+	})
+
+	return state
+}
+
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, err := w.Write([]byte("method is not implemented"))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(buildControllerState())
+	if err != nil {
+		log.Errorln("Cannot write controller state:", err)
+	}
+}
+
+// dumpStateOnSignal writes the controller state as JSON to stderr every time
+// the process receives a SIGUSR1, e.g. `kill -USR1 1` for a support bundle
+func dumpStateOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		state, err := json.MarshalIndent(buildControllerState(), "", "  ")
+		if err != nil {
+			log.Errorln("Cannot marshal controller state:", err)
+			continue
+		}
+		log.Infoln("Received SIGUSR1, dumping controller state to stderr")
+		_, err = os.Stderr.Write(append(state, '\n'))
+		if err != nil {
+			log.Errorln("Cannot write controller state:", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_buildControllerState(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	defer func() {
+		managedVolumes = newVolumeStore()
+		deadLetters = newDeadLetterStore()
+	}()
+
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "b", Synced: true})
+	managedVolumes.set(managedVolume{VolumeID: "vol-2", Provider: providerAWSEBS, Namespace: "default", PVC: "a"})
+	managedVolumes.set(managedVolume{VolumeID: "fsap-1", Provider: providerAWSEFS, Namespace: "other", PVC: "c"})
+
+	state := buildControllerState()
+
+	wantNamespaces := map[string]int{"default": 2, "other": 1}
+	if !reflect.DeepEqual(state.Namespaces, wantNamespaces) {
+		t.Errorf("buildControllerState() namespaces = %v, want %v", state.Namespaces, wantNamespaces)
+	}
+	wantPending := []pendingVolume{
+		{VolumeID: "vol-2", Provider: providerAWSEBS, Namespace: "default", PVC: "a"},
+		{VolumeID: "fsap-1", Provider: providerAWSEFS, Namespace: "other", PVC: "c"},
+	}
+	if !reflect.DeepEqual(state.Pending, wantPending) {
+		t.Errorf("buildControllerState() pending = %v, want %v", state.Pending, wantPending)
+	}
+	if state.Policy.DefaultTags != hashTags(defaultTags) {
+		t.Errorf("buildControllerState() defaultTags = %v, want %v", state.Policy.DefaultTags, hashTags(defaultTags))
+	}
+}
@@ -0,0 +1,162 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// deletionProtection sets the deletion protection tag from the
+	// deletion-protection annotation of the PVC or its namespace
+	deletionProtection bool
+	// deletionProtectionTagKey is the tag cloud-side guard automation, e.g. a
+	// policy denying the deletion of tagged volumes, selects the volumes with
+	deletionProtectionTagKey = "deletion-protection"
+)
+
+// getDeletionProtectionTagKeys returns the key of the deletion protection
+// tag, or nil when it's disabled
+func getDeletionProtectionTagKeys() []string {
+	if !deletionProtection {
+		return nil
+	}
+	return []string{deletionProtectionTagKey}
+}
+
+// errInvalidDeletionProtection is returned for a deletion-protection
+// annotation that is not a boolean
+var errInvalidDeletionProtection = errors.New("the deletion-protection annotation is not a boolean")
+
+// isDeletionProtected returns whether the deletion-protection annotation of
+// the PVC, or else of its namespace, is true. The namespace is only read when
+// the PVC has no annotation.
+func isDeletionProtected(pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	value, ok := getPVCAnnotation(pvc, "deletion-protection")
+	if !ok {
+		annotations, err := getNamespaceAnnotations(pvc)
+		if err != nil {
+			return false, fmt.Errorf("cannot read the deletion-protection annotation of namespace %s: %w", pvc.GetNamespace(), err)
+		}
+		if value, ok = annotations[annotationPrefix+"/deletion-protection"]; !ok {
+			return false, nil
+		}
+	}
+	protected, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %q", errInvalidDeletionProtection, value)
+	}
+	return protected, nil
+}
+
+// setDeletionProtectionTag sets the deletion protection tag of a protected
+// PVC's volume, over the same tag of the tags annotation. When whether the
+// PVC is protected can't be known, an error is returned so that the volume
+// isn't reconciled, rather than stripping its protection.
+func setDeletionProtectionTag(pvc *corev1.PersistentVolumeClaim, tags map[string]string) error {
+	if !deletionProtection || isIgnored(pvc) {
+		return nil
+	}
+	protected, err := isDeletionProtected(pvc)
+	if err != nil {
+		if errors.Is(err, errInvalidDeletionProtection) {
+			reportInvalidTags(pvc, []error{err})
+		}
+		return err
+	}
+	if protected {
+		tags[deletionProtectionTagKey] = "true"
+	}
+	return nil
+}
+
+// withDeletionProtectionRemoval adds the deletion protection tag to the
+// removed tags when the PVC isn't protected and the volume may have it: the
+// tagger applied it, or the volume wasn't tagged since the tagger started, so
+// a protection cleared while it was down is removed too. Tags that are no
+// longer set are otherwise left on the volume.
+func withDeletionProtectionRemoval(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string) []string {
+	if !deletionProtection || containsString(removedTags, deletionProtectionTagKey) {
+		return removedTags
+	}
+	if _, ok := tags[deletionProtectionTagKey]; ok {
+		return removedTags
+	}
+	if v, ok := managedVolumes.get(volumeID); ok && v.Tags[deletionProtectionTagKey] != "true" {
+		return removedTags
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("PVC isn't protected, removing the deletion protection tag")
+	return append(removedTags, deletionProtectionTagKey)
+}
+
+// hasClearedDeletionProtection returns whether the volume's existing tags
+// have the deletion protection tag while the PVC isn't protected, so that
+// the backfill doesn't skip its removal
+func hasClearedDeletionProtection(existing map[string]string, tags map[string]string) bool {
+	if !deletionProtection {
+		return false
+	}
+	_, has := existing[deletionProtectionTagKey]
+	_, wanted := tags[deletionProtectionTagKey]
+	return has && !wanted
+}
+
+// isDeletionProtectionChanged returns whether the deletion-protection
+// annotation of the namespace was set, changed or cleared
+func isDeletionProtectionChanged(oldNS *corev1.Namespace, newNS *corev1.Namespace) bool {
+	oldValue, oldOK := oldNS.GetAnnotations()[annotationPrefix+"/deletion-protection"]
+	newValue, newOK := newNS.GetAnnotations()[annotationPrefix+"/deletion-protection"]
+	return oldOK != newOK || oldValue != newValue
+}
+
+// watchNamespaceDeletionProtection resyncs the PVCs of a namespace when its
+// deletion-protection annotation changes, since the PVCs get no event of
+// their own
+func watchNamespaceDeletionProtection(ch <-chan struct{}) {
+	newNamespaceDeletionProtectionInformer().Run(ch)
+}
+
+func newNamespaceDeletionProtectionInformer() cache.SharedIndexInformer {
+	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	informer := factory.Core().V1().Namespaces().Informer()
+	if err := informer.SetWatchErrorHandler(watchErrorHandler); err != nil {
+		log.Warnln("Could not set the watch error handler:", err)
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldNS := old.(*corev1.Namespace)
+			newNS := new.(*corev1.Namespace)
+			if !isDeletionProtectionChanged(oldNS, newNS) {
+				return
+			}
+			value := newNS.GetAnnotations()[annotationPrefix+"/deletion-protection"]
+			resynced := pvcInformers.resync(newNS.GetName(), "", "namespace-deletion-protection")
+			log.WithFields(log.Fields{"namespace": newNS.GetName(), "deletionProtection": value, "resynced": resynced}).Infoln("Namespace deletion protection changed")
+		},
+	})
+	return informer
+}
@@ -0,0 +1,306 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_setDeletionProtectionTag(t *testing.T) {
+	origClient := k8sClient
+	deletionProtection = true
+	defer func() {
+		k8sClient, deletionProtection = origClient, false
+	}()
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Annotations: map[string]string{"k8s-pvc-tagger/deletion-protection": "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "scratch"}},
+	)
+	pvc := func(namespace string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "data", Annotations: annotations}}
+	}
+
+	tests := []struct {
+		name    string
+		pvc     *corev1.PersistentVolumeClaim
+		tags    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "protected PVC",
+			pvc:  pvc("scratch", map[string]string{"k8s-pvc-tagger/deletion-protection": "true"}),
+			tags: map[string]string{"team": "a"},
+			want: map[string]string{"team": "a", "deletion-protection": "true"},
+		},
+		{
+			name: "protected namespace",
+			pvc:  pvc("payments", nil),
+			tags: map[string]string{},
+			want: map[string]string{"deletion-protection": "true"},
+		},
+		{
+			name: "PVC opted out of a protected namespace",
+			pvc:  pvc("payments", map[string]string{"k8s-pvc-tagger/deletion-protection": "false"}),
+			tags: map[string]string{},
+			want: map[string]string{},
+		},
+		{
+			name: "over the tags annotation",
+			pvc:  pvc("payments", nil),
+			tags: map[string]string{"deletion-protection": "no"},
+			want: map[string]string{"deletion-protection": "true"},
+		},
+		{
+			name:    "not a boolean",
+			pvc:     pvc("scratch", map[string]string{"k8s-pvc-tagger/deletion-protection": "always"}),
+			tags:    map[string]string{},
+			want:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:    "namespace can't be read",
+			pvc:     pvc("unknown", nil),
+			tags:    map[string]string{},
+			want:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name: "PVC annotation without reading the namespace",
+			pvc:  pvc("unknown", map[string]string{"k8s-pvc-tagger/deletion-protection": "true"}),
+			tags: map[string]string{},
+			want: map[string]string{"deletion-protection": "true"},
+		},
+		{
+			name: "unprotected",
+			pvc:  pvc("scratch", nil),
+			tags: map[string]string{},
+			want: map[string]string{},
+		},
+		{
+			name: "ignored",
+			pvc:  pvc("payments", map[string]string{"k8s-pvc-tagger/ignore": ""}),
+			tags: map[string]string{},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setDeletionProtectionTag(tt.pvc, tt.tags); (err != nil) != tt.wantErr {
+				t.Errorf("setDeletionProtectionTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.tags, tt.want) {
+				t.Errorf("setDeletionProtectionTag() tags = %v, want %v", tt.tags, tt.want)
+			}
+		})
+	}
+}
+
+func Test_withDeletionProtectionRemoval(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deletionProtection = true
+	defer func() {
+		deletionProtection = false
+	}()
+	managedVolumes.set(managedVolume{VolumeID: "vol-protected", Namespace: "default", PVC: "protected", Tags: map[string]string{"team": "a", "deletion-protection": "true"}})
+	managedVolumes.set(managedVolume{VolumeID: "vol-unprotected", Namespace: "default", PVC: "unprotected", Tags: map[string]string{"team": "a"}})
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data"}}
+
+	tests := []struct {
+		name        string
+		volumeID    string
+		tags        map[string]string
+		removedTags []string
+		want        []string
+	}{
+		{name: "protection cleared", volumeID: "vol-protected", tags: map[string]string{"team": "a"}, want: []string{"deletion-protection"}},
+		{name: "still protected", volumeID: "vol-protected", tags: map[string]string{"team": "a", "deletion-protection": "true"}, want: nil},
+		{name: "already removed", volumeID: "vol-protected", tags: map[string]string{}, removedTags: []string{"deletion-protection"}, want: []string{"deletion-protection"}},
+		{name: "never protected", volumeID: "vol-unprotected", tags: map[string]string{"team": "a"}, want: nil},
+		{name: "not tagged since the start", volumeID: "vol-unknown", tags: map[string]string{}, want: []string{"deletion-protection"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withDeletionProtectionRemoval(pvc, tt.volumeID, tt.tags, tt.removedTags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withDeletionProtectionRemoval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	deletionProtection = false
+	if got := withDeletionProtectionRemoval(pvc, "vol-protected", map[string]string{}, nil); got != nil {
+		t.Errorf("withDeletionProtectionRemoval() when disabled = %v, want nil", got)
+	}
+}
+
+func Test_deletionProtectionCleared(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deletionProtection = true
+	defer func() {
+		managedVolumes.deleteByPVC("default", "data")
+		deletionProtection = false
+	}()
+	fakeStore := newFakeTagStore()
+	efsClient, ec2Client := &EFSClient{&fakeEFS{store: fakeStore}}, &EBSClient{&fakeEC2{store: fakeStore}}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", Annotations: map[string]string{
+			"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+		}},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+	}
+
+	tagVolume(pvc, "vol-1", map[string]string{"team": "a", "deletion-protection": "true"}, nil, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); tags["deletion-protection"] != "true" {
+		t.Fatalf("tagVolume() tags = %v, want the deletion protection tag", tags)
+	}
+	tagVolume(pvc, "vol-1", map[string]string{"team": "a"}, nil, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); !reflect.DeepEqual(tags, map[string]string{"team": "a"}) {
+		t.Errorf("tagVolume() tags after the protection was cleared = %v, want the deletion protection tag removed", tags)
+	}
+
+	// The protection was cleared while the tagger was down
+	managedVolumes.deleteByPVC("default", "data")
+	fakeStore.addTags("vol-1", map[string]string{"deletion-protection": "true"})
+	tagVolume(pvc, "vol-1", map[string]string{"team": "a"}, nil, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); !reflect.DeepEqual(tags, map[string]string{"team": "a"}) {
+		t.Errorf("tagVolume() tags after a restart = %v, want the deletion protection tag removed", tags)
+	}
+}
+
+func Test_hasClearedDeletionProtection(t *testing.T) {
+	deletionProtection = true
+	defer func() {
+		deletionProtection = false
+	}()
+	tests := []struct {
+		name     string
+		existing map[string]string
+		tags     map[string]string
+		want     bool
+	}{
+		{name: "cleared", existing: map[string]string{"deletion-protection": "true"}, tags: map[string]string{}, want: true},
+		{name: "still protected", existing: map[string]string{"deletion-protection": "true"}, tags: map[string]string{"deletion-protection": "true"}, want: false},
+		{name: "never protected", existing: map[string]string{"team": "a"}, tags: map[string]string{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasClearedDeletionProtection(tt.existing, tt.tags); got != tt.want {
+				t.Errorf("hasClearedDeletionProtection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isDeletionProtectionChanged(t *testing.T) {
+	ns := func(annotations map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Annotations: annotations}}
+	}
+	protected := map[string]string{"k8s-pvc-tagger/deletion-protection": "true"}
+	tests := []struct {
+		name  string
+		oldNS *corev1.Namespace
+		newNS *corev1.Namespace
+		want  bool
+	}{
+		{name: "set", oldNS: ns(nil), newNS: ns(protected), want: true},
+		{name: "cleared", oldNS: ns(protected), newNS: ns(nil), want: true},
+		{name: "changed", oldNS: ns(protected), newNS: ns(map[string]string{"k8s-pvc-tagger/deletion-protection": "false"}), want: true},
+		{name: "unchanged", oldNS: ns(protected), newNS: ns(map[string]string{"k8s-pvc-tagger/deletion-protection": "true", "team": "a"}), want: false},
+		{name: "never set", oldNS: ns(nil), newNS: ns(map[string]string{"team": "a"}), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDeletionProtectionChanged(tt.oldNS, tt.newNS); got != tt.want {
+				t.Errorf("isDeletionProtectionChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_watchNamespaceDeletionProtection(t *testing.T) {
+	origClient := k8sClient
+	managedVolumes = newVolumeStore()
+	pvcInformers = newPVCInformerRegistry()
+	deletionProtection = true
+	defer func() {
+		k8sClient, deletionProtection = origClient, false
+		pvcInformers = newPVCInformerRegistry()
+	}()
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}}
+	k8sClient = fake.NewSimpleClientset(namespace, &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-1"},
+		}},
+	})
+	fakeStore := newFakeTagStore()
+	efsClient, ec2Client := &EFSClient{&fakeEFS{store: fakeStore}}, &EBSClient{&fakeEC2{store: fakeStore}}
+	storageClass := "gp3"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "data", Annotations: map[string]string{
+			"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+			"k8s-pvc-tagger/tags":                           `{"team": "a"}`,
+		}},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1", StorageClassName: &storageClass},
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := store.Add(pvc); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan struct{})
+	defer close(ch)
+	pvcInformers.add(ch, pvcInformer{store: store, efsClient: efsClient, ec2Client: ec2Client})
+	informer := newNamespaceDeletionProtectionInformer()
+	go informer.Run(ch)
+	if !cache.WaitForCacheSync(ch, informer.HasSynced) {
+		t.Fatal("the namespace informer didn't sync")
+	}
+
+	waitForTag := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for fakeStore.get("vol-1")["deletion-protection"] != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := fakeStore.get("vol-1")["deletion-protection"]; got != want {
+			t.Fatalf("deletion-protection tag = %q, want %q", got, want)
+		}
+	}
+	update := func(annotations map[string]string) {
+		t.Helper()
+		ns := namespace.DeepCopy()
+		ns.Annotations = annotations
+		if _, err := k8sClient.CoreV1().Namespaces().Update(context.TODO(), ns, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update(map[string]string{"k8s-pvc-tagger/deletion-protection": "true"})
+	waitForTag("true")
+	update(nil)
+	waitForTag("")
+}
@@ -0,0 +1,64 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// The cluster tags set on the instances by cluster-autoscaler style tooling and by EKS
+	clusterTagPrefix     = "kubernetes.io/cluster/"
+	eksClusterNameTagKey = "eks:cluster-name"
+)
+
+// discoverClusterName is whether to read the cluster name from the tags of
+// the instance the tagger runs on when --cluster-name is not set
+var discoverClusterName bool
+
+// getInstanceClusterName returns the cluster name from the tags of the instance
+func (client *EBSClient) getInstanceClusterName(instanceID string) (string, error) {
+	tags, err := client.getEBSVolumeTags(instanceID)
+	if err != nil {
+		return "", err
+	}
+	name := clusterNameFromTags(tags)
+	if name == "" {
+		return "", fmt.Errorf("instance %s has no %s<name> or %s tag", instanceID, clusterTagPrefix, eksClusterNameTagKey)
+	}
+	return name, nil
+}
+
+// clusterNameFromTags returns the name from the kubernetes.io/cluster/<name>
+// tag, or from the eks:cluster-name tag, or an empty string
+func clusterNameFromTags(tags map[string]string) string {
+	names := []string{}
+	for k := range tags {
+		if name := strings.TrimPrefix(k, clusterTagPrefix); name != k && name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return names[0]
+	}
+	return tags[eksClusterNameTagKey]
+}
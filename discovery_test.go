@@ -0,0 +1,64 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func Test_clusterNameFromTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{name: "cluster tag", tags: map[string]string{"kubernetes.io/cluster/prod": "owned", "Name": "node"}, want: "prod"},
+		{name: "shared cluster tag", tags: map[string]string{"kubernetes.io/cluster/prod": "shared"}, want: "prod"},
+		{name: "eks tag", tags: map[string]string{"eks:cluster-name": "prod"}, want: "prod"},
+		{name: "cluster tag over eks tag", tags: map[string]string{"kubernetes.io/cluster/prod": "owned", "eks:cluster-name": "other"}, want: "prod"},
+		{name: "several cluster tags", tags: map[string]string{"kubernetes.io/cluster/staging": "owned", "kubernetes.io/cluster/prod": "owned"}, want: "prod"},
+		{name: "empty cluster tag", tags: map[string]string{"kubernetes.io/cluster/": "owned"}, want: ""},
+		{name: "no cluster tag", tags: map[string]string{"Name": "node"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterNameFromTags(tt.tags); got != tt.want {
+				t.Errorf("clusterNameFromTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getInstanceClusterName(t *testing.T) {
+	cloudProvider = cloudProviderFake
+	fakeVolumes = newFakeTagStore()
+	defer func() {
+		cloudProvider = cloudProviderAWS
+		fakeVolumes = newFakeTagStore()
+	}()
+	ec2Client, _ := newEC2Client()
+
+	if _, err := ec2Client.getInstanceClusterName("i-12345"); err == nil {
+		t.Errorf("getInstanceClusterName() err = nil for an untagged instance")
+	}
+	fakeVolumes.addTags("i-12345", map[string]string{"kubernetes.io/cluster/prod": "owned"})
+	if got, err := ec2Client.getInstanceClusterName("i-12345"); err != nil || got != "prod" {
+		t.Errorf("getInstanceClusterName() = %v, %v, want prod", got, err)
+	}
+}
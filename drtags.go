@@ -0,0 +1,249 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// drTags sets the well-known DR tags from the dr-replicate and dr-region
+	// annotations of the PVC, its namespace or its StorageClass
+	drTags bool
+	// drReplicateTagKey is the tag DR tooling selects the volumes and
+	// snapshots to replicate with, set to true or false
+	drReplicateTagKey = "dr-replicate"
+	// drRegionTagKey is the tag with the region to replicate to
+	drRegionTagKey = "dr-region"
+)
+
+var drRegionFormat = regexp.MustCompile(regexpAWSRegion)
+
+// drAnnotations are the DR annotations and the tag key each one sets
+func drAnnotations() map[string]string {
+	return map[string]string{"dr-replicate": drReplicateTagKey, "dr-region": drRegionTagKey}
+}
+
+// getDRTagKeys returns the keys of the DR tags, or nil when they're disabled
+func getDRTagKeys() []string {
+	if !drTags {
+		return nil
+	}
+	return []string{drReplicateTagKey, drRegionTagKey}
+}
+
+// validateDRTagKeys checks the keys of the DR tags are distinct valid tag keys
+func validateDRTagKeys(replicateKey string, regionKey string) error {
+	for _, key := range []string{replicateKey, regionKey} {
+		if key == "" {
+			return errors.New("the DR tag keys can't be empty")
+		}
+		if err := validateTag(key, "true"); err != nil {
+			return err
+		}
+	}
+	if replicateKey == regionKey {
+		return fmt.Errorf("the DR tag keys are both %q", replicateKey)
+	}
+	return nil
+}
+
+// parseDRTagValue returns the normalized tag value of a DR annotation
+func parseDRTagValue(annotation string, value string) (string, error) {
+	switch annotation {
+	case "dr-replicate":
+		replicate, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%s annotation %q is not a boolean", annotation, value)
+		}
+		return strconv.FormatBool(replicate), nil
+	case "dr-region":
+		if !drRegionFormat.MatchString(value) {
+			return "", fmt.Errorf("%s annotation %q is not an AWS region", annotation, value)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown DR annotation %q", annotation)
+}
+
+// getNamespaceAnnotations returns the annotations of the PVC's namespace
+func getNamespaceAnnotations(pvc *corev1.PersistentVolumeClaim) (map[string]string, error) {
+	ns, err := k8sClient.CoreV1().Namespaces().Get(context.TODO(), pvc.GetNamespace(), metav1.GetOptions{})
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace()}).Debugln("Get Namespace from kubernetes cluster error:", err)
+		return nil, err
+	}
+	return ns.GetAnnotations(), nil
+}
+
+// setDRTags sets the DR tags that aren't already set from the first of the
+// PVC, its namespace and its StorageClass with the DR annotation. A volume
+// restored from a snapshot inherits the DR tags of the snapshot otherwise.
+func setDRTags(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string) {
+	if !drTags || isIgnored(pvc) {
+		return
+	}
+	namespaceAnnotations, _ := getNamespaceAnnotations(pvc)
+	policies := []map[string]string{pvc.GetAnnotations(), namespaceAnnotations, getStorageClassAnnotations(pvc)}
+	var inherited map[string]string
+	for annotation, key := range drAnnotations() {
+		if _, ok := tags[key]; ok {
+			continue
+		}
+		if value, ok := getDRPolicy(policies, annotation); ok {
+			parsed, err := parseDRTagValue(annotation, value)
+			if err != nil {
+				reportInvalidTags(pvc, []error{err})
+				continue
+			}
+			tags[key] = parsed
+			continue
+		}
+		if inherited == nil {
+			inherited = drSnapshotSources.get(pvc, volumeID)
+		}
+		if value, ok := inherited[key]; ok {
+			tags[key] = value
+		}
+	}
+}
+
+// getDRPolicy returns the value of the DR annotation in the first of the
+// policies' annotations that has it
+func getDRPolicy(policies []map[string]string, annotation string) (string, bool) {
+	for _, annotations := range policies {
+		if value, ok := annotations[annotationPrefix+"/"+annotation]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// drSnapshotSourceStore looks up the DR tags of the snapshot a volume was
+// restored from, caching them by volume ID since they never change
+type drSnapshotSourceStore struct {
+	sync.Mutex
+	ec2  *EBSClient
+	tags map[string]map[string]string
+}
+
+// drSnapshotSources is only set with --dr-tags
+var drSnapshotSources *drSnapshotSourceStore
+
+func newDRSnapshotSourceStore(ec2Client *EBSClient) *drSnapshotSourceStore {
+	return &drSnapshotSourceStore{ec2: ec2Client, tags: map[string]map[string]string{}}
+}
+
+// isRestoredFromSnapshot returns whether the PVC was restored from a VolumeSnapshot
+func isRestoredFromSnapshot(pvc *corev1.PersistentVolumeClaim) bool {
+	for _, source := range []*corev1.TypedLocalObjectReference{pvc.Spec.DataSource, pvc.Spec.DataSourceRef} {
+		if source != nil && source.Kind == "VolumeSnapshot" {
+			return true
+		}
+	}
+	return false
+}
+
+// flush empties the cache
+func (s *drSnapshotSourceStore) flush() {
+	s.Lock()
+	defer s.Unlock()
+	s.tags = map[string]map[string]string{}
+}
+
+// get returns the DR tags of the snapshot the PVC's EBS volume was restored
+// from, or nil
+func (s *drSnapshotSourceStore) get(pvc *corev1.PersistentVolumeClaim, volumeID string) map[string]string {
+	if s == nil || getProvider(pvc) != providerAWSEBS || !isRestoredFromSnapshot(pvc) {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if tags, ok := s.tags[volumeID]; ok {
+		return tags
+	}
+	tags, err := s.describe(pvc, volumeID)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Warnln("Could not get the DR tags of the source snapshot:", err)
+		return nil
+	}
+	s.tags[volumeID] = tags
+	return tags
+}
+
+func (s *drSnapshotSourceStore) describe(pvc *corev1.PersistentVolumeClaim, volumeID string) (map[string]string, error) {
+	client := s.ec2.forRegion(getPVCRegion(pvc))
+	defer apiCallOwners.attribute(pvc.GetNamespace(), volumeID)()
+	volumes, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String(volumeID)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found", volumeID)
+	}
+	snapshotID := aws.StringValue(volumes.Volumes[0].SnapshotId)
+	if snapshotID == "" {
+		return map[string]string{}, nil
+	}
+	defer apiCallOwners.attribute(pvc.GetNamespace(), snapshotID)()
+	snapshots, err := client.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(snapshotID)}})
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, snapshot := range snapshots.Snapshots {
+		for _, tag := range snapshot.Tags {
+			key := aws.StringValue(tag.Key)
+			if key == drReplicateTagKey || key == drRegionTagKey {
+				tags[key] = aws.StringValue(tag.Value)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// drSnapshotTags returns the DR tags of tags and the removed DR tags, which
+// are copied to the volume's snapshots even without the snapshots target
+func drSnapshotTags(tags map[string]string, removedTags []string) (map[string]string, []string) {
+	keys := getDRTagKeys()
+	snapshotTags := map[string]string{}
+	for _, k := range keys {
+		if v, ok := tags[k]; ok {
+			snapshotTags[k] = v
+		}
+	}
+	var removed []string
+	for _, k := range removedTags {
+		if containsString(keys, k) {
+			removed = append(removed, k)
+		}
+	}
+	return snapshotTags, removed
+}
@@ -0,0 +1,205 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type describeSnapshotsEC2 struct {
+	describeVolumesEC2
+	snapshots map[string]*ec2.Snapshot
+}
+
+func (f *describeSnapshotsEC2) DescribeSnapshots(input *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	f.calls++
+	output := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range input.SnapshotIds {
+		if s, ok := f.snapshots[aws.StringValue(id)]; ok {
+			output.Snapshots = append(output.Snapshots, s)
+		}
+	}
+	return output, nil
+}
+
+func Test_validateDRTagKeys(t *testing.T) {
+	tests := []struct {
+		name         string
+		replicateKey string
+		regionKey    string
+		wantErr      bool
+	}{
+		{name: "defaults", replicateKey: "dr-replicate", regionKey: "dr-region"},
+		{name: "empty", replicateKey: "", regionKey: "dr-region", wantErr: true},
+		{name: "same keys", replicateKey: "dr", regionKey: "dr", wantErr: true},
+		{name: "aws prefix", replicateKey: "aws:dr", regionKey: "dr-region", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDRTagKeys(tt.replicateKey, tt.regionKey); (err != nil) != tt.wantErr {
+				t.Errorf("validateDRTagKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_setDRTags(t *testing.T) {
+	origClient := k8sClient
+	drTags = true
+	defer func() {
+		k8sClient, drTags, drSnapshotSources = origClient, false, nil
+	}()
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Annotations: map[string]string{"k8s-pvc-tagger/dr-region": "us-west-2"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "scratch"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "gp3-replicated", Annotations: map[string]string{"k8s-pvc-tagger/dr-replicate": "true", "k8s-pvc-tagger/dr-region": "eu-west-1"}}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "gp3"}},
+	)
+	ec2Client := &describeSnapshotsEC2{
+		describeVolumesEC2: describeVolumesEC2{volumes: map[string]*ec2.Volume{
+			"vol-restored": {VolumeId: aws.String("vol-restored"), SnapshotId: aws.String("snap-1")},
+		}},
+		snapshots: map[string]*ec2.Snapshot{
+			"snap-1": {SnapshotId: aws.String("snap-1"), Tags: []*ec2.Tag{
+				{Key: aws.String("dr-replicate"), Value: aws.String("true")},
+				{Key: aws.String("dr-region"), Value: aws.String("ca-central-1")},
+				{Key: aws.String("team"), Value: aws.String("a")},
+			}},
+		},
+	}
+	drSnapshotSources = newDRSnapshotSourceStore(&EBSClient{ec2Client})
+	snapshotSource := &corev1.TypedLocalObjectReference{APIGroup: aws.String("snapshot.storage.k8s.io"), Kind: "VolumeSnapshot", Name: "nightly"}
+
+	tests := []struct {
+		name         string
+		namespace    string
+		storageClass string
+		annotations  map[string]string
+		dataSource   *corev1.TypedLocalObjectReference
+		volumeID     string
+		tags         map[string]string
+		want         map[string]string
+	}{
+		{
+			name:         "storage class policy",
+			namespace:    "scratch",
+			storageClass: "gp3-replicated",
+			want:         map[string]string{"dr-replicate": "true", "dr-region": "eu-west-1"},
+		},
+		{
+			name:         "namespace policy before the storage class",
+			namespace:    "payments",
+			storageClass: "gp3-replicated",
+			want:         map[string]string{"dr-replicate": "true", "dr-region": "us-west-2"},
+		},
+		{
+			name:         "pvc annotation before the namespace",
+			namespace:    "payments",
+			storageClass: "gp3-replicated",
+			annotations:  map[string]string{"k8s-pvc-tagger/dr-replicate": "False", "k8s-pvc-tagger/dr-region": "eu-central-1"},
+			want:         map[string]string{"dr-replicate": "false", "dr-region": "eu-central-1"},
+		},
+		{
+			name:         "invalid annotation",
+			namespace:    "scratch",
+			storageClass: "gp3",
+			annotations:  map[string]string{"k8s-pvc-tagger/dr-replicate": "yes please", "k8s-pvc-tagger/dr-region": "europe"},
+			want:         map[string]string{},
+		},
+		{
+			name:         "tag already set",
+			namespace:    "scratch",
+			storageClass: "gp3-replicated",
+			tags:         map[string]string{"dr-replicate": "false"},
+			want:         map[string]string{"dr-replicate": "false", "dr-region": "eu-west-1"},
+		},
+		{
+			name:         "no policy",
+			namespace:    "scratch",
+			storageClass: "gp3",
+			want:         map[string]string{},
+		},
+		{
+			name:         "restored from a snapshot",
+			namespace:    "scratch",
+			storageClass: "gp3",
+			dataSource:   snapshotSource,
+			volumeID:     "vol-restored",
+			want:         map[string]string{"dr-replicate": "true", "dr-region": "ca-central-1"},
+		},
+		{
+			name:         "restored from a snapshot with a policy",
+			namespace:    "payments",
+			storageClass: "gp3",
+			dataSource:   snapshotSource,
+			volumeID:     "vol-restored",
+			want:         map[string]string{"dr-replicate": "true", "dr-region": "us-west-2"},
+		},
+		{
+			name:         "ignored",
+			namespace:    "scratch",
+			storageClass: "gp3-replicated",
+			annotations:  map[string]string{"k8s-pvc-tagger/ignore": ""},
+			want:         map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "data", Annotations: annotations},
+				Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: aws.String(tt.storageClass), DataSource: tt.dataSource},
+			}
+			tags := map[string]string{}
+			for k, v := range tt.tags {
+				tags[k] = v
+			}
+			setDRTags(pvc, tt.volumeID, tags)
+			if !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("setDRTags() tags = %v, want %v", tags, tt.want)
+			}
+		})
+	}
+	if ec2Client.calls != 2 {
+		t.Errorf("EC2 calls = %d, want 2 as the source snapshot of a volume is cached", ec2Client.calls)
+	}
+}
+
+func Test_drSnapshotTags(t *testing.T) {
+	drTags = true
+	defer func() { drTags = false }()
+	tags, removed := drSnapshotTags(map[string]string{"dr-replicate": "true", "team": "a"}, []string{"dr-region", "env"})
+	if !reflect.DeepEqual(tags, map[string]string{"dr-replicate": "true"}) {
+		t.Errorf("drSnapshotTags() tags = %v, want the dr-replicate tag", tags)
+	}
+	if !reflect.DeepEqual(removed, []string{"dr-region"}) {
+		t.Errorf("drSnapshotTags() removed = %v, want [dr-region]", removed)
+	}
+}
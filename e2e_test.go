@@ -0,0 +1,107 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitForFakeTags polls the fake provider until the volume has the wanted tags
+func waitForFakeTags(t *testing.T, volumeID string, want map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := fakeVolumes.get(volumeID)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("volume %s tags = %v, want %v", volumeID, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test_e2eFakeProvider runs the whole watch, compute and tag pipeline against
+// a fake Kubernetes API and the fake provider
+func Test_e2eFakeProvider(t *testing.T) {
+	cloudProvider = cloudProviderFake
+	fakeVolumes = newFakeTagStore()
+	managedVolumes = newVolumeStore()
+	defaultTags = map[string]string{"team": "platform"}
+	defer func() {
+		cloudProvider = cloudProviderAWS
+		fakeVolumes = newFakeTagStore()
+		managedVolumes = newVolumeStore()
+		defaultTags = map[string]string{}
+	}()
+
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-e2e"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "vol-e2e"},
+			},
+		},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Annotations: map[string]string{
+				"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+				annotationPrefix + "/tags":                      `{"app": "{{ .Name }}"}`,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pvc-e2e"},
+	}
+	k8sClient = fake.NewSimpleClientset(pv, pvc)
+
+	ch := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchForPersistentVolumeClaims(ch, "")
+		close(stopped)
+	}()
+	// The globals are only restored once the informer's handlers have stopped
+	defer func() {
+		close(ch)
+		<-stopped
+	}()
+
+	waitForFakeTags(t, "vol-e2e", map[string]string{"team": "platform", "app": "my-pvc"})
+
+	pvc = pvc.DeepCopy()
+	pvc.ResourceVersion = "2"
+	pvc.Annotations[annotationPrefix+"/tags"] = `{"env": "prod"}`
+	_, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() err = %v", err)
+	}
+
+	waitForFakeTags(t, "vol-e2e", map[string]string{"team": "platform", "env": "prod"})
+}
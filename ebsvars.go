@@ -0,0 +1,177 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	// ebsTemplateVars is whether to describe the PVC's EBS volume for the
+	// Encrypted, KMSKeyID, KMSKeyAlias, VolumeType, Iops and Throughput template variables
+	ebsTemplateVars bool
+	// ebsVolumeAttributesTTL is how long the described attributes of a volume are used
+	ebsVolumeAttributesTTL = 10 * time.Minute
+)
+
+// ebsVolumeVars are the attributes of an EBS volume
+type ebsVolumeVars struct {
+	Encrypted   bool
+	KMSKeyID    string
+	KMSKeyAlias string
+	VolumeType  string
+	Iops        int64
+	Throughput  int64
+}
+
+type ebsVolumeAttributesEntry struct {
+	vars      ebsVolumeVars
+	fetchedAt time.Time
+}
+
+// ebsVolumeAttributes describes EBS volumes, caching their attributes by volume ID
+type ebsVolumeAttributes struct {
+	sync.Mutex
+	ec2     ec2iface.EC2API
+	kms     kmsiface.KMSAPI
+	volumes map[string]ebsVolumeAttributesEntry
+}
+
+// volumeAttributes is only set with --ebs-template-vars
+var volumeAttributes *ebsVolumeAttributes
+
+func newEBSVolumeAttributes(ec2Client ec2iface.EC2API, kmsClient kmsiface.KMSAPI) *ebsVolumeAttributes {
+	return &ebsVolumeAttributes{ec2: ec2Client, kms: kmsClient, volumes: map[string]ebsVolumeAttributesEntry{}}
+}
+
+func newEBSVolumeAttributesFromSession(sess *session.Session) *ebsVolumeAttributes {
+	return newEBSVolumeAttributes(ec2.New(sess), kms.New(sess))
+}
+
+// flush empties the cache, the volumes are described again on their next use
+func (a *ebsVolumeAttributes) flush() {
+	a.Lock()
+	defer a.Unlock()
+	a.volumes = map[string]ebsVolumeAttributesEntry{}
+}
+
+// get returns the attributes of the volume, describing it if it isn't cached or
+// is older than ebsVolumeAttributesTTL. If describing it fails the expired
+// attributes are used.
+func (a *ebsVolumeAttributes) get(volumeID string, now time.Time) (ebsVolumeVars, error) {
+	a.Lock()
+	defer a.Unlock()
+	entry, ok := a.volumes[volumeID]
+	if ok && now.Sub(entry.fetchedAt) < ebsVolumeAttributesTTL {
+		return entry.vars, nil
+	}
+	vars, err := a.describe(volumeID)
+	if err != nil {
+		if ok {
+			log.WithFields(log.Fields{"volumeID": volumeID}).Warnln("Could not describe the volume, using the expired attributes:", err)
+			return entry.vars, nil
+		}
+		return ebsVolumeVars{}, err
+	}
+	a.volumes[volumeID] = ebsVolumeAttributesEntry{vars: vars, fetchedAt: now}
+	return vars, nil
+}
+
+func (a *ebsVolumeAttributes) describe(volumeID string) (ebsVolumeVars, error) {
+	output, err := a.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String(volumeID)}})
+	if err != nil {
+		return ebsVolumeVars{}, err
+	}
+	if len(output.Volumes) == 0 {
+		return ebsVolumeVars{}, fmt.Errorf("volume %s not found", volumeID)
+	}
+	volume := output.Volumes[0]
+	vars := ebsVolumeVars{
+		Encrypted:  aws.BoolValue(volume.Encrypted),
+		KMSKeyID:   aws.StringValue(volume.KmsKeyId),
+		VolumeType: aws.StringValue(volume.VolumeType),
+		Iops:       aws.Int64Value(volume.Iops),
+		Throughput: aws.Int64Value(volume.Throughput),
+	}
+	if vars.KMSKeyID != "" {
+		// Only the alias is missing without kms:ListAliases, the other attributes are still set
+		alias, err := a.keyAlias(vars.KMSKeyID)
+		if err != nil {
+			log.WithFields(log.Fields{"volumeID": volumeID, "kmsKeyID": vars.KMSKeyID}).Warnln("Could not list the aliases of the KMS key:", err)
+		}
+		vars.KMSKeyAlias = alias
+	}
+	return vars, nil
+}
+
+// keyAlias returns the first alias, in alphabetical order, of the KMS key
+func (a *ebsVolumeAttributes) keyAlias(keyID string) (string, error) {
+	if a.kms == nil {
+		return "", errors.New("no KMS client")
+	}
+	var aliases []string
+	err := a.kms.ListAliasesPages(&kms.ListAliasesInput{KeyId: aws.String(keyID)}, func(page *kms.ListAliasesOutput, lastPage bool) bool {
+		for _, alias := range page.Aliases {
+			aliases = append(aliases, aws.StringValue(alias.AliasName))
+		}
+		return true
+	})
+	if err != nil || len(aliases) == 0 {
+		return "", err
+	}
+	sort.Strings(aliases)
+	return aliases[0], nil
+}
+
+// getPVCEBSVolumeVars returns the attributes of the PVC's EBS volume, or empty
+// values if it isn't an EBS volume or it can't be described
+func getPVCEBSVolumeVars(pvc *corev1.PersistentVolumeClaim) ebsVolumeVars {
+	if volumeAttributes == nil || pvc.Spec.VolumeName == "" || getProvider(pvc) != providerAWSEBS {
+		return ebsVolumeVars{}
+	}
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Could not get the PV:", err)
+		return ebsVolumeVars{}
+	}
+	volumeID := getPVVolumeID(pv)
+	if volumeID == "" {
+		return ebsVolumeVars{}
+	}
+	defer apiCallOwners.attribute(pvc.GetNamespace(), volumeID)()
+	vars, err := volumeAttributes.get(volumeID, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Warnln("Could not describe the volume:", err)
+		return ebsVolumeVars{}
+	}
+	return vars
+}
@@ -0,0 +1,172 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type describeVolumesEC2 struct {
+	ec2iface.EC2API
+	volumes map[string]*ec2.Volume
+	calls   int
+	err     error
+}
+
+func (f *describeVolumesEC2) DescribeVolumes(input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	output := &ec2.DescribeVolumesOutput{}
+	for _, id := range input.VolumeIds {
+		if v, ok := f.volumes[aws.StringValue(id)]; ok {
+			output.Volumes = append(output.Volumes, v)
+		}
+	}
+	return output, nil
+}
+
+type listAliasesKMS struct {
+	kmsiface.KMSAPI
+	aliases map[string][]string
+	err     error
+}
+
+func (f *listAliasesKMS) ListAliasesPages(input *kms.ListAliasesInput, fn func(*kms.ListAliasesOutput, bool) bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	output := &kms.ListAliasesOutput{}
+	for _, alias := range f.aliases[aws.StringValue(input.KeyId)] {
+		output.Aliases = append(output.Aliases, &kms.AliasListEntry{AliasName: aws.String(alias)})
+	}
+	fn(output, true)
+	return nil
+}
+
+func Test_ebsVolumeAttributes(t *testing.T) {
+	keyARN := "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	ec2Client := &describeVolumesEC2{volumes: map[string]*ec2.Volume{
+		"vol-encrypted": {Encrypted: aws.Bool(true), KmsKeyId: aws.String(keyARN), VolumeType: aws.String("gp3"), Iops: aws.Int64(3000), Throughput: aws.Int64(125)},
+		"vol-plain":     {Encrypted: aws.Bool(false), VolumeType: aws.String("st1")},
+	}}
+
+	tests := []struct {
+		name     string
+		volumeID string
+		kms      kmsiface.KMSAPI
+		want     ebsVolumeVars
+		wantErr  bool
+	}{
+		{
+			name:     "encrypted",
+			volumeID: "vol-encrypted",
+			kms:      &listAliasesKMS{aliases: map[string][]string{keyARN: {"alias/zz", "alias/app"}}},
+			want:     ebsVolumeVars{Encrypted: true, KMSKeyID: keyARN, KMSKeyAlias: "alias/app", VolumeType: "gp3", Iops: 3000, Throughput: 125},
+		},
+		{
+			name:     "missing kms:ListAliases",
+			volumeID: "vol-encrypted",
+			kms:      &listAliasesKMS{err: errors.New("AccessDeniedException")},
+			want:     ebsVolumeVars{Encrypted: true, KMSKeyID: keyARN, VolumeType: "gp3", Iops: 3000, Throughput: 125},
+		},
+		{
+			name:     "not encrypted",
+			volumeID: "vol-plain",
+			want:     ebsVolumeVars{VolumeType: "st1"},
+		},
+		{
+			name:     "unknown volume",
+			volumeID: "vol-missing",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newEBSVolumeAttributes(ec2Client, tt.kms).get(tt.volumeID, time.Now())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("get() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ebsVolumeAttributesCache(t *testing.T) {
+	now := time.Now()
+	ec2Client := &describeVolumesEC2{volumes: map[string]*ec2.Volume{"vol-1": {VolumeType: aws.String("gp2")}}}
+	a := newEBSVolumeAttributes(ec2Client, nil)
+
+	a.get("vol-1", now)
+	a.get("vol-1", now.Add(ebsVolumeAttributesTTL/2))
+	if ec2Client.calls != 1 {
+		t.Errorf("got %d DescribeVolumes calls, want 1", ec2Client.calls)
+	}
+
+	// The expired attributes are used when the volume can't be described
+	ec2Client.err = errors.New("RequestLimitExceeded")
+	got, err := a.get("vol-1", now.Add(ebsVolumeAttributesTTL))
+	if err != nil || got.VolumeType != "gp2" {
+		t.Errorf("get() = %+v, %v, want the expired attributes", got, err)
+	}
+	if ec2Client.calls != 2 {
+		t.Errorf("got %d DescribeVolumes calls, want 2", ec2Client.calls)
+	}
+}
+
+func Test_renderTagTemplatesEBSVars(t *testing.T) {
+	ebsTemplateVars = true
+	volumeAttributes = newEBSVolumeAttributes(&describeVolumesEC2{volumes: map[string]*ec2.Volume{
+		"vol-123": {Encrypted: aws.Bool(true), VolumeType: aws.String("io2"), Iops: aws.Int64(16000)},
+	}}, nil)
+	defer func() {
+		ebsTemplateVars = false
+		volumeAttributes = nil
+	}()
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-123"},
+		}},
+	})
+
+	pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"}}
+	pvc.SetName("data")
+	pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"})
+	got := renderTagTemplates(pvc, map[string]string{"encrypted": "{{ .Encrypted }}", "type": "{{ .VolumeType }}/{{ .Iops }}"})
+	want := map[string]string{"encrypted": "true", "type": "io2/16000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getExemptionExpiry returns when the exemption set by the PVC's exempt-until
+// annotation expires, if the PVC is exempt from tag enforcement at now
+func getExemptionExpiry(pvc *corev1.PersistentVolumeClaim, now time.Time) (time.Time, bool) {
+	value, ok := getPVCAnnotation(pvc, "exempt-until")
+	if !ok {
+		return time.Time{}, false
+	}
+	expiry, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Ignoring invalid exemption:", err)
+		recordEvent(pvc, corev1.EventTypeWarning, "InvalidExemption", fmt.Sprintf("%s/exempt-until must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z, got %q", annotationPrefix, value))
+		return time.Time{}, false
+	}
+	if !expiry.After(now) {
+		return time.Time{}, false
+	}
+	return expiry, true
+}
+
+var exemptions = newPVCTimers(promExemptPVCs)
@@ -0,0 +1,73 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_getExemptionExpiry(t *testing.T) {
+	now := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantExpiry  time.Time
+		wantOk      bool
+	}{
+		{
+			name:        "no exemption",
+			annotations: map[string]string{},
+			wantOk:      false,
+		},
+		{
+			name:        "active exemption",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "2022-07-02T12:00:00Z"},
+			wantExpiry:  now.Add(24 * time.Hour),
+			wantOk:      true,
+		},
+		{
+			name:        "expired exemption",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "2022-06-30T12:00:00Z"},
+			wantOk:      false,
+		},
+		{
+			name:        "exemption expiring now",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "2022-07-01T12:00:00Z"},
+			wantOk:      false,
+		},
+		{
+			name:        "invalid exemption",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "tomorrow"},
+			wantOk:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetAnnotations(tt.annotations)
+			gotExpiry, gotOk := getExemptionExpiry(pvc, now)
+			if gotOk != tt.wantOk || !gotExpiry.Equal(tt.wantExpiry) {
+				t.Errorf("getExemptionExpiry() = %v, %v, want %v, %v", gotExpiry, gotOk, tt.wantExpiry, tt.wantOk)
+			}
+		})
+	}
+}
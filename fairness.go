@@ -0,0 +1,125 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfillQueue runs the resyncs of the existing PVCs round-robin across
+// namespaces, so a namespace with thousands of PVCs doesn't delay the others
+type backfillQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+	// namespaces with pending resyncs, in round-robin order
+	namespaces []string
+	// names of the PVCs per namespace, in the order they were added
+	pending map[string][]string
+	// resyncs keyed by namespace/name, deleted ones are skipped
+	resyncs map[string]func()
+	started sync.Once
+}
+
+var backfills = newBackfillQueue()
+
+func newBackfillQueue() *backfillQueue {
+	q := &backfillQueue{pending: map[string][]string{}, resyncs: map[string]func(){}}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+func (q *backfillQueue) add(namespace string, name string, resync func()) {
+	q.Lock()
+	defer q.Unlock()
+	key := namespace + "/" + name
+	if _, ok := q.resyncs[key]; !ok {
+		if len(q.pending[namespace]) == 0 {
+			q.namespaces = append(q.namespaces, namespace)
+		}
+		q.pending[namespace] = append(q.pending[namespace], name)
+	}
+	q.resyncs[key] = resync
+	promBackfillQueueLength.Set(float64(len(q.resyncs)))
+	q.cond.Signal()
+}
+
+// delete removes the resync of the PVC, e.g. when it was changed and tagged since
+func (q *backfillQueue) delete(namespace string, name string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.resyncs, namespace+"/"+name)
+	promBackfillQueueLength.Set(float64(len(q.resyncs)))
+}
+
+// pop returns the next resync of the namespace at the head of the round-robin
+func (q *backfillQueue) pop() (func(), bool) {
+	for len(q.namespaces) > 0 {
+		namespace := q.namespaces[0]
+		q.namespaces = q.namespaces[1:]
+		names := q.pending[namespace]
+		for len(names) > 0 {
+			key := namespace + "/" + names[0]
+			names = names[1:]
+			resync, ok := q.resyncs[key]
+			if !ok {
+				continue
+			}
+			delete(q.resyncs, key)
+			promBackfillQueueLength.Set(float64(len(q.resyncs)))
+			promBackfilledPVCsTotal.With(prometheus.Labels{"namespace": namespace}).Inc()
+			if len(names) > 0 {
+				q.pending[namespace] = names
+				q.namespaces = append(q.namespaces, namespace)
+			} else {
+				delete(q.pending, namespace)
+			}
+			return resync, true
+		}
+		delete(q.pending, namespace)
+	}
+	return nil, false
+}
+
+// next blocks until there is a resync to run
+func (q *backfillQueue) next() func() {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		if resync, ok := q.pop(); ok {
+			return resync
+		}
+		q.cond.Wait()
+	}
+}
+
+// start runs the resyncs one at a time, like the event handlers did, the
+// first time it is called
+func (q *backfillQueue) start() {
+	q.started.Do(func() {
+		log.Debugln("Starting the backfill queue")
+		go func() {
+			for {
+				q.next()()
+			}
+		}()
+	})
+}
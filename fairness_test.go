@@ -0,0 +1,97 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_backfillQueueOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		adds    []string
+		deletes []string
+		want    []string
+	}{
+		{
+			name: "round-robin across namespaces",
+			adds: []string{"a/1", "a/2", "a/3", "b/1", "c/1", "c/2"},
+			want: []string{"a/1", "b/1", "c/1", "a/2", "c/2", "a/3"},
+		},
+		{
+			name:    "deleted resyncs are skipped",
+			adds:    []string{"a/1", "a/2", "b/1"},
+			deletes: []string{"a/1"},
+			want:    []string{"a/2", "b/1"},
+		},
+		{
+			name: "added again keeps its place",
+			adds: []string{"a/1", "a/2", "a/1", "b/1"},
+			want: []string{"a/1", "b/1", "a/2"},
+		},
+		{
+			name:    "namespace with only deleted resyncs",
+			adds:    []string{"a/1", "b/1"},
+			deletes: []string{"a/1"},
+			want:    []string{"b/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newBackfillQueue()
+			var got []string
+			for _, key := range tt.adds {
+				key := key
+				q.add(key[:1], key[2:], func() { got = append(got, key) })
+			}
+			for _, key := range tt.deletes {
+				q.delete(key[:1], key[2:])
+			}
+			for {
+				resync, ok := q.pop()
+				if !ok {
+					break
+				}
+				resync()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("backfillQueue order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_backfillQueueStart(t *testing.T) {
+	q := newBackfillQueue()
+	q.start()
+	q.start()
+
+	done := make(chan string, 2)
+	q.add("a", "1", func() { done <- "a/1" })
+	q.add("b", "1", func() { done <- "b/1" })
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("backfillQueue did not run the resyncs")
+		}
+	}
+}
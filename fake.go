@@ -0,0 +1,224 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cloudProviderAWS  = "aws"
+	cloudProviderFake = "fake"
+)
+
+// fakeTagStore is the in-memory cloud used by the fake provider, it keeps the
+// tags of every volume keyed by volumeID
+type fakeTagStore struct {
+	sync.RWMutex
+	volumes map[string]map[string]string
+}
+
+var fakeVolumes = newFakeTagStore()
+
+func newFakeTagStore() *fakeTagStore {
+	return &fakeTagStore{volumes: map[string]map[string]string{}}
+}
+
+func (s *fakeTagStore) addTags(volumeID string, tags map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.volumes[volumeID] == nil {
+		s.volumes[volumeID] = map[string]string{}
+	}
+	for k, v := range tags {
+		s.volumes[volumeID][k] = v
+	}
+	log.WithFields(log.Fields{"volumeID": volumeID, "tags": s.volumes[volumeID]}).Infoln("Fake provider tagged volume")
+}
+
+func (s *fakeTagStore) deleteTags(volumeID string, keys []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, k := range keys {
+		delete(s.volumes[volumeID], k)
+	}
+	log.WithFields(log.Fields{"volumeID": volumeID, "tags": s.volumes[volumeID]}).Infoln("Fake provider untagged volume")
+}
+
+// ids returns the IDs of the volumes starting with prefix, in sorted order
+func (s *fakeTagStore) ids(prefix string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	var ids []string
+	for id := range s.volumes {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// get returns a copy of the volume's tags
+func (s *fakeTagStore) get(volumeID string) map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	tags := map[string]string{}
+	for k, v := range s.volumes[volumeID] {
+		tags[k] = v
+	}
+	return tags
+}
+
+// fakeEC2 implements the EC2 calls made by the tagger against the fakeTagStore
+type fakeEC2 struct {
+	ec2iface.EC2API
+	store *fakeTagStore
+}
+
+func (f *fakeEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if err := faults.fault("CreateTags"); err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, t := range input.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for _, id := range input.Resources {
+		f.store.addTags(aws.StringValue(id), tags)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	if err := faults.fault("DeleteTags"); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, t := range input.Tags {
+		keys = append(keys, aws.StringValue(t.Key))
+	}
+	for _, id := range input.Resources {
+		f.store.deleteTags(aws.StringValue(id), keys)
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// DescribeTagsPages supports the resource-id, resource-type, key and value filters
+func (f *fakeEC2) DescribeTagsPages(input *ec2.DescribeTagsInput, fn func(*ec2.DescribeTagsOutput, bool) bool) error {
+	if err := faults.fault("DescribeTags"); err != nil {
+		return err
+	}
+	output := &ec2.DescribeTagsOutput{}
+	ids := f.store.ids("")
+	filters := map[string][]string{}
+	for _, filter := range input.Filters {
+		filters[aws.StringValue(filter.Name)] = aws.StringValueSlice(filter.Values)
+	}
+	if values, ok := filters["resource-id"]; ok {
+		ids = values
+	} else if values, ok := filters["resource-type"]; ok && containsString(values, "volume") {
+		ids = f.store.ids("vol-")
+	}
+	for _, id := range ids {
+		for k, v := range f.store.get(id) {
+			if keys, ok := filters["key"]; ok && !containsString(keys, k) {
+				continue
+			}
+			if values, ok := filters["value"]; ok && !containsString(values, v) {
+				continue
+			}
+			output.Tags = append(output.Tags, &ec2.TagDescription{ResourceId: aws.String(id), Key: aws.String(k), Value: aws.String(v)})
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+// DescribeSnapshotsPages returns no snapshots, the fake provider doesn't have any
+func (f *fakeEC2) DescribeSnapshotsPages(input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool) error {
+	if err := faults.fault("DescribeSnapshots"); err != nil {
+		return err
+	}
+	fn(&ec2.DescribeSnapshotsOutput{}, true)
+	return nil
+}
+
+// fakeEFS implements the EFS calls made by the tagger against the fakeTagStore
+type fakeEFS struct {
+	efsiface.EFSAPI
+	store *fakeTagStore
+}
+
+func (f *fakeEFS) TagResource(input *efs.TagResourceInput) (*efs.TagResourceOutput, error) {
+	if err := faults.fault("TagResource"); err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, t := range input.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	f.store.addTags(aws.StringValue(input.ResourceId), tags)
+	return &efs.TagResourceOutput{}, nil
+}
+
+func (f *fakeEFS) UntagResource(input *efs.UntagResourceInput) (*efs.UntagResourceOutput, error) {
+	if err := faults.fault("UntagResource"); err != nil {
+		return nil, err
+	}
+	f.store.deleteTags(aws.StringValue(input.ResourceId), aws.StringValueSlice(input.TagKeys))
+	return &efs.UntagResourceOutput{}, nil
+}
+
+func (f *fakeEFS) ListTagsForResourcePages(input *efs.ListTagsForResourceInput, fn func(*efs.ListTagsForResourceOutput, bool) bool) error {
+	if err := faults.fault("ListTagsForResource"); err != nil {
+		return err
+	}
+	output := &efs.ListTagsForResourceOutput{}
+	for k, v := range f.store.get(aws.StringValue(input.ResourceId)) {
+		output.Tags = append(output.Tags, &efs.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f *fakeEFS) DescribeAccessPointsPages(input *efs.DescribeAccessPointsInput, fn func(*efs.DescribeAccessPointsOutput, bool) bool) error {
+	if err := faults.fault("DescribeAccessPoints"); err != nil {
+		return err
+	}
+	output := &efs.DescribeAccessPointsOutput{}
+	for _, id := range f.store.ids("fsap-") {
+		ap := &efs.AccessPointDescription{AccessPointId: aws.String(id)}
+		for k, v := range f.store.get(id) {
+			ap.Tags = append(ap.Tags, &efs.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		output.AccessPoints = append(output.AccessPoints, ap)
+	}
+	fn(output, true)
+	return nil
+}
@@ -0,0 +1,162 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// faultCodes are the AWS error code and HTTP status of the faults that can be
+// injected for each error class
+var faultCodes = map[string]struct {
+	code   string
+	status int
+}{
+	errorClassThrottled:        {code: "Throttling", status: http.StatusBadRequest},
+	errorClassPermissionDenied: {code: "UnauthorizedOperation", status: http.StatusForbidden},
+	errorClassNotFound:         {code: "InvalidVolume.NotFound", status: http.StatusBadRequest},
+	errorClassTransient:        {code: "InternalError", status: http.StatusInternalServerError},
+}
+
+// faultRate is the rate at which the faults of an error class are injected
+type faultRate struct {
+	class string
+	rate  float64
+}
+
+// faultInjector fails a share of the cloud API calls with simulated errors,
+// to validate the alerting and the retries in staging clusters
+type faultInjector struct {
+	sync.Mutex
+	rates      []faultRate
+	operations []string
+	random     func() float64
+}
+
+var (
+	faultInjectionString           string
+	faultInjectionOperationsString string
+	// faults is only set with --fault-injection
+	faults *faultInjector
+)
+
+// parseFaultInjection parses the comma separated list of <class>=<rate> of
+// --fault-injection, e.g. throttled=0.1,not-found=0.01. The rates can't add
+// up to more than 1.
+func parseFaultInjection(value string) ([]faultRate, error) {
+	var rates []faultRate
+	total := 0.0
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		class, rateString, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not <class>=<rate>", item)
+		}
+		class = strings.TrimSpace(class)
+		if _, ok := faultCodes[class]; !ok {
+			return nil, fmt.Errorf("unknown fault %q, must be one of %s", class, strings.Join(faultClasses(), ", "))
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateString), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("the rate of %s must be between 0 and 1", class)
+		}
+		total += rate
+		rates = append(rates, faultRate{class: class, rate: rate})
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("the rates add up to %v, more than 1", total)
+	}
+	return rates, nil
+}
+
+func faultClasses() []string {
+	classes := make([]string, 0, len(faultCodes))
+	for class := range faultCodes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// newFaultInjector returns the injector of the rates, for the given API
+// operations only, e.g. CreateTags, or all of them when empty
+func newFaultInjector(rates []faultRate, operations []string) *faultInjector {
+	return &faultInjector{rates: rates, operations: operations, random: rand.Float64}
+}
+
+// pick returns the class of the fault to inject into the operation, or an
+// empty string to let the call through
+func (f *faultInjector) pick(operation string) string {
+	if f == nil || (len(f.operations) > 0 && !containsString(f.operations, operation)) {
+		return ""
+	}
+	f.Lock()
+	r := f.random()
+	f.Unlock()
+	for _, rate := range f.rates {
+		if r < rate.rate {
+			return rate.class
+		}
+		r -= rate.rate
+	}
+	return ""
+}
+
+// fault returns the simulated error of the operation, or nil. It's used by
+// the fake provider's clients.
+func (f *faultInjector) fault(operation string) error {
+	class := f.pick(operation)
+	if class == "" {
+		return nil
+	}
+	promInjectedFaultsTotal.With(prometheus.Labels{"class": class}).Inc()
+	log.WithFields(log.Fields{"operation": operation, "class": class}).Debugln("Injecting a fault")
+	fault := faultCodes[class]
+	return awserr.NewRequestFailure(awserr.New(fault.code, "injected by --fault-injection", nil), fault.status, "fault-injection")
+}
+
+// inject is a Send handler failing the request with a simulated error instead
+// of sending it, so that the SDK's retries see the fault like a real one
+func (f *faultInjector) inject(r *request.Request) {
+	err := f.fault(r.Operation.Name)
+	if err == nil {
+		return
+	}
+	r.Error = err
+	r.HTTPResponse = &http.Response{
+		StatusCode: err.(awserr.RequestFailure).StatusCode(),
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+}
@@ -0,0 +1,123 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func Test_parseFaultInjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []faultRate
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "one class", value: "throttled=0.1", want: []faultRate{{class: errorClassThrottled, rate: 0.1}}},
+		{name: "classes", value: "throttled=0.5, not-found=0.25,permission-denied=0.25", want: []faultRate{
+			{class: errorClassThrottled, rate: 0.5}, {class: errorClassNotFound, rate: 0.25}, {class: errorClassPermissionDenied, rate: 0.25},
+		}},
+		{name: "unknown class", value: "invalid-tag=0.1", wantErr: true},
+		{name: "no rate", value: "throttled", wantErr: true},
+		{name: "rate above 1", value: "throttled=2", wantErr: true},
+		{name: "negative rate", value: "throttled=-0.1", wantErr: true},
+		{name: "rates above 1", value: "throttled=0.6,transient=0.6", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFaultInjection(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFaultInjection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFaultInjection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_faultInjector_pick(t *testing.T) {
+	f := newFaultInjector([]faultRate{{class: errorClassThrottled, rate: 0.2}, {class: errorClassNotFound, rate: 0.1}}, []string{"CreateTags"})
+	tests := []struct {
+		name      string
+		operation string
+		random    float64
+		want      string
+	}{
+		{name: "first class", operation: "CreateTags", random: 0.1, want: errorClassThrottled},
+		{name: "second class", operation: "CreateTags", random: 0.25, want: errorClassNotFound},
+		{name: "no fault", operation: "CreateTags", random: 0.5, want: ""},
+		{name: "other operation", operation: "DescribeTags", random: 0.1, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.random = func() float64 { return tt.random }
+			if got := f.pick(tt.operation); got != tt.want {
+				t.Errorf("pick(%s) = %q, want %q", tt.operation, got, tt.want)
+			}
+		})
+	}
+	var disabled *faultInjector
+	if got := disabled.pick("CreateTags"); got != "" {
+		t.Errorf("pick() without fault injection = %q, want none", got)
+	}
+}
+
+func Test_faultInjection(t *testing.T) {
+	defer func() { faults = nil }()
+	faults = newFaultInjector([]faultRate{{class: errorClassPermissionDenied, rate: 1}}, nil)
+
+	t.Run("aws session", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+		origEndpoint, origLocalstack := providerEndpoint, localstack
+		defer func() { providerEndpoint, localstack = origEndpoint, origLocalstack }()
+		providerEndpoint, localstack = server.URL, true
+
+		client := ec2.New(createAWSSession("us-east-1"))
+		_, err := client.CreateTags(&ec2.CreateTagsInput{Resources: []*string{aws.String("vol-1")}, Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("a")}}})
+		if got := classifyError(err); got != errorClassPermissionDenied {
+			t.Errorf("CreateTags() error = %v, class %q, want %q", err, got, errorClassPermissionDenied)
+		}
+		if requests != 0 {
+			t.Errorf("the endpoint received %d requests, want none", requests)
+		}
+	})
+
+	t.Run("fake provider", func(t *testing.T) {
+		client := &fakeEC2{store: newFakeTagStore()}
+		_, err := client.CreateTags(&ec2.CreateTagsInput{Resources: []*string{aws.String("vol-1")}, Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("a")}}})
+		if got := classifyError(err); got != errorClassPermissionDenied {
+			t.Errorf("CreateTags() error = %v, class %q, want %q", err, got, errorClassPermissionDenied)
+		}
+		if tags := client.store.get("vol-1"); len(tags) != 0 {
+			t.Errorf("the fake volume was tagged with %v", tags)
+		}
+	})
+}
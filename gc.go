@@ -0,0 +1,271 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// staleVolume is a volume with the managed-by tag of this cluster whose PV
+// no longer exists
+type staleVolume struct {
+	VolumeID string
+	Provider string
+}
+
+// listTaggedVolumes returns the EBS volumes and EFS access points with the
+// managed-by tag of this cluster
+func listTaggedVolumes(ec2Client *EBSClient, efsClient *EFSClient) ([]staleVolume, error) {
+	var volumes []staleVolume
+	err := ec2Client.DescribeTagsPages(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-type"), Values: []*string{aws.String("volume")}},
+			{Name: aws.String("key"), Values: []*string{aws.String(managedByTagKey)}},
+			{Name: aws.String("value"), Values: []*string{aws.String(managedByTagValue())}},
+		},
+	}, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			volumes = append(volumes, staleVolume{VolumeID: aws.StringValue(t.ResourceId), Provider: providerAWSEBS})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe the EBS volume tags: %w", err)
+	}
+
+	err = efsClient.DescribeAccessPointsPages(&efs.DescribeAccessPointsInput{}, func(page *efs.DescribeAccessPointsOutput, lastPage bool) bool {
+		for _, ap := range page.AccessPoints {
+			for _, t := range ap.Tags {
+				if aws.StringValue(t.Key) == managedByTagKey && aws.StringValue(t.Value) == managedByTagValue() {
+					volumes = append(volumes, staleVolume{VolumeID: aws.StringValue(ap.AccessPointId), Provider: providerAWSEFS})
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe the EFS access points: %w", err)
+	}
+	return volumes, nil
+}
+
+// listClusterVolumeIDs returns the IDs of the volumes of all the PVs of the
+// cluster, and the regions of the PVs that have one, sorted
+func listClusterVolumeIDs(ctx context.Context, client kubernetes.Interface) (map[string]bool, []string, error) {
+	ids := map[string]bool{}
+	regions := []string{}
+	options := metav1.ListOptions{Limit: 500}
+	for {
+		pvs, err := client.CoreV1().PersistentVolumes().List(ctx, options)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot list the PVs: %w", err)
+		}
+		for i := range pvs.Items {
+			if id := getPVVolumeID(&pvs.Items[i]); id != "" {
+				ids[id] = true
+			}
+			if region := getPVRegion(&pvs.Items[i]); region != "" && !containsString(regions, region) {
+				regions = append(regions, region)
+			}
+		}
+		if pvs.Continue == "" {
+			sort.Strings(regions)
+			return ids, regions, nil
+		}
+		options.Continue = pvs.Continue
+	}
+}
+
+// gcRegions returns the regions to look for stale volumes in: the --regions,
+// or else the --region and the regions of the cluster's PVs
+func gcRegions(regionsString string, region string, pvRegions []string) []string {
+	regions := []string{}
+	if regionsString != "" {
+		for _, r := range strings.Split(regionsString, ",") {
+			if r = strings.TrimSpace(r); r != "" && !containsString(regions, r) {
+				regions = append(regions, r)
+			}
+		}
+		return regions
+	}
+	if region != "" {
+		regions = append(regions, region)
+	}
+	for _, r := range pvRegions {
+		if !containsString(regions, r) {
+			regions = append(regions, r)
+		}
+	}
+	return regions
+}
+
+// getPVVolumeID returns the ID of the EBS volume or EFS access point of the PV
+func getPVVolumeID(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == "ebs.csi.aws.com":
+		return pv.Spec.CSI.VolumeHandle
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == "efs.csi.aws.com":
+		if matches := regexp.MustCompile(regexpEFSVolumeHandle).FindStringSubmatch(pv.Spec.CSI.VolumeHandle); matches != nil {
+			return matches[2]
+		}
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return parseAWSEBSVolumeID(pv.Spec.AWSElasticBlockStore.VolumeID)
+	}
+	return ""
+}
+
+// findStaleVolumes returns the volumes with the managed-by tag of this cluster
+// that are not in live, the volumes of its PVs, sorted by volumeID
+func findStaleVolumes(live map[string]bool, ec2Client *EBSClient, efsClient *EFSClient) ([]staleVolume, error) {
+	tagged, err := listTaggedVolumes(ec2Client, efsClient)
+	if err != nil {
+		return nil, err
+	}
+	stale := []staleVolume{}
+	for _, v := range tagged {
+		if !live[v.VolumeID] {
+			stale = append(stale, v)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].VolumeID < stale[j].VolumeID })
+	return stale, nil
+}
+
+// removeControllerTags removes the managed-by tag and the given tag keys from the volume
+func removeControllerTags(v staleVolume, keys []string, ec2Client *EBSClient, efsClient *EFSClient) error {
+	keys = append([]string{managedByTagKey}, keys...)
+	if v.Provider == providerAWSEFS {
+		return efsClient.deleteEFSVolumeTags(v.VolumeID, keys, "")
+	}
+	return ec2Client.deleteEBSVolumeTags(v.VolumeID, keys, "")
+}
+
+// runGCCommand runs the gc subcommand which reports, or with --delete removes
+// the tags of, the volumes tagged by this cluster's tagger whose PV no longer
+// exists, e.g. Retain volumes left behind after their PV was deleted
+func runGCCommand(args []string, w io.Writer, errW io.Writer) int {
+	fs := newCommandFlagSet("gc", errW)
+	kubeconfig := fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	kubeContext := fs.String("context", "", "the context to use")
+	region := fs.String("region", os.Getenv("AWS_REGION"), "the region")
+	regionsString := fs.String("regions", "", "Comma separated list of the regions to look for stale volumes in (default is --region and the regions of the PVs)")
+	fs.StringVar(&clusterName, "cluster-name", "", "The name of the cluster whose managed-by tag is looked for")
+	fs.StringVar(&providerEndpoint, "provider-endpoint", "", "Override the AWS API endpoint, e.g. for LocalStack")
+	fs.BoolVar(&localstack, "localstack", false, "Use static test credentials with the provider-endpoint, for LocalStack")
+	deleteTags := fs.Bool("delete", false, "Remove the tags of the stale volumes instead of only reporting them")
+	tagKeysString := fs.String("tag-keys", "", "Comma separated list of the tag keys to remove along with the managed-by tag, e.g. the keys of --default-tags")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if clusterName == "" {
+		fmt.Fprintln(errW, "--cluster-name is required")
+		return 2
+	}
+	var tagKeys []string
+	for _, k := range strings.Split(*tagKeysString, ",") {
+		if k = strings.TrimSpace(k); k != "" && k != managedByTagKey {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+
+	client, err := BuildClient(*kubeconfig, *kubeContext)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot connect to the cluster:", err)
+		return 1
+	}
+	live, pvRegions, err := listClusterVolumeIDs(context.Background(), client)
+	if err != nil {
+		fmt.Fprintln(errW, err)
+		return 1
+	}
+	if *region == "" && *regionsString == "" {
+		*region, _ = getMetadataRegion()
+	}
+	regions := gcRegions(*regionsString, *region, pvRegions)
+	if len(regions) == 0 {
+		fmt.Fprintln(errW, "--region or --regions is required")
+		return 2
+	}
+
+	code := 0
+	for _, r := range regions {
+		awsSession = createAWSSession(r)
+		ec2Client, err := newEC2Client()
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot create the EC2 client of %s: %v\n", r, err)
+			return 1
+		}
+		efsClient, err := newEFSClient()
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot create the EFS client of %s: %v\n", r, err)
+			return 1
+		}
+		stale, err := findStaleVolumes(live, ec2Client, efsClient)
+		if err != nil {
+			fmt.Fprintf(errW, "%s: %v\n", r, err)
+			return 1
+		}
+		if len(regions) > 1 {
+			fmt.Fprintf(w, "%s:\n", r)
+		}
+		if gcStaleVolumes(stale, tagKeys, *deleteTags, w, errW, ec2Client, efsClient) != 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// gcStaleVolumes reports the stale volumes and removes their tags if remove is true
+func gcStaleVolumes(stale []staleVolume, tagKeys []string, remove bool, w io.Writer, errW io.Writer, ec2Client *EBSClient, efsClient *EFSClient) int {
+	failed := 0
+	for _, v := range stale {
+		if !remove {
+			fmt.Fprintf(w, "%s\t%s\tstale\n", v.VolumeID, v.Provider)
+			continue
+		}
+		if err := removeControllerTags(v, tagKeys, ec2Client, efsClient); err != nil {
+			fmt.Fprintf(errW, "Cannot remove the tags of %s: %v\n", v.VolumeID, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\tuntagged\n", v.VolumeID, v.Provider)
+	}
+	if remove {
+		fmt.Fprintf(w, "%d stale volumes, %d untagged\n", len(stale), len(stale)-failed)
+	} else {
+		fmt.Fprintf(w, "%d stale volumes, run with --delete to remove their tags\n", len(stale))
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
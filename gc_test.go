@@ -0,0 +1,120 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_findStaleVolumes(t *testing.T) {
+	clusterName = "prod"
+	defer func() { clusterName = "" }()
+	store := newFakeTagStore()
+	store.addTags("vol-live", map[string]string{"managed-by": "k8s-pvc-tagger/prod", "team": "a"})
+	store.addTags("vol-intree", map[string]string{"managed-by": "k8s-pvc-tagger/prod"})
+	store.addTags("vol-stale", map[string]string{"managed-by": "k8s-pvc-tagger/prod", "team": "a"})
+	store.addTags("vol-other-cluster", map[string]string{"managed-by": "k8s-pvc-tagger/staging"})
+	store.addTags("vol-untagged", map[string]string{"team": "a"})
+	store.addTags("fsap-live", map[string]string{"managed-by": "k8s-pvc-tagger/prod"})
+	store.addTags("fsap-stale", map[string]string{"managed-by": "k8s-pvc-tagger/prod"})
+	ec2Client := &EBSClient{&fakeEC2{store: store}}
+	efsClient := &EFSClient{&fakeEFS{store: store}}
+
+	newPV := func(name string, source corev1.PersistentVolumeSource) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: source}}
+	}
+	ebsPV := newPV("ebs", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-live"}})
+	ebsPV.SetLabels(map[string]string{"topology.kubernetes.io/region": "us-west-2"})
+	client := fake.NewSimpleClientset(
+		ebsPV,
+		newPV("in-tree", corev1.PersistentVolumeSource{AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-intree"}}),
+		newPV("efs", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-123::fsap-live"}}),
+	)
+
+	live, regions, err := listClusterVolumeIDs(context.Background(), client)
+	if err != nil {
+		t.Fatalf("listClusterVolumeIDs() error = %v", err)
+	}
+	if want := []string{"us-west-2"}; !reflect.DeepEqual(regions, want) {
+		t.Errorf("listClusterVolumeIDs() regions = %v, want %v", regions, want)
+	}
+	got, err := findStaleVolumes(live, ec2Client, efsClient)
+	if err != nil {
+		t.Fatalf("findStaleVolumes() error = %v", err)
+	}
+	want := []staleVolume{{VolumeID: "fsap-stale", Provider: providerAWSEFS}, {VolumeID: "vol-stale", Provider: providerAWSEBS}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("findStaleVolumes() = %v, want %v", got, want)
+	}
+
+	var out, errOut bytes.Buffer
+	if code := gcStaleVolumes(got, []string{"team"}, false, &out, &errOut, ec2Client, efsClient); code != 0 {
+		t.Errorf("gcStaleVolumes() = %v, want 0: %v", code, errOut.String())
+	}
+	if tags := store.get("vol-stale"); len(tags) != 2 {
+		t.Errorf("gcStaleVolumes() without --delete changed the tags to %v", tags)
+	}
+	wantOut := "fsap-stale\taws-efs\tstale\nvol-stale\taws-ebs\tstale\n2 stale volumes, run with --delete to remove their tags\n"
+	if out.String() != wantOut {
+		t.Errorf("gcStaleVolumes() output = %q, want %q", out.String(), wantOut)
+	}
+
+	out.Reset()
+	if code := gcStaleVolumes(got, []string{"team"}, true, &out, &errOut, ec2Client, efsClient); code != 0 {
+		t.Errorf("gcStaleVolumes() = %v, want 0: %v", code, errOut.String())
+	}
+	for _, id := range []string{"vol-stale", "fsap-stale"} {
+		if tags := store.get(id); len(tags) != 0 {
+			t.Errorf("gcStaleVolumes() left the tags %v on %v", tags, id)
+		}
+	}
+	if tags := store.get("vol-live"); len(tags) != 2 {
+		t.Errorf("gcStaleVolumes() changed the tags of a live volume to %v", tags)
+	}
+}
+
+func Test_gcRegions(t *testing.T) {
+	tests := []struct {
+		name          string
+		regionsString string
+		region        string
+		pvRegions     []string
+		want          []string
+	}{
+		{name: "region", region: "us-east-1", want: []string{"us-east-1"}},
+		{name: "region and the regions of the PVs", region: "us-east-1", pvRegions: []string{"eu-west-1", "us-east-1"}, want: []string{"us-east-1", "eu-west-1"}},
+		{name: "regions of the PVs", pvRegions: []string{"eu-west-1"}, want: []string{"eu-west-1"}},
+		{name: "regions", regionsString: "us-east-1, eu-west-1,us-east-1", region: "us-west-2", pvRegions: []string{"ap-south-1"}, want: []string{"us-east-1", "eu-west-1"}},
+		{name: "none", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gcRegions(tt.regionsString, tt.region, tt.pvRegions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("gcRegions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
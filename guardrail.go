@@ -0,0 +1,121 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	guardrailPass      = "pass"
+	guardrailNamespace = "namespace"
+)
+
+var (
+	// maxMutationsPerPass is the number of volumes that can be tagged per
+	// mutationPassDuration, 0 for no limit. It limits the blast radius of a
+	// policy change that would otherwise re-tag the whole fleet at once.
+	maxMutationsPerPass  int
+	mutationPassDuration = time.Hour
+	// maxVolumesPerNamespace is the number of volumes the tagger manages in a
+	// namespace, 0 for no limit
+	maxVolumesPerNamespace int
+)
+
+// guardrailDeferrals are the PVCs whose tagging was deferred to the next pass
+var guardrailDeferrals = newPVCTimers(promGuardrailDeferredPVCs)
+
+func validateMutationGuardrails(perPass int, passDuration time.Duration, perNamespace int) error {
+	if perPass < 0 {
+		return fmt.Errorf("the maximum mutations per pass must not be negative")
+	}
+	if passDuration <= 0 {
+		return fmt.Errorf("the pass duration must be positive")
+	}
+	if perNamespace < 0 {
+		return fmt.Errorf("the maximum volumes per namespace must not be negative")
+	}
+	return nil
+}
+
+// mutationGuardrail counts the volumes tagged during the current pass
+type mutationGuardrail struct {
+	sync.Mutex
+	passStart time.Time
+	// mutated are the volumes tagged during the pass, a volume tagged more
+	// than once only counts once
+	mutated map[string]bool
+}
+
+var mutationGuardrails = newMutationGuardrail()
+
+func newMutationGuardrail() *mutationGuardrail {
+	return &mutationGuardrail{mutated: map[string]bool{}}
+}
+
+// allow returns the limit that stops the volume from being tagged, or an
+// empty string if it can be tagged, in which case it's counted against the
+// pass. It also returns when the next pass starts.
+func (g *mutationGuardrail) allow(namespace string, volumeID string, now time.Time) (string, time.Time) {
+	g.Lock()
+	defer g.Unlock()
+	if now.Sub(g.passStart) >= mutationPassDuration {
+		g.passStart = now
+		g.mutated = map[string]bool{}
+		promPassMutations.Set(0)
+	}
+	nextPass := g.passStart.Add(mutationPassDuration)
+	if maxVolumesPerNamespace > 0 {
+		if _, ok := managedVolumes.get(volumeID); !ok && managedVolumes.countNamespace(namespace) >= maxVolumesPerNamespace {
+			return guardrailNamespace, nextPass
+		}
+	}
+	if maxMutationsPerPass > 0 && !g.mutated[volumeID] && len(g.mutated) >= maxMutationsPerPass {
+		return guardrailPass, nextPass
+	}
+	g.mutated[volumeID] = true
+	promPassMutations.Set(float64(len(g.mutated)))
+	return "", nextPass
+}
+
+// deferMutation records that a guardrail stopped the PVC's volume from being
+// tagged. The PVCs stopped by the per pass limit are synced again at the next
+// pass, the ones stopped by the per namespace limit on their next change.
+func deferMutation(pvc *corev1.PersistentVolumeClaim, volumeID string, limit string, nextPass time.Time, efsClient *EFSClient, ec2Client *EBSClient) {
+	promGuardrailBlocksTotal.With(prometheus.Labels{"limit": limit}).Inc()
+	fields := log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "limit": limit}
+	if limit == guardrailNamespace {
+		log.WithFields(fields).Warnln("Not tagging the volume, the namespace reached the maximum number of volumes")
+		tracePVC(pvc, log.Fields{"limit": limit}, "The namespace reached the maximum number of volumes, not tagging the volume")
+		recordEvent(pvc, corev1.EventTypeWarning, "MutationLimitReached", fmt.Sprintf("Not tagging volume %s, the namespace already has %d managed volumes", volumeID, maxVolumesPerNamespace))
+		return
+	}
+	log.WithFields(fields).WithField("nextPass", nextPass).Warnln("Not tagging the volume, the maximum number of volumes tagged per pass was reached")
+	tracePVC(pvc, log.Fields{"limit": limit, "nextPass": nextPass}, "The maximum number of volumes tagged per pass was reached, deferring to the next pass")
+	recordEvent(pvc, corev1.EventTypeWarning, "MutationLimitReached", fmt.Sprintf("Deferred tagging volume %s to %s, %d volumes were already tagged in this pass", volumeID, nextPass.UTC().Format(time.RFC3339), maxMutationsPerPass))
+	guardrailDeferrals.schedule(pvc.GetNamespace(), pvc.GetName(), nextPass, func() {
+		resyncPVC(pvc.GetNamespace(), pvc.GetName(), efsClient, ec2Client)
+	})
+}
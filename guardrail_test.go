@@ -0,0 +1,112 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_validateMutationGuardrails(t *testing.T) {
+	tests := []struct {
+		name         string
+		perPass      int
+		passDuration time.Duration
+		perNamespace int
+		wantErr      bool
+	}{
+		{name: "disabled", passDuration: time.Hour},
+		{name: "limits", perPass: 100, passDuration: time.Hour, perNamespace: 50},
+		{name: "negative per pass", perPass: -1, passDuration: time.Hour, wantErr: true},
+		{name: "no pass duration", perPass: 100, wantErr: true},
+		{name: "negative per namespace", passDuration: time.Hour, perNamespace: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMutationGuardrails(tt.perPass, tt.passDuration, tt.perNamespace); (err != nil) != tt.wantErr {
+				t.Errorf("validateMutationGuardrails() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_mutationGuardrail_pass(t *testing.T) {
+	maxMutationsPerPass = 2
+	defer func() { maxMutationsPerPass = 0 }()
+	g := newMutationGuardrail()
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		volumeID  string
+		at        time.Time
+		wantLimit string
+	}{
+		{volumeID: "vol-1", at: start},
+		{volumeID: "vol-2", at: start.Add(time.Minute)},
+		{volumeID: "vol-3", at: start.Add(2 * time.Minute), wantLimit: guardrailPass},
+		{volumeID: "vol-1", at: start.Add(3 * time.Minute)},
+		{volumeID: "vol-3", at: start.Add(time.Hour)},
+	}
+	for _, step := range steps {
+		limit, nextPass := g.allow("default", step.volumeID, step.at)
+		if limit != step.wantLimit {
+			t.Errorf("allow(%s) at %s = %q, want %q", step.volumeID, step.at, limit, step.wantLimit)
+		}
+		if !nextPass.After(step.at) {
+			t.Errorf("allow(%s) at %s next pass = %s, want after it", step.volumeID, step.at, nextPass)
+		}
+	}
+}
+
+func Test_mutationGuardrail_namespace(t *testing.T) {
+	maxVolumesPerNamespace = 1
+	defer func() {
+		maxVolumesPerNamespace = 0
+		managedVolumes.deleteByPVC("guardrail", "data")
+	}()
+	managedVolumes.set(managedVolume{VolumeID: "vol-guardrail-1", Namespace: "guardrail", PVC: "data"})
+	g := newMutationGuardrail()
+
+	if limit, _ := g.allow("guardrail", "vol-guardrail-1", time.Now()); limit != "" {
+		t.Errorf("allow() of a managed volume = %q, want it allowed", limit)
+	}
+	if limit, _ := g.allow("guardrail", "vol-guardrail-2", time.Now()); limit != guardrailNamespace {
+		t.Errorf("allow() of a new volume = %q, want %q", limit, guardrailNamespace)
+	}
+	if limit, _ := g.allow("other", "vol-guardrail-2", time.Now()); limit != "" {
+		t.Errorf("allow() in another namespace = %q, want it allowed", limit)
+	}
+}
+
+func Test_deferMutation(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "guardrail"}}
+	defer guardrailDeferrals.cancel("guardrail", "data")
+
+	deferMutation(pvc, "vol-1", guardrailNamespace, time.Now().Add(time.Hour), nil, nil)
+	if _, ok := guardrailDeferrals.timers["guardrail/data"]; ok {
+		t.Errorf("deferMutation() deferred a PVC stopped by the per namespace limit")
+	}
+	deferMutation(pvc, "vol-1", guardrailPass, time.Now().Add(time.Hour), nil, nil)
+	if _, ok := guardrailDeferrals.timers["guardrail/data"]; !ok {
+		t.Errorf("deferMutation() did not defer the PVC to the next pass")
+	}
+}
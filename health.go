@@ -0,0 +1,117 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// providerHealthCheck is the result of the last provider health probe
+type providerHealthCheck struct {
+	sync.RWMutex
+	err error
+}
+
+var providerHealth = &providerHealthCheck{}
+
+func (h *providerHealthCheck) set(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.err = err
+	healthy := 1.0
+	if err != nil {
+		healthy = 0
+	}
+	promProviderHealthy.With(prometheus.Labels{"provider": cloudProvider}).Set(healthy)
+}
+
+func (h *providerHealthCheck) get() error {
+	h.RLock()
+	defer h.RUnlock()
+	return h.err
+}
+
+// probeAWSProvider checks that the AWS credentials are still valid.
+// GetCallerIdentity doesn't need any IAM permission.
+func probeAWSProvider() error {
+	_, err := sts.New(awsSession).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	return err
+}
+
+// runProviderHealthCheck periodically probes the provider so that stale
+// credentials are noticed before the next PVC event fails to be tagged
+func runProviderHealthCheck(ctx context.Context, interval time.Duration, probe func() error) {
+	check := func() {
+		err := probe()
+		if err != nil {
+			log.Errorln("Provider health check failed:", err)
+		}
+		providerHealth.set(err)
+	}
+	check()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, err := w.Write([]byte("method is not implemented"))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	if err := apiServerHealth.get(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err = w.Write([]byte("degraded: " + err.Error()))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	if err := providerHealth.get(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err = w.Write([]byte("provider health check failed: " + err.Error()))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	_, err := w.Write([]byte("OK"))
+	if err != nil {
+		log.Errorln("Cannot write status message:", err)
+	}
+}
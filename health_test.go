@@ -0,0 +1,71 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_readyHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		probeErr   error
+		wantStatus int
+		wantHealth float64
+	}{
+		{
+			name:       "healthy provider",
+			probeErr:   nil,
+			wantStatus: http.StatusOK,
+			wantHealth: 1,
+		},
+		{
+			name:       "expired credentials",
+			probeErr:   errors.New("ExpiredToken: The security token included in the request is expired"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantHealth: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			// the first check runs before the context is checked
+			runProviderHealthCheck(ctx, time.Hour, func() error { return tt.probeErr })
+			defer providerHealth.set(nil)
+
+			w := httptest.NewRecorder()
+			readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("readyHandler() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := testutil.ToFloat64(promProviderHealthy.With(prometheus.Labels{"provider": cloudProvider})); got != tt.wantHealth {
+				t.Errorf("k8s_pvc_tagger_provider_healthy = %v, want %v", got, tt.wantHealth)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The reasons a PVC is ignored on top of its skip reasons
+const (
+	ignoreReasonIgnoredProvisioner     = "ignored-provisioner"
+	ignoreReasonUnsupportedProvisioner = "unsupported-provisioner"
+	ignoreReasonUnbound                = "unbound"
+	ignoreReasonDeleting               = "deleting"
+	ignoreReasonNamespaceTerminating   = "namespace-terminating"
+	ignoreReasonMutationLimit          = "mutation-limit"
+	ignoreReasonPaused                 = "paused"
+)
+
+// ignoredPVC is a PVC whose volume isn't, or isn't fully, tagged
+type ignoredPVC struct {
+	Namespace   string `json:"namespace"`
+	PVC         string `json:"pvc"`
+	Reason      string `json:"reason"`
+	Provisioner string `json:"provisioner,omitempty"`
+}
+
+// getIgnoreReason returns why the tagger doesn't tag the PVC's volume, or
+// doesn't apply all its tags, or an empty string if it's tagged
+func getIgnoreReason(pvc *corev1.PersistentVolumeClaim, now time.Time) string {
+	if !isSupportedProvisioner(pvc) {
+		return ignoreReasonIgnoredProvisioner
+	}
+	if getProvider(pvc) == "" {
+		return ignoreReasonUnsupportedProvisioner
+	}
+	if pvc.Spec.VolumeName == "" {
+		return ignoreReasonUnbound
+	}
+	if pvc.GetDeletionTimestamp() != nil {
+		return ignoreReasonDeleting
+	}
+	if terminatingNamespaces.isTerminating(pvc.GetNamespace()) {
+		return ignoreReasonNamespaceTerminating
+	}
+	if pausedNamespaces.isPaused(pvc.GetNamespace()) {
+		return ignoreReasonPaused
+	}
+	if reason := getSkipReason(pvc, now); reason != "" {
+		return reason
+	}
+	if guardrailDeferrals.has(pvc.GetNamespace(), pvc.GetName()) {
+		return ignoreReasonMutationLimit
+	}
+	return ""
+}
+
+// listIgnoredPVCs returns the watched PVCs of the namespace, or of all the
+// watched namespaces when it's empty, that are ignored, sorted by namespace
+// and name. The PVCs are read from the running informers, or else listed from
+// the API server, e.g. on a replica that isn't the leader.
+func listIgnoredPVCs(ctx context.Context, client kubernetes.Interface, namespace string, now time.Time) ([]ignoredPVC, error) {
+	pvcs, ok := pvcInformers.list(namespace)
+	if !ok {
+		list, err := listNamespacePVCs(ctx, client, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list {
+			pvcs = append(pvcs, &list[i])
+		}
+	}
+	sort.Slice(pvcs, func(i, j int) bool {
+		return pvcs[i].Namespace+"/"+pvcs[i].Name < pvcs[j].Namespace+"/"+pvcs[j].Name
+	})
+	ignored := []ignoredPVC{}
+	for _, pvc := range pvcs {
+		if reason := getIgnoreReason(pvc, now); reason != "" {
+			ignored = append(ignored, ignoredPVC{
+				Namespace:   pvc.GetNamespace(),
+				PVC:         pvc.GetName(),
+				Reason:      reason,
+				Provisioner: pvc.GetAnnotations()["volume.beta.kubernetes.io/storage-provisioner"],
+			})
+		}
+	}
+	return ignored, nil
+}
+
+// ignoredPVCsHandler serves the ignored PVCs, only those of the namespace
+// query parameter when it's set
+func ignoredPVCsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, err := w.Write([]byte("method is not implemented"))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	ignored, err := listIgnoredPVCs(r.Context(), k8sClient, r.URL.Query().Get("namespace"), time.Now())
+	if err != nil {
+		log.Errorln("Cannot list the ignored PVCs:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, err = w.Write([]byte(err.Error()))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ignored)
+	if err != nil {
+		log.Errorln("Cannot write the ignored PVCs:", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_ignoredPVCsHandler(t *testing.T) {
+	origClient, origProvisioners := k8sClient, ignoredProvisioners
+	defer func() { k8sClient, ignoredProvisioners = origClient, origProvisioners }()
+	ignoredProvisioners = []string{"ebs.csi.example.com"}
+	deleted := metav1.NewTime(time.Now())
+	pvc := func(namespace string, name string, provisioner string, volumeName string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		all := map[string]string{"volume.beta.kubernetes.io/storage-provisioner": provisioner}
+		for k, v := range annotations {
+			all[k] = v
+		}
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: all, CreationTimestamp: metav1.Now()},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		}
+	}
+	deleting := pvc("default", "deleting", "ebs.csi.aws.com", "pv-4", nil)
+	deleting.DeletionTimestamp = &deleted
+	deleting.Finalizers = []string{"kubernetes.io/pvc-protection"}
+	k8sClient = fake.NewSimpleClientset(
+		pvc("default", "tagged", "ebs.csi.aws.com", "pv-1", nil),
+		pvc("default", "opted-out", "ebs.csi.aws.com", "pv-2", map[string]string{annotationPrefix + "/ignore": ""}),
+		pvc("default", "pending", "ebs.csi.aws.com", "", nil),
+		pvc("default", "nfs", "nfs.csi.k8s.io", "pv-3", nil),
+		pvc("other", "excluded", "ebs.csi.example.com", "pv-5", nil),
+		deleting,
+	)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		want       []ignoredPVC
+	}{
+		{
+			name:       "all namespaces",
+			method:     "GET",
+			path:       "/debug/ignored-pvcs",
+			wantStatus: http.StatusOK,
+			want: []ignoredPVC{
+				{Namespace: "default", PVC: "deleting", Reason: ignoreReasonDeleting, Provisioner: "ebs.csi.aws.com"},
+				{Namespace: "default", PVC: "nfs", Reason: ignoreReasonUnsupportedProvisioner, Provisioner: "nfs.csi.k8s.io"},
+				{Namespace: "default", PVC: "opted-out", Reason: skipReasonIgnored, Provisioner: "ebs.csi.aws.com"},
+				{Namespace: "default", PVC: "pending", Reason: ignoreReasonUnbound, Provisioner: "ebs.csi.aws.com"},
+				{Namespace: "other", PVC: "excluded", Reason: ignoreReasonIgnoredProvisioner, Provisioner: "ebs.csi.example.com"},
+			},
+		},
+		{
+			name:       "one namespace",
+			method:     "GET",
+			path:       "/debug/ignored-pvcs?namespace=other",
+			wantStatus: http.StatusOK,
+			want: []ignoredPVC{
+				{Namespace: "other", PVC: "excluded", Reason: ignoreReasonIgnoredProvisioner, Provisioner: "ebs.csi.example.com"},
+			},
+		},
+		{
+			name:       "POST",
+			method:     "POST",
+			path:       "/debug/ignored-pvcs",
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ignoredPVCsHandler(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %v", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got []ignoredPVC
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("cannot decode the response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listIgnoredPVCs(t *testing.T) {
+	origClient, origNamespace := k8sClient, watchNamespace
+	defer func() { k8sClient, watchNamespace = origClient, origNamespace }()
+	pending := func(namespace string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace, Name: "pending", Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"},
+		}}
+	}
+	client := fake.NewSimpleClientset(pending("default"), pending("other"))
+	k8sClient = client
+
+	t.Run("namespace listed from the API server", func(t *testing.T) {
+		client.ClearActions()
+		got, err := listIgnoredPVCs(context.TODO(), client, "other", time.Now())
+		if err != nil || len(got) != 1 || got[0].Namespace != "other" {
+			t.Fatalf("listIgnoredPVCs() = %+v, %v, want the pending PVC of other", got, err)
+		}
+		if actions := client.Actions(); len(actions) != 1 || actions[0].GetNamespace() != "other" {
+			t.Errorf("listIgnoredPVCs() actions = %v, want a single list of the namespace", actions)
+		}
+	})
+
+	t.Run("namespace that isn't watched", func(t *testing.T) {
+		watchNamespace = "default"
+		defer func() { watchNamespace = "" }()
+		client.ClearActions()
+		got, err := listIgnoredPVCs(context.TODO(), client, "other", time.Now())
+		if err != nil || len(got) != 0 || len(client.Actions()) != 0 {
+			t.Errorf("listIgnoredPVCs() = %+v, %v, %d actions, want none", got, err, len(client.Actions()))
+		}
+	})
+
+	t.Run("informer stores", func(t *testing.T) {
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		for _, pvc := range []*corev1.PersistentVolumeClaim{pending("default"), pending("other"), pending("third")} {
+			if err := store.Add(pvc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ch := make(chan struct{})
+		defer func() {
+			close(ch)
+			for _, ok := pvcInformers.list(""); ok; _, ok = pvcInformers.list("") {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		pvcInformers.add(ch, pvcInformer{store: store})
+		client.ClearActions()
+		got, err := listIgnoredPVCs(context.TODO(), client, "", time.Now())
+		if err != nil || len(got) != 3 || got[0].Namespace != "default" || got[2].Namespace != "third" {
+			t.Errorf("listIgnoredPVCs() = %+v, %v, want the sorted PVCs of the store", got, err)
+		}
+		if len(client.Actions()) != 0 {
+			t.Errorf("listIgnoredPVCs() actions = %v, want none", client.Actions())
+		}
+	})
+}
@@ -0,0 +1,283 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// csiTagPrefixes are the prefixes of the tags set by the CSI drivers when
+// they provision a volume, they are never imported
+var csiTagPrefixes = []string{"CSIVolume", "ebs.csi.aws.com/", "efs.csi.aws.com/"}
+
+// importOptions are which of the volumes' existing tags are imported
+type importOptions struct {
+	includeKeys []string
+	excludeKeys []string
+	// overwrite replaces the values already in the tags annotation
+	overwrite bool
+	dryRun    bool
+}
+
+func (o importOptions) isImportedKey(key string) bool {
+	if len(o.includeKeys) > 0 && !containsString(o.includeKeys, key) {
+		return false
+	}
+	return !containsString(o.excludeKeys, key)
+}
+
+// isImportableTag returns whether the volume's tag can be written to the tags
+// annotation. The tags of AWS, Kubernetes, the CSI drivers and the controller
+// itself, i.e. the managed-by, tags hash, DR and deletion protection tags, are
+// left alone.
+func isImportableTag(key string, value string) bool {
+	if validateTag(key, value) != nil || !isValidTagName(key) || key == managedByTagKey || key == tagsHashKey || containsString(getDRTagKeys(), key) || containsString(getDeletionProtectionTagKeys(), key) {
+		return false
+	}
+	for _, prefix := range csiTagPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	if tagFormat == "csv" {
+		return value != "" && !strings.ContainsAny(key, ",=") && !strings.Contains(value, ",") &&
+			key == strings.TrimSpace(key) && value == strings.TrimSpace(value)
+	}
+	return true
+}
+
+// importedTags returns the tags annotation merged with the volume's existing
+// tags that the current policy does not already compute, and the tags that
+// were imported
+func importedTags(existing map[string]string, computed map[string]string, annotated map[string]string, opts importOptions) (map[string]string, map[string]string) {
+	merged := make(map[string]string, len(annotated))
+	for k, v := range annotated {
+		merged[k] = v
+	}
+	imported := map[string]string{}
+	for k, v := range existing {
+		if !opts.isImportedKey(k) || !isImportableTag(k, v) {
+			continue
+		}
+		if old, ok := annotated[k]; ok {
+			if old == v || !opts.overwrite {
+				continue
+			}
+		} else if computed[k] == v {
+			continue
+		}
+		merged[k] = v
+		imported[k] = v
+	}
+	return merged, imported
+}
+
+// formatTags returns the tags in the configured tag format
+func formatTags(tags map[string]string) (string, error) {
+	if tagFormat == "csv" {
+		pairs := make([]string, 0, len(tags))
+		for k, v := range tags {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	}
+	value, err := json.Marshal(tags)
+	return string(value), err
+}
+
+// importVolumeTags writes the existing tags of the volume of every bound PVC to
+// the PVC's tags annotation, so the controller keeps them instead of the PVC
+// only describing the tags it adds. It returns the number of PVCs that could
+// not be imported.
+func importVolumeTags(ctx context.Context, client kubernetes.Interface, efsClient *EFSClient, ec2Client *EBSClient, opts importOptions, w io.Writer, errW io.Writer) (int, error) {
+	pvcs, err := listClusterPVCs(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+
+	annotated, failed := 0, 0
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if getProvider(pvc) == "" || pvc.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		volumeID, computed, err := processPersistentVolumeClaim(pvc)
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot compute the tags of %s/%s: %v\n", pvc.Namespace, pvc.Name, err)
+			failed++
+			continue
+		}
+		existing, err := getVolumeTags(getProvider(pvc), volumeID, efsClient, ec2Client)
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot get the tags of %s for %s/%s: %v\n", volumeID, pvc.Namespace, pvc.Name, err)
+			failed++
+			continue
+		}
+		if owner, ok := existing[managedByTagKey]; ok && clusterName != "" && owner != managedByTagValue() && !forceTakeover {
+			fmt.Fprintf(w, "%s/%s\t%s\tskipped, managed by %s\n", pvc.Namespace, pvc.Name, volumeID, owner)
+			continue
+		}
+		current := map[string]string{}
+		if value, ok := getPVCAnnotation(pvc, "tags"); ok {
+			var errs []error
+			if current, errs = parseTags(value); len(errs) > 0 {
+				fmt.Fprintf(errW, "Cannot import the tags of %s into %s/%s, its tags annotation is not valid: %v\n", volumeID, pvc.Namespace, pvc.Name, errs[0])
+				failed++
+				continue
+			}
+		}
+		merged, imported := importedTags(existing, computed, current, opts)
+		if len(imported) == 0 {
+			continue
+		}
+		value, err := formatTags(merged)
+		if err == nil && len(merged) > maxAnnotationTags {
+			err = fmt.Errorf("the annotation would have %d tags, more than the limit of %d tags", len(merged), maxAnnotationTags)
+		} else if err == nil && len(value) > maxAnnotationSize {
+			err = fmt.Errorf("the annotation would be %d bytes, more than the limit of %d bytes", len(value), maxAnnotationSize)
+		}
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot import the tags of %s into %s/%s: %v\n", volumeID, pvc.Namespace, pvc.Name, err)
+			failed++
+			continue
+		}
+		if !opts.dryRun {
+			patch, _ := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{annotationPrefix + "/tags": value},
+				},
+			})
+			if _, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+				fmt.Fprintf(errW, "Cannot annotate %s/%s: %v\n", pvc.Namespace, pvc.Name, err)
+				failed++
+				continue
+			}
+		}
+		annotated++
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\n", pvc.Namespace, pvc.Name, volumeID, tagChange{Added: imported})
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(w, "%d PVCs would be annotated, run with --dry-run=false to annotate them\n", annotated)
+	} else {
+		fmt.Fprintf(w, "%d PVCs annotated\n", annotated)
+	}
+	return failed, nil
+}
+
+// runImportCommand runs the import subcommand which writes the tags already on
+// the volumes, set by hand or by infrastructure as code, to the tags annotation
+// of their PVCs before the controller is deployed on an existing cluster
+func runImportCommand(args []string, w io.Writer, errW io.Writer) int {
+	fs := newCommandFlagSet("import", errW)
+	kubeconfig := fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	kubeContext := fs.String("context", "", "the context to use")
+	region := fs.String("region", os.Getenv("AWS_REGION"), "the region")
+	fs.StringVar(&cloudProvider, "provider", cloudProviderAWS, "The cloud provider the volumes are tagged with (aws, fake)")
+	fs.StringVar(&providerEndpoint, "provider-endpoint", "", "Override the AWS API endpoint, e.g. for LocalStack")
+	fs.BoolVar(&localstack, "localstack", false, "Use static test credentials with the provider-endpoint, for LocalStack")
+	defaultTagsString := fs.String("default-tags", "", "Default tags to add to EBS/EFS volume, they are not imported")
+	tagAnnotationAliasesString := fs.String("tag-annotation-aliases", "", "Comma separated list of tag keys that can be set with their own annotation, they are not imported")
+	fs.StringVar(&tagFormat, "tag-format", "json", "Whether the tags are in json or csv format")
+	fs.StringVar(&annotationPrefix, "annotation-prefix", "k8s-pvc-tagger", "Annotation prefix to write")
+	fs.StringVar(&watchNamespace, "watch-namespace", "", "A specific namespace to import (default is all namespaces)")
+	fs.StringVar(&pvcLabelSelector, "label-selector", "", "Only import PVCs matching this label selector")
+	fs.StringVar(&pvcFieldSelector, "field-selector", "", "Only import PVCs matching this field selector")
+	fs.StringVar(&clusterName, "cluster-name", "", "The name of the cluster, volumes managed by another cluster are skipped")
+	fs.BoolVar(&forceTakeover, "force-takeover", false, "Whether or not to import the tags of volumes whose managed-by tag belongs to another cluster")
+	fs.IntVar(&maxAnnotationSize, "max-annotation-size", maxAnnotationSize, "The maximum size in bytes of a tags annotation")
+	fs.IntVar(&maxAnnotationTags, "max-annotation-tags", maxAnnotationTags, "The maximum number of tags in a tags annotation")
+	fs.StringVar(&tagsHashKey, "tags-hash-key", "", "The tag key set to a hash of the other tags, it is not imported")
+	fs.BoolVar(&drTags, "dr-tags", false, "Whether or not the DR tags are set from the dr-replicate and dr-region annotations, they are not imported")
+	fs.StringVar(&drReplicateTagKey, "dr-replicate-tag-key", "dr-replicate", "The tag key DR tooling selects the volumes and snapshots to replicate with")
+	fs.StringVar(&drRegionTagKey, "dr-region-tag-key", "dr-region", "The tag key set to the region the volume is replicated to")
+	fs.BoolVar(&deletionProtection, "deletion-protection", false, "Whether or not the deletion protection tag is set from the deletion-protection annotation, it is not imported")
+	fs.StringVar(&deletionProtectionTagKey, "deletion-protection-tag-key", "deletion-protection", "The tag key set to true on the volumes of protected PVCs")
+	includeKeys := fs.String("include-keys", "", "Comma separated list of the only tag keys to import")
+	excludeKeys := fs.String("exclude-keys", "", "Comma separated list of tag keys not to import")
+	overwrite := fs.Bool("overwrite", false, "Replace the values already in the tags annotation with the volume's tag values")
+	dryRun := fs.Bool("dry-run", true, "Only report the annotations that would be written")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if defaultTags, err = parseDefaultTags(*defaultTagsString); err != nil {
+		fmt.Fprintln(errW, "default-tags are not valid json key/value pairs:", err)
+		return 2
+	}
+	if tagAnnotationAliases, err = parseTagAnnotationAliases(*tagAnnotationAliasesString); err != nil {
+		fmt.Fprintln(errW, "tag-annotation-aliases is not valid:", err)
+		return 2
+	}
+	opts := importOptions{overwrite: *overwrite, dryRun: *dryRun}
+	for _, k := range strings.Split(*includeKeys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			opts.includeKeys = append(opts.includeKeys, k)
+		}
+	}
+	for _, k := range strings.Split(*excludeKeys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			opts.excludeKeys = append(opts.excludeKeys, k)
+		}
+	}
+
+	// The per-PVC errors are reported on errW, keep the logs for real problems
+	if log.GetLevel() > log.WarnLevel {
+		log.SetLevel(log.WarnLevel)
+	}
+	client, err := BuildClient(*kubeconfig, *kubeContext)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot connect to the cluster:", err)
+		return 1
+	}
+	k8sClient = client
+	if cloudProvider != cloudProviderFake {
+		if *region == "" {
+			*region, _ = getMetadataRegion()
+		}
+		awsSession = createAWSSession(*region)
+	}
+	ec2Client, _ := newEC2Client()
+	efsClient, _ := newEFSClient()
+
+	failed, err := importVolumeTags(context.Background(), client, efsClient, ec2Client, opts, w, errW)
+	if err != nil {
+		fmt.Fprintln(errW, err)
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(errW, "%d PVCs could not be imported\n", failed)
+		return 1
+	}
+	return 0
+}
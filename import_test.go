@@ -0,0 +1,179 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_importedTags(t *testing.T) {
+	existing := map[string]string{
+		"team":                               "storage",
+		"owner":                              "alice",
+		"env":                                "prod",
+		"notes":                              "a,b",
+		"managed-by":                         "k8s-pvc-tagger/prod",
+		"CSIVolumeName":                      "pvc-1234",
+		"ebs.csi.aws.com/cluster":            "true",
+		"kubernetes.io/created-for/pvc/name": "data",
+		"aws:cloudformation:stack-name":      "storage",
+	}
+	tests := []struct {
+		name         string
+		tagFormat    string
+		annotated    map[string]string
+		opts         importOptions
+		wantMerged   map[string]string
+		wantImported map[string]string
+	}{
+		{
+			name:         "no annotation",
+			tagFormat:    "json",
+			wantMerged:   map[string]string{"team": "storage", "owner": "alice", "notes": "a,b"},
+			wantImported: map[string]string{"team": "storage", "owner": "alice", "notes": "a,b"},
+		},
+		{
+			name:         "annotation wins",
+			tagFormat:    "json",
+			annotated:    map[string]string{"team": "platform", "tier": "gold"},
+			wantMerged:   map[string]string{"team": "platform", "tier": "gold", "owner": "alice", "notes": "a,b"},
+			wantImported: map[string]string{"owner": "alice", "notes": "a,b"},
+		},
+		{
+			name:         "overwrite",
+			tagFormat:    "json",
+			annotated:    map[string]string{"team": "platform"},
+			opts:         importOptions{overwrite: true},
+			wantMerged:   map[string]string{"team": "storage", "owner": "alice", "notes": "a,b"},
+			wantImported: map[string]string{"team": "storage", "owner": "alice", "notes": "a,b"},
+		},
+		{
+			name:         "include and exclude keys",
+			tagFormat:    "json",
+			opts:         importOptions{includeKeys: []string{"team", "owner"}, excludeKeys: []string{"owner"}},
+			wantMerged:   map[string]string{"team": "storage"},
+			wantImported: map[string]string{"team": "storage"},
+		},
+		{
+			name:         "csv skips values with commas",
+			tagFormat:    "csv",
+			wantMerged:   map[string]string{"team": "storage", "owner": "alice"},
+			wantImported: map[string]string{"team": "storage", "owner": "alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagFormat = tt.tagFormat
+			defer func() { tagFormat = "json" }()
+			merged, imported := importedTags(existing, map[string]string{"env": "prod"}, tt.annotated, tt.opts)
+			if !reflect.DeepEqual(merged, tt.wantMerged) {
+				t.Errorf("importedTags() merged = %v, want %v", merged, tt.wantMerged)
+			}
+			if !reflect.DeepEqual(imported, tt.wantImported) {
+				t.Errorf("importedTags() imported = %v, want %v", imported, tt.wantImported)
+			}
+		})
+	}
+}
+
+func Test_importVolumeTags(t *testing.T) {
+	defaultTags = map[string]string{"env": "prod"}
+	defer func() { defaultTags = map[string]string{} }()
+	store := newFakeTagStore()
+	store.addTags("vol-annotated", map[string]string{"team": "storage", "cost-center": "123", "env": "prod", "CSIVolumeName": "pvc-1"})
+	store.addTags("vol-bare", map[string]string{"owner": "alice"})
+	store.addTags("vol-tagged", map[string]string{"env": "prod"})
+	ec2Client := &EBSClient{&fakeEC2{store: store}}
+	efsClient := &EFSClient{&fakeEFS{store: store}}
+
+	newPVC := func(name string, volumeName string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		}
+		for k, v := range annotations {
+			pvc.Annotations[k] = v
+		}
+		return pvc
+	}
+	newPV := func(name string, volumeID string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: volumeID},
+		}}}
+	}
+	client := fake.NewSimpleClientset(
+		newPVC("annotated", "pv-annotated", map[string]string{"k8s-pvc-tagger/tags": `{"team": "platform"}`}),
+		newPVC("bare", "pv-bare", nil),
+		newPVC("tagged", "pv-tagged", nil),
+		newPVC("invalid", "pv-bare", map[string]string{"k8s-pvc-tagger/tags": `["team"]`}),
+		newPV("pv-annotated", "vol-annotated"),
+		newPV("pv-bare", "vol-bare"),
+		newPV("pv-tagged", "vol-tagged"),
+	)
+	k8sClient = client
+
+	getAnnotation := func(name string) string {
+		pvc, err := client.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("cannot get %s: %v", name, err)
+		}
+		return pvc.Annotations["k8s-pvc-tagger/tags"]
+	}
+
+	var out, errOut bytes.Buffer
+	failed, err := importVolumeTags(context.Background(), client, efsClient, ec2Client, importOptions{dryRun: true}, &out, &errOut)
+	if err != nil {
+		t.Fatalf("importVolumeTags() error = %v", err)
+	}
+	if failed != 1 {
+		t.Errorf("importVolumeTags() failed = %v, want 1: %v", failed, errOut.String())
+	}
+	want := "default/annotated\tvol-annotated\t+cost-center=123\n" +
+		"default/bare\tvol-bare\t+owner=alice\n" +
+		"2 PVCs would be annotated, run with --dry-run=false to annotate them\n"
+	if out.String() != want {
+		t.Errorf("importVolumeTags() output =\n%s\nwant\n%s", out.String(), want)
+	}
+	if got := getAnnotation("bare"); got != "" {
+		t.Errorf("importVolumeTags() annotated default/bare with %q in dry-run", got)
+	}
+
+	out.Reset()
+	if _, err := importVolumeTags(context.Background(), client, efsClient, ec2Client, importOptions{}, &out, &errOut); err != nil {
+		t.Fatalf("importVolumeTags() error = %v", err)
+	}
+	wantAnnotations := map[string]string{
+		"annotated": `{"cost-center":"123","team":"platform"}`,
+		"bare":      `{"owner":"alice"}`,
+		"tagged":    "",
+	}
+	for name, want := range wantAnnotations {
+		if got := getAnnotation(name); got != want {
+			t.Errorf("importVolumeTags() annotated default/%s with %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// maxInFlightAPICalls is the maximum number of cloud API calls waiting for a
+// response at the same time (0 is unlimited)
+var maxInFlightAPICalls int
+
+// inFlightLimiter caps the number of outstanding cloud API calls. A call waits
+// for a slot before it is sent, which holds back the informer handlers and
+// retries instead of piling up goroutines when the API is slow.
+type inFlightLimiter struct {
+	// slots is nil when the number of calls is unlimited
+	slots chan struct{}
+	// acquired are the requests holding a slot, so that it is released once
+	acquired sync.Map
+}
+
+var inFlightAPICalls = newInFlightLimiter(0)
+
+func newInFlightLimiter(limit int) *inFlightLimiter {
+	l := &inFlightLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+func validateMaxInFlightAPICalls(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("must not be negative, got %d", limit)
+	}
+	return nil
+}
+
+// acquire is a Send handler taking a slot for each attempt of the request
+func (l *inFlightLimiter) acquire(r *request.Request) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			promInFlightAPICallWaitsTotal.Inc()
+			l.slots <- struct{}{}
+		}
+	}
+	l.acquired.Store(r, struct{}{})
+	promInFlightAPICalls.Inc()
+}
+
+// release is a CompleteAttempt handler freeing the slot of the attempt
+func (l *inFlightLimiter) release(r *request.Request) {
+	if _, ok := l.acquired.LoadAndDelete(r); !ok {
+		return
+	}
+	promInFlightAPICalls.Dec()
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,107 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newInFlightTestRequest() *request.Request {
+	return request.New(aws.Config{}, metadata.ClientInfo{SigningName: "ec2"}, request.Handlers{}, nil, &request.Operation{Name: "CreateTags"}, nil, nil)
+}
+
+func Test_validateMaxInFlightAPICalls(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr bool
+	}{
+		{name: "unlimited", limit: 0},
+		{name: "limited", limit: 20},
+		{name: "negative", limit: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMaxInFlightAPICalls(tt.limit); (err != nil) != tt.wantErr {
+				t.Errorf("validateMaxInFlightAPICalls() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_inFlightLimiter(t *testing.T) {
+	l := newInFlightLimiter(1)
+	inFlight := testutil.ToFloat64(promInFlightAPICalls)
+	waits := testutil.ToFloat64(promInFlightAPICallWaitsTotal)
+
+	first, second := newInFlightTestRequest(), newInFlightTestRequest()
+	l.acquire(first)
+	if got := testutil.ToFloat64(promInFlightAPICalls) - inFlight; got != 1 {
+		t.Errorf("in-flight API calls = %v, want 1", got)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire(second)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire() didn't wait for the in-flight call to complete")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.release(first)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("acquire() still waiting after the in-flight call completed")
+	}
+	if got := testutil.ToFloat64(promInFlightAPICallWaitsTotal) - waits; got != 1 {
+		t.Errorf("in-flight API call waits = %v, want 1", got)
+	}
+
+	// A request is only released once, e.g. when its Send handlers didn't run
+	l.release(first)
+	l.release(newInFlightTestRequest())
+	if got := testutil.ToFloat64(promInFlightAPICalls) - inFlight; got != 1 {
+		t.Errorf("in-flight API calls = %v, want 1", got)
+	}
+	l.release(second)
+	if got := testutil.ToFloat64(promInFlightAPICalls) - inFlight; got != 0 {
+		t.Errorf("in-flight API calls = %v, want 0", got)
+	}
+}
+
+func Test_inFlightLimiterUnlimited(t *testing.T) {
+	l := newInFlightLimiter(0)
+	requests := []*request.Request{newInFlightTestRequest(), newInFlightTestRequest(), newInFlightTestRequest()}
+	for _, r := range requests {
+		l.acquire(r)
+	}
+	for _, r := range requests {
+		l.release(r)
+	}
+}
@@ -0,0 +1,223 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// journalEntry is a tag operation that was started but not finished
+type journalEntry struct {
+	Namespace   string            `json:"namespace"`
+	PVC         string            `json:"pvc"`
+	Tags        map[string]string `json:"tags"`
+	RemovedTags []string          `json:"removedTags,omitempty"`
+	StartedAt   time.Time         `json:"startedAt"`
+}
+
+// tagJournalStore is a write-ahead journal of the in-flight tag operations,
+// keyed by volume ID and persisted to a ConfigMap before each operation, so
+// that a new leader can complete the operations a crashed leader left behind
+type tagJournalStore struct {
+	sync.Mutex
+	namespace string
+	name      string
+	entries   map[string]journalEntry
+	dirty     bool
+}
+
+var tagJournal = newTagJournalStore("", "")
+
+// newTagJournalStore returns a journal persisted to the namespace/name
+// ConfigMap, or a disabled journal if name is empty
+func newTagJournalStore(namespace string, name string) *tagJournalStore {
+	return &tagJournalStore{namespace: namespace, name: name, entries: map[string]journalEntry{}}
+}
+
+// begin persists the operation before it is run. The operation is run even if
+// it can't be persisted, the next resync is still there to catch up.
+func (j *tagJournalStore) begin(volumeID string, e journalEntry) {
+	if j.name == "" {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.entries[volumeID] = e
+	if err := j.save(); err != nil {
+		log.WithFields(log.Fields{"volumeID": volumeID}).Errorln("Could not save the tag journal:", err)
+	}
+}
+
+// end removes the operation once it succeeded or was given up, unless a newer
+// operation with other tags has been started for the volume since. The journal
+// is saved lazily, completing an operation twice is harmless.
+func (j *tagJournalStore) end(volumeID string, tags map[string]string) {
+	if j.name == "" {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	if e, ok := j.entries[volumeID]; ok && reflect.DeepEqual(e.Tags, tags) {
+		delete(j.entries, volumeID)
+		j.dirty = true
+	}
+}
+
+// save must be called with the lock held
+func (j *tagJournalStore) save() error {
+	data := make(map[string]string, len(j.entries))
+	for volumeID, e := range j.entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data[volumeID] = string(b)
+	}
+	if err := saveStateSnapshot(j.namespace, j.name, data); err != nil {
+		return err
+	}
+	j.dirty = false
+	promJournalEntries.Set(float64(len(j.entries)))
+	return nil
+}
+
+func (j *tagJournalStore) flush() {
+	j.Lock()
+	defer j.Unlock()
+	if !j.dirty {
+		return
+	}
+	if err := j.save(); err != nil {
+		log.Errorln("Could not save the tag journal:", err)
+	}
+}
+
+// load reads the operations left in the journal by the previous leader
+func (j *tagJournalStore) load() (map[string]journalEntry, error) {
+	data, err := loadStateSnapshot(j.namespace, j.name)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]journalEntry{}
+	for volumeID, value := range data {
+		var e journalEntry
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			log.WithFields(log.Fields{"volumeID": volumeID}).Warnln("Skipping invalid tag journal entry:", err)
+			continue
+		}
+		entries[volumeID] = e
+	}
+	return entries, nil
+}
+
+// recover verifies the operations left in the journal by the previous leader
+// and completes the ones that were not fully applied
+func (j *tagJournalStore) recover(efsClient *EFSClient, ec2Client *EBSClient) {
+	entries, err := j.load()
+	if err != nil {
+		log.Errorln("Could not load the tag journal:", err)
+		return
+	}
+	if len(entries) > 0 {
+		log.WithFields(log.Fields{"operations": len(entries)}).Infoln("Recovering the tag operations of the previous leader")
+	}
+	j.Lock()
+	j.entries = map[string]journalEntry{}
+	j.dirty = true
+	j.Unlock()
+
+	for volumeID, e := range entries {
+		fields := log.Fields{"namespace": e.Namespace, "pvc": e.PVC, "volumeID": volumeID}
+		pvc, err := k8sClient.CoreV1().PersistentVolumeClaims(e.Namespace).Get(context.TODO(), e.PVC, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			log.WithFields(fields).Debugln("PVC of the tag journal entry was deleted")
+			continue
+		} else if err != nil {
+			log.WithFields(fields).Errorln("Could not get the PVC of the tag journal entry:", err)
+			continue
+		}
+		if isJournalEntryApplied(pvc, volumeID, e, efsClient, ec2Client) {
+			log.WithFields(fields).Debugln("Tag operation was already applied")
+			promJournalRecoveredTotal.WithLabelValues("applied").Inc()
+			continue
+		}
+		log.WithFields(fields).Infoln("Completing the tag operation of the previous leader")
+		promJournalRecoveredTotal.WithLabelValues("completed").Inc()
+		applyTags(pvc, volumeID, e.Tags, e.RemovedTags, efsClient, ec2Client)
+	}
+	j.flush()
+}
+
+// isJournalEntryApplied returns true if the volume has all of the tags of the
+// operation and none of its removed tags. Only the volume itself is checked,
+// the operations that also target snapshots or file systems are completed again.
+func isJournalEntryApplied(pvc *corev1.PersistentVolumeClaim, volumeID string, e journalEntry, efsClient *EFSClient, ec2Client *EBSClient) bool {
+	targets := getTargets(pvc)
+	if len(targets) != 1 || targets[0] != targetVolume {
+		return false
+	}
+	efsClient, ec2Client = regionalClients(getPVCRegion(pvc), efsClient, ec2Client)
+	var existing map[string]string
+	var err error
+	switch getProvider(pvc) {
+	case providerAWSEBS:
+		existing, err = ec2Client.getEBSVolumeTags(volumeID)
+	case providerAWSEFS:
+		existing, err = efsClient.getEFSVolumeTags(volumeID)
+	default:
+		return false
+	}
+	if err != nil {
+		return false
+	}
+	for k, v := range e.Tags {
+		if existing[k] != v {
+			return false
+		}
+	}
+	for _, k := range e.RemovedTags {
+		if _, ok := existing[k]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func runTagJournalSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			tagJournal.flush()
+			return
+		case <-ticker.C:
+			tagJournal.flush()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_tagJournalStore(t *testing.T) {
+	k8sClient = fake.NewSimpleClientset()
+	j := newTagJournalStore("default", "k8s-pvc-tagger-journal")
+
+	e := journalEntry{Namespace: "default", PVC: "my-pvc", Tags: map[string]string{"foo": "bar"}, StartedAt: time.Unix(0, 0).UTC()}
+	j.begin("vol-12345", e)
+	got, err := j.load()
+	if err != nil {
+		t.Fatalf("load() err = %v", err)
+	}
+	if want := map[string]journalEntry{"vol-12345": e}; !reflect.DeepEqual(got, want) {
+		t.Errorf("load() after begin() = %v, want %v", got, want)
+	}
+
+	// A newer operation with other tags is still in flight
+	j.end("vol-12345", map[string]string{"foo": "old"})
+	j.flush()
+	if got, _ := j.load(); len(got) != 1 {
+		t.Errorf("load() after end() with other tags = %v, want the entry", got)
+	}
+
+	j.end("vol-12345", map[string]string{"foo": "bar"})
+	if got, _ := j.load(); len(got) != 1 {
+		t.Errorf("load() after end() = %v, want the entry until the journal is flushed", got)
+	}
+	j.flush()
+	if got, _ := j.load(); len(got) != 0 {
+		t.Errorf("load() after flush() = %v, want empty", got)
+	}
+}
+
+func Test_tagJournalDisabled(t *testing.T) {
+	k8sClient = fake.NewSimpleClientset()
+	j := newTagJournalStore("default", "")
+	j.begin("vol-12345", journalEntry{Tags: map[string]string{"foo": "bar"}})
+	if len(j.entries) != 0 {
+		t.Errorf("begin() on a disabled journal = %v, want no entries", j.entries)
+	}
+}
+
+func Test_tagJournalRecover(t *testing.T) {
+	cloudProvider = cloudProviderFake
+	fakeVolumes = newFakeTagStore()
+	managedVolumes = newVolumeStore()
+	defer func() {
+		cloudProvider = cloudProviderAWS
+		fakeVolumes = newFakeTagStore()
+		managedVolumes = newVolumeStore()
+		tagJournal = newTagJournalStore("", "")
+	}()
+	efsClient, _ := newEFSClient()
+	ec2Client, _ := newEC2Client()
+
+	pvc := func(name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"},
+		}}
+	}
+	k8sClient = fake.NewSimpleClientset(pvc("partial-pvc"), pvc("applied-pvc"))
+	fakeVolumes.addTags("vol-partial", map[string]string{"foo": "bar", "old": "tag"})
+	fakeVolumes.addTags("vol-applied", map[string]string{"foo": "bar"})
+
+	previous := newTagJournalStore("default", "k8s-pvc-tagger-journal")
+	previous.begin("vol-partial", journalEntry{Namespace: "default", PVC: "partial-pvc", Tags: map[string]string{"foo": "bar", "env": "prod"}, RemovedTags: []string{"old"}})
+	previous.begin("vol-applied", journalEntry{Namespace: "default", PVC: "applied-pvc", Tags: map[string]string{"foo": "bar"}})
+	previous.begin("vol-deleted", journalEntry{Namespace: "default", PVC: "deleted-pvc", Tags: map[string]string{"foo": "bar"}})
+
+	tagJournal = newTagJournalStore("default", "k8s-pvc-tagger-journal")
+	tagJournal.recover(efsClient, ec2Client)
+
+	want := map[string]string{"foo": "bar", "env": "prod"}
+	if got := fakeVolumes.get("vol-partial"); !reflect.DeepEqual(got, want) {
+		t.Errorf("recover() tags = %v, want %v", got, want)
+	}
+	if got := fakeVolumes.get("vol-deleted"); len(got) != 0 {
+		t.Errorf("recover() tagged the volume of a deleted PVC: %v", got)
+	}
+	if got, _ := tagJournal.load(); len(got) != 0 {
+		t.Errorf("load() after recover() = %v, want empty", got)
+	}
+}
@@ -0,0 +1,76 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/metrics"
+)
+
+// registerKubernetesClientMetrics reports the requests of the Kubernetes client
+// to the API server, so that API server slowness can be told apart from the
+// cloud API slowness. It must be called before the client is built.
+func registerKubernetesClientMetrics() {
+	metrics.Register(metrics.RegisterOpts{
+		RequestLatency:     kubernetesLatencyMetric{promKubernetesRequestDuration},
+		RateLimiterLatency: kubernetesLatencyMetric{promKubernetesRateLimiterDuration},
+		RequestResult:      kubernetesResultMetric{},
+	})
+}
+
+type kubernetesLatencyMetric struct {
+	histogram *prometheus.HistogramVec
+}
+
+func (m kubernetesLatencyMetric) Observe(_ context.Context, verb string, u url.URL, latency time.Duration) {
+	m.histogram.With(prometheus.Labels{"verb": verb, "resource": requestResource(u)}).Observe(latency.Seconds())
+}
+
+type kubernetesResultMetric struct{}
+
+func (kubernetesResultMetric) Increment(_ context.Context, code string, method string, _ string) {
+	promKubernetesRequestsTotal.With(prometheus.Labels{"code": code, "method": method}).Inc()
+}
+
+// requestResource returns the resource of the API server URL, e.g.
+// persistentvolumeclaims for /api/v1/namespaces/default/persistentvolumeclaims/data,
+// so that the metrics don't have a label per object
+func requestResource(u url.URL) string {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return "other"
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	if len(parts) == 0 || parts[0] == "" {
+		return "other"
+	}
+	return parts[0]
+}
@@ -0,0 +1,69 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_requestResource(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/v1/namespaces/default/persistentvolumeclaims/data", want: "persistentvolumeclaims"},
+		{path: "/api/v1/namespaces/default/persistentvolumeclaims", want: "persistentvolumeclaims"},
+		{path: "/api/v1/persistentvolumeclaims", want: "persistentvolumeclaims"},
+		{path: "/api/v1/persistentvolumes/pv-1", want: "persistentvolumes"},
+		{path: "/api/v1/namespaces/default", want: "namespaces"},
+		{path: "/api/v1/namespaces", want: "namespaces"},
+		{path: "/apis/coordination.k8s.io/v1/namespaces/kube-system/leases/k8s-pvc-tagger", want: "leases"},
+		{path: "/apis/storage.k8s.io/v1/storageclasses/gp3", want: "storageclasses"},
+		{path: "/version", want: "other"},
+		{path: "/api/v1", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := requestResource(url.URL{Path: tt.path}); got != tt.want {
+				t.Errorf("requestResource() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_kubernetesClientMetrics(t *testing.T) {
+	u := url.URL{Scheme: "https", Host: "10.0.0.1", Path: "/api/v1/namespaces/default/persistentvolumeclaims/data"}
+	kubernetesLatencyMetric{promKubernetesRequestDuration}.Observe(context.TODO(), "GET", u, 20*time.Millisecond)
+	if got := testutil.CollectAndCount(promKubernetesRequestDuration); got != 1 {
+		t.Errorf("got %d request duration series, want 1", got)
+	}
+
+	labels := prometheus.Labels{"code": "429", "method": "PATCH"}
+	before := testutil.ToFloat64(promKubernetesRequestsTotal.With(labels))
+	kubernetesResultMetric{}.Increment(context.TODO(), "429", "PATCH", "10.0.0.1")
+	if got := testutil.ToFloat64(promKubernetesRequestsTotal.With(labels)); got != before+1 {
+		t.Errorf("requests total = %v, want %v", got, before+1)
+	}
+}
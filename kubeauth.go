@@ -0,0 +1,223 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/connrotation"
+)
+
+// clientCertReloadInterval is how often the client certificate of the
+// kubeconfig is read again, out of the cluster, it's disabled when 0
+var clientCertReloadInterval time.Duration
+
+// kubeAuthMethod returns how the client authenticates to the API server, so
+// that the credential refresh issues can be told apart in the logs
+func kubeAuthMethod(config *rest.Config) string {
+	switch {
+	case config.ExecProvider != nil:
+		return "exec"
+	case config.AuthProvider != nil:
+		return "auth-provider:" + config.AuthProvider.Name
+	case config.CertFile != "" || len(config.CertData) > 0:
+		return "client-certificate"
+	case config.BearerTokenFile != "":
+		return "token-file"
+	case config.BearerToken != "":
+		return "token"
+	case config.Username != "":
+		return "basic"
+	}
+	return "none"
+}
+
+// inMemoryAuthPersister keeps the tokens refreshed by an auth provider, such
+// as oidc, when they can't be written back to the kubeconfig, e.g. when it's
+// mounted read-only from a Secret. The oidc provider fails every request
+// once its ID token expires if its refreshed tokens can't be persisted.
+type inMemoryAuthPersister struct {
+	persister rest.AuthProviderConfigPersister
+	warned    sync.Once
+}
+
+func (p *inMemoryAuthPersister) Persist(config map[string]string) error {
+	if err := p.persister.Persist(config); err != nil {
+		p.warned.Do(func() {
+			log.Warnln("Cannot write the refreshed credentials to the kubeconfig, keeping them in memory:", err)
+		})
+	}
+	return nil
+}
+
+// withInMemoryAuthPersister makes the auth provider of the config keep its
+// refreshed tokens in memory when the kubeconfig can't be written
+func withInMemoryAuthPersister(config *rest.Config) *rest.Config {
+	if config.AuthProvider == nil || config.AuthConfigPersister == nil {
+		return config
+	}
+	config = rest.CopyConfig(config)
+	config.AuthConfigPersister = &inMemoryAuthPersister{persister: config.AuthConfigPersister}
+	return config
+}
+
+// clientCertReloader serves the client certificate of the kubeconfig to the
+// TLS handshakes, and closes the connections to the API server when it's
+// rotated, since the API server authenticates the requests with the
+// certificate of their connection
+type clientCertReloader struct {
+	sync.RWMutex
+	load        func() (*tls.Certificate, error)
+	cert        *tls.Certificate
+	fingerprint [sha256.Size]byte
+	dialer      *connrotation.Dialer
+}
+
+func newClientCertReloader(load func() (*tls.Certificate, error)) *clientCertReloader {
+	return &clientCertReloader{
+		load:   load,
+		dialer: connrotation.NewDialer((&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext),
+	}
+}
+
+// reload loads the certificate and returns whether it changed. The
+// connections opened with the previous certificate are closed.
+func (r *clientCertReloader) reload() (bool, error) {
+	cert, err := r.load()
+	if err != nil {
+		return false, err
+	}
+	if len(cert.Certificate) == 0 {
+		return false, errors.New("the client certificate is empty")
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	r.Lock()
+	if r.cert != nil && fingerprint == r.fingerprint {
+		r.Unlock()
+		return false, nil
+	}
+	rotated := r.cert != nil
+	r.cert, r.fingerprint = cert, fingerprint
+	r.Unlock()
+	if rotated {
+		r.dialer.CloseAll()
+	}
+	return rotated, nil
+}
+
+func (r *clientCertReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// loadClientCert reads the client certificate and key of the config, from
+// their files or their data
+func loadClientCert(config *rest.Config) (*tls.Certificate, error) {
+	certData, keyData := config.CertData, config.KeyData
+	var err error
+	if config.CertFile != "" {
+		if certData, err = os.ReadFile(config.CertFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.KeyFile != "" {
+		if keyData, err = os.ReadFile(config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.X509KeyPair(bytes.TrimSpace(certData), bytes.TrimSpace(keyData))
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// withClientCertReload returns a copy of the config whose client certificate
+// is served by a reloader, or the config itself if it has no client
+// certificate. The exec plugins rotate their own certificates.
+func withClientCertReload(config *rest.Config, load func() (*tls.Certificate, error)) (*rest.Config, *clientCertReloader, error) {
+	if config.ExecProvider != nil || (config.CertFile == "" && len(config.CertData) == 0) {
+		return config, nil, nil
+	}
+	reloader := newClientCertReloader(load)
+	if _, err := reloader.reload(); err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = reloader.getClientCertificate
+
+	proxy := config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport := utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:               proxy,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 25,
+		DialContext:         reloader.dialer.DialContext,
+	})
+
+	config = rest.CopyConfig(config)
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	config.Proxy = nil
+	config.Transport = transport
+	return config, reloader, nil
+}
+
+// runClientCertReload reloads the client certificate every interval, so that
+// a rotated certificate is used before the previous one expires
+func runClientCertReload(ctx context.Context, reloader *clientCertReloader, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rotated, err := reloader.reload()
+			if err != nil {
+				log.Warnln("Cannot reload the client certificate of the kubeconfig, keeping the current one:", err)
+				promKubeClientCertReloads.WithLabelValues("error").Inc()
+				continue
+			}
+			if rotated {
+				log.Infoln("The client certificate of the kubeconfig was rotated, reconnecting to the API server")
+				promKubeClientCertReloads.WithLabelValues("rotated").Inc()
+			}
+		}
+	}
+}
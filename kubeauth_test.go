@@ -0,0 +1,221 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func Test_kubeAuthMethod(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *rest.Config
+		want   string
+	}{
+		{name: "exec", config: &rest.Config{ExecProvider: &clientcmdapi.ExecConfig{Command: "aws"}}, want: "exec"},
+		{name: "oidc", config: &rest.Config{AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "oidc"}}, want: "auth-provider:oidc"},
+		{name: "client certificate", config: &rest.Config{TLSClientConfig: rest.TLSClientConfig{CertFile: "/tls.crt"}}, want: "client-certificate"},
+		{name: "token file", config: &rest.Config{BearerTokenFile: "/token"}, want: "token-file"},
+		{name: "token", config: &rest.Config{BearerToken: "token"}, want: "token"},
+		{name: "none", config: &rest.Config{}, want: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kubeAuthMethod(tt.config); got != tt.want {
+				t.Errorf("kubeAuthMethod() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type failingPersister struct {
+	calls int
+}
+
+func (p *failingPersister) Persist(map[string]string) error {
+	p.calls++
+	return errors.New("read-only file system")
+}
+
+func Test_withInMemoryAuthPersister(t *testing.T) {
+	persister := &failingPersister{}
+	config := withInMemoryAuthPersister(&rest.Config{
+		AuthProvider:        &clientcmdapi.AuthProviderConfig{Name: "oidc"},
+		AuthConfigPersister: persister,
+	})
+	for i := 0; i < 2; i++ {
+		if err := config.AuthConfigPersister.Persist(map[string]string{"id-token": "new"}); err != nil {
+			t.Errorf("Persist() error = %v, want nil", err)
+		}
+	}
+	if persister.calls != 2 {
+		t.Errorf("Persist() calls = %v, want the kubeconfig to be written every time", persister.calls)
+	}
+
+	static := &rest.Config{BearerToken: "token"}
+	if got := withInMemoryAuthPersister(static); got != static {
+		t.Errorf("withInMemoryAuthPersister() changed a config without an auth provider")
+	}
+}
+
+// writeTestCert writes a certificate and key for the common name, signed by
+// the CA, or self-signed if the CA is nil
+func writeTestCert(t *testing.T, dir string, name string, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+func Test_withClientCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeTestCert(t, dir, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	rotate := func(name string) {
+		writeTestCert(t, dir, name, &ca)
+		for _, ext := range []string{".crt", ".key"} {
+			if err := os.Rename(filepath.Join(dir, name+ext), filepath.Join(dir, "client"+ext)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rotate("first")
+	config := &rest.Config{Host: server.URL, TLSClientConfig: rest.TLSClientConfig{
+		CAData:   serverCA,
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}}
+	reloaded, reloader, err := withClientCertReload(config, func() (*tls.Certificate, error) { return loadClientCert(config) })
+	if err != nil || reloader == nil {
+		t.Fatalf("withClientCertReload() = %v, %v", reloader, err)
+	}
+	client, err := rest.HTTPClientFor(reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() string {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if got := get(); got != "first" {
+		t.Errorf("client certificate = %v, want first", got)
+	}
+
+	if rotated, err := reloader.reload(); rotated || err != nil {
+		t.Errorf("reload() of the same certificate = %v, %v, want false", rotated, err)
+	}
+	rotate("second")
+	if rotated, err := reloader.reload(); !rotated || err != nil {
+		t.Errorf("reload() of a rotated certificate = %v, %v, want true", rotated, err)
+	}
+	if got := get(); got != "second" {
+		t.Errorf("client certificate after the rotation = %v, want second", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "client.crt"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloader.reload(); err == nil {
+		t.Errorf("reload() of an invalid certificate error = nil, want an error")
+	}
+	if got := get(); got != "second" {
+		t.Errorf("client certificate after a failed reload = %v, want second", got)
+	}
+
+	for _, unchanged := range []*rest.Config{
+		{Host: server.URL, BearerToken: "token"},
+		{Host: server.URL, ExecProvider: &clientcmdapi.ExecConfig{Command: "aws"}, TLSClientConfig: rest.TLSClientConfig{CertData: []byte("cert")}},
+	} {
+		if got, reloader, err := withClientCertReload(unchanged, nil); got != unchanged || reloader != nil || err != nil {
+			t.Errorf("withClientCertReload() of a config without a reloadable certificate = %v, %v, %v", got, reloader, err)
+		}
+	}
+}
@@ -21,37 +21,75 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
 	// DefaultKubeConfigFile local kubeconfig if not running in cluster
 	DefaultKubeConfigFile = filepath.Join(os.Getenv("HOME"), ".kube", "config")
-	k8sClient             kubernetes.Interface
+	// serviceAccountNamespaceFile is the namespace of the pod's service account
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	k8sClient                   kubernetes.Interface
+	eventRecorder               record.EventRecorder
 )
 
 const (
 	// Matching strings for volume operations.
-	regexpAWSVolumeID = `^aws:\/\/\w{2}-\w{4,9}-\d\w\/(vol-\w+)$`
-	regexpEFSVolumeID = `^fs-\w+::(fsap-\w+)$`
+	regexpAWSVolumeID     = `^aws:\/\/\w{2}-\w{4,9}-\d\w\/(vol-\w+)$`
+	regexpEFSVolumeID     = `^fs-\w+::(fsap-\w+)$`
+	regexpEFSFileSystemID = `^(fs-\w+)::fsap-\w+$`
+
+	// Sources tags can be read from
+	tagSourceAnnotations   = "annotations"
+	tagSourceLabels        = "labels"
+	tagSourcePVAnnotations = "pv-annotations"
+
+	// Resources related to a PVC that can be tagged
+	targetVolume     = "volume"
+	targetSnapshots  = "snapshots"
+	targetFileSystem = "file-system"
+
+	// Provisioners of host path, local and NFS volumes, which have nothing to tag
+	defaultIgnoredProvisioners = "kubernetes.io/host-path,kubernetes.io/no-provisioner,rancher.io/local-path,nfs.csi.k8s.io,k8s-sigs.io/nfs-subdir-external-provisioner"
+
+	// The tag used by the AWS console as the volume's name
+	nameTagKey = "Name"
+
+	// Values of the ignore annotation that only ignore some of the tags
+	ignoreValueDefaultTags = "default-tags"
+	ignoreValueKeysPrefix  = "keys:"
+
+	// AWS tag restrictions
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
 )
 
 type TagTemplate struct {
@@ -59,6 +97,32 @@ type TagTemplate struct {
 	Namespace   string
 	Labels      map[string]string
 	Annotations map[string]string
+	VolumeMode  string
+	Pod         string
+	ClusterName string
+	// The kind and name of the workload of the pod using the PVC, e.g. its
+	// Deployment, once a pod uses it
+	OwnerKind  string
+	Owner      string
+	Node       string
+	NodeLabels map[string]string
+	NodePool   string
+	// The well-known node labels, with --node-template-vars
+	InstanceType string
+	Zone         string
+	CapacityType string
+	// The provisioning parameters recorded on the PV, with --volume-template-vars
+	VolumeHandle     string
+	VolumeAttributes map[string]string
+	AccessPointID    string
+	AccessPointPath  string
+	// The attributes of the EBS volume, with --ebs-template-vars
+	Encrypted   bool
+	KMSKeyID    string
+	KMSKeyAlias string
+	VolumeType  string
+	Iops        int64
+	Throughput  int64
 }
 
 func BuildClient(kubeconfig string, kubeContext string) (*kubernetes.Clientset, error) {
@@ -71,6 +135,24 @@ func BuildClient(kubeconfig string, kubeContext string) (*kubernetes.Clientset,
 		if err != nil {
 			return nil, err
 		}
+		log.WithFields(log.Fields{"kubeconfig": kubeconfig, "auth": kubeAuthMethod(config)}).Infoln("Running out of the cluster")
+		config = withInMemoryAuthPersister(config)
+		if clientCertReloadInterval > 0 {
+			var reloader *clientCertReloader
+			config, reloader, err = withClientCertReload(config, func() (*tls.Certificate, error) {
+				latest, err := buildConfigFromFlags(kubeconfig, kubeContext)
+				if err != nil {
+					return nil, err
+				}
+				return loadClientCert(latest)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if reloader != nil {
+				go runClientCertReload(context.Background(), reloader, clientCertReloadInterval)
+			}
+		}
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
@@ -90,90 +172,455 @@ func buildConfigFromFlags(kubeconfig string, context string) (*rest.Config, erro
 
 func watchForPersistentVolumeClaims(ch chan struct{}, watchNamespace string) {
 
-	var factory informers.SharedInformerFactory
 	log.WithFields(log.Fields{"namespace": watchNamespace}).Infoln("Starting informer")
-	if watchNamespace == "" {
-		factory = informers.NewSharedInformerFactory(k8sClient, 0)
-	} else {
-		factory = informers.NewSharedInformerFactoryWithOptions(k8sClient, 0, informers.WithNamespace(watchNamespace))
+	options := []informers.SharedInformerOption{informers.WithTweakListOptions(tweakListOptions)}
+	if watchNamespace != "" {
+		options = append(options, informers.WithNamespace(watchNamespace))
 	}
+	factory := informers.NewSharedInformerFactoryWithOptions(k8sClient, informerResyncPeriod, options...)
 
 	informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	if err := informer.SetWatchErrorHandler(watchErrorHandler); err != nil {
+		log.Warnln("Could not set the watch error handler:", err)
+	}
 
 	efsClient, _ := newEFSClient()
 	ec2Client, _ := newEC2Client()
 
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			pvc := obj.(*corev1.PersistentVolumeClaim)
-			if !provisionedByAwsEfs(pvc) && !provisionedByAwsEbs(pvc) {
-				return
-			}
-			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("New PVC Added to Store")
+	backfills.start()
+	pvcInformers.add(ch, pvcInformer{store: informer.GetStore(), efsClient: efsClient, ec2Client: ec2Client})
 
-			volumeID, tags, err := processPersistentVolumeClaim(pvc)
-			if err != nil || len(tags) == 0 {
-				return
-			}
-			if provisionedByAwsEfs(pvc) {
-				efsClient.addEFSVolumeTags(volumeID, tags, *pvc.Spec.StorageClassName)
-			}
-			if provisionedByAwsEbs(pvc) {
-				ec2Client.addEBSVolumeTags(volumeID, tags, *pvc.Spec.StorageClassName)
-			}
+	informer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: isSupportedProvisioner,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				pvc := obj.(*corev1.PersistentVolumeClaim)
+				if getProvider(pvc) == "" {
+					return
+				}
+				log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeMode": getVolumeMode(pvc), "pod": getOwningPod(pvc)}).Infoln("New PVC Added to Store")
+				terminatingNamespaces.observePVC(pvc)
+				reconcileTraces.start(pvc, "add")
+				updateSkipReason(pvc)
+
+				volumeID, tags, err := processPersistentVolumeClaim(pvc)
+				removedTags := buildRemovedTags(pvc)
+				tracePVC(pvc, log.Fields{"volumeID": volumeID, "tags": tags, "removedTags": removedTags, "error": err}, "Computed the tags")
+				if err != nil || (len(tags) == 0 && len(removedTags) == 0) {
+					return
+				}
+				if len(removedTags) == 0 && isInPreviousState(volumeID, tags) {
+					log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Tags unchanged since the state snapshot")
+					managedVolumes.claim(volumeID, pvc.GetNamespace(), pvc.GetName(), tags)
+					managedVolumes.set(managedVolume{VolumeID: volumeID, Provider: getProvider(pvc), Namespace: pvc.GetNamespace(), PVC: pvc.GetName(), Tags: tags, Synced: true})
+					return
+				}
+				resync := func() {
+					if len(removedTags) == 0 && isBackfilled(pvc, volumeID, tags, efsClient, ec2Client) {
+						log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Volume already tagged, skipping the backfill")
+						promBackfillSkipped.Inc()
+						managedVolumes.claim(volumeID, pvc.GetNamespace(), pvc.GetName(), tags)
+						managedVolumes.set(managedVolume{VolumeID: volumeID, Provider: getProvider(pvc), Namespace: pvc.GetNamespace(), PVC: pvc.GetName(), Tags: tags, Synced: true})
+						return
+					}
+					logTagDiff(pvc, volumeID, nil, tags, removedTags)
+					tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+				}
+				if isBulkResync(pvc) && !inSyncWindow(time.Now()) {
+					log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Deferring resync until the next sync window")
+					deferredResyncs.add(pvc.GetNamespace(), pvc.GetName(), resync)
+					return
+				}
+				if isBulkResync(pvc) {
+					backfills.add(pvc.GetNamespace(), pvc.GetName(), resync)
+					return
+				}
+				resync()
+			},
+			UpdateFunc: func(old, new interface{}) {
+
+				newPVC := new.(*corev1.PersistentVolumeClaim)
+				oldPVC := old.(*corev1.PersistentVolumeClaim)
+				if newPVC.ResourceVersion == oldPVC.ResourceVersion {
+					log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("ResourceVersion are the same")
+					// Only the informer resync re-delivers a PVC without a change
+					if informerResyncPeriod > 0 && getProvider(newPVC) != "" {
+						scheduleInformerResync(informer.GetStore(), newPVC, efsClient, ec2Client)
+					}
+					return
+				}
+				if getProvider(newPVC) == "" {
+					return
+				}
+				if newPVC.Spec.VolumeName == "" {
+					log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolume not created yet")
+					return
+				}
+				if newPVC.GetDeletionTimestamp() != nil {
+					log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolumeClaim is being deleted")
+					return
+				}
+				reconcileTraces.start(newPVC, "update")
+				updateSkipReason(newPVC)
+
+				oldSyncAt, _ := getPVCAnnotation(oldPVC, "sync-at")
+				newSyncAt, _ := getPVCAnnotation(newPVC, "sync-at")
+				if oldSyncAt != newSyncAt {
+					log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln(annotationPrefix + "/sync-at annotation changed, forcing reconcile")
+				}
+
+				volumeID, tags, err := processPersistentVolumeClaim(newPVC)
+				tracePVC(newPVC, log.Fields{"volumeID": volumeID, "tags": tags, "error": err}, "Computed the tags")
+				if err != nil {
+					return
+				}
+				if isTagStateUnchanged(oldPVC, newPVC, volumeID, tags) {
+					tracePVC(newPVC, nil, "Tags and annotations unchanged since the last reconcile, skipping")
+					log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("Tags have not changed")
+					return
+				}
+				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln("Need to reconcile tags")
+				oldTags := buildTags(oldPVC)
+				deletedTags := buildRemovedTags(newPVC)
+				for k := range oldTags {
+					if _, ok := tags[k]; !ok && !containsString(deletedTags, k) {
+						deletedTags = append(deletedTags, k)
+					}
+				}
+				if previous, ok := managedVolumes.get(volumeID); ok {
+					oldTags = previous.Tags
+				}
+				logTagDiff(newPVC, volumeID, oldTags, tags, deletedTags)
+				tracePVC(newPVC, log.Fields{"oldTags": oldTags, "deletedTags": deletedTags}, "Reconciling the tags")
+				deferredResyncs.delete(newPVC.GetNamespace(), newPVC.GetName())
+				backfills.delete(newPVC.GetNamespace(), newPVC.GetName())
+				tagVolume(newPVC, volumeID, tags, deletedTags, efsClient, ec2Client)
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+				if !ok {
+					return
+				}
+				managedVolumes.deleteByPVC(pvc.GetNamespace(), pvc.GetName())
+				deadLetters.deleteByPVC(pvc.GetNamespace(), pvc.GetName())
+				deferredResyncs.delete(pvc.GetNamespace(), pvc.GetName())
+				exemptions.cancel(pvc.GetNamespace(), pvc.GetName())
+				observations.cancel(pvc.GetNamespace(), pvc.GetName())
+				consumerWaits.cancel(pvc.GetNamespace(), pvc.GetName())
+				consumers.delete(pvc.GetNamespace(), pvc.GetName())
+				tagExpiries.cancel(pvc.GetNamespace(), pvc.GetName())
+				skipReasons.delete(pvc.GetNamespace(), pvc.GetName())
+				reconcileTraces.delete(pvc.GetNamespace(), pvc.GetName())
+				backfills.delete(pvc.GetNamespace(), pvc.GetName())
+				informerResyncs.cancel(pvc.GetNamespace(), pvc.GetName())
+				guardrailDeferrals.cancel(pvc.GetNamespace(), pvc.GetName())
+			},
 		},
-		UpdateFunc: func(old, new interface{}) {
+	})
 
-			newPVC := new.(*corev1.PersistentVolumeClaim)
-			oldPVC := old.(*corev1.PersistentVolumeClaim)
-			if newPVC.ResourceVersion == oldPVC.ResourceVersion {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("ResourceVersion are the same")
-				return
-			}
-			if !provisionedByAwsEfs(newPVC) && !provisionedByAwsEbs(newPVC) {
-				return
-			}
-			if newPVC.Spec.VolumeName == "" {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolume not created yet")
-				return
-			}
-			if newPVC.GetDeletionTimestamp() != nil {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolumeClaim is being deleted")
-				return
-			}
+	runInformerWithListSlot(ch, watchNamespace, informer)
+}
 
-			log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln("Need to reconcile tags")
-			volumeID, tags, err := processPersistentVolumeClaim(newPVC)
-			if err != nil {
-				return
+// diffTags returns the sorted keys that were added or changed between oldTags and newTags
+func diffTags(oldTags map[string]string, newTags map[string]string) ([]string, []string) {
+	added := []string{}
+	changed := []string{}
+	for k, v := range newTags {
+		if oldValue, ok := oldTags[k]; !ok {
+			added = append(added, k)
+		} else if oldValue != v {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	return added, changed
+}
+
+// logTagDiff logs the tag keys that are being added, changed, and removed on the volume
+func logTagDiff(pvc *corev1.PersistentVolumeClaim, volumeID string, oldTags map[string]string, newTags map[string]string, removedTags []string) {
+	added, changed := diffTags(oldTags, newTags)
+	removed := append([]string{}, removedTags...)
+	sort.Strings(removed)
+	if len(added) == 0 && len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"namespace": pvc.GetNamespace(),
+		"pvc":       pvc.GetName(),
+		"volumeID":  volumeID,
+		"added":     added,
+		"changed":   changed,
+		"removed":   removed,
+	}).Infoln("Applying tag changes")
+}
+
+// isTagStateUnchanged returns true if the volume has already been reconciled with
+// the same tags and none of the remove, sync-at, targets, exempt-until,
+// wait-for-consumer, ttl-tags or debug-reconciles annotations have changed
+func isTagStateUnchanged(oldPVC *corev1.PersistentVolumeClaim, newPVC *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string) bool {
+	for _, annotation := range []string{"remove", "sync-at", "targets", "exempt-until", "wait-for-consumer", "ttl-tags", "debug-reconciles"} {
+		oldValue, _ := getPVCAnnotation(oldPVC, annotation)
+		newValue, _ := getPVCAnnotation(newPVC, annotation)
+		if oldValue != newValue {
+			return false
+		}
+	}
+	v, ok := managedVolumes.get(volumeID)
+	return ok && reflect.DeepEqual(v.Tags, tags)
+}
+
+// tagVolume records the desired tags of the PVC's volume and then applies them,
+// after the coalesce window if one is set
+func tagVolume(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string, efsClient *EFSClient, ec2Client *EBSClient) {
+	removedTags = withDeletionProtectionRemoval(pvc, volumeID, tags, removedTags)
+	if skipTerminatingNamespace(pvc.GetNamespace(), "tag") {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Namespace is terminating, abandoning the tag operation")
+		tracePVC(pvc, nil, "The namespace is terminating, not tagging the volume")
+		return
+	}
+	// The namespace's PVCs are resynced when it's resumed
+	if pausedNamespaces.isPaused(pvc.GetNamespace()) {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Namespace is paused, not tagging the volume")
+		tracePVC(pvc, nil, "The namespace is paused, not tagging the volume")
+		return
+	}
+	// The tags are enforced again when the exemption expires
+	if expiry, ok := getExemptionExpiry(pvc, time.Now()); ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "until": expiry}).Infoln("Volume is exempt from tag enforcement")
+		tracePVC(pvc, log.Fields{"until": expiry}, "Exempt, not tagging the volume")
+		exemptions.schedule(pvc.GetNamespace(), pvc.GetName(), expiry, func() {
+			updateSkipReason(pvc)
+			tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+		})
+		return
+	}
+	exemptions.cancel(pvc.GetNamespace(), pvc.GetName())
+
+	// The changes are only reported until the tags are enforced
+	if start, ok := getEnforcementStart(pvc.GetNamespace(), time.Now()); ok {
+		observeTagChange(pvc, volumeID, tags, removedTags, start, efsClient, ec2Client)
+		tracePVC(pvc, log.Fields{"enforceAfter": start}, "Observing, not tagging the volume")
+		observations.schedule(pvc.GetNamespace(), pvc.GetName(), start, func() {
+			updateSkipReason(pvc)
+			tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+		})
+		return
+	}
+	observations.cancel(pvc.GetNamespace(), pvc.GetName())
+
+	// The PVC is checked again until a pod uses it or the wait times out
+	if isWaitingForConsumer(pvc, time.Now()) {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Waiting for a pod to use the PVC before tagging")
+		tracePVC(pvc, nil, "Waiting for a pod to use the PVC, not tagging the volume")
+		next := time.Now().Add(consumerPollInterval)
+		if timeout := pvc.GetCreationTimestamp().Add(waitForConsumerTimeout); timeout.Before(next) {
+			next = timeout
+		}
+		consumerWaits.schedule(pvc.GetNamespace(), pvc.GetName(), next, func() {
+			resyncPVC(pvc.GetNamespace(), pvc.GetName(), efsClient, ec2Client)
+		})
+		return
+	}
+	consumerWaits.cancel(pvc.GetNamespace(), pvc.GetName())
+
+	// Only one of the PVCs bound to a multi-attach volume tags it
+	owner, conflict := managedVolumes.claim(volumeID, pvc.GetNamespace(), pvc.GetName(), tags)
+	if conflict {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "owner": owner}).Warnln("PVCs bound to the same volume want different tags")
+		recordEvent(pvc, corev1.EventTypeWarning, "ConflictingTags", fmt.Sprintf("Volume %s is shared with other PVCs that want different tags, the tags of %s are used", volumeID, owner))
+	}
+	if owner != pvc.GetNamespace()+"/"+pvc.GetName() {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "owner": owner}).Debugln("Volume is tagged by another PVC")
+		tracePVC(pvc, log.Fields{"owner": owner}, "The volume is tagged by another PVC, not tagging it")
+		return
+	}
+
+	// The PVC is synced again when its next ttl-tags tag expires
+	if expiry, ok := nextTagExpiry(pvc, time.Now()); ok {
+		tagExpiries.schedule(pvc.GetNamespace(), pvc.GetName(), expiry, func() {
+			resyncPVC(pvc.GetNamespace(), pvc.GetName(), efsClient, ec2Client)
+		})
+	} else {
+		tagExpiries.cancel(pvc.GetNamespace(), pvc.GetName())
+	}
+
+	// A policy change can't re-tag every volume at once
+	if limit, nextPass := mutationGuardrails.allow(pvc.GetNamespace(), volumeID, time.Now()); limit != "" {
+		deferMutation(pvc, volumeID, limit, nextPass, efsClient, ec2Client)
+		return
+	}
+	guardrailDeferrals.cancel(pvc.GetNamespace(), pvc.GetName())
+
+	v := managedVolume{VolumeID: volumeID, Provider: getProvider(pvc), Namespace: pvc.GetNamespace(), PVC: pvc.GetName(), Region: getPVCRegion(pvc), Tags: tags}
+	managedVolumes.set(v)
+
+	tracePVC(pvc, log.Fields{"volumeID": volumeID, "tags": tags, "removedTags": removedTags, "coalesceWindow": coalesceWindow}, "Tagging the volume")
+	if coalesceWindow > 0 {
+		pendingTagOperations.add(pvc, volumeID, tags, removedTags, func(pvc *corev1.PersistentVolumeClaim, tags map[string]string, removedTags []string) {
+			applyTags(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+		})
+		return
+	}
+	applyTags(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+}
+
+// applyTags adds the tags to, and deletes the removedTags from, the PVC's targets
+func applyTags(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string, efsClient *EFSClient, ec2Client *EBSClient) {
+	// The coalesced operations are applied after the window, when the namespace may be terminating
+	if skipTerminatingNamespace(pvc.GetNamespace(), "tag") {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Namespace is terminating, abandoning the tag operation")
+		return
+	}
+	// The namespace may have been paused during the coalesce window
+	if pausedNamespaces.isPaused(pvc.GetNamespace()) {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Namespace is paused, abandoning the tag operation")
+		return
+	}
+	v := managedVolume{VolumeID: volumeID, Provider: getProvider(pvc), Namespace: pvc.GetNamespace(), PVC: pvc.GetName(), Region: getPVCRegion(pvc), Tags: tags}
+	efsClient, ec2Client = regionalClients(v.Region, efsClient, ec2Client)
+	storageclass := getStorageClassName(pvc)
+	targets := getTargets(pvc)
+	tagJournal.begin(volumeID, journalEntry{Namespace: v.Namespace, PVC: v.PVC, Tags: tags, RemovedTags: removedTags, StartedAt: time.Now()})
+	runTagOperation(v, guardTagOperation(func() error {
+		defer apiCallOwners.attribute(v.Namespace, volumeID)()
+		switch v.Provider {
+		case providerAWSEFS:
+			ids := []string{}
+			if containsString(targets, targetVolume) {
+				ids = append(ids, volumeID)
+			}
+			if containsString(targets, targetFileSystem) {
+				fileSystemID, err := getEFSFileSystemID(pvc)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, fileSystemID)
+				defer apiCallOwners.attribute(v.Namespace, fileSystemID)()
 			}
-			if len(tags) > 0 {
-				if provisionedByAwsEfs(newPVC) {
-					efsClient.addEFSVolumeTags(volumeID, tags, *newPVC.Spec.StorageClassName)
+			for _, id := range ids {
+				if clusterName != "" {
+					existing, err := efsClient.getEFSVolumeTags(id)
+					if err != nil {
+						return err
+					}
+					if err := checkOwnership(pvc, id, existing); err != nil {
+						return err
+					}
 				}
-				if provisionedByAwsEbs(newPVC) {
-					ec2Client.addEBSVolumeTags(volumeID, tags, *newPVC.Spec.StorageClassName)
+				if len(tags) > 0 {
+					if err := efsClient.addEFSVolumeTags(id, tags, storageclass); err != nil {
+						return err
+					}
+				}
+				if len(removedTags) > 0 {
+					if err := efsClient.deleteEFSVolumeTags(id, removedTags, storageclass); err != nil {
+						return err
+					}
 				}
 			}
-			oldTags := buildTags(oldPVC)
-			var deletedTags []string
-			for k := range oldTags {
-				if _, ok := tags[k]; !ok {
-					deletedTags = append(deletedTags, k)
+		case providerAWSEBS:
+			if containsString(targets, targetVolume) {
+				if clusterName != "" {
+					existing, err := ec2Client.getEBSVolumeTags(volumeID)
+					if err != nil {
+						return err
+					}
+					if err := checkOwnership(pvc, volumeID, existing); err != nil {
+						return err
+					}
+				}
+				if len(tags) > 0 {
+					if err := ec2Client.addEBSVolumeTags(volumeID, tags, storageclass); err != nil {
+						return err
+					}
+				}
+				if len(removedTags) > 0 {
+					if err := ec2Client.deleteEBSVolumeTags(volumeID, removedTags, storageclass); err != nil {
+						return err
+					}
 				}
 			}
-			if len(deletedTags) > 0 {
-				if provisionedByAwsEfs(newPVC) {
-					efsClient.deleteEFSVolumeTags(volumeID, deletedTags, *oldPVC.Spec.StorageClassName)
+			// Without the volume target the volume itself is left untouched,
+			// e.g. when its tags are managed by IaC but not its snapshots'
+			if containsString(targets, targetSnapshots) && (len(tags) > 0 || len(removedTags) > 0) {
+				if err := ec2Client.syncSnapshotTags(volumeID, tags, removedTags); err != nil {
+					return err
 				}
-				if provisionedByAwsEbs(newPVC) {
-					ec2Client.deleteEBSVolumeTags(volumeID, deletedTags, *oldPVC.Spec.StorageClassName)
+			} else if snapshotTags, removedSnapshotTags := drSnapshotTags(tags, removedTags); len(snapshotTags) > 0 || len(removedSnapshotTags) > 0 {
+				// DR tooling selects the snapshots to copy with the DR tags
+				if err := ec2Client.syncSnapshotTags(volumeID, snapshotTags, removedSnapshotTags); err != nil {
+					return err
 				}
 			}
-		},
-	})
+		}
+		return nil
+	}))
+}
+
+// getTargets returns the resources to tag for the PVC from the targets
+// annotation, or the default targets if it isn't set
+func getTargets(pvc *corev1.PersistentVolumeClaim) []string {
+	annotation, ok := getPVCAnnotation(pvc, "targets")
+	if !ok {
+		return defaultTargets
+	}
+	targets := []string{}
+	for _, target := range strings.Split(annotation, ",") {
+		target = strings.TrimSpace(target)
+		if !isValidTarget(target) {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "target": target}).Warnln("Skipping invalid target")
+			continue
+		}
+		if !containsString(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
 
-	informer.Run(ch)
+func isValidTarget(target string) bool {
+	return target == targetVolume || target == targetSnapshots || target == targetFileSystem
+}
+
+// getEFSFileSystemID returns the ID of the file system of the PVC's EFS access point
+func getEFSFileSystemID(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
+	if err != nil {
+		return "", err
+	}
+	if pv.Spec.CSI == nil {
+		return "", errors.New("cannot get the EFS CSI volume handle")
+	}
+	re := regexp.MustCompile(regexpEFSFileSystemID)
+	matches := re.FindStringSubmatch(pv.Spec.CSI.VolumeHandle)
+	if len(matches) <= 1 {
+		return "", fmt.Errorf("cannot parse EFS file system ID from %q", pv.Spec.CSI.VolumeHandle)
+	}
+	return matches[1], nil
+}
+
+// tweakListOptions pushes the label and field selectors down to the API server
+// so that PVCs that don't match are never sent to the informer. It also tunes
+// the list/watch calls for clusters with a large number of PVCs.
+func tweakListOptions(options *metav1.ListOptions) {
+	options.LabelSelector = pvcLabelSelector
+	options.FieldSelector = pvcFieldSelector
+	if options.Watch {
+		options.AllowWatchBookmarks = true
+		return
+	}
+	if listPageSize > 0 {
+		options.Limit = listPageSize
+	}
+	// resourceVersion=0 is served from the API server's watch cache, which
+	// ignores pagination. Listing from etcd instead honors the page size.
+	if !listFromWatchCache && options.ResourceVersion == "0" {
+		options.ResourceVersion = ""
+	}
 }
 
 func parseAWSEBSVolumeID(k8sVolumeID string) string {
@@ -197,77 +644,314 @@ func parseAWSEFSVolumeID(k8sVolumeID string) string {
 }
 
 func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	return buildTagsWithProvenance(pvc, nil)
+}
+
+// buildTagsWithProvenance builds the tags of the PVC and, when provenance is
+// not nil, records in it where each of the returned tags was set from
+func buildTagsWithProvenance(pvc *corev1.PersistentVolumeClaim, provenance map[string]string) map[string]string {
 
 	tags := map[string]string{}
-	customTags := map[string]string{}
-	var tagString string
-	var legacyTagString string
 
-	annotations := pvc.GetAnnotations()
 	// Skip if the annotation says to ignore this PVC
-	if _, ok := annotations[annotationPrefix+"/ignore"]; ok {
-		log.Debugln(annotationPrefix + "/ignore annotation is set")
-		promIgnoredTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
-		promIgnoredLegacyTotal.Inc()
-		return renderTagTemplates(pvc, tags)
-	}
-	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
-	if annotationPrefix == defaultAnnotationPrefix {
-		if _, ok := annotations[legacyAnnotationPrefix+"/ignore"]; ok {
-			log.Debugln(legacyAnnotationPrefix + "/ignore annotation is set")
+	if isIgnored(pvc) {
+		if !isPlaygroundPVC(pvc) {
 			promIgnoredTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
 			promIgnoredLegacyTotal.Inc()
-			return renderTagTemplates(pvc, tags)
 		}
+		return renderTagTemplates(pvc, tags)
 	}
 
 	// Set the default tags
-	for k, v := range defaultTags {
-		if !isValidTagName(k) {
-			if !allowAllTags {
-				log.Warnln(k, "is a restricted tag. Skipping...")
-				promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
-				promInvalidTagsLegacyTotal.Inc()
-				continue
-			} else {
-				log.Warnln(k, "is a restricted tag but still allowing it to be set...")
-			}
+	if !isIgnoringDefaultTags(pvc) {
+		mergeValidTags(pvc, tags, defaultTags)
+		recordProvenance(provenance, tags, defaultTags, "default-tags")
+		if volumeType, typeTags := getVolumeTypeDefaultTags(pvc); len(typeTags) > 0 {
+			mergeValidTags(pvc, tags, typeTags)
+			recordProvenance(provenance, tags, typeTags, "volume-type-default-tags/"+volumeType)
 		}
-		tags[k] = v
 	}
 
-	var legacyOk bool
-	tagString, ok := annotations[annotationPrefix+"/tags"]
-	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
-	if annotationPrefix == defaultAnnotationPrefix {
-		legacyTagString, legacyOk = annotations[legacyAnnotationPrefix+"/tags"]
-	} else {
-		legacyOk = false
-		legacyTagString = ""
+	if plan, ok := getPVCAnnotation(pvc, "backup-plan"); ok {
+		setBackupPlanTag(pvc, tags, plan)
+		recordProvenance(provenance, tags, map[string]string{backupPlanTagKey: plan}, "backup-plan")
+	}
+
+	for _, name := range tagSources {
+		source, ok := getTagSource(name)
+		if !ok {
+			continue
+		}
+		sourceTags := source.Compute(pvc)
+		mergeValidTags(pvc, tags, sourceTags)
+		recordProvenance(provenance, tags, sourceTags, name)
+	}
+
+	// The replace annotation overwrites any tag set above, including the default tags
+	if replaceString, ok := getPVCAnnotation(pvc, "replace"); ok {
+		replaceTags, errs := parseTags(replaceString)
+		reportInvalidTags(pvc, errs)
+		mergeValidTags(pvc, tags, replaceTags)
+		recordProvenance(provenance, tags, replaceTags, "replace")
+	}
+
+	// The Name tag is restricted, it can only be set from a template once opted in
+	if nameTagTemplate != "" {
+		nameTemplate, nameSource := nameTagTemplate, "name-tag-template"
+		if annotation, ok := getPVCAnnotation(pvc, "name"); ok && annotation != "" {
+			nameTemplate, nameSource = annotation, "name"
+		}
+		tags[nameTagKey] = nameTemplate
+		recordProvenance(provenance, tags, map[string]string{nameTagKey: nameTemplate}, nameSource)
+	}
+
+	// Never set a tag that has been asked to be removed or ignored
+	for _, k := range buildRemovedTags(pvc) {
+		delete(tags, k)
+	}
+	for _, k := range getIgnoredKeys(pvc) {
+		delete(tags, k)
 	}
-	if !ok && !legacyOk {
+
+	// The ownership tag can't be overwritten from the PVC
+	if clusterName != "" {
+		tags[managedByTagKey] = managedByTagValue()
+		recordProvenance(provenance, tags, map[string]string{managedByTagKey: tags[managedByTagKey]}, "cluster-name")
+	}
+
+	tags = renderTagTemplates(pvc, tags)
+	filterAllowedValues(pvc, tags)
+	filterTagPolicy(pvc, tags)
+	for k := range provenance {
+		if _, ok := tags[k]; !ok {
+			delete(provenance, k)
+		}
+	}
+	return tags
+}
+
+// recordProvenance records source as the provenance of the keys of newTags
+// that made it into tags, i.e. that were valid. It's a no-op for a nil provenance.
+func recordProvenance(provenance map[string]string, tags map[string]string, newTags map[string]string, source string) {
+	if provenance == nil {
+		return
+	}
+	for k, v := range newTags {
+		if current, ok := tags[k]; ok && current == v {
+			provenance[k] = source
+		}
+	}
+}
+
+// buildAnnotationTags returns the tags from the PVC's tags annotation and its
+// alias annotations
+func buildAnnotationTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	aliasTags := buildAliasAnnotationTags(pvc)
+	tagString, ok := getPVCAnnotation(pvc, "tags")
+	if !ok {
 		log.Debugln("Does not have " + annotationPrefix + "/tags or legacy " + legacyAnnotationPrefix + "/tags annotation")
-		return renderTagTemplates(pvc, tags)
-	} else if ok && legacyOk {
-		log.Warnln("Has both " + annotationPrefix + "/tags AND legacy " + legacyAnnotationPrefix + "/tags annotation. Using newer " + annotationPrefix + "/tags annotation")
-	} else if legacyOk && !ok {
-		tagString = legacyTagString
+		return aliasTags
+	}
+	customTags, errs := parseTags(tagString)
+	reportInvalidTags(pvc, errs)
+	// The tags annotation takes precedence over the alias annotations
+	for k, v := range customTags {
+		aliasTags[k] = v
+	}
+	return aliasTags
+}
+
+// buildPVAnnotationTags returns the tags from the tags annotation of the PV
+// bound to the PVC, e.g. set by a storage admin on a statically provisioned PV
+func buildPVAnnotationTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if pvc.Spec.VolumeName == "" {
+		return nil
 	}
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Get PV from kubernetes cluster error:", err)
+		return nil
+	}
+	tagString, ok := pv.GetAnnotations()[annotationPrefix+"/tags"]
+	if !ok {
+		return nil
+	}
+	pvTags, errs := parseTags(tagString)
+	reportInvalidTags(pvc, errs)
+	return pvTags
+}
+
+// buildLabelTags returns the tags from the PVC's labels that use the annotation
+// prefix, e.g. the label k8s-pvc-tagger/team=payments sets the tag team=payments
+func buildLabelTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	tags := map[string]string{}
+	for k, v := range pvc.GetLabels() {
+		if !strings.HasPrefix(k, annotationPrefix+"/") {
+			continue
+		}
+		key := labelValueReplacer.Replace(strings.TrimPrefix(k, annotationPrefix+"/"))
+		tags[key] = labelValueReplacer.Replace(v)
+	}
+	return tags
+}
+
+// newLabelValueReplacer builds the replacer used to convert label keys and
+// values, which have a limited character set, into tag keys and values
+func newLabelValueReplacer(replacements map[string]string) *strings.Replacer {
+	var olds []string
+	for old := range replacements {
+		olds = append(olds, old)
+	}
+	// Prefer the longest match when replacements overlap
+	sort.Slice(olds, func(i, j int) bool {
+		if len(olds[i]) != len(olds[j]) {
+			return len(olds[i]) > len(olds[j])
+		}
+		return olds[i] < olds[j]
+	})
+	var pairs []string
+	for _, old := range olds {
+		pairs = append(pairs, old, replacements[old])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// buildRemovedTags returns the tag keys from the remove annotation that should
+// be deleted from the volume
+func buildRemovedTags(pvc *corev1.PersistentVolumeClaim) []string {
+	if isIgnored(pvc) {
+		return nil
+	}
+	// The expired tags of the ttl-tags annotation are removed too
+	removed := expiredTagKeys(pvc, time.Now())
+	removeString, ok := getPVCAnnotation(pvc, "remove")
+	if !ok {
+		return removed
+	}
+
+	var keys []string
 	if tagFormat == "csv" {
-		customTags = parseCsv(tagString)
+		for _, k := range strings.Split(removeString, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, k)
+			}
+		}
 	} else {
-		err := json.Unmarshal([]byte(tagString), &customTags)
+		err := json.Unmarshal([]byte(removeString), &keys)
 		if err != nil {
 			log.Errorln("Failed to Unmarshal JSON:", err)
+			reportInvalidTags(pvc, []error{fmt.Errorf("%s/remove annotation is not a valid json list of keys: %v", annotationPrefix, err)})
+			return removed
 		}
 	}
 
-	for k, v := range customTags {
+	var errs []error
+	for _, k := range keys {
+		if !isValidTagName(k) && !allowAllTags {
+			errs = append(errs, fmt.Errorf("tag %q is a restricted tag and cannot be removed", k))
+			continue
+		}
+		if k == managedByTagKey && clusterName != "" {
+			errs = append(errs, fmt.Errorf("tag %q is the ownership tag and cannot be removed", k))
+			continue
+		}
+		if k == tagsHashKey {
+			errs = append(errs, fmt.Errorf("tag %q is the tags hash tag and cannot be removed", k))
+			continue
+		}
+		if !containsString(removed, k) {
+			removed = append(removed, k)
+		}
+	}
+	reportInvalidTags(pvc, errs)
+	return removed
+}
+
+// parseTags parses a tag annotation in the configured tag format. Values that
+// are not strings are skipped and returned as errors.
+func parseTags(tagString string) (map[string]string, []error) {
+	tags := map[string]string{}
+	if len(tagString) > maxAnnotationSize {
+		return tags, []error{fmt.Errorf("annotation is %d bytes, more than the limit of %d bytes", len(tagString), maxAnnotationSize)}
+	}
+	if tagFormat == "csv" {
+		return limitTags(parseCsv(tagString), nil)
+	}
+
+	var raw map[string]interface{}
+	err := json.Unmarshal([]byte(tagString), &raw)
+	if err != nil {
+		log.Errorln("Failed to Unmarshal JSON:", err)
+		return tags, []error{fmt.Errorf("annotation is not a valid json object of key/value pairs: %v", err)}
+	}
+
+	var errs []error
+	for k, v := range raw {
+		switch value := v.(type) {
+		case string:
+			tags[k] = value
+		case map[string]interface{}:
+			errs = append(errs, fmt.Errorf("tag %q has a nested object value, which is not supported", k))
+		case []interface{}:
+			errs = append(errs, fmt.Errorf("tag %q has a list value, which is not supported", k))
+		default:
+			errs = append(errs, fmt.Errorf("tag %q value must be a string, got %v", k, v))
+		}
+	}
+	return limitTags(tags, errs)
+}
+
+// limitTags removes the values that are too long and the tags over the limit
+// of tags per annotation, in key order so the same tags are always kept
+func limitTags(tags map[string]string, errs []error) (map[string]string, []error) {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if utf8.RuneCountInString(v) > maxAnnotationValueLen {
+			errs = append(errs, fmt.Errorf("tag %q value is longer than the limit of %d characters", k, maxAnnotationValueLen))
+			delete(tags, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) > maxAnnotationTags {
+		sort.Strings(keys)
+		dropped := keys[maxAnnotationTags:]
+		for _, k := range dropped {
+			delete(tags, k)
+		}
+		errs = append(errs, fmt.Errorf("annotation has %d tags, more than the limit of %d tags, ignoring %s", len(keys), maxAnnotationTags, strings.Join(dropped, ", ")))
+	}
+	return tags, errs
+}
+
+// validateTag checks the tag against the AWS tag restrictions
+func validateTag(key string, value string) error {
+	if len(key) == 0 {
+		return errors.New("tag key cannot be empty")
+	}
+	if utf8.RuneCountInString(key) > maxTagKeyLength {
+		return fmt.Errorf("tag %q key is longer than %d characters", key, maxTagKeyLength)
+	}
+	if utf8.RuneCountInString(value) > maxTagValueLength {
+		return fmt.Errorf("tag %q value is longer than %d characters", key, maxTagValueLength)
+	}
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return fmt.Errorf("tag %q uses the reserved aws: prefix", key)
+	}
+	return nil
+}
+
+// mergeValidTags copies newTags into tags, skipping invalid tags and restricted tags unless allowAllTags is set
+func mergeValidTags(pvc *corev1.PersistentVolumeClaim, tags map[string]string, newTags map[string]string) {
+	var errs []error
+	for k, v := range newTags {
+		if err := validateTag(k, v); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 		if !isValidTagName(k) {
 			if !allowAllTags {
-				log.Warnln(k, "is a restricted tag. Skipping...")
-				promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
-				promInvalidTagsLegacyTotal.Inc()
+				errs = append(errs, fmt.Errorf("tag %q is a restricted tag", k))
 				continue
 			} else {
 				log.Warnln(k, "is a restricted tag but still allowing it to be set...")
@@ -275,8 +959,113 @@ func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
 		}
 		tags[k] = v
 	}
+	reportInvalidTags(pvc, errs)
+}
+
+// reportInvalidTags logs the validation errors and records them as an Event on the PVC
+func reportInvalidTags(pvc *corev1.PersistentVolumeClaim, errs []error) {
+	if len(errs) == 0 || collectPlaygroundErrors(pvc, errs) {
+		return
+	}
+	var messages []string
+	for _, err := range errs {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Skipping invalid tag:", err)
+		promInvalidTagsTotal.With(prometheus.Labels{"storageclass": getStorageClassName(pvc)}).Inc()
+		promInvalidTagsLegacyTotal.Inc()
+		messages = append(messages, err.Error())
+	}
+	sort.Strings(messages)
+	recordEvent(pvc, corev1.EventTypeWarning, "InvalidTags", strings.Join(messages, "; "))
+}
+
+// recordEvent records an Event on the object if an event recorder has been configured
+func recordEvent(object runtime.Object, eventtype string, reason string, message string) {
+	if eventRecorder == nil {
+		return
+	}
+	eventRecorder.Event(object, eventtype, reason, message)
+}
+
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(terminatingNamespaceEventSink{&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")}})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-pvc-tagger"})
+}
+
+// getIgnoreAnnotation returns the value of the PVC's ignore annotation
+func getIgnoreAnnotation(pvc *corev1.PersistentVolumeClaim) (string, bool) {
+	value, ok := getPVCAnnotation(pvc, "ignore")
+	if ok {
+		log.Debugln("ignore annotation is set")
+	}
+	return value, ok
+}
+
+// isIgnored returns true if the PVC must not be tagged at all. Any value of the
+// ignore annotation, other than the ones to ignore the default tags or specific
+// keys, ignores the PVC.
+func isIgnored(pvc *corev1.PersistentVolumeClaim) bool {
+	value, ok := getIgnoreAnnotation(pvc)
+	if !ok {
+		return false
+	}
+	return value != ignoreValueDefaultTags && !strings.HasPrefix(value, ignoreValueKeysPrefix)
+}
+
+// isIgnoringDefaultTags returns true if the PVC opted out of the default tags
+func isIgnoringDefaultTags(pvc *corev1.PersistentVolumeClaim) bool {
+	value, ok := getIgnoreAnnotation(pvc)
+	return ok && value == ignoreValueDefaultTags
+}
 
-	return renderTagTemplates(pvc, tags)
+// getIgnoredKeys returns the tag keys the PVC opted out of
+func getIgnoredKeys(pvc *corev1.PersistentVolumeClaim) []string {
+	value, ok := getIgnoreAnnotation(pvc)
+	if !ok || !strings.HasPrefix(value, ignoreValueKeysPrefix) {
+		return nil
+	}
+	keys := []string{}
+	for _, k := range strings.Split(strings.TrimPrefix(value, ignoreValueKeysPrefix), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// setBackupPlanTag sets the backup selection tag used by AWS Backup / DLM policies
+// from the backup-plan annotation of the PVC or its StorageClass, if the plan is
+// in the list of allowed backup plans
+func setBackupPlanTag(pvc *corev1.PersistentVolumeClaim, tags map[string]string, plan string) {
+	if !isAllowedBackupPlan(plan) {
+		reportInvalidTags(pvc, []error{fmt.Errorf("backup plan %q is not an allowed backup plan", plan)})
+		return
+	}
+	tags[backupPlanTagKey] = plan
+}
+
+// isAllowedBackupPlan returns whether the plan is allowed, every plan is
+// allowed when the list of allowed backup plans is empty
+func isAllowedBackupPlan(plan string) bool {
+	return len(allowedBackupPlans) == 0 || containsString(allowedBackupPlans, plan)
+}
+
+// getStorageClassBackupPlan returns the backup plan set on the PVC's StorageClass, if any
+func getStorageClassBackupPlan(pvc *corev1.PersistentVolumeClaim) string {
+	return getStorageClassAnnotations(pvc)[annotationPrefix+"/backup-plan"]
+}
+
+// getStorageClassAnnotations returns the annotations of the PVC's StorageClass
+func getStorageClassAnnotations(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return nil
+	}
+	sc, err := k8sClient.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		log.WithFields(log.Fields{"storageclass": *pvc.Spec.StorageClassName}).Debugln("Get StorageClass from kubernetes cluster error:", err)
+		return nil
+	}
+	return sc.GetAnnotations()
 }
 
 func renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]string) map[string]string {
@@ -286,24 +1075,114 @@ func renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]strin
 		Namespace:   pvc.GetNamespace(),
 		Labels:      pvc.GetLabels(),
 		Annotations: pvc.GetAnnotations(),
+		VolumeMode:  getVolumeMode(pvc),
+		Pod:         getOwningPod(pvc),
+		ClusterName: clusterName,
+	}
+	var pod *corev1.Pod
+	if nodeTemplateVars || isWaitForConsumerEnabled(pvc) {
+		pod = getPVCPod(pvc)
+	}
+	if pod != nil {
+		tplData.OwnerKind, tplData.Owner = getPodOwner(pod)
+	}
+	if nodeTemplateVars {
+		tplData.Node, tplData.NodeLabels = getPVCNode(pvc, pod)
+		tplData.NodePool = getNodePool(tplData.NodeLabels)
+		tplData.InstanceType = getNodeLabel(tplData.NodeLabels, instanceTypeLabels)
+		tplData.Zone = getNodeLabel(tplData.NodeLabels, zoneLabels)
+		tplData.CapacityType = getCapacityType(tplData.NodeLabels)
+	}
+	if volumeTemplateVars {
+		vars := getPVCVolumeVars(pvc)
+		tplData.VolumeHandle = vars.Handle
+		tplData.VolumeAttributes = vars.Attributes
+		tplData.AccessPointID = vars.AccessPointID
+		tplData.AccessPointPath = vars.AccessPointPath
+	}
+	if ebsTemplateVars {
+		vars := getPVCEBSVolumeVars(pvc)
+		tplData.Encrypted = vars.Encrypted
+		tplData.KMSKeyID = vars.KMSKeyID
+		tplData.KMSKeyAlias = vars.KMSKeyAlias
+		tplData.VolumeType = vars.VolumeType
+		tplData.Iops = vars.Iops
+		tplData.Throughput = vars.Throughput
 	}
 
+	key := tagCacheKey(tplData, tags)
+	if cached, ok := renderedTags.get(key); ok {
+		return cached
+	}
+
+	// The looked up values can change without the PVC changing, so they aren't cached
+	lookedUp := false
+	funcs := template.FuncMap{
+		"lookup": func(url string, key string) (string, error) {
+			lookedUp = true
+			return lookup(url, key)
+		},
+	}
 	for k, v := range tags {
-		tmpl, err := template.New("tag").Parse(v)
+		tmpl, err := template.New("tag").Funcs(funcs).Parse(v)
 		if err != nil {
 			continue
 		}
 		buf := new(bytes.Buffer)
 		err = tmpl.Execute(buf, tplData)
+		if errors.Is(err, errLookupFailed) {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "key": k}).Warnln("Not setting the tag:", err)
+			delete(tags, k)
+			continue
+		}
 		if err != nil {
 			continue
 		}
 		tags[k] = buf.String()
 	}
 
+	if !lookedUp {
+		renderedTags.add(key, tags)
+	}
 	return tags
 }
 
+// getStorageClassName returns the PVC's StorageClass name or an empty string if it is not set
+func getStorageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
+
+// getVolumeMode returns the PVC's volumeMode, defaulting to Filesystem when it is not set
+func getVolumeMode(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.VolumeMode == nil {
+		return string(corev1.PersistentVolumeFilesystem)
+	}
+	return string(*pvc.Spec.VolumeMode)
+}
+
+// getOwningPod returns the name of the Pod that owns the PVC. This is only set
+// for PVCs created from a generic ephemeral volume.
+func getOwningPod(pvc *corev1.PersistentVolumeClaim) string {
+	for _, owner := range pvc.GetOwnerReferences() {
+		if owner.Kind == "Pod" && owner.Controller != nil && *owner.Controller {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func isValidTagName(name string) bool {
 	if strings.HasPrefix(strings.ToLower(name), "kubernetes.io") {
 		return false
@@ -316,6 +1195,20 @@ func isValidTagName(name string) bool {
 	return true
 }
 
+// getProvider returns the provider that manages the PVC's volume
+func getProvider(pvc *corev1.PersistentVolumeClaim) string {
+	if provisionedByAwsEfs(pvc) {
+		return providerAWSEFS
+	}
+	if provisionedByAwsEbs(pvc) {
+		return providerAWSEBS
+	}
+	if rule := getVolumeIDRule(pvc); rule != nil {
+		return rule.Provider
+	}
+	return ""
+}
+
 func provisionedByAwsEfs(pvc *corev1.PersistentVolumeClaim) bool {
 	annotations := pvc.GetAnnotations()
 	if provisionedBy, ok := annotations["volume.beta.kubernetes.io/storage-provisioner"]; !ok {
@@ -328,6 +1221,18 @@ func provisionedByAwsEfs(pvc *corev1.PersistentVolumeClaim) bool {
 	return false
 }
 
+// isSupportedProvisioner filters out the PVCs of the ignored provisioners, e.g.
+// host path, local or NFS volumes, before they reach the event handlers
+func isSupportedProvisioner(obj interface{}) bool {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		// Let the delete handler deal with the tombstones
+		return true
+	}
+	provisionedBy := pvc.GetAnnotations()["volume.beta.kubernetes.io/storage-provisioner"]
+	return !containsString(ignoredProvisioners, provisionedBy)
+}
+
 func provisionedByAwsEbs(pvc *corev1.PersistentVolumeClaim) bool {
 	annotations := pvc.GetAnnotations()
 	if provisionedBy, ok := annotations["volume.beta.kubernetes.io/storage-provisioner"]; !ok {
@@ -345,14 +1250,22 @@ func provisionedByAwsEbs(pvc *corev1.PersistentVolumeClaim) bool {
 
 func processPersistentVolumeClaim(pvc *corev1.PersistentVolumeClaim) (string, map[string]string, error) {
 	tags := buildTags(pvc)
+	if _, ok := tags[backupPlanTagKey]; !ok && !isIgnored(pvc) {
+		if plan := getStorageClassBackupPlan(pvc); plan != "" {
+			setBackupPlanTag(pvc, tags, plan)
+		}
+	}
 
 	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "tags": tags}).Debugln("PVC Tags")
 
-	pv, err := k8sClient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
 	if err != nil {
 		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Get PV from kubernetes cluster error:", err)
 		return "", nil, err
 	}
+	if !isIgnored(pvc) {
+		setReclaimPolicyTag(tags, pv)
+	}
 
 	var volumeID string
 	annotations := pvc.GetAnnotations()
@@ -369,23 +1282,52 @@ func processPersistentVolumeClaim(pvc *corev1.PersistentVolumeClaim) (string, ma
 		volumeID = parseAWSEFSVolumeID(pv.Spec.PersistentVolumeSource.CSI.VolumeHandle)
 	} else if provisionedBy == "kubernetes.io/aws-ebs" {
 		volumeID = parseAWSEBSVolumeID(pv.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID)
+	} else if rule := getVolumeIDRule(pvc); rule != nil && pv.Spec.CSI != nil {
+		volumeID = rule.resolve(pv.Spec.CSI.VolumeHandle)
 	}
 	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("parsed volumeID:", volumeID)
 	if len(volumeID) == 0 {
 		log.Errorf("Cannot parse VolumeID")
 		return "", nil, errors.New("cannot parse VolumeID")
 	}
+	setDRTags(pvc, volumeID, tags)
+	if err := setDeletionProtectionTag(pvc, tags); err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Warnln("Not reconciling the volume:", err)
+		return "", nil, err
+	}
+	setTagsHashTag(tags)
 
 	return volumeID, tags, nil
 }
 
-func getCurrentNamespace() string {
+// getCurrentNamespace returns the namespace the tagger runs in, from the
+// POD_NAMESPACE downward API variable, the service account or the namespace
+// of the kubeconfig context when running out of the cluster
+func getCurrentNamespace(kubeconfig string, kubeContext string) string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
 	// Fall back to the namespace associated with the service account token, if available
-	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+	if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
 		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
 			return ns
 		}
 	}
 
-	return ""
+	if kubeconfig == "" {
+		kubeconfig = DefaultKubeConfigFile
+	}
+	if _, err := os.Stat(kubeconfig); err != nil {
+		return ""
+	}
+	ns, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{
+			CurrentContext: kubeContext,
+		}).Namespace()
+	if err != nil {
+		return ""
+	}
+	return ns
 }
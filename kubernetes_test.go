@@ -20,11 +20,15 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 var dummyStorageClassName string = "fakeName"
@@ -267,6 +271,27 @@ func Test_buildTags(t *testing.T) {
 			annotations:  map[string]string{"k8s-pvc-tagger/ignore": "exists", "k8s-pvc-tagger/tags": "{\"foo\": \"bar\"}"},
 			want:         map[string]string{},
 		},
+		{
+			name:         "ignore annotation set to default-tags",
+			defaultTags:  map[string]string{"foo": "bar"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/ignore": "default-tags", "k8s-pvc-tagger/tags": "{\"something\": \"else\"}"},
+			want:         map[string]string{"something": "else"},
+		},
+		{
+			name:         "ignore annotation set to keys",
+			defaultTags:  map[string]string{"foo": "bar", "cost-center": "1234", "owner": "me"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/ignore": "keys: owner, something", "k8s-pvc-tagger/tags": "{\"something\": \"else\"}"},
+			want:         map[string]string{"foo": "bar", "cost-center": "1234"},
+		},
+		{
+			name:         "ignore annotation set to keys legacy",
+			defaultTags:  map[string]string{"foo": "bar", "owner": "me"},
+			allowAllTags: false,
+			annotations:  map[string]string{"aws-ebs-tagger/ignore": "keys:owner"},
+			want:         map[string]string{"foo": "bar"},
+		},
 		{
 			name:         "tags annotation not set with default tags",
 			defaultTags:  map[string]string{"foo": "bar", "something": "else"},
@@ -484,6 +509,56 @@ func Test_buildTags(t *testing.T) {
 			annotations:  map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"selected\"}", "aws-ebs-tagger/ignore": ""},
 			want:         map[string]string{},
 		},
+		{
+			name:         "tags annotation with non-string values",
+			defaultTags:  map[string]string{},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"bar\", \"num\": 1, \"nested\": {\"a\": \"b\"}, \"list\": [\"a\"]}"},
+			want:         map[string]string{"foo": "bar"},
+		},
+		{
+			name:         "tags annotation with too long value",
+			defaultTags:  map[string]string{},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"bar\", \"long\": \"" + strings.Repeat("a", 257) + "\"}"},
+			want:         map[string]string{"foo": "bar"},
+		},
+		{
+			name:         "replace annotation overrides default and custom tags",
+			defaultTags:  map[string]string{"foo": "default", "owner": "platform"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"custom\"}", "k8s-pvc-tagger/replace": "{\"foo\": \"replaced\", \"owner\": \"team\"}"},
+			want:         map[string]string{"foo": "replaced", "owner": "team"},
+		},
+		{
+			name:         "replace annotation without tags annotation",
+			defaultTags:  map[string]string{"foo": "default"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/replace": "{\"foo\": \"replaced\"}"},
+			want:         map[string]string{"foo": "replaced"},
+		},
+		{
+			name:         "replace annotation with restricted tag",
+			defaultTags:  map[string]string{},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/replace": "{\"Name\": \"replaced\"}"},
+			want:         map[string]string{},
+		},
+		{
+			name:         "remove annotation drops default tag",
+			defaultTags:  map[string]string{"foo": "bar", "something": "else"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/remove": "[\"foo\"]"},
+			want:         map[string]string{"something": "else"},
+		},
+		{
+			name:         "remove annotation - csv",
+			defaultTags:  map[string]string{"foo": "bar", "something": "else"},
+			allowAllTags: false,
+			annotations:  map[string]string{"k8s-pvc-tagger/tags": "old=value", "k8s-pvc-tagger/remove": "foo, old"},
+			want:         map[string]string{"something": "else"},
+			tagFormat:    "csv",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -862,3 +937,900 @@ func Test_templatedTags(t *testing.T) {
 		})
 	}
 }
+
+func Test_getVolumeMode(t *testing.T) {
+	block := corev1.PersistentVolumeBlock
+	filesystem := corev1.PersistentVolumeFilesystem
+
+	tests := []struct {
+		name       string
+		volumeMode *corev1.PersistentVolumeMode
+		want       string
+	}{
+		{
+			name:       "volumeMode not set",
+			volumeMode: nil,
+			want:       "Filesystem",
+		},
+		{
+			name:       "volumeMode Filesystem",
+			volumeMode: &filesystem,
+			want:       "Filesystem",
+		},
+		{
+			name:       "volumeMode Block",
+			volumeMode: &block,
+			want:       "Block",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.Spec.VolumeMode = tt.volumeMode
+			if got := getVolumeMode(pvc); got != tt.want {
+				t.Errorf("getVolumeMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getOwningPod(t *testing.T) {
+	isController := true
+	notController := false
+
+	tests := []struct {
+		name            string
+		ownerReferences []metav1.OwnerReference
+		want            string
+	}{
+		{
+			name:            "no owner",
+			ownerReferences: nil,
+			want:            "",
+		},
+		{
+			name:            "generic ephemeral volume owned by pod",
+			ownerReferences: []metav1.OwnerReference{{Kind: "Pod", Name: "my-pod", Controller: &isController}},
+			want:            "my-pod",
+		},
+		{
+			name:            "pod owner that is not the controller",
+			ownerReferences: []metav1.OwnerReference{{Kind: "Pod", Name: "my-pod", Controller: &notController}},
+			want:            "",
+		},
+		{
+			name:            "owned by statefulset",
+			ownerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "my-sts", Controller: &isController}},
+			want:            "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetOwnerReferences(tt.ownerReferences)
+			if got := getOwningPod(pvc); got != tt.want {
+				t.Errorf("getOwningPod() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_templatedTagsEphemeralBlockVolume(t *testing.T) {
+	isController := true
+	block := corev1.PersistentVolumeBlock
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pod-scratch")
+	pvc.SetNamespace("my-namespace")
+	pvc.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Pod", Name: "my-pod", Controller: &isController}})
+	pvc.SetAnnotations(map[string]string{annotationPrefix + "/tags": "{\"workload\": \"{{ .Pod }}\", \"mode\": \"{{ .VolumeMode }}\"}"})
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.Spec.VolumeMode = &block
+
+	want := map[string]string{"workload": "my-pod", "mode": "Block"}
+	if got := buildTags(pvc); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+}
+
+func Test_backupPlanTags(t *testing.T) {
+	volumeName := "pvc-1234"
+	storageClassName := "gp3-backup"
+
+	tests := []struct {
+		name                    string
+		allowedBackupPlans      []string
+		annotations             map[string]string
+		storageClassAnnotations map[string]string
+		want                    map[string]string
+	}{
+		{
+			name:               "backup plan annotation allowed",
+			allowedBackupPlans: []string{"gold", "silver"},
+			annotations:        map[string]string{"k8s-pvc-tagger/backup-plan": "gold"},
+			want:               map[string]string{"backup-plan": "gold"},
+		},
+		{
+			name:               "backup plan annotation not allowed",
+			allowedBackupPlans: []string{"gold", "silver"},
+			annotations:        map[string]string{"k8s-pvc-tagger/backup-plan": "platinum"},
+			want:               map[string]string{},
+		},
+		{
+			name:               "backup plan annotation with no allowed plans",
+			allowedBackupPlans: nil,
+			annotations:        map[string]string{"k8s-pvc-tagger/backup-plan": "gold"},
+			want:               map[string]string{"backup-plan": "gold"},
+		},
+		{
+			name:               "backup plan from the tags annotation isn't checked",
+			allowedBackupPlans: []string{"gold", "silver"},
+			annotations:        map[string]string{"k8s-pvc-tagger/tags": `{"backup-plan": "platinum"}`},
+			want:               map[string]string{"backup-plan": "platinum"},
+		},
+		{
+			name:                    "backup plan from storageclass",
+			allowedBackupPlans:      []string{"gold", "silver"},
+			annotations:             map[string]string{},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/backup-plan": "silver"},
+			want:                    map[string]string{"backup-plan": "silver"},
+		},
+		{
+			name:                    "backup plan annotation overrides storageclass",
+			allowedBackupPlans:      []string{"gold", "silver"},
+			annotations:             map[string]string{"k8s-pvc-tagger/backup-plan": "gold"},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/backup-plan": "silver"},
+			want:                    map[string]string{"backup-plan": "gold"},
+		},
+		{
+			name:                    "backup plan from storageclass not allowed",
+			allowedBackupPlans:      []string{"gold"},
+			annotations:             map[string]string{},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/backup-plan": "silver"},
+			want:                    map[string]string{},
+		},
+		{
+			name:                    "backup plan from storageclass with ignore annotation",
+			allowedBackupPlans:      []string{"gold", "silver"},
+			annotations:             map[string]string{"k8s-pvc-tagger/ignore": ""},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/backup-plan": "silver"},
+			want:                    map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.Spec.VolumeName = volumeName
+			pvc.Spec.StorageClassName = &storageClassName
+			annotations := map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pvc.SetAnnotations(annotations)
+
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        storageClassName,
+					Annotations: tt.storageClassAnnotations,
+				},
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: volumeName,
+				},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-12345",
+						},
+					},
+				},
+			}
+			k8sClient = fake.NewSimpleClientset(pv, sc)
+			allowedBackupPlans = tt.allowedBackupPlans
+			_, got, err := processPersistentVolumeClaim(pvc)
+			if err != nil {
+				t.Errorf("processPersistentVolumeClaim() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", got, tt.want)
+			}
+			allowedBackupPlans = nil
+		})
+	}
+}
+
+func Test_buildRemovedTags(t *testing.T) {
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	tests := []struct {
+		name         string
+		allowAllTags bool
+		annotations  map[string]string
+		want         []string
+		tagFormat    string
+	}{
+		{
+			name:        "remove annotation not set",
+			annotations: map[string]string{},
+			want:        nil,
+		},
+		{
+			name:        "remove annotation set",
+			annotations: map[string]string{"k8s-pvc-tagger/remove": "[\"foo\", \"bar\"]"},
+			want:        []string{"foo", "bar"},
+		},
+		{
+			name:        "remove annotation invalid json",
+			annotations: map[string]string{"k8s-pvc-tagger/remove": "foo"},
+			want:        nil,
+		},
+		{
+			name:        "remove annotation set - csv",
+			annotations: map[string]string{"k8s-pvc-tagger/remove": "foo,,bar "},
+			want:        []string{"foo", "bar"},
+			tagFormat:   "csv",
+		},
+		{
+			name:        "remove annotation with restricted tag",
+			annotations: map[string]string{"k8s-pvc-tagger/remove": "[\"foo\", \"kubernetes.io/created-for/pvc/name\"]"},
+			want:        []string{"foo"},
+		},
+		{
+			name:         "remove annotation with restricted tag but allowAllTags",
+			allowAllTags: true,
+			annotations:  map[string]string{"k8s-pvc-tagger/remove": "[\"Name\"]"},
+			want:         []string{"Name"},
+		},
+		{
+			name:        "remove annotation with ignore annotation",
+			annotations: map[string]string{"k8s-pvc-tagger/remove": "[\"foo\"]", "k8s-pvc-tagger/ignore": ""},
+			want:        nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(tt.annotations)
+			allowAllTags = tt.allowAllTags
+			if tt.tagFormat != "" {
+				tagFormat = tt.tagFormat
+			}
+			if got := buildRemovedTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildRemovedTags() = %v, want %v", got, tt.want)
+			}
+			allowAllTags = false
+			tagFormat = "json"
+		})
+	}
+}
+
+func Test_isTagStateUnchanged(t *testing.T) {
+	volumeID := "vol-12345"
+
+	tests := []struct {
+		name           string
+		storedTags     map[string]string
+		oldAnnotations map[string]string
+		newAnnotations map[string]string
+		tags           map[string]string
+		want           bool
+	}{
+		{
+			name:           "volume not reconciled yet",
+			storedTags:     nil,
+			oldAnnotations: map[string]string{},
+			newAnnotations: map[string]string{},
+			tags:           map[string]string{"foo": "bar"},
+			want:           false,
+		},
+		{
+			name:           "same tags",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{},
+			newAnnotations: map[string]string{},
+			tags:           map[string]string{"foo": "bar"},
+			want:           true,
+		},
+		{
+			name:           "changed tags",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{},
+			newAnnotations: map[string]string{},
+			tags:           map[string]string{"foo": "baz"},
+			want:           false,
+		},
+		{
+			name:           "sync-at annotation added",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{},
+			newAnnotations: map[string]string{"k8s-pvc-tagger/sync-at": "2022-07-20T10:00:00Z"},
+			tags:           map[string]string{"foo": "bar"},
+			want:           false,
+		},
+		{
+			name:           "sync-at annotation changed",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{"k8s-pvc-tagger/sync-at": "2022-07-20T10:00:00Z"},
+			newAnnotations: map[string]string{"k8s-pvc-tagger/sync-at": "2022-07-21T10:00:00Z"},
+			tags:           map[string]string{"foo": "bar"},
+			want:           false,
+		},
+		{
+			name:           "sync-at annotation unchanged",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{"k8s-pvc-tagger/sync-at": "2022-07-20T10:00:00Z"},
+			newAnnotations: map[string]string{"k8s-pvc-tagger/sync-at": "2022-07-20T10:00:00Z"},
+			tags:           map[string]string{"foo": "bar"},
+			want:           true,
+		},
+		{
+			name:           "remove annotation changed",
+			storedTags:     map[string]string{"foo": "bar"},
+			oldAnnotations: map[string]string{},
+			newAnnotations: map[string]string{"k8s-pvc-tagger/remove": "[\"old\"]"},
+			tags:           map[string]string{"foo": "bar"},
+			want:           false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			managedVolumes = newVolumeStore()
+			if tt.storedTags != nil {
+				managedVolumes.set(managedVolume{VolumeID: volumeID, Tags: tt.storedTags})
+			}
+			oldPVC := &corev1.PersistentVolumeClaim{}
+			oldPVC.SetAnnotations(tt.oldAnnotations)
+			newPVC := &corev1.PersistentVolumeClaim{}
+			newPVC.SetAnnotations(tt.newAnnotations)
+			if got := isTagStateUnchanged(oldPVC, newPVC, volumeID, tt.tags); got != tt.want {
+				t.Errorf("isTagStateUnchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	managedVolumes = newVolumeStore()
+}
+
+func Test_validateTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{
+			name:    "valid tag",
+			key:     "foo",
+			value:   "bar",
+			wantErr: false,
+		},
+		{
+			name:    "empty value",
+			key:     "foo",
+			value:   "",
+			wantErr: false,
+		},
+		{
+			name:    "empty key",
+			key:     "",
+			value:   "bar",
+			wantErr: true,
+		},
+		{
+			name:    "max length key and value",
+			key:     strings.Repeat("k", 128),
+			value:   strings.Repeat("v", 256),
+			wantErr: false,
+		},
+		{
+			name:    "key too long",
+			key:     strings.Repeat("k", 129),
+			value:   "bar",
+			wantErr: true,
+		},
+		{
+			name:    "value too long",
+			key:     "foo",
+			value:   strings.Repeat("v", 257),
+			wantErr: true,
+		},
+		{
+			name:    "reserved aws prefix",
+			key:     "aws:cloudformation:stack-name",
+			value:   "bar",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTag(tt.key, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("validateTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_invalidTagsEvent(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"bar\", \"num\": 1}"})
+
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	defer func() { eventRecorder = nil }()
+
+	buildTags(pvc)
+
+	select {
+	case event := <-recorder.Events:
+		want := "Warning InvalidTags tag \"num\" value must be a string, got 1"
+		if event != want {
+			t.Errorf("event = %v, want %v", event, want)
+		}
+	default:
+		t.Errorf("expected an InvalidTags event")
+	}
+}
+
+func Test_parseTagsLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		tagString string
+		tagFormat string
+		wantTags  map[string]string
+		wantErrs  []string
+	}{
+		{
+			name:      "within the limits",
+			tagString: `{"a": "1", "b": "2"}`,
+			wantTags:  map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name:      "annotation too large",
+			tagString: `{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6"}`,
+			wantTags:  map[string]string{},
+			wantErrs:  []string{"annotation is 60 bytes, more than the limit of 50 bytes"},
+		},
+		{
+			name:      "too many tags",
+			tagString: `{"d": "4", "a": "1", "c": "3", "b": "2"}`,
+			wantTags:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			wantErrs:  []string{"annotation has 4 tags, more than the limit of 3 tags, ignoring d"},
+		},
+		{
+			name:      "value too long",
+			tagString: `{"a": "1", "b": "123456"}`,
+			wantTags:  map[string]string{"a": "1"},
+			wantErrs:  []string{`tag "b" value is longer than the limit of 5 characters`},
+		},
+		{
+			name:      "csv too many tags",
+			tagString: "d=4,a=1,c=3,b=2",
+			tagFormat: "csv",
+			wantTags:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			wantErrs:  []string{"annotation has 4 tags, more than the limit of 3 tags, ignoring d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxAnnotationSize = 50
+			maxAnnotationTags = 3
+			maxAnnotationValueLen = 5
+			tagFormat = tt.tagFormat
+			defer func() {
+				maxAnnotationSize = 16384
+				maxAnnotationTags = 50
+				maxAnnotationValueLen = maxTagValueLength
+				tagFormat = "json"
+			}()
+			gotTags, gotErrs := parseTags(tt.tagString)
+			if !reflect.DeepEqual(gotTags, tt.wantTags) {
+				t.Errorf("parseTags() tags = %v, want %v", gotTags, tt.wantTags)
+			}
+			var errs []string
+			for _, err := range gotErrs {
+				errs = append(errs, err.Error())
+			}
+			if !reflect.DeepEqual(errs, tt.wantErrs) {
+				t.Errorf("parseTags() errs = %v, want %v", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func Test_diffTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		oldTags     map[string]string
+		newTags     map[string]string
+		wantAdded   []string
+		wantChanged []string
+	}{
+		{
+			name:        "no old tags",
+			oldTags:     nil,
+			newTags:     map[string]string{"foo": "bar", "another": "tag"},
+			wantAdded:   []string{"another", "foo"},
+			wantChanged: []string{},
+		},
+		{
+			name:        "no changes",
+			oldTags:     map[string]string{"foo": "bar"},
+			newTags:     map[string]string{"foo": "bar"},
+			wantAdded:   []string{},
+			wantChanged: []string{},
+		},
+		{
+			name:        "added and changed",
+			oldTags:     map[string]string{"foo": "bar", "removed": "tag"},
+			newTags:     map[string]string{"foo": "baz", "new": "tag"},
+			wantAdded:   []string{"new"},
+			wantChanged: []string{"foo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, changed := diffTags(tt.oldTags, tt.newTags)
+			if !reflect.DeepEqual(added, tt.wantAdded) {
+				t.Errorf("diffTags() added = %v, want %v", added, tt.wantAdded)
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("diffTags() changed = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func Test_labelTags(t *testing.T) {
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	tests := []struct {
+		name         string
+		tagSources   []string
+		replacements map[string]string
+		annotations  map[string]string
+		labels       map[string]string
+		want         map[string]string
+	}{
+		{
+			name:        "labels not enabled",
+			tagSources:  []string{"annotations"},
+			annotations: map[string]string{},
+			labels:      map[string]string{"k8s-pvc-tagger/team": "payments"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "labels enabled",
+			tagSources:  []string{"annotations", "labels"},
+			annotations: map[string]string{},
+			labels:      map[string]string{"k8s-pvc-tagger/team": "payments", "app": "my-app"},
+			want:        map[string]string{"team": "payments"},
+		},
+		{
+			name:        "labels take precedence",
+			tagSources:  []string{"annotations", "labels"},
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"checkout\", \"foo\": \"bar\"}"},
+			labels:      map[string]string{"k8s-pvc-tagger/team": "payments"},
+			want:        map[string]string{"team": "payments", "foo": "bar"},
+		},
+		{
+			name:        "annotations take precedence",
+			tagSources:  []string{"labels", "annotations"},
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"checkout\"}"},
+			labels:      map[string]string{"k8s-pvc-tagger/team": "payments"},
+			want:        map[string]string{"team": "checkout"},
+		},
+		{
+			name:         "labels with replacements",
+			tagSources:   []string{"labels"},
+			replacements: map[string]string{"__": "/", "_": " "},
+			annotations:  map[string]string{},
+			labels:       map[string]string{"k8s-pvc-tagger/team__name": "payments_team"},
+			want:         map[string]string{"team/name": "payments team"},
+		},
+		{
+			name:        "labels with ignore annotation",
+			tagSources:  []string{"annotations", "labels"},
+			annotations: map[string]string{"k8s-pvc-tagger/ignore": ""},
+			labels:      map[string]string{"k8s-pvc-tagger/team": "payments"},
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetLabels(tt.labels)
+			tagSources = tt.tagSources
+			labelValueReplacer = newLabelValueReplacer(tt.replacements)
+			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			tagSources = []string{"annotations"}
+			labelValueReplacer = strings.NewReplacer()
+		})
+	}
+}
+
+func Test_pvAnnotationTags(t *testing.T) {
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.Spec.VolumeName = "pvc-1234"
+
+	tests := []struct {
+		name          string
+		tagSources    []string
+		annotations   map[string]string
+		pvAnnotations map[string]string
+		want          map[string]string
+	}{
+		{
+			name:          "pv annotations not enabled",
+			tagSources:    []string{"annotations"},
+			annotations:   map[string]string{},
+			pvAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"storage\"}"},
+			want:          map[string]string{},
+		},
+		{
+			name:          "pvc annotations take precedence",
+			tagSources:    []string{"pv-annotations", "annotations"},
+			annotations:   map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"payments\"}"},
+			pvAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"storage\", \"tier\": \"gold\"}"},
+			want:          map[string]string{"team": "payments", "tier": "gold"},
+		},
+		{
+			name:          "pv annotations take precedence",
+			tagSources:    []string{"annotations", "pv-annotations"},
+			annotations:   map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"payments\"}"},
+			pvAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"team\": \"storage\"}"},
+			want:          map[string]string{"team": "storage"},
+		},
+		{
+			name:          "pv without annotation",
+			tagSources:    []string{"pv-annotations"},
+			annotations:   map[string]string{},
+			pvAnnotations: map[string]string{},
+			want:          map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", Annotations: tt.pvAnnotations},
+			})
+			pvc.SetAnnotations(tt.annotations)
+			tagSources = tt.tagSources
+			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			tagSources = []string{"annotations"}
+		})
+	}
+}
+
+func Test_nameTag(t *testing.T) {
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("my-namespace")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	tests := []struct {
+		name            string
+		nameTagTemplate string
+		annotations     map[string]string
+		want            map[string]string
+	}{
+		{
+			name:            "name tag not enabled",
+			nameTagTemplate: "",
+			annotations:     map[string]string{"k8s-pvc-tagger/name": "my-volume", "k8s-pvc-tagger/tags": "{\"Name\": \"my-volume\"}"},
+			want:            map[string]string{},
+		},
+		{
+			name:            "name tag template",
+			nameTagTemplate: "{{ .Namespace }}/{{ .Name }}",
+			annotations:     map[string]string{},
+			want:            map[string]string{"Name": "my-namespace/my-pvc"},
+		},
+		{
+			name:            "name annotation overrides the template",
+			nameTagTemplate: "{{ .Namespace }}/{{ .Name }}",
+			annotations:     map[string]string{"k8s-pvc-tagger/name": "db-{{ .Name }}"},
+			want:            map[string]string{"Name": "db-my-pvc"},
+		},
+		{
+			name:            "name tag ignored",
+			nameTagTemplate: "{{ .Namespace }}/{{ .Name }}",
+			annotations:     map[string]string{"k8s-pvc-tagger/ignore": "keys:Name"},
+			want:            map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(tt.annotations)
+			nameTagTemplate = tt.nameTagTemplate
+			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			nameTagTemplate = ""
+		})
+	}
+}
+
+func Test_tweakListOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		labelSelector      string
+		listPageSize       int64
+		listFromWatchCache bool
+		options            metav1.ListOptions
+		want               metav1.ListOptions
+	}{
+		{
+			name:               "list with defaults",
+			listFromWatchCache: true,
+			options:            metav1.ListOptions{ResourceVersion: "0", Limit: 500},
+			want:               metav1.ListOptions{ResourceVersion: "0", Limit: 500},
+		},
+		{
+			name:               "list with selector and page size",
+			labelSelector:      "app=database",
+			listPageSize:       100,
+			listFromWatchCache: true,
+			options:            metav1.ListOptions{ResourceVersion: "0", Limit: 500},
+			want:               metav1.ListOptions{LabelSelector: "app=database", ResourceVersion: "0", Limit: 100},
+		},
+		{
+			name:               "list not from watch cache",
+			listPageSize:       100,
+			listFromWatchCache: false,
+			options:            metav1.ListOptions{ResourceVersion: "0", Limit: 500},
+			want:               metav1.ListOptions{ResourceVersion: "", Limit: 100},
+		},
+		{
+			name:               "watch",
+			labelSelector:      "app=database",
+			listPageSize:       100,
+			listFromWatchCache: false,
+			options:            metav1.ListOptions{ResourceVersion: "1234", Watch: true},
+			want:               metav1.ListOptions{LabelSelector: "app=database", ResourceVersion: "1234", Watch: true, AllowWatchBookmarks: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvcLabelSelector = tt.labelSelector
+			listPageSize = tt.listPageSize
+			listFromWatchCache = tt.listFromWatchCache
+			tweakListOptions(&tt.options)
+			if !reflect.DeepEqual(tt.options, tt.want) {
+				t.Errorf("tweakListOptions() = %v, want %v", tt.options, tt.want)
+			}
+			pvcLabelSelector = ""
+			listPageSize = 0
+			listFromWatchCache = true
+		})
+	}
+}
+
+func Test_getTargets(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name:        "no annotation",
+			annotations: map[string]string{},
+			want:        []string{"volume"},
+		},
+		{
+			name:        "volume and snapshots",
+			annotations: map[string]string{"k8s-pvc-tagger/targets": "volume, snapshots"},
+			want:        []string{"volume", "snapshots"},
+		},
+		{
+			name:        "invalid and duplicate targets",
+			annotations: map[string]string{"k8s-pvc-tagger/targets": "file-system,foo,file-system"},
+			want:        []string{"file-system"},
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{"k8s-pvc-tagger/targets": ""},
+			want:        []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetAnnotations(tt.annotations)
+			if got := getTargets(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getEFSFileSystemID(t *testing.T) {
+	tests := []struct {
+		name         string
+		volumeHandle string
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "access point",
+			volumeHandle: "fs-12345::fsap-12345",
+			want:         "fs-12345",
+			wantErr:      false,
+		},
+		{
+			name:         "invalid volume handle",
+			volumeHandle: "vol-12345",
+			want:         "",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: tt.volumeHandle},
+					},
+				},
+			}
+			k8sClient = fake.NewSimpleClientset(pv)
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.Spec.VolumeName = "pvc-1234"
+			got, err := getEFSFileSystemID(pvc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getEFSFileSystemID() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getEFSFileSystemID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isSupportedProvisioner(t *testing.T) {
+	ignoredProvisioners = strings.Split(defaultIgnoredProvisioners, ",")
+	defer func() { ignoredProvisioners = nil }()
+
+	tests := []struct {
+		name        string
+		obj         interface{}
+		provisioner string
+		want        bool
+	}{
+		{name: "ebs", provisioner: "ebs.csi.aws.com", want: true},
+		{name: "host path", provisioner: "kubernetes.io/host-path", want: false},
+		{name: "local", provisioner: "kubernetes.io/no-provisioner", want: false},
+		{name: "nfs", provisioner: "nfs.csi.k8s.io", want: false},
+		{name: "unknown provisioner", provisioner: "example.com/storage", want: true},
+		{name: "tombstone", obj: cache.DeletedFinalStateUnknown{Key: "default/my-pvc"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := tt.obj
+			if obj == nil {
+				pvc := &corev1.PersistentVolumeClaim{}
+				pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": tt.provisioner})
+				obj = pvc
+			}
+			if got := isSupportedProvisioner(obj); got != tt.want {
+				t.Errorf("isSupportedProvisioner() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElectResourceLock is the type of the leader election lock. The
+// configmapsleases and endpointsleases multilocks hold both the old lock and a
+// Lease, so that they can be used to upgrade from releases that used a
+// ConfigMap or Endpoints lock without two leaders during the rollout.
+var leaderElectResourceLock = resourcelock.LeasesResourceLock
+
+func validateResourceLock(lockType string) error {
+	switch lockType {
+	case resourcelock.LeasesResourceLock, resourcelock.ConfigMapsLeasesResourceLock, resourcelock.EndpointsLeasesResourceLock:
+		return nil
+	case "configmaps", "endpoints":
+		return fmt.Errorf("the %s lock is no longer supported, use %sleases to migrate to a Lease lock", lockType, lockType)
+	}
+	return fmt.Errorf("invalid lock type %q, must be one of %s, %s or %s", lockType, resourcelock.LeasesResourceLock, resourcelock.ConfigMapsLeasesResourceLock, resourcelock.EndpointsLeasesResourceLock)
+}
+
+func newLeaderElectionLock(client kubernetes.Interface, lockType string, namespace string, name string, identity string) (resourcelock.Interface, error) {
+	return resourcelock.New(lockType, namespace, name, client.CoreV1(), client.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity: identity,
+	})
+}
+
+// defaultLeaseID returns the lease holder identity made of the pod name, the
+// node name and a UUID, so that it's obvious which replica is the leader
+func defaultLeaseID() string {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	var parts []string
+	for _, part := range []string{name, os.Getenv("NODE_NAME")} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, uuid.New().String()), "_")
+}
+
+// leaderTracker keeps track of the current lease holder
+type leaderTracker struct {
+	sync.RWMutex
+	identity string
+}
+
+var currentLeader = &leaderTracker{}
+
+func (l *leaderTracker) set(identity string, self string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.identity != "" {
+		promLeaderInfo.Delete(prometheus.Labels{"identity": l.identity})
+	}
+	l.identity = identity
+	promLeaderInfo.With(prometheus.Labels{"identity": identity}).Set(1)
+	if identity == self {
+		promIsLeader.Set(1)
+	} else {
+		promIsLeader.Set(0)
+	}
+}
+
+func (l *leaderTracker) get() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.identity
+}
@@ -0,0 +1,149 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func Test_newLeaderElectionLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		lockType  string
+		wantValid bool
+		wantMulti bool
+	}{
+		{name: "leases", lockType: "leases", wantValid: true},
+		{name: "configmapsleases", lockType: "configmapsleases", wantValid: true, wantMulti: true},
+		{name: "endpointsleases", lockType: "endpointsleases", wantValid: true, wantMulti: true},
+		{name: "configmaps", lockType: "configmaps"},
+		{name: "endpoints", lockType: "endpoints"},
+		{name: "invalid", lockType: "foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateResourceLock(tt.lockType); (err == nil) != tt.wantValid {
+				t.Fatalf("validateResourceLock() error = %v, wantValid %v", err, tt.wantValid)
+			}
+			if !tt.wantValid {
+				return
+			}
+			lock, err := newLeaderElectionLock(fake.NewSimpleClientset(), tt.lockType, "default", "k8s-pvc-tagger", "pod-1")
+			if err != nil {
+				t.Fatalf("newLeaderElectionLock() error = %v", err)
+			}
+			if _, ok := lock.(*resourcelock.MultiLock); ok != tt.wantMulti {
+				t.Errorf("newLeaderElectionLock() = %T, want a multilock %v", lock, tt.wantMulti)
+			}
+			if lock.Identity() != "pod-1" {
+				t.Errorf("newLeaderElectionLock() identity = %v, want pod-1", lock.Identity())
+			}
+		})
+	}
+}
+
+func Test_getCurrentNamespace(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "config")
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://localhost:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    namespace: tagger
+current-context: test
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceAccountNamespaceFile = filepath.Join(dir, "namespace")
+	defer func() { serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace" }()
+
+	tests := []struct {
+		name             string
+		podNamespace     string
+		serviceAccountNs string
+		kubeconfig       string
+		want             string
+	}{
+		{name: "pod namespace", podNamespace: "pod", serviceAccountNs: "sa", kubeconfig: kubeconfig, want: "pod"},
+		{name: "service account", serviceAccountNs: "sa", kubeconfig: kubeconfig, want: "sa"},
+		{name: "kubeconfig context", kubeconfig: kubeconfig, want: "tagger"},
+		{name: "nothing", kubeconfig: filepath.Join(dir, "missing"), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POD_NAMESPACE", tt.podNamespace)
+			os.Remove(serviceAccountNamespaceFile)
+			if tt.serviceAccountNs != "" {
+				if err := os.WriteFile(serviceAccountNamespaceFile, []byte(tt.serviceAccountNs+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := getCurrentNamespace(tt.kubeconfig, ""); got != tt.want {
+				t.Errorf("getCurrentNamespace() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_defaultLeaseID(t *testing.T) {
+	t.Setenv("POD_NAME", "k8s-pvc-tagger-abc")
+	t.Setenv("NODE_NAME", "ip-10-0-0-1")
+	if got := defaultLeaseID(); !regexp.MustCompile(`^k8s-pvc-tagger-abc_ip-10-0-0-1_[0-9a-f-]{36}$`).MatchString(got) {
+		t.Errorf("defaultLeaseID() = %v, want <pod>_<node>_<uuid>", got)
+	}
+	t.Setenv("NODE_NAME", "")
+	if got := defaultLeaseID(); !regexp.MustCompile(`^k8s-pvc-tagger-abc_[0-9a-f-]{36}$`).MatchString(got) {
+		t.Errorf("defaultLeaseID() = %v, want <pod>_<uuid>", got)
+	}
+}
+
+func Test_leaderTracker(t *testing.T) {
+	l := &leaderTracker{}
+	defer promLeaderInfo.Reset()
+
+	l.set("pod-1", "pod-2")
+	if l.get() != "pod-1" || testutil.ToFloat64(promIsLeader) != 0 {
+		t.Errorf("set() leader = %v, is leader %v, want pod-1, 0", l.get(), testutil.ToFloat64(promIsLeader))
+	}
+	l.set("pod-2", "pod-2")
+	if l.get() != "pod-2" || testutil.ToFloat64(promIsLeader) != 1 {
+		t.Errorf("set() leader = %v, is leader %v, want pod-2, 1", l.get(), testutil.ToFloat64(promIsLeader))
+	}
+	if got := testutil.CollectAndCount(promLeaderInfo); got != 1 {
+		t.Errorf("k8s_pvc_tagger_leader_info has %v series, want 1", got)
+	}
+	if got := testutil.ToFloat64(promLeaderInfo.With(prometheus.Labels{"identity": "pod-2"})); got != 1 {
+		t.Errorf("k8s_pvc_tagger_leader_info{identity=pod-2} = %v, want 1", got)
+	}
+}
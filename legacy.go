@@ -0,0 +1,50 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getPVCAnnotation returns the value of the PVC's <prefix>/<name> annotation.
+// With the default prefix, the legacy aws-ebs-tagger/<name> annotation is read
+// when the new one is not set, and counted so the PVCs still using it can be found.
+func getPVCAnnotation(pvc *corev1.PersistentVolumeClaim, name string) (string, bool) {
+	annotations := pvc.GetAnnotations()
+	value, ok := annotations[annotationPrefix+"/"+name]
+	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
+	if annotationPrefix != defaultAnnotationPrefix {
+		return value, ok
+	}
+	legacyValue, legacyOk := annotations[legacyAnnotationPrefix+"/"+name]
+	if !legacyOk {
+		return value, ok
+	}
+	if !isPlaygroundPVC(pvc) {
+		promLegacyAnnotationsTotal.With(prometheus.Labels{"namespace": pvc.GetNamespace(), "annotation": name}).Inc()
+	}
+	if ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Has both " + annotationPrefix + "/" + name + " AND legacy " + legacyAnnotationPrefix + "/" + name + " annotation. Using newer " + annotationPrefix + "/" + name + " annotation")
+		return value, ok
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Using the deprecated " + legacyAnnotationPrefix + "/" + name + " annotation")
+	return legacyValue, legacyOk
+}
@@ -0,0 +1,96 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_getPVCAnnotation(t *testing.T) {
+	tests := []struct {
+		name             string
+		annotationPrefix string
+		annotations      map[string]string
+		wantValue        string
+		wantOk           bool
+		wantLegacyCount  float64
+	}{
+		{
+			name:             "annotation",
+			annotationPrefix: "k8s-pvc-tagger",
+			annotations:      map[string]string{"k8s-pvc-tagger/remove": "foo"},
+			wantValue:        "foo",
+			wantOk:           true,
+		},
+		{
+			name:             "legacy annotation",
+			annotationPrefix: "k8s-pvc-tagger",
+			annotations:      map[string]string{"aws-ebs-tagger/remove": "foo"},
+			wantValue:        "foo",
+			wantOk:           true,
+			wantLegacyCount:  1,
+		},
+		{
+			name:             "both annotations",
+			annotationPrefix: "k8s-pvc-tagger",
+			annotations:      map[string]string{"k8s-pvc-tagger/remove": "foo", "aws-ebs-tagger/remove": "bar"},
+			wantValue:        "foo",
+			wantOk:           true,
+			wantLegacyCount:  1,
+		},
+		{
+			name:             "legacy annotation with a custom prefix",
+			annotationPrefix: "custom",
+			annotations:      map[string]string{"aws-ebs-tagger/remove": "foo"},
+			wantValue:        "",
+			wantOk:           false,
+		},
+		{
+			name:             "no annotation",
+			annotationPrefix: "k8s-pvc-tagger",
+			annotations:      map[string]string{},
+			wantValue:        "",
+			wantOk:           false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotationPrefix = tt.annotationPrefix
+			defer func() { annotationPrefix = defaultAnnotationPrefix }()
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetNamespace(tt.name)
+			pvc.SetAnnotations(tt.annotations)
+
+			value, ok := getPVCAnnotation(pvc, "remove")
+			if value != tt.wantValue || ok != tt.wantOk {
+				t.Errorf("getPVCAnnotation() = %v, %v, want %v, %v", value, ok, tt.wantValue, tt.wantOk)
+			}
+			count := testutil.ToFloat64(promLegacyAnnotationsTotal.With(prometheus.Labels{"namespace": tt.name, "annotation": "remove"}))
+			if count != tt.wantLegacyCount {
+				t.Errorf("getPVCAnnotation() legacy annotations count = %v, want %v", count, tt.wantLegacyCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// providerLimiter limits the number of concurrent tag operations and their
+// rate for a provider, since each cloud API throttles differently
+type providerLimiter struct {
+	// workers is nil when the concurrency is unlimited
+	workers chan struct{}
+	// rateLimiter is nil when the rate is unlimited
+	rateLimiter flowcontrol.RateLimiter
+}
+
+var providerLimiters = map[string]*providerLimiter{}
+
+// parseProviderLimits parses a csv list of provider=limit pairs, e.g. aws-ebs=10,aws-efs=0.5
+func parseProviderLimits(limitsString string) (map[string]float64, error) {
+	limits := map[string]float64{}
+	for provider, value := range parseCsv(limitsString) {
+		if provider != providerAWSEBS && provider != providerAWSEFS {
+			return nil, fmt.Errorf("%q is not a valid provider", provider)
+		}
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%q is not a valid limit for %s", value, provider)
+		}
+		limits[provider] = limit
+	}
+	return limits, nil
+}
+
+// parseProviderConcurrency parses a csv list of provider=workers pairs, e.g.
+// aws-ebs=10,aws-efs=2. The number of workers is a whole number of at least 1.
+func parseProviderConcurrency(concurrencyString string) (map[string]int, error) {
+	concurrency := map[string]int{}
+	for provider, value := range parseCsv(concurrencyString) {
+		if provider != providerAWSEBS && provider != providerAWSEFS {
+			return nil, fmt.Errorf("%q is not a valid provider", provider)
+		}
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("%q is not a valid concurrency for %s, it must be a whole number of at least 1", value, provider)
+		}
+		concurrency[provider] = workers
+	}
+	return concurrency, nil
+}
+
+// newProviderLimiters builds the limiters from the per provider concurrency and
+// operations per second limits. Providers without limits are not limited.
+func newProviderLimiters(concurrency map[string]int, qps map[string]float64) map[string]*providerLimiter {
+	limiters := map[string]*providerLimiter{}
+	for _, provider := range []string{providerAWSEBS, providerAWSEFS} {
+		l := &providerLimiter{}
+		if workers, ok := concurrency[provider]; ok {
+			l.workers = make(chan struct{}, workers)
+		}
+		if limit, ok := qps[provider]; ok {
+			burst := int(limit)
+			if burst < 1 {
+				burst = 1
+			}
+			l.rateLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(limit), burst)
+		}
+		limiters[provider] = l
+	}
+	return limiters
+}
+
+// limitTagOperation runs the tag operation within the limits of the provider
+func limitTagOperation(provider string, op func() error) error {
+	l, ok := providerLimiters[provider]
+	if !ok {
+		return op()
+	}
+	if l.workers != nil {
+		l.workers <- struct{}{}
+		defer func() { <-l.workers }()
+	}
+	if l.rateLimiter != nil {
+		l.rateLimiter.Accept()
+	}
+	return op()
+}
+
+// maxAPICallsPerMinute is the budget of cloud API calls shared by every
+// provider, so that the tagger only uses a slice of the account's API quota
+var maxAPICallsPerMinute int
+
+// apiBudget is the token bucket of maxAPICallsPerMinute, shared by the
+// sessions of every region. It's nil when the budget is unlimited.
+var apiBudget flowcontrol.RateLimiter
+
+// newAPIBudget returns the token bucket of the API call budget, with a burst
+// of about one second of calls so the budget is spread over the minute
+func newAPIBudget(callsPerMinute int) flowcontrol.RateLimiter {
+	burst := callsPerMinute / 60
+	if burst < 1 {
+		burst = 1
+	}
+	return flowcontrol.NewTokenBucketRateLimiter(float32(callsPerMinute)/60, burst)
+}
@@ -0,0 +1,153 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_parseProviderLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:   "empty",
+			limits: "",
+			want:   map[string]float64{},
+		},
+		{
+			name:   "both providers",
+			limits: "aws-ebs=10,aws-efs=0.5",
+			want:   map[string]float64{"aws-ebs": 10, "aws-efs": 0.5},
+		},
+		{
+			name:    "invalid provider",
+			limits:  "gcp=10",
+			wantErr: true,
+		},
+		{
+			name:    "invalid limit",
+			limits:  "aws-ebs=ten",
+			wantErr: true,
+		},
+		{
+			name:    "zero limit",
+			limits:  "aws-ebs=0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProviderLimits(tt.limits)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProviderLimits() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProviderLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseProviderConcurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency string
+		want        map[string]int
+		wantErr     bool
+	}{
+		{name: "empty", concurrency: "", want: map[string]int{}},
+		{name: "both providers", concurrency: "aws-ebs=10,aws-efs=1", want: map[string]int{"aws-ebs": 10, "aws-efs": 1}},
+		{name: "invalid provider", concurrency: "gcp=10", wantErr: true},
+		{name: "fraction", concurrency: "aws-ebs=0.5", wantErr: true},
+		{name: "zero", concurrency: "aws-ebs=0", wantErr: true},
+		{name: "negative", concurrency: "aws-ebs=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProviderConcurrency(tt.concurrency)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProviderConcurrency() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProviderConcurrency() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_limitTagOperationConcurrency(t *testing.T) {
+	providerLimiters = newProviderLimiters(map[string]int{providerAWSEFS: 2}, nil)
+	defer func() { providerLimiters = map[string]*providerLimiter{} }()
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = limitTagOperation(providerAWSEFS, func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Errorf("limitTagOperation() ran %v operations concurrently, want at most 2", maxRunning)
+	}
+}
+
+func Test_newAPIBudget(t *testing.T) {
+	tests := []struct {
+		name           string
+		callsPerMinute int
+		wantQPS        float32
+	}{
+		{name: "under one call per second", callsPerMinute: 30, wantQPS: 0.5},
+		{name: "several calls per second", callsPerMinute: 600, wantQPS: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := newAPIBudget(tt.callsPerMinute)
+			if got := budget.QPS(); got != tt.wantQPS {
+				t.Errorf("newAPIBudget() QPS = %v, want %v", got, tt.wantQPS)
+			}
+			if !budget.TryAccept() {
+				t.Errorf("newAPIBudget() did not allow the first call")
+			}
+		})
+	}
+}
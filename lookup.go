@@ -0,0 +1,220 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// lookupAllowedURLs are the URL prefixes the lookup template function can
+	// fetch, matched on their scheme, host and path prefix
+	lookupAllowedURLs []string
+	// lookupTTL is how long a fetched document is used before it is fetched again
+	lookupTTL = 5 * time.Minute
+	// lookupTimeout is the timeout of fetching a document
+	lookupTimeout = 5 * time.Second
+	// lookupMaxBytes is the maximum size of a document
+	lookupMaxBytes int64 = 1 << 20
+)
+
+var errLookupFailed = errors.New("lookup failed")
+
+// lookupDocument is a fetched json document of keys to values, e.g. teams to cost centers
+type lookupDocument struct {
+	values    map[string]interface{}
+	fetchedAt time.Time
+}
+
+// lookupFetch is a document being fetched, done is closed once it's fetched
+type lookupFetch struct {
+	done   chan struct{}
+	values map[string]interface{}
+	err    error
+}
+
+// lookupCache keeps the fetched documents keyed by URL. The documents are
+// fetched without holding the lock, and only once for concurrent gets of the
+// same URL.
+type lookupCache struct {
+	sync.Mutex
+	docs     map[string]lookupDocument
+	fetching map[string]*lookupFetch
+}
+
+var lookupDocuments = newLookupCache()
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{docs: map[string]lookupDocument{}, fetching: map[string]*lookupFetch{}}
+}
+
+// flush empties the cache, the documents are fetched again on their next use
+func (c *lookupCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.docs = map[string]lookupDocument{}
+}
+
+// get returns the document of the URL, fetching it if it isn't cached or is
+// older than lookupTTL. If fetching it fails the expired document is used.
+func (c *lookupCache) get(url string, now time.Time) (map[string]interface{}, error) {
+	c.Lock()
+	doc, ok := c.docs[url]
+	if ok && now.Sub(doc.fetchedAt) < lookupTTL {
+		c.Unlock()
+		promLookupsTotal.WithLabelValues("hit").Inc()
+		return doc.values, nil
+	}
+	result := "hit"
+	fetch, fetching := c.fetching[url]
+	if !fetching {
+		// This get fetches the document, the concurrent ones wait for it
+		result = "miss"
+		fetch = &lookupFetch{done: make(chan struct{})}
+		c.fetching[url] = fetch
+		c.Unlock()
+		fetch.values, fetch.err = fetchLookupDocument(url)
+		c.Lock()
+		delete(c.fetching, url)
+		if fetch.err == nil {
+			c.docs[url] = lookupDocument{values: fetch.values, fetchedAt: now}
+		}
+		c.Unlock()
+		close(fetch.done)
+	} else {
+		c.Unlock()
+		<-fetch.done
+	}
+	if fetch.err != nil {
+		promLookupsTotal.WithLabelValues("error").Inc()
+		if ok {
+			log.WithFields(log.Fields{"url": url}).Warnln("Could not fetch the lookup document, using the expired one:", fetch.err)
+			return doc.values, nil
+		}
+		return nil, fetch.err
+	}
+	promLookupsTotal.WithLabelValues(result).Inc()
+	return fetch.values, nil
+}
+
+func fetchLookupDocument(url string) (map[string]interface{}, error) {
+	client := http.Client{
+		Timeout: lookupTimeout,
+		// The redirects could leave the allowed URLs
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !isAllowedLookupURL(req.URL.String()) {
+				return fmt.Errorf("redirect to %s is not in the lookup-allowed-urls", req.URL)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	values := map[string]interface{}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, lookupMaxBytes)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// isAllowedLookupURL returns whether the URL has the scheme and host of one
+// of the lookupAllowedURLs, and is under its path
+func isAllowedLookupURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, allowedURL := range lookupAllowedURLs {
+		allowed, err := url.Parse(allowedURL)
+		if err != nil {
+			continue
+		}
+		if u.Scheme == allowed.Scheme && strings.EqualFold(u.Host, allowed.Host) && isUnderPath(u.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnderPath returns whether p is prefix or one of its sub paths, once cleaned
+// so that e.g. /teams/../admin isn't under /teams
+func isUnderPath(p string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	p = path.Clean("/" + p)
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// validateLookupAllowedURL returns an error if the allowed URL doesn't have a
+// scheme and a host to match the URLs against
+func validateLookupAllowedURL(allowedURL string) error {
+	u, err := url.Parse(allowedURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s is not an http or https URL", allowedURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s has no host", allowedURL)
+	}
+	return nil
+}
+
+// lookup is the template function returning the value of the key in the json
+// document at the URL, e.g. {{ lookup "http://finops/cost-centers.json" .Labels.team }}
+func lookup(url string, key string) (string, error) {
+	if !isAllowedLookupURL(url) {
+		return "", fmt.Errorf("%w: %s is not in the lookup-allowed-urls", errLookupFailed, url)
+	}
+	values, err := lookupDocuments.get(url, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errLookupFailed, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %q is not in %s", errLookupFailed, key, url)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,288 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_lookup(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/teams/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"payments": "cc-1234", "search": 42}`))
+	}))
+	defer server.Close()
+
+	lookupAllowedURLs = []string{server.URL + "/teams"}
+	lookupDocuments = newLookupCache()
+	defer func() {
+		lookupAllowedURLs = nil
+		lookupDocuments = newLookupCache()
+	}()
+
+	tests := []struct {
+		name    string
+		url     string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{name: "string value", url: server.URL + "/teams", key: "payments", want: "cc-1234"},
+		{name: "number value", url: server.URL + "/teams", key: "search", want: "42"},
+		{name: "missing key", url: server.URL + "/teams", key: "unknown", wantErr: true},
+		{name: "not allowed url", url: server.URL + "/other", key: "payments", wantErr: true},
+		{name: "broken url", url: server.URL + "/teams/broken", key: "payments", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookup(tt.url, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("lookup() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if requests != 2 {
+		t.Errorf("lookup() made %v requests, want 2 since the document is cached", requests)
+	}
+}
+
+func Test_lookupCacheTTL(t *testing.T) {
+	var requests int32
+	broken := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if broken {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"payments": "cc-1234"}`))
+	}))
+	defer server.Close()
+
+	c := newLookupCache()
+	now := time.Now()
+	if _, err := c.get(server.URL, now); err != nil {
+		t.Fatalf("get() err = %v", err)
+	}
+	if _, err := c.get(server.URL, now.Add(lookupTTL/2)); err != nil || requests != 1 {
+		t.Errorf("get() before the ttl err = %v, requests = %v, want the cached document", err, requests)
+	}
+	broken = true
+	values, err := c.get(server.URL, now.Add(2*lookupTTL))
+	if err != nil || requests != 2 || values["payments"] != "cc-1234" {
+		t.Errorf("get() after the ttl = %v, %v, requests = %v, want the expired document after fetching again", values, err, requests)
+	}
+}
+
+func Test_renderTagTemplatesLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"payments": "cc-1234"}`))
+	}))
+	defer server.Close()
+
+	lookupAllowedURLs = []string{server.URL}
+	lookupDocuments = newLookupCache()
+	renderedTags = newTagCache(10)
+	defer func() {
+		lookupAllowedURLs = nil
+		lookupDocuments = newLookupCache()
+		renderedTags = newTagCache(tagCacheSize)
+	}()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("default")
+	pvc.SetLabels(map[string]string{"team": "payments"})
+
+	tags := map[string]string{
+		"cost-center": `{{ lookup "` + server.URL + `" .Labels.team }}`,
+		"unknown":     `{{ lookup "` + server.URL + `" "search" }}`,
+		"foo":         "bar",
+	}
+	want := map[string]string{"cost-center": "cc-1234", "foo": "bar"}
+	if got := renderTagTemplates(pvc, tags); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() = %v, want %v", got, want)
+	}
+	if len(renderedTags.tags) != 0 {
+		t.Errorf("renderTagTemplates() cached the looked up tags")
+	}
+}
+
+func Test_lookupCacheConcurrentGets(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte(`{"payments": "cc-1234"}`))
+	}))
+	defer server.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"search": "cc-5678"}`))
+	}))
+	defer other.Close()
+
+	c := newLookupCache()
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if values, err := c.get(server.URL, now); err != nil || values["payments"] != "cc-1234" {
+				t.Errorf("get() = %v, %v, want the document", values, err)
+			}
+		}()
+	}
+
+	// A slow document doesn't block the other URLs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if values, err := c.get(other.URL, now); err != nil || values["search"] != "cc-5678" {
+			t.Errorf("get() = %v, %v, want the other document", values, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("get() of another URL waited for the slow fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("get() made %v requests, want 1 for the concurrent gets", got)
+	}
+}
+
+func Test_isAllowedLookupURL(t *testing.T) {
+	lookupAllowedURLs = []string{"http://finops", "https://teams.internal/cost-centers/"}
+	defer func() { lookupAllowedURLs = nil }()
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "http://finops/cost-centers.json", want: true},
+		{url: "http://FINOPS/cost-centers.json", want: true},
+		{url: "http://finops.evil.com/cost-centers.json", want: false},
+		{url: "http://finops:8080/cost-centers.json", want: false},
+		{url: "https://finops/cost-centers.json", want: false},
+		{url: "http://user@finops/cost-centers.json", want: false},
+		{url: "https://teams.internal/cost-centers/payments.json", want: true},
+		{url: "https://teams.internal/cost-centers", want: true},
+		{url: "https://teams.internal/cost-centers-old/payments.json", want: false},
+		{url: "https://teams.internal/cost-centers/../admin", want: false},
+		{url: "://invalid", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := isAllowedLookupURL(tt.url); got != tt.want {
+				t.Errorf("isAllowedLookupURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateLookupAllowedURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "http://finops", wantErr: false},
+		{url: "https://teams.internal/cost-centers/", wantErr: false},
+		{url: "finops/cost-centers", wantErr: true},
+		{url: "file:///etc/passwd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := validateLookupAllowedURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateLookupAllowedURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_fetchLookupDocument(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"payments": "cc-other"}`))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/teams/moved":
+			http.Redirect(w, r, "/teams", http.StatusFound)
+		case "/teams/away":
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		case "/teams/large":
+			_, _ = w.Write([]byte(`{"payments": "` + strings.Repeat("a", 100) + `"}`))
+		default:
+			_, _ = w.Write([]byte(`{"payments": "cc-1234"}`))
+		}
+	}))
+	defer server.Close()
+
+	lookupAllowedURLs = []string{server.URL + "/teams"}
+	lookupMaxBytes = 64
+	defer func() {
+		lookupAllowedURLs = nil
+		lookupMaxBytes = 1 << 20
+	}()
+
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "document", url: server.URL + "/teams", want: "cc-1234"},
+		{name: "redirect to an allowed url", url: server.URL + "/teams/moved", want: "cc-1234"},
+		{name: "redirect to another url", url: server.URL + "/teams/away", wantErr: true},
+		{name: "too large", url: server.URL + "/teams/large", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := fetchLookupDocument(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchLookupDocument() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && values["payments"] != tt.want {
+				t.Errorf("fetchLookupDocument() = %v, want %v", values["payments"], tt.want)
+			}
+		})
+	}
+}
@@ -32,19 +32,19 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/leaderelection"
-	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 var (
 	buildVersion            string = ""
 	buildTime               string = ""
+	buildCommit             string = ""
 	debugEnv                string = os.Getenv("DEBUG")
 	logFormatEnv            string = os.Getenv("LOG_FORMAT")
 	debug                   bool
@@ -53,14 +53,45 @@ var (
 	annotationPrefix        string = "k8s-pvc-tagger"
 	legacyAnnotationPrefix  string = "aws-ebs-tagger"
 	watchNamespace          string
+	cloudProvider           string = cloudProviderAWS
+	pvcLabelSelector        string
+	pvcFieldSelector        string
+	listPageSize            int64
+	listFromWatchCache      bool   = true
 	tagFormat               string = "json"
 	allowAllTags            bool
+	backupPlanTagKey        string = "backup-plan"
+	nameTagTemplate         string
+	allowedBackupPlans      []string
+	ignoredProvisioners     []string
+	tagSources              []string          = []string{tagSourceAnnotations}
+	defaultTargets          []string          = []string{targetVolume}
+	labelValueReplacer      *strings.Replacer = strings.NewReplacer()
+	maxRetries              int               = 5
+	retryBaseDelay          time.Duration     = 5 * time.Second
+	retryMaxDelay           time.Duration     = 5 * time.Minute
+	maxAnnotationSize       int               = 16384
+	maxAnnotationTags       int               = 50
+	maxAnnotationValueLen   int               = maxTagValueLength
 
 	promActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "k8s_pvc_tagger_actions_total",
 		Help: "The total number of PVCs tagged",
 	}, []string{"status", "storageclass"})
 
+	promTagSuccessRatio = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_tag_success_ratio",
+		Help: "The ratio of successful tag operations over the --success-ratio-window, 1 when there were none",
+	}, func() float64 { return tagSuccesses.ratio(time.Now()) })
+
+	promTagWindowOperations = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_tag_window_operations",
+		Help: "The number of tag operations over the --success-ratio-window",
+	}, func() float64 {
+		successes, failures := tagSuccesses.counts(time.Now())
+		return float64(successes + failures)
+	})
+
 	promIgnoredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "k8s_pvc_tagger_pvc_ignored_total",
 		Help: "The total number of PVCs ignored",
@@ -71,6 +102,260 @@ var (
 		Help: "The total number of invalid tags found",
 	}, []string{"storageclass"})
 
+	promSnapshotActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_snapshot_actions_total",
+		Help: "The total number of snapshots tagged",
+	}, []string{"status"})
+
+	promRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_retries_total",
+		Help: "The total number of retried tag operations",
+	})
+
+	promTagErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_tag_errors_total",
+		Help: "The total number of failed tag operations by provider and error class",
+	}, []string{"provider", "class"})
+
+	promCoalescedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_coalesced_operations_total",
+		Help: "The total number of tag operations merged into a pending one by the coalesce window",
+	})
+
+	promMultiAttachConflicts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_multi_attach_conflicts",
+		Help: "The number of multi-attach volumes whose PVCs want different tags",
+	})
+
+	promTagCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_tag_cache_hits_total",
+		Help: "The total number of rendered tag sets found in the cache",
+	})
+	promTagCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_tag_cache_misses_total",
+		Help: "The total number of rendered tag sets not found in the cache",
+	})
+	promTagCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_tag_cache_entries",
+		Help: "The number of rendered tag sets in the cache",
+	})
+
+	promLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_lookups_total",
+		Help: "The total number of documents used by the lookup tag template function, by whether they were cached (hit), fetched (miss) or could not be fetched (error)",
+	}, []string{"result"})
+
+	promLegacyAnnotationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_legacy_annotations_total",
+		Help: "The total number of times a deprecated aws-ebs-tagger annotation was read",
+	}, []string{"namespace", "annotation"})
+
+	promAPIServerDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_api_server_degraded",
+		Help: "Whether or not cloud writes are paused because the Kubernetes API server is unavailable",
+	})
+
+	promObservedPVCs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_observed_pvcs",
+		Help: "The number of PVCs whose tag changes are only reported until they are enforced",
+	})
+
+	promPausedNamespaces = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_paused_namespaces",
+		Help: "The number of namespaces whose tagging is paused with the admin API",
+	})
+
+	promWouldChangeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_would_change_total",
+		Help: "The total number of times the tags of an observed volume would have been changed",
+	}, []string{"namespace"})
+
+	promExemptPVCs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_exempt_pvcs",
+		Help: "The number of PVCs whose volumes are exempt from tag enforcement",
+	})
+
+	promWaitingForConsumerPVCs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_waiting_for_consumer_pvcs",
+		Help: "The number of PVCs whose volumes are not tagged until a pod uses them",
+	})
+
+	promExpiringTagsPVCs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_expiring_tags_pvcs",
+		Help: "The number of PVCs with ttl-tags tags that have not expired yet",
+	})
+
+	promJournalEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_journal_entries",
+		Help: "The number of in-flight tag operations in the tag journal",
+	})
+	promJournalRecoveredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_journal_recovered_total",
+		Help: "The total number of tag operations of a previous leader found in the tag journal, by whether they were already applied or had to be completed",
+	}, []string{"result"})
+
+	promKubernetesRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_pvc_tagger_kubernetes_request_duration_seconds",
+		Help:    "The latency of the requests to the Kubernetes API server, by verb and resource",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"verb", "resource"})
+
+	promKubernetesRateLimiterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_pvc_tagger_kubernetes_rate_limiter_duration_seconds",
+		Help:    "How long the requests to the Kubernetes API server waited for the client side rate limiter, by verb and resource",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"verb", "resource"})
+
+	promKubernetesRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_kubernetes_requests_total",
+		Help: "The total number of requests to the Kubernetes API server, by status code and method",
+	}, []string{"code", "method"})
+
+	promKubeClientCertReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_kube_client_cert_reloads_total",
+		Help: "The total number of times the client certificate of the kubeconfig was rotated, or failed to be reloaded, by result",
+	}, []string{"result"})
+
+	promBackfilledPVCsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_backfilled_pvcs_total",
+		Help: "The total number of existing PVCs resynced by the backfill queue, by namespace",
+	}, []string{"namespace"})
+
+	promNamespaceSynced = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_namespace_synced",
+		Help: "Whether the initial list of the PVCs of the watched namespace is done (1) or not (0), the namespace being all when watching every namespace",
+	}, []string{"namespace"})
+
+	promNamespaceSyncDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_namespace_sync_duration_seconds",
+		Help: "How long the initial list of the PVCs of the watched namespace took, including waiting for a list slot",
+	}, []string{"namespace"})
+
+	promNamespaceListedPVCs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_namespace_listed_pvcs",
+		Help: "The number of PVCs returned by the initial list of the watched namespace",
+	}, []string{"namespace"})
+
+	promBackfillQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_backfill_queue_length",
+		Help: "The number of existing PVCs waiting to be resynced",
+	})
+
+	promReclaimPolicyChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_reclaim_policy_changes_total",
+		Help: "The total number of PV reclaim policy changes that re-tagged a volume, by new reclaim policy",
+	}, []string{"policy"})
+
+	promMissingPermissions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_missing_permissions",
+		Help: "Whether the controller's IAM role is missing the permission, by IAM action",
+	}, []string{"action"})
+
+	promPermissionDenialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_permission_denials_total",
+		Help: "The total number of AWS calls denied for a missing permission, by IAM action",
+	}, []string{"action"})
+
+	promTerminatingNamespaceSkipsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_terminating_namespace_skips_total",
+		Help: "The total number of events, annotations and queued tag operations skipped because their namespace is terminating, by operation",
+	}, []string{"operation"})
+
+	promStateSnapshotConfigMaps = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_state_snapshot_configmaps",
+		Help: "The number of ConfigMaps the state snapshot is split across",
+	})
+
+	promPendingInformerResyncs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_pending_informer_resyncs",
+		Help: "The number of PVCs re-delivered by the informer resync waiting for their jitter delay",
+	})
+
+	promInformerResyncsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_informer_resyncs_total",
+		Help: "The total number of PVCs reconciled by the informer resync, by whether their tags changed",
+	}, []string{"result"})
+
+	promInFlightAPICalls = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_in_flight_api_calls",
+		Help: "The number of cloud API calls waiting for a response",
+	})
+
+	promInFlightAPICallWaitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_in_flight_api_call_waits_total",
+		Help: "The total number of cloud API calls that waited for a slot because max-in-flight-api-calls were outstanding",
+	})
+
+	promNamespaceAPICallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_namespace_api_calls_total",
+		Help: "The total number of cloud API calls, including retries, made for the PVCs of the namespace",
+	}, []string{"namespace", "service"})
+
+	promPassMutations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_pass_mutations",
+		Help: "The number of volumes tagged during the current mutation pass",
+	})
+
+	promGuardrailBlocksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_guardrail_blocks_total",
+		Help: "The total number of times a volume was not tagged because of the per pass or per namespace limit",
+	}, []string{"limit"})
+
+	promGuardrailDeferredPVCs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_guardrail_deferred_pvcs",
+		Help: "The number of PVCs whose tagging is deferred to the next mutation pass",
+	})
+
+	promAWSSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_aws_sessions",
+		Help: "The number of regions with an AWS session",
+	})
+
+	promInjectedFaultsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_injected_faults_total",
+		Help: "The total number of cloud API calls failed by --fault-injection",
+	}, []string{"class"})
+
+	promBackfillSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_backfill_skipped_total",
+		Help: "The total number of volumes skipped by the startup resync because they were already tagged",
+	})
+
+	promDeferredResyncs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_deferred_resyncs",
+		Help: "The number of PVCs waiting for the next sync window to be resynced",
+	})
+
+	promProviderHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_provider_healthy",
+		Help: "Whether the last provider health check succeeded",
+	}, []string{"provider"})
+
+	promAPICallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_api_calls_total",
+		Help: "The total number of cloud API calls, including retries",
+	}, []string{"service"})
+
+	promLeaderInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_leader_info",
+		Help: "The identity of the current leader, as seen by this replica",
+	}, []string{"identity"})
+
+	promIsLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_is_leader",
+		Help: "Whether or not this replica is the leader",
+	})
+
+	promDeadLetterVolumes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_dead_letter_volumes",
+		Help: "The number of volumes that could not be tagged after all retries",
+	})
+
+	promPVCInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_pvc_info",
+		Help: "Information about the volume of each PVC managed by the tagger",
+	}, []string{"namespace", "persistentvolumeclaim", "volume_id", "provider"})
+
 	promActionsLegacyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "k8s_aws_ebs_tagger_actions_total",
 		Help: "The total number of PVCs tagged",
@@ -107,9 +392,14 @@ func init() {
 	// APP Build information
 	log.Debugln("Application Version:", buildVersion)
 	log.Debugln("Application Build Time:", buildTime)
+	log.Debugln("Application Commit:", buildCommit)
 }
 
 func main() {
+	if code, ok := runCommand(os.Args[1:], os.Stdout, os.Stderr); ok {
+		os.Exit(code)
+	}
+
 	var kubeconfig string
 	var kubeContext string
 	var region string
@@ -117,84 +407,466 @@ func main() {
 	var leaseLockNamespace string
 	var leaseID string
 	var defaultTagsString string
+	var volumeTypeDefaultTagsString string
 	var statusPort string
 	var metricsPort string
+	var allowedBackupPlansString string
+	var snapshotSyncInterval time.Duration
+	var tagSourcesString string
+	var tagAnnotationAliasesString string
+	var defaultTargetsString string
+	var ignoredProvisionersString string
+	var lookupAllowedURLsString string
+	var stateConfigMap string
+	var enableEvents bool
+	var journalConfigMap string
+	var showVersion bool
+	var stateSyncInterval time.Duration
+	var labelValueReplacementsString string
+	var volumeIDRulesString string
+	var syncWindowsString string
+	var providerConcurrencyString string
+	var providerQPSString string
+	var enforceAfterString string
+	var namespaceEnforceAfterString string
+	var allowedValuesSource string
+	var providerHealthInterval time.Duration
+	var allowedValuesRefreshInterval time.Duration
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	flag.StringVar(&kubeContext, "context", "", "the context to use")
+	flag.DurationVar(&clientCertReloadInterval, "kube-client-cert-reload-interval", 0, "How often to read the client certificate of the kubeconfig again when running out of the cluster, so that a rotated certificate is used without a restart (0 disables)")
 	flag.StringVar(&region, "region", os.Getenv("AWS_REGION"), "the region")
-	flag.StringVar(&leaseID, "lease-id", uuid.New().String(), "the holder identity name")
+	flag.StringVar(&providerEndpoint, "provider-endpoint", "", "Override the cloud provider API endpoint, e.g. http://localhost:4566 for LocalStack")
+	flag.BoolVar(&localstack, "localstack", false, "Use static test credentials with the provider-endpoint, unless AWS_ACCESS_KEY_ID or AWS_PROFILE is set, for LocalStack")
+	flag.StringVar(&cloudProvider, "provider", cloudProviderAWS, "The cloud provider to tag volumes with (aws, fake). The fake provider keeps the tags in memory and needs no cloud credentials")
+	flag.StringVar(&leaseID, "lease-id", defaultLeaseID(), "the holder identity name, defaults to <pod name>_<node name>_<uuid>")
 	flag.StringVar(&leaseLockName, "lease-lock-name", "k8s-pvc-tagger", "the lease lock resource name")
-	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", os.Getenv("NAMESPACE"), "the lease lock resource namespace")
+	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", os.Getenv("NAMESPACE"), "the lease lock resource namespace, defaults to the pod's namespace")
+	flag.StringVar(&leaderElectResourceLock, "leader-elect-resource-lock", leaderElectResourceLock, "The type of the leader election lock: leases, or configmapsleases/endpointsleases to migrate from a ConfigMap/Endpoints lock")
 	flag.StringVar(&defaultTagsString, "default-tags", "", "Default tags to add to EBS/EFS volume")
+	flag.StringVar(&volumeTypeDefaultTagsString, "volume-type-default-tags", "", "A json encoded map of volume type (e.g. gp3, io2, st1 or efs) to the default tags to add to the volumes of that type")
 	flag.StringVar(&tagFormat, "tag-format", "json", "Whether the tags are in json or csv format. Default: json")
 	flag.StringVar(&annotationPrefix, "annotation-prefix", "k8s-pvc-tagger", "Annotation prefix to check")
 	flag.StringVar(&watchNamespace, "watch-namespace", os.Getenv("WATCH_NAMESPACE"), "A specific namespace to watch (default is all namespaces)")
+	flag.StringVar(&pvcLabelSelector, "label-selector", "", "Only watch PVCs matching this label selector, e.g. app=database")
+	flag.StringVar(&pvcFieldSelector, "field-selector", "", "Only watch PVCs matching this field selector, e.g. metadata.namespace!=kube-system")
+	flag.IntVar(&namespaceListConcurrency, "namespace-list-concurrency", 5, "How many of the --watch-namespace namespaces list their PVCs at the same time on startup, 0 for no limit")
+	flag.Int64Var(&listPageSize, "list-page-size", 0, "The number of PVCs to request per page when listing PVCs (default is the client-go default of 500)")
+	flag.BoolVar(&listFromWatchCache, "list-from-watch-cache", true, "Whether the initial PVC list is served from the API server watch cache (resourceVersion=0). Disable to paginate the list from etcd")
+	flag.DurationVar(&informerResyncPeriod, "informer-resync-period", 0, "How often the PVC informer re-delivers every PVC to recompute its tags, which only tags the volumes whose tags changed (0 disables)")
+	flag.Float64Var(&informerResyncJitter, "informer-resync-jitter", informerResyncJitter, "The fraction of the informer-resync-period over which the re-delivered PVCs are spread, between 0 and 1")
+	flag.IntVar(&maxMutationsPerPass, "max-mutations-per-pass", 0, "The maximum number of volumes tagged per mutation-pass-duration, the others are deferred to the next pass (0 for no limit)")
+	flag.DurationVar(&mutationPassDuration, "mutation-pass-duration", mutationPassDuration, "The duration of a pass for max-mutations-per-pass")
+	flag.StringVar(&enforceAfterString, "enforce-after", "", "An RFC 3339 time until which the tag changes are only reported with WouldChangeTags events, e.g. 2006-01-02T15:04:05Z, then they are enforced (default is to enforce them right away)")
+	flag.StringVar(&namespaceEnforceAfterString, "namespace-enforce-after", "", "Comma separated list of <namespace>=<RFC 3339 time> overriding enforce-after for the PVCs of the namespace")
+	flag.IntVar(&maxVolumesPerNamespace, "max-volumes-per-namespace", 0, "The maximum number of volumes tagged per namespace (0 for no limit)")
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 0, "How long to wait for more changes to a PVC before tagging its volume, so that repeated edits result in a single API call (0 disables)")
+	flag.StringVar(&providerConcurrencyString, "provider-concurrency", "", "Comma separated list of the maximum number of concurrent tag operations per provider, e.g. aws-ebs=10,aws-efs=2 (default is unlimited)")
+	flag.StringVar(&providerQPSString, "provider-qps", "", "Comma separated list of the maximum number of tag operations per second per provider, e.g. aws-ebs=20,aws-efs=1 (default is unlimited)")
+	flag.DurationVar(&providerHealthInterval, "provider-health-interval", time.Minute, "How often to check that the cloud provider credentials are valid, the result is served by /readyz (0 disables)")
+	flag.IntVar(&maxInFlightAPICalls, "max-in-flight-api-calls", 0, "The maximum number of cloud API calls waiting for a response at the same time, the others wait for one to complete (0 is unlimited)")
+	flag.BoolVar(&multiRegion, "multi-region", false, "Whether or not to send the API calls of a volume to the region of its PV, read from its topology, instead of the tagger's region")
+	flag.DurationVar(&sessionRefreshInterval, "aws-session-refresh-interval", 0, "How often the AWS credentials of every region's session are retrieved again (0 only retrieves them when they expire)")
+	flag.StringVar(&faultInjectionString, "fault-injection", "", "Comma separated list of <class>=<rate> of the cloud API calls to fail with simulated errors, e.g. throttled=0.1,not-found=0.01 (classes: throttled, permission-denied, not-found, transient). Only for testing the alerting and retries in staging")
+	flag.StringVar(&faultInjectionOperationsString, "fault-injection-operations", "", "Comma separated list of the cloud API operations to inject faults into, e.g. CreateTags,TagResource (default is all operations)")
+	flag.IntVar(&maxAPICallsPerMinute, "max-api-calls-per-minute", 0, "The maximum number of cloud API calls per minute, shared by all providers, to only use a slice of an account's API quota (0 is unlimited)")
+	flag.IntVar(&tagCacheSize, "tag-cache-size", tagCacheSize, "The maximum number of rendered tag sets to cache so the templates aren't executed again on every resync (0 disables the cache)")
+	flag.IntVar(&maxAnnotationSize, "max-annotation-size", maxAnnotationSize, "The maximum size in bytes of a tags annotation, larger annotations are ignored")
+	flag.IntVar(&maxAnnotationTags, "max-annotation-tags", maxAnnotationTags, "The maximum number of tags in a tags annotation, the tags after it in key order are ignored")
+	flag.IntVar(&maxAnnotationValueLen, "max-annotation-value-length", maxAnnotationValueLen, "The maximum length of a tag value in a tags annotation, longer values are ignored")
+	flag.IntVar(&maxRetries, "max-retries", 5, "The number of times a failed tag operation is retried before the volume is moved to the dead letters")
+	flag.BoolVar(&enableEvents, "enable-events", true, "Whether or not to record Events on the PVCs, which needs the create and patch permissions on events")
+	flag.BoolVar(&writeSkipReasons, "write-skip-reason", false, "Write why a PVC's tags are not applied (ignored, exempt, waiting-for-consumer, invalid-tags) to its skip-reason annotation. Requires the patch permission on PVCs")
+	flag.BoolVar(&enableTagPlayground, "enable-tag-playground", false, "Serve /debug/tags on the status port, which returns the tags computed for the PVC manifest in the request body and where each tag was set from")
+	flag.BoolVar(&enableDesiredTagsAPI, "enable-desired-tags-api", false, "Serve the desired tags of the managed volumes at /v1/volumes/{id}/desired-tags, /v1/pvcs/{namespace}/{name} and /v1/desired-tag-hashes on the status port")
+	flag.DurationVar(&apiServerDegradedAfter, "api-server-degraded-after", apiServerDegradedAfter, "How long the Kubernetes API server has to be unreachable before cloud writes are paused until it is reachable again")
+	flag.BoolVar(&showVersion, "version", false, "Print the version and exit, see the version command for the json output")
+	flag.StringVar(&journalConfigMap, "journal-configmap", "", "The name of the ConfigMap, in the lease lock namespace, used as a journal of the in-flight tag operations so a new leader can complete them after a crash (disabled if empty)")
+	flag.StringVar(&stateConfigMap, "state-configmap", "", "The name of the ConfigMap, in the lease lock namespace, used to persist which volumes are already tagged (disabled if empty)")
+	flag.DurationVar(&stateSyncInterval, "state-sync-interval", time.Minute, "How often to persist the state to the state-configmap")
 	flag.StringVar(&statusPort, "status-port", "8000", "The healthz port")
 	flag.StringVar(&metricsPort, "metrics-port", "8001", "The prometheus metrics port")
+	flag.StringVar(&taggingAPI, "tagging-api", taggingAPI, "The API the volumes are tagged with: service for the EC2 and EFS APIs, or resourcegroups for the Resource Groups Tagging API")
+	flag.DurationVar(&taggingAPIBatchWindow, "tagging-api-batch-window", taggingAPIBatchWindow, "With tagging-api=resourcegroups, how long a call waits for the calls of other volumes with the same tags to be sent along, up to 20 volumes per call (0 disables)")
+	flag.StringVar(&statsdAddress, "statsd-address", "", "The host:port of a StatsD/DogStatsD agent, e.g. a Datadog agent, to also send the metrics to over UDP")
+	flag.DurationVar(&successRatioWindow, "success-ratio-window", successRatioWindow, "The rolling window of the k8s_pvc_tagger_tag_success_ratio metric")
+	flag.DurationVar(&statsdInterval, "statsd-interval", statsdInterval, "How often the metrics are sent to the StatsD agent")
+	flag.StringVar(&clusterName, "cluster-name", "", "The name of the cluster, used to set the managed-by=k8s-pvc-tagger/<cluster-name> tag and to not modify volumes managed by another cluster (disabled if empty)")
+	flag.StringVar(&backfillMode, "backfill", backfillAll, "Which volumes the startup resync tags: all, or missing-only to skip the volumes that already have the managed-by tag and all of their tags (needs --cluster-name)")
+	flag.BoolVar(&discoverClusterName, "discover-cluster-name", false, "Whether or not to read the cluster name from the kubernetes.io/cluster/<name> or eks:cluster-name tag of the instance the tagger runs on when cluster-name is not set")
+	flag.BoolVar(&forceTakeover, "force-takeover", false, "Whether or not to tag volumes whose managed-by tag belongs to another cluster")
+	flag.StringVar(&nameTagTemplate, "name-tag-template", "", "A template for the Name tag of the volumes, e.g. {{ .Namespace }}/{{ .Name }}. It can be overridden with the name annotation (disabled if empty)")
 	flag.BoolVar(&allowAllTags, "allow-all-tags", false, "Whether or not to allow any tag, even Kubernetes assigned ones, to be set")
+	flag.StringVar(&reclaimPolicyTagKey, "reclaim-policy-tag-key", "", "The tag key set to the reclaim policy (Retain, Delete) of the PVC's PV, updated when the policy changes. Disabled when empty")
+	flag.StringVar(&tagsHashKey, "tags-hash-key", "", "The tag key set to a hash of the other tags applied to the volume, for drift detection. Disabled when empty")
+	flag.StringVar(&backupPlanTagKey, "backup-plan-tag-key", "backup-plan", "The tag key used by AWS Backup / DLM policies to select volumes")
+	flag.BoolVar(&drTags, "dr-tags", false, "Whether or not to set the DR tags from the dr-replicate and dr-region annotations of the PVC, its namespace or its StorageClass, and copy them to the volume's snapshots")
+	flag.StringVar(&drReplicateTagKey, "dr-replicate-tag-key", drReplicateTagKey, "The tag key DR tooling selects the volumes and snapshots to replicate with")
+	flag.StringVar(&drRegionTagKey, "dr-region-tag-key", drRegionTagKey, "The tag key set to the region the volume is replicated to")
+	flag.BoolVar(&deletionProtection, "deletion-protection", false, "Whether or not to set the deletion protection tag from the deletion-protection annotation of the PVC or its namespace, and remove it when the annotation is cleared")
+	flag.StringVar(&deletionProtectionTagKey, "deletion-protection-tag-key", deletionProtectionTagKey, "The tag key set to true on the volumes of protected PVCs")
+	flag.StringVar(&tagAnnotationAliasesString, "tag-annotation-aliases", "", "Comma separated list of tag keys that can be set with their own <annotation-prefix>/<key> annotation")
+	flag.StringVar(&tagSourcesString, "tag-sources", tagSourceAnnotations, "Comma separated list of where to read PVC tags from (annotations, labels, pv-annotations). Sources later in the list take precedence")
+	flag.StringVar(&defaultTargetsString, "default-targets", targetVolume, "Comma separated list of the resources to tag for PVCs without a targets annotation (volume, snapshots, file-system)")
+	flag.StringVar(&volumeIDRulesString, "volume-id-rules", "", "A json encoded list of rules to resolve the volume ID of custom CSI drivers, e.g. [{\"driver\": \"ebs.example.com\", \"pattern\": \"^wrapped-(vol-\\\\w+)$\", \"provider\": \"aws-ebs\"}]")
+	flag.StringVar(&labelValueReplacementsString, "label-value-replacements", "", "A json encoded map of strings to replace in label keys and values when converting them to tags, e.g. {\"__\": \"/\"}")
+	flag.StringVar(&syncWindowsString, "sync-windows", "", "Comma separated list of daily HH:MM-HH:MM windows, in UTC, during which the startup resync of existing PVCs and the snapshot tag sync run, e.g. 22:00-06:00 (default is always)")
+	flag.DurationVar(&snapshotSyncInterval, "snapshot-sync-interval", 0, "How often to copy volume tags onto EBS snapshots created outside of Kubernetes (0 disables)")
+	flag.StringVar(&allowedValuesSource, "allowed-values-source", "", "A URL returning a json map of tag keys to their allowed values, or configmap:<namespace>/<name>, used to reject unknown values of tags such as cost-center (disabled if empty)")
+	flag.BoolVar(&validateTagPolicy, "validate-tag-policy", false, "Whether or not to check the tags against the effective AWS Organizations tag policy of the account before applying them")
+	flag.DurationVar(&tagPolicyRefreshInterval, "tag-policy-refresh-interval", tagPolicyRefreshInterval, "How often to reload the effective tag policy")
+	flag.DurationVar(&allowedValuesRefreshInterval, "allowed-values-refresh-interval", 5*time.Minute, "How often to reload the allowed-values-source")
+	flag.BoolVar(&nodeTemplateVars, "node-template-vars", false, "Whether or not to look up the node of the PVC's pod for the Node, NodeLabels, NodePool, InstanceType, Zone and CapacityType tag template variables")
+	flag.BoolVar(&ebsTemplateVars, "ebs-template-vars", false, "Whether or not to describe the PVC's EBS volume for the Encrypted, KMSKeyID, KMSKeyAlias, VolumeType, Iops and Throughput tag template variables")
+	flag.BoolVar(&volumeTemplateVars, "volume-template-vars", false, "Whether or not to read the PV bound to the PVC for the VolumeHandle, VolumeAttributes, AccessPointID and AccessPointPath template variables")
+	flag.BoolVar(&waitForConsumer, "wait-for-consumer", false, "Whether or not to wait for a pod to use a PVC before tagging its volume, so that the node template variables are known")
+	flag.DurationVar(&waitForConsumerTimeout, "wait-for-consumer-timeout", waitForConsumerTimeout, "How long after a PVC is created to wait for a pod to use it before tagging its volume with what is known")
+	flag.StringVar(&lookupAllowedURLsString, "lookup-allowed-urls", "", "Comma separated list of URL prefixes the lookup tag template function can fetch json documents from (disabled if empty)")
+	flag.DurationVar(&lookupTTL, "lookup-ttl", lookupTTL, "How long the documents fetched by the lookup tag template function are cached")
+	flag.DurationVar(&lookupTimeout, "lookup-timeout", lookupTimeout, "The timeout of fetching a document for the lookup tag template function")
+	flag.StringVar(&ignoredProvisionersString, "ignored-provisioners", defaultIgnoredProvisioners, "Comma separated list of provisioners whose PVCs are never tagged, and are skipped without being logged")
+	flag.StringVar(&allowedBackupPlansString, "allowed-backup-plans", "", "Comma separated list of backup plan values that can be set via the backup-plan annotation")
+	flag.StringVar(&adminSocket, "admin-socket", "", "The Unix socket to serve the admin API on, e.g. "+defaultAdminSocket+" (disabled if empty)")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "A file with the bearer token the admin API requests must have")
+	flag.BoolVar(&adminInsecureNoToken, "admin-insecure-no-token", false, "Serve the admin API without admin-token-file, only protected by the permissions of the socket")
+	flag.Usage = func() { printUsage(flag.CommandLine.Output(), flag.CommandLine) }
 	flag.Parse()
 
+	if showVersion {
+		if err := printVersion(os.Stdout, "text"); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+
 	if leaseLockName == "" {
 		log.Fatalln("unable to get lease lock resource name (missing lease-lock-name flag).")
 	}
 	if leaseLockNamespace == "" {
-		leaseLockNamespace = getCurrentNamespace()
+		leaseLockNamespace = getCurrentNamespace(kubeconfig, kubeContext)
 		if leaseLockNamespace == "" {
 			log.Fatalln("unable to get lease lock resource namespace (missing lease-lock-namespace flag).")
 		}
 	}
+	if err := validateResourceLock(leaderElectResourceLock); err != nil {
+		log.Fatalln("leader-elect-resource-lock is not valid:", err)
+	}
+	log.WithFields(log.Fields{"name": leaseLockName, "namespace": leaseLockNamespace, "type": leaderElectResourceLock}).Infoln("Leader Election Lock")
 
-	defaultTags = make(map[string]string)
-	if defaultTagsString != "" {
-		log.Debugln("defaultTagsString:", defaultTagsString)
-		if tagFormat == "csv" {
-			defaultTags = parseCsv(defaultTagsString)
-		} else {
-			err := json.Unmarshal([]byte(defaultTagsString), &defaultTags)
-			if err != nil {
-				log.Fatalln("default-tags are not valid json key/value pairs:", err)
-			}
-		}
+	if err := validateInformerResync(informerResyncPeriod, informerResyncJitter); err != nil {
+		log.Fatalln("informer-resync-period is not valid:", err)
+	}
+	if err := validateMutationGuardrails(maxMutationsPerPass, mutationPassDuration, maxVolumesPerNamespace); err != nil {
+		log.Fatalln("mutation guardrails are not valid:", err)
 	}
+	if _, err := labels.Parse(pvcLabelSelector); err != nil {
+		log.Fatalln("label-selector is not a valid label selector:", err)
+	}
+	if _, err := fields.ParseSelector(pvcFieldSelector); err != nil {
+		log.Fatalln("field-selector is not a valid field selector:", err)
+	}
+
+	log.Debugln("defaultTagsString:", defaultTagsString)
+	tags, err := parseDefaultTags(defaultTagsString)
+	if err != nil {
+		log.Fatalln("default-tags are not valid json key/value pairs:", err)
+	}
+	defaultTags = tags
 	log.WithFields(log.Fields{"tags": defaultTags}).Infoln("Default Tags")
 
-	// Parse AWS_REGION environment variable.
-	if len(region) == 0 {
-		region, _ = getMetadataRegion()
-		log.WithFields(log.Fields{"region": region}).Debugln("ec2Metadata region")
+	typeTags, err := parseVolumeTypeDefaultTags(volumeTypeDefaultTagsString)
+	if err != nil {
+		log.Fatalln("volume-type-default-tags are not a valid json map of volume type to key/value pairs:", err)
 	}
-	ok, err := regexp.Match(regexpAWSRegion, []byte(region))
+	volumeTypeDefaultTags = typeTags
+	if len(volumeTypeDefaultTags) > 0 {
+		log.WithFields(log.Fields{"volumeTypes": volumeTypes(volumeTypeDefaultTags)}).Infoln("Volume type default tags")
+	}
+
+	tagSources, err = parseTagSources(tagSourcesString)
 	if err != nil {
-		log.Fatalln("Failed to parse AWS_REGION:", err.Error())
+		log.WithFields(log.Fields{"sources": tagSourceNames()}).Fatalln("tag-sources is not valid:", err)
+	}
+	log.WithFields(log.Fields{"sources": tagSources}).Infoln("Tag Sources")
+
+	tagAnnotationAliases, err = parseTagAnnotationAliases(tagAnnotationAliasesString)
+	if err != nil {
+		log.Fatalln("tag-annotation-aliases is not valid:", err)
+	}
+	if drTags {
+		if err := validateDRTagKeys(drReplicateTagKey, drRegionTagKey); err != nil {
+			log.Fatalln("dr-replicate-tag-key and dr-region-tag-key are not valid:", err)
+		}
+		log.WithFields(log.Fields{"replicate": drReplicateTagKey, "region": drRegionTagKey}).Infoln("DR tags")
+	}
+	if deletionProtection {
+		if err := validateTag(deletionProtectionTagKey, "true"); err != nil {
+			log.Fatalln("deletion-protection-tag-key is not valid:", err)
+		}
+		log.WithFields(log.Fields{"key": deletionProtectionTagKey}).Infoln("Deletion protection tag")
 	}
-	if !ok {
-		log.Fatalln("Given AWS_REGION does not match AWS Region format.")
+	if len(tagAnnotationAliases) > 0 {
+		log.WithFields(log.Fields{"aliases": tagAnnotationAliases}).Infoln("Tag annotation aliases")
 	}
-	awsSession = createAWSSession(region)
-	if awsSession == nil {
-		err = fmt.Errorf("nil AWS session: %v", awsSession)
+
+	defaultTargets = nil
+	for _, target := range strings.Split(defaultTargetsString, ",") {
+		target = strings.TrimSpace(target)
+		if !isValidTarget(target) {
+			log.Fatalln("default-targets has an invalid target:", target)
+		}
+		defaultTargets = append(defaultTargets, target)
+	}
+	log.WithFields(log.Fields{"targets": defaultTargets}).Infoln("Default Targets")
+	if containsString(defaultTargets, targetSnapshots) && snapshotSyncInterval == 0 {
+		log.Warnln("default-targets has the snapshots target without --snapshot-sync-interval, the snapshots created after a PVC is reconciled won't be tagged")
+	}
+
+	if labelValueReplacementsString != "" {
+		labelValueReplacements := map[string]string{}
+		err := json.Unmarshal([]byte(labelValueReplacementsString), &labelValueReplacements)
 		if err != nil {
-			log.Println(err.Error())
+			log.Fatalln("label-value-replacements are not valid json key/value pairs:", err)
 		}
-		os.Exit(1)
+		labelValueReplacer = newLabelValueReplacer(labelValueReplacements)
+	}
+
+	if volumeIDRulesString != "" {
+		rules, err := parseVolumeIDRules(volumeIDRulesString)
+		if err != nil {
+			log.Fatalln("volume-id-rules are not valid:", err)
+		}
+		volumeIDRules = rules
+		log.WithFields(log.Fields{"rules": len(volumeIDRules)}).Infoln("Volume ID Rules")
+	}
+
+	providerConcurrency, err := parseProviderConcurrency(providerConcurrencyString)
+	if err != nil {
+		log.Fatalln("provider-concurrency is not valid:", err)
+	}
+	if enforceAfterString != "" {
+		enforceAfter, err = time.Parse(time.RFC3339, enforceAfterString)
+		if err != nil {
+			log.Fatalln("enforce-after must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z:", err)
+		}
+	}
+	namespaceEnforceAfter, err = parseNamespaceEnforceAfter(namespaceEnforceAfterString)
+	if err != nil {
+		log.Fatalln("namespace-enforce-after is not valid:", err)
+	}
+	if !enforceAfter.IsZero() || len(namespaceEnforceAfter) > 0 {
+		log.WithFields(log.Fields{"enforceAfter": enforceAfterString, "namespaces": namespaceEnforceAfterString}).Infoln("Tag changes are only reported until they are enforced")
+	}
+
+	providerQPS, err := parseProviderLimits(providerQPSString)
+	if err != nil {
+		log.Fatalln("provider-qps is not valid:", err)
+	}
+	providerLimiters = newProviderLimiters(providerConcurrency, providerQPS)
+	log.WithFields(log.Fields{"concurrency": providerConcurrency, "qps": providerQPS}).Infoln("Provider Limits")
+
+	if err := validateMaxInFlightAPICalls(maxInFlightAPICalls); err != nil {
+		log.Fatalln("max-in-flight-api-calls is not valid:", err)
+	}
+	inFlightAPICalls = newInFlightLimiter(maxInFlightAPICalls)
+	if maxAPICallsPerMinute > 0 {
+		apiBudget = newAPIBudget(maxAPICallsPerMinute)
+	}
+	if faultInjectionString != "" {
+		rates, err := parseFaultInjection(faultInjectionString)
+		if err != nil {
+			log.Fatalln("fault-injection is not valid:", err)
+		}
+		var operations []string
+		for _, operation := range strings.Split(faultInjectionOperationsString, ",") {
+			if operation = strings.TrimSpace(operation); operation != "" {
+				operations = append(operations, operation)
+			}
+		}
+		faults = newFaultInjector(rates, operations)
+		log.WithFields(log.Fields{"faults": faultInjectionString, "operations": operations}).Warnln("Injecting faults into the cloud API calls, do not use in production")
+	}
+
+	if err := validateAdminToken(adminSocket, adminTokenFile, adminInsecureNoToken); err != nil {
+		log.Fatalln(err)
+	}
+	if adminTokenFile != "" {
+		token, err := readAdminToken(adminTokenFile)
+		if err != nil {
+			log.Fatalln("admin-token-file is not valid:", err)
+		}
+		adminToken = token
 	}
 
+	renderedTags = newTagCache(tagCacheSize)
+	tagSuccesses = newSuccessWindow(successRatioWindow)
+
+	if syncWindowsString != "" {
+		windows, err := parseSyncWindows(syncWindowsString)
+		if err != nil {
+			log.Fatalln("sync-windows are not valid:", err)
+		}
+		syncWindows = windows
+		log.WithFields(log.Fields{"windows": syncWindowsString}).Infoln("Sync Windows")
+	}
+
+	for _, provisioner := range strings.Split(ignoredProvisionersString, ",") {
+		if provisioner = strings.TrimSpace(provisioner); provisioner != "" {
+			ignoredProvisioners = append(ignoredProvisioners, provisioner)
+		}
+	}
+	log.WithFields(log.Fields{"provisioners": ignoredProvisioners}).Infoln("Ignored Provisioners")
+
+	for _, url := range strings.Split(lookupAllowedURLsString, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			if err := validateLookupAllowedURL(url); err != nil {
+				log.Fatalln("lookup-allowed-urls are not valid:", err)
+			}
+			lookupAllowedURLs = append(lookupAllowedURLs, url)
+		}
+	}
+
+	for _, plan := range strings.Split(allowedBackupPlansString, ",") {
+		if plan = strings.TrimSpace(plan); plan != "" {
+			allowedBackupPlans = append(allowedBackupPlans, plan)
+		}
+	}
+	if len(allowedBackupPlans) > 0 {
+		log.WithFields(log.Fields{"plans": allowedBackupPlans}).Infoln("Allowed Backup Plans")
+	}
+
+	switch cloudProvider {
+	case cloudProviderAWS:
+		// Parse AWS_REGION environment variable.
+		if len(region) == 0 && providerEndpoint != "" && localstack {
+			region = "us-east-1"
+		} else if len(region) == 0 {
+			region, _ = getMetadataRegion()
+			log.WithFields(log.Fields{"region": region}).Debugln("ec2Metadata region")
+		}
+		ok, err := regexp.Match(regexpAWSRegion, []byte(region))
+		if err != nil {
+			log.Fatalln("Failed to parse AWS_REGION:", err.Error())
+		}
+		if !ok {
+			log.Fatalln("Given AWS_REGION does not match AWS Region format.")
+		}
+		awsSession = awsSessions.session(region)
+		defaultRegion = region
+		if awsSession == nil {
+			err = fmt.Errorf("nil AWS session: %v", awsSession)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			os.Exit(1)
+		}
+		if err := validateTaggingAPI(taggingAPI); err != nil {
+			log.Fatalln("tagging-api is not valid:", err)
+		}
+		if multiRegion && taggingAPI == taggingAPIResourceGroups {
+			log.Fatalln("multi-region can't be used with tagging-api=" + taggingAPIResourceGroups + ", the volume ARNs are built for a single region")
+		}
+		if taggingAPI == taggingAPIResourceGroups {
+			resourceGroupsTagger, err = newResourceTagger(awsSession, region)
+			if err != nil {
+				log.Fatalln("Could not set up the Resource Groups Tagging API:", err)
+			}
+			log.WithFields(log.Fields{"accountID": resourceGroupsTagger.accountID, "partition": resourceGroupsTagger.partition}).Infoln("Tagging volumes with the Resource Groups Tagging API")
+		}
+		// The EBS volume types are described with the template variables' cache
+		if ebsTemplateVars || len(volumeTypeDefaultTags) > 0 {
+			volumeAttributes = newEBSVolumeAttributesFromSession(awsSession)
+		}
+		if drTags {
+			ec2Client, _ := newEC2Client()
+			drSnapshotSources = newDRSnapshotSourceStore(ec2Client)
+		}
+		if clusterName == "" && discoverClusterName {
+			instanceID, err := getMetadataInstanceID()
+			if err != nil {
+				log.Fatalln("Could not discover the cluster name:", err)
+			}
+			ec2Client, _ := newEC2Client()
+			clusterName, err = ec2Client.getInstanceClusterName(instanceID)
+			if err != nil {
+				log.Fatalln("Could not discover the cluster name:", err)
+			}
+			log.WithFields(log.Fields{"clusterName": clusterName, "instanceID": instanceID}).Infoln("Discovered the cluster name")
+		}
+	case cloudProviderFake:
+		log.Warnln("Using the fake provider, tags are only kept in memory and no cloud volume is tagged")
+	default:
+		log.Fatalln("provider is not a supported provider:", cloudProvider)
+	}
+
+	if err := validateBackfillMode(backfillMode); err != nil {
+		log.Fatalln("backfill is not valid:", err)
+	}
+
+	registerKubernetesClientMetrics()
 	k8sClient, err = BuildClient(kubeconfig, kubeContext)
 	if err != nil {
 		log.Fatalln("Unable to create kubernetes client", err)
 		os.Exit(1)
 	}
+	if enableEvents {
+		eventRecorder = newEventRecorder(k8sClient)
+	}
+	log.WithFields(log.Fields{"events": enableEvents, "stateConfigMap": stateConfigMap != "", "journalConfigMap": journalConfigMap != ""}).Infoln("Kubernetes Writes")
+
+	go runAPIServerHealthCheck(context.Background(), 10*time.Second, probeAPIServer)
+
+	if statsdAddress != "" {
+		go runStatsdEmitter(context.Background(), statsdAddress, statsdInterval)
+	}
+
+	if providerHealthInterval > 0 && cloudProvider == cloudProviderAWS {
+		go runProviderHealthCheck(context.Background(), providerHealthInterval, probeAWSProvider)
+	}
+
+	if validateTagPolicy && cloudProvider == cloudProviderAWS {
+		orgs := newOrganizationsClient()
+		refreshTagPolicy(orgs)
+		go runTagPolicyRefresh(context.Background(), orgs, tagPolicyRefreshInterval)
+	}
+	if allowedValuesSource != "" {
+		refreshAllowedValues(allowedValuesSource)
+		go runAllowedValuesRefresh(context.Background(), allowedValuesSource, allowedValuesRefreshInterval)
+	}
+	leaderIdentity = leaseID
+	providerRegion = region
+	go dumpStateOnSignal()
 
 	go func() {
 		mux := http.NewServeMux()
 		mux.HandleFunc("/healthz", statusHandler)
+		mux.HandleFunc("/readyz", readyHandler)
+		mux.HandleFunc("/debug/dead-letters", deadLettersHandler)
+		mux.HandleFunc("/debug/state", stateHandler)
+		mux.HandleFunc("/debug/ignored-pvcs", ignoredPVCsHandler)
+		if enableTagPlayground {
+			mux.HandleFunc("/debug/tags", tagPlaygroundHandler)
+		}
+		if enableDesiredTagsAPI {
+			mux.HandleFunc("/v1/volumes/", volumeDesiredTagsHandler)
+			mux.HandleFunc("/v1/pvcs/", pvcDesiredTagsHandler)
+			mux.HandleFunc("/v1/desired-tag-hashes", desiredTagHashesHandler)
+		}
 		err := http.ListenAndServe("0.0.0.0:"+statusPort, mux)
 		if err != nil {
 			log.Errorln(err)
 		}
 	}()
 
+	if adminSocket != "" {
+		go func() {
+			if err := serveAdminAPI(context.Background(), adminSocket); err != nil {
+				log.Errorln("Cannot serve the admin API:", err)
+			}
+		}()
+	}
+
 	go func() {
 		// Handle just the /metrics endpoint on the metrics port
 		mux := http.NewServeMux()
@@ -206,6 +878,31 @@ func main() {
 	}()
 
 	run := func(ctx context.Context) {
+		if stateConfigMap != "" {
+			state, err := loadStateSnapshot(leaseLockNamespace, stateConfigMap)
+			if err != nil {
+				log.Errorln("Could not load state snapshot:", err)
+			} else {
+				previousState = state
+				log.WithFields(log.Fields{"volumes": len(previousState)}).Infoln("Loaded state snapshot")
+			}
+			go runStateSnapshotSync(ctx, leaseLockNamespace, stateConfigMap, stateSyncInterval)
+		}
+
+		if journalConfigMap != "" {
+			tagJournal = newTagJournalStore(leaseLockNamespace, journalConfigMap)
+			efsClient, _ := newEFSClient()
+			ec2Client, _ := newEC2Client()
+			tagJournal.recover(efsClient, ec2Client)
+			go runTagJournalSync(ctx, 10*time.Second)
+		}
+
+		controllerStartTime = time.Now()
+		if len(syncWindows) > 0 {
+			go runDeferredResyncs(ctx, time.Minute)
+		}
+
+		namespaceListSlots = newNamespaceListSlots(namespaceListConcurrency)
 		var namespaces []string
 		if watchNamespace != "" {
 			namespaces = strings.Split(watchNamespace, ",")
@@ -215,6 +912,21 @@ func main() {
 		for _, ns := range namespaces {
 			go runWatchNamespaceTask(ctx, ns)
 		}
+		if snapshotSyncInterval > 0 {
+			go runSnapshotTagSync(ctx, snapshotSyncInterval)
+		}
+		if deletionProtection {
+			go watchNamespaceDeletionProtection(ctx.Done())
+		}
+		go watchPVs(ctx.Done(), namespaces)
+		if waitForConsumer || nodeTemplateVars {
+			for _, ns := range namespaces {
+				go watchPods(ctx.Done(), ns)
+			}
+		}
+		if cloudProvider == cloudProviderAWS && sessionRefreshInterval > 0 {
+			go runSessionRefresh(ctx, sessionRefreshInterval)
+		}
 	}
 
 	// use a Go context so we can tell the leaderelection code when we
@@ -233,17 +945,11 @@ func main() {
 		cancel()
 	}()
 
-	// we use the Lease lock type since edits to Leases are less common
-	// and fewer objects in the cluster watch "all Leases".
-	lock := &resourcelock.LeaseLock{
-		LeaseMeta: metav1.ObjectMeta{
-			Name:      leaseLockName,
-			Namespace: leaseLockNamespace,
-		},
-		Client: k8sClient.CoordinationV1(),
-		LockConfig: resourcelock.ResourceLockConfig{
-			Identity: leaseID,
-		},
+	// we use the Lease lock type by default since edits to Leases are less
+	// common and fewer objects in the cluster watch "all Leases".
+	lock, err := newLeaderElectionLock(k8sClient, leaderElectResourceLock, leaseLockNamespace, leaseLockName, leaseID)
+	if err != nil {
+		log.Fatalln("Cannot create the leader election lock:", err)
 	}
 
 	// start the leader election code loop
@@ -269,6 +975,7 @@ func main() {
 			},
 			OnNewLeader: func(identity string) {
 				// we're notified when new leader elected
+				currentLeader.set(identity, leaseID)
 				if identity == leaseID {
 					return
 				}
@@ -288,12 +995,36 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	_, err := w.Write([]byte("OK"))
+	status := "OK"
+	// Still healthy so the pod isn't restarted, the tagger resumes on its own
+	if err := apiServerHealth.get(); err != nil {
+		status = "degraded: " + err.Error()
+	}
+	if leader := currentLeader.get(); leader != "" {
+		status += "\nleader: " + leader
+	}
+	_, err := w.Write([]byte(status))
 	if err != nil {
 		log.Errorln("Cannot write status message:", err)
 	}
 }
 
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, err := w.Write([]byte("method is not implemented"))
+		if err != nil {
+			log.Errorln("Cannot write status message:", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(deadLetters.list())
+	if err != nil {
+		log.Errorln("Cannot write dead letters:", err)
+	}
+}
+
 func runWatchNamespaceTask(ctx context.Context, namespace string) {
 
 	// Make the informer's channel here so we can close it when the
@@ -305,6 +1036,47 @@ func runWatchNamespaceTask(ctx context.Context, namespace string) {
 	close(ch)
 }
 
+func runSnapshotTagSync(ctx context.Context, interval time.Duration) {
+	ec2Client, _ := newEC2Client()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !inSyncWindow(time.Now()) {
+				log.Debugln("Outside of the sync windows, skipping snapshot tag sync")
+				continue
+			}
+			if apiServerHealth.get() != nil {
+				log.Debugln("Kubernetes API server unavailable, skipping snapshot tag sync")
+				continue
+			}
+			log.Debugln("Syncing snapshot tags")
+			for _, v := range managedVolumes.list(providerAWSEBS) {
+				// The errors are logged, the volume is synced again on the next tick
+				ec2Client.forRegion(v.Region).syncSnapshotTags(v.VolumeID, v.Tags, nil)
+			}
+		}
+	}
+}
+
+// parseDefaultTags parses the --default-tags in the --tag-format
+func parseDefaultTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if value == "" {
+		return tags, nil
+	}
+	if tagFormat == "csv" {
+		return parseCsv(value), nil
+	}
+	if err := json.Unmarshal([]byte(value), &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
 func parseCsv(value string) map[string]string {
 
 	tags := make(map[string]string)
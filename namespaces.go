@@ -0,0 +1,88 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceListConcurrency is how many namespaces list their PVCs at the same time on startup
+var namespaceListConcurrency int
+
+// namespaceListSlots bounds how many namespaces list their PVCs at the same
+// time on startup, with --namespace-list-concurrency. There's no limit when nil.
+var namespaceListSlots chan struct{}
+
+func newNamespaceListSlots(concurrency int) chan struct{} {
+	if concurrency <= 0 {
+		return nil
+	}
+	return make(chan struct{}, concurrency)
+}
+
+// namespaceLabel is the namespace metric label, all when watching every namespace
+func namespaceLabel(namespace string) string {
+	if namespace == "" {
+		return "all"
+	}
+	return namespace
+}
+
+// runInformerWithListSlot runs the informer, waiting for a list slot for its
+// initial list, and reports the namespace's sync progress. It returns when ch
+// is closed and the informer and its event handlers have stopped.
+func runInformerWithListSlot(ch chan struct{}, namespace string, informer cache.SharedIndexInformer) {
+	labels := prometheus.Labels{"namespace": namespaceLabel(namespace)}
+	promNamespaceSynced.With(labels).Set(0)
+	start := time.Now()
+
+	if namespaceListSlots != nil {
+		select {
+		case namespaceListSlots <- struct{}{}:
+		case <-ch:
+			return
+		}
+	}
+	log.WithFields(log.Fields{"namespace": namespace}).Debugln("Listing the PVCs of the namespace")
+	stopped := make(chan struct{})
+	go func() {
+		informer.Run(ch)
+		close(stopped)
+	}()
+	defer func() { <-stopped }()
+	synced := cache.WaitForCacheSync(ch, informer.HasSynced)
+	if namespaceListSlots != nil {
+		<-namespaceListSlots
+	}
+	if !synced {
+		return
+	}
+
+	duration := time.Since(start)
+	pvcs := len(informer.GetStore().ListKeys())
+	promNamespaceSynced.With(labels).Set(1)
+	promNamespaceSyncDuration.With(labels).Set(duration.Seconds())
+	promNamespaceListedPVCs.With(labels).Set(float64(pvcs))
+	log.WithFields(log.Fields{"namespace": namespace, "pvcs": pvcs, "duration": duration}).Infoln("Listed the PVCs of the namespace")
+	<-ch
+}
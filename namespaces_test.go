@@ -0,0 +1,99 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_runInformerWithListSlot(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team-a"}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team-a"}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "team-b"}},
+	)
+	namespaceListSlots = newNamespaceListSlots(1)
+	defer func() { namespaceListSlots = nil }()
+
+	ch := make(chan struct{})
+	defer close(ch)
+	for _, ns := range []string{"team-a", "team-b", "team-c"} {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(ns))
+		go runInformerWithListSlot(ch, ns, factory.Core().V1().PersistentVolumeClaims().Informer())
+	}
+
+	want := map[string]float64{"team-a": 2, "team-b": 1, "team-c": 0}
+	deadline := time.Now().Add(5 * time.Second)
+	for ns, pvcs := range want {
+		labels := prometheus.Labels{"namespace": ns}
+		for testutil.ToFloat64(promNamespaceSynced.With(labels)) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("namespace %s was not synced", ns)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := testutil.ToFloat64(promNamespaceListedPVCs.With(labels)); got != pvcs {
+			t.Errorf("listed PVCs of %s = %v, want %v", ns, got, pvcs)
+		}
+	}
+	// Every slot is released once the namespaces are listed
+	if len(namespaceListSlots) != 0 {
+		t.Errorf("%d list slots are still taken", len(namespaceListSlots))
+	}
+}
+
+func Test_runInformerWithListSlotStopped(t *testing.T) {
+	namespaceListSlots = newNamespaceListSlots(1)
+	defer func() { namespaceListSlots = nil }()
+	namespaceListSlots <- struct{}{}
+
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	factory := informers.NewSharedInformerFactoryWithOptions(fake.NewSimpleClientset(), 0, informers.WithNamespace("waiting"))
+	go func() {
+		runInformerWithListSlot(ch, "waiting", factory.Core().V1().PersistentVolumeClaims().Informer())
+		close(done)
+	}()
+	close(ch)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runInformerWithListSlot() did not return while waiting for a list slot")
+	}
+	if got := testutil.ToFloat64(promNamespaceSynced.With(prometheus.Labels{"namespace": "waiting"})); got != 0 {
+		t.Errorf("namespace synced = %v, want 0", got)
+	}
+}
+
+func Test_namespaceLabel(t *testing.T) {
+	if got := namespaceLabel(""); got != "all" {
+		t.Errorf("namespaceLabel(\"\") = %q, want all", got)
+	}
+	if got := namespaceLabel("team-a"); got != "team-a" {
+		t.Errorf("namespaceLabel(team-a) = %q, want team-a", got)
+	}
+}
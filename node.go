@@ -0,0 +1,141 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Set by the scheduler on WaitForFirstConsumer PVCs to the node of the first pod using it
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+)
+
+// nodeTemplateVars is whether to look up the node of the PVC's pod for the
+// Node, NodeLabels, NodePool, InstanceType, Zone and CapacityType template variables
+var nodeTemplateVars bool
+
+// The node labels of the node pools of Karpenter, Karpenter before v1beta1 and EKS managed node groups
+var nodePoolLabels = []string{
+	"karpenter.sh/nodepool",
+	"karpenter.sh/provisioner-name",
+	"eks.amazonaws.com/nodegroup",
+}
+
+// The node labels of the instance type and the zone, the beta labels are set by older clusters
+var (
+	instanceTypeLabels = []string{
+		"node.kubernetes.io/instance-type",
+		"beta.kubernetes.io/instance-type",
+	}
+	zoneLabels = []string{
+		"topology.kubernetes.io/zone",
+		"failure-domain.beta.kubernetes.io/zone",
+	}
+)
+
+// The node labels of the capacity type of Karpenter and EKS managed node groups
+var capacityTypeLabels = []string{
+	"karpenter.sh/capacity-type",
+	"eks.amazonaws.com/capacityType",
+}
+
+// getPVCPod returns the pod using the PVC: the pod owning a generic ephemeral
+// volume, or else the pod scheduled on a node that mounts it. It's nil if it
+// is not known.
+func getPVCPod(pvc *corev1.PersistentVolumeClaim) *corev1.Pod {
+	if name := getOwningPod(pvc); name != "" {
+		pod, err := k8sClient.CoreV1().Pods(pvc.GetNamespace()).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "pod": name}).Debugln("Could not get the pod:", err)
+			return nil
+		}
+		return pod
+	}
+	pod, err := consumers.get(pvc)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Could not list the pods using the PVC:", err)
+		return nil
+	}
+	return pod
+}
+
+// getPodOwner returns the kind and the name of the workload of the pod, e.g.
+// the Deployment of the ReplicaSet of the pod, or empty values if it has none
+func getPodOwner(pod *corev1.Pod) (string, string) {
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		// The ReplicaSets of a Deployment are named after it and the pod template hash
+		hash := pod.GetLabels()["pod-template-hash"]
+		if owner.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return owner.Kind, owner.Name
+	}
+	return "", ""
+}
+
+// getPVCNode returns the name and the labels of the node where the pod using
+// the PVC, if known, is scheduled, or empty values if it is not known
+func getPVCNode(pvc *corev1.PersistentVolumeClaim, pod *corev1.Pod) (string, map[string]string) {
+	nodeName := pvc.GetAnnotations()[selectedNodeAnnotation]
+	if nodeName == "" && pod != nil {
+		nodeName = pod.Spec.NodeName
+	}
+	if nodeName == "" {
+		return "", nil
+	}
+
+	node, err := k8sClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		// The node may have been removed since, e.g. by Karpenter consolidation
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "node": nodeName}).Debugln("Could not get the node:", err)
+		return nodeName, nil
+	}
+	return nodeName, node.GetLabels()
+}
+
+// getNodePool returns the node pool from the node labels
+func getNodePool(labels map[string]string) string {
+	return getNodeLabel(labels, nodePoolLabels)
+}
+
+// getNodeLabel returns the value of the first of the keys set in the node labels
+func getNodeLabel(labels map[string]string, keys []string) string {
+	for _, l := range keys {
+		if v, ok := labels[l]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// getCapacityType returns the capacity type from the node labels, as spot or
+// on-demand for both Karpenter (on-demand) and EKS managed node groups (ON_DEMAND)
+func getCapacityType(labels map[string]string) string {
+	value := getNodeLabel(labels, capacityTypeLabels)
+	return strings.ReplaceAll(strings.ToLower(value), "_", "-")
+}
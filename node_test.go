@@ -0,0 +1,245 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_getPVCNode(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"karpenter.sh/nodepool": "spot-general"}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "default"}, Spec: corev1.PodSpec{NodeName: "node-1"}}
+	consumer := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+		Spec: corev1.PodSpec{NodeName: "node-1", Volumes: []corev1.Volume{{
+			Name:         "data",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"}},
+		}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	controller := true
+
+	tests := []struct {
+		name        string
+		pvcName     string
+		annotations map[string]string
+		owners      []metav1.OwnerReference
+		wantNode    string
+		wantLabels  map[string]string
+	}{
+		{
+			name:        "selected node",
+			annotations: map[string]string{"volume.kubernetes.io/selected-node": "node-1"},
+			wantNode:    "node-1",
+			wantLabels:  map[string]string{"karpenter.sh/nodepool": "spot-general"},
+		},
+		{
+			name:       "ephemeral volume pod",
+			owners:     []metav1.OwnerReference{{Kind: "Pod", Name: "my-pod", Controller: &controller}},
+			wantNode:   "node-1",
+			wantLabels: map[string]string{"karpenter.sh/nodepool": "spot-general"},
+		},
+		{
+			name:       "pod using the PVC",
+			pvcName:    "data-web-0",
+			wantNode:   "node-1",
+			wantLabels: map[string]string{"karpenter.sh/nodepool": "spot-general"},
+		},
+		{
+			name:        "removed node",
+			annotations: map[string]string{"volume.kubernetes.io/selected-node": "node-2"},
+			wantNode:    "node-2",
+		},
+		{
+			name:     "unknown node",
+			wantNode: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient = fake.NewSimpleClientset(node, pod, consumer)
+			consumers = newConsumerStore()
+			defer func() { consumers = newConsumerStore() }()
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			if tt.pvcName != "" {
+				pvc.SetName(tt.pvcName)
+			}
+			pvc.SetNamespace("default")
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetOwnerReferences(tt.owners)
+
+			gotNode, gotLabels := getPVCNode(pvc, getPVCPod(pvc))
+			if gotNode != tt.wantNode {
+				t.Errorf("getPVCNode() node = %v, want %v", gotNode, tt.wantNode)
+			}
+			if !reflect.DeepEqual(gotLabels, tt.wantLabels) {
+				t.Errorf("getPVCNode() labels = %v, want %v", gotLabels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func Test_getPodOwner(t *testing.T) {
+	controller := true
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		owners   []metav1.OwnerReference
+		wantKind string
+		wantName string
+	}{
+		{
+			name:     "deployment",
+			labels:   map[string]string{"pod-template-hash": "5d8f7c9b4"},
+			owners:   []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f7c9b4", Controller: &controller}},
+			wantKind: "Deployment",
+			wantName: "web",
+		},
+		{
+			name:     "replicaset",
+			owners:   []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web", Controller: &controller}},
+			wantKind: "ReplicaSet",
+			wantName: "web",
+		},
+		{
+			name:     "statefulset",
+			owners:   []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &controller}},
+			wantKind: "StatefulSet",
+			wantName: "db",
+		},
+		{
+			name:   "not a controller",
+			owners: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+		},
+		{
+			name: "no owner",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Labels: tt.labels, OwnerReferences: tt.owners}}
+			kind, name := getPodOwner(pod)
+			if kind != tt.wantKind || name != tt.wantName {
+				t.Errorf("getPodOwner() = %v, %v, want %v, %v", kind, name, tt.wantKind, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_getNodePool(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "karpenter", labels: map[string]string{"karpenter.sh/nodepool": "spot-general"}, want: "spot-general"},
+		{name: "karpenter provisioner", labels: map[string]string{"karpenter.sh/provisioner-name": "default"}, want: "default"},
+		{name: "eks node group", labels: map[string]string{"eks.amazonaws.com/nodegroup": "workers"}, want: "workers"},
+		{name: "no node pool", labels: map[string]string{"kubernetes.io/os": "linux"}, want: ""},
+		{name: "no labels", labels: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getNodePool(tt.labels); got != tt.want {
+				t.Errorf("getNodePool() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getCapacityType(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "karpenter spot", labels: map[string]string{"karpenter.sh/capacity-type": "spot"}, want: "spot"},
+		{name: "karpenter on-demand", labels: map[string]string{"karpenter.sh/capacity-type": "on-demand"}, want: "on-demand"},
+		{name: "eks node group on demand", labels: map[string]string{"eks.amazonaws.com/capacityType": "ON_DEMAND"}, want: "on-demand"},
+		{name: "eks node group spot", labels: map[string]string{"eks.amazonaws.com/capacityType": "SPOT"}, want: "spot"},
+		{name: "no capacity type", labels: map[string]string{"kubernetes.io/os": "linux"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getCapacityType(tt.labels); got != tt.want {
+				t.Errorf("getCapacityType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_renderTagTemplatesNodeVars(t *testing.T) {
+	nodeTemplateVars = true
+	defer func() { nodeTemplateVars = false }()
+	k8sClient = fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{
+		"beta.kubernetes.io/instance-type": "m5.large",
+		"topology.kubernetes.io/zone":      "us-east-1a",
+		"eks.amazonaws.com/capacityType":   "SPOT",
+		"eks.amazonaws.com/nodegroup":      "workers",
+	}}})
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("data")
+	pvc.SetAnnotations(map[string]string{"volume.kubernetes.io/selected-node": "node-1"})
+
+	got := renderTagTemplates(pvc, map[string]string{"compute": "{{ .InstanceType }}/{{ .CapacityType }}", "zone": "{{ .Zone }}", "pool": "{{ .NodePool }}"})
+	want := map[string]string{"compute": "m5.large/spot", "zone": "us-east-1a", "pool": "workers"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() = %v, want %v", got, want)
+	}
+}
+
+func Test_renderTagTemplatesOwnerVars(t *testing.T) {
+	waitForConsumer = true
+	consumers = newConsumerStore()
+	renderedTags = newTagCache(10)
+	defer func() {
+		waitForConsumer = false
+		consumers = newConsumerStore()
+		renderedTags = newTagCache(tagCacheSize)
+	}()
+	controller := true
+	k8sClient = fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7c9b4-x2x7q",
+			Namespace:       "default",
+			Labels:          map[string]string{"pod-template-hash": "5d8f7c9b4"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f7c9b4", Controller: &controller}},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1", Volumes: []corev1.Volume{{
+			Name:         "data",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}},
+		}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	})
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("data")
+	pvc.SetNamespace("default")
+
+	got := renderTagTemplates(pvc, map[string]string{"workload": "{{ .OwnerKind }}/{{ .Owner }}"})
+	want := map[string]string{"workload": "Deployment/web"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renderTagTemplates() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const managedByTagKey = "managed-by"
+
+var (
+	// clusterName enables the managed-by ownership tag when set
+	clusterName   string
+	forceTakeover bool
+
+	errVolumeClaimed = errors.New("volume is managed by another cluster")
+)
+
+// managedByTagValue returns the value of the managed-by tag for this cluster
+func managedByTagValue() string {
+	return "k8s-pvc-tagger/" + clusterName
+}
+
+// checkOwnership returns an error if the volume's existing tags show that it is
+// managed by the tagger of another cluster, unless forceTakeover is set
+func checkOwnership(pvc *corev1.PersistentVolumeClaim, volumeID string, existing map[string]string) error {
+	owner, ok := existing[managedByTagKey]
+	if !ok || owner == managedByTagValue() {
+		return nil
+	}
+	if forceTakeover {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "owner": owner}).Warnln("Taking over volume managed by another cluster")
+		recordEvent(pvc, corev1.EventTypeNormal, "VolumeTakenOver", fmt.Sprintf("Took over volume %s from %s", volumeID, owner))
+		return nil
+	}
+	recordEvent(pvc, corev1.EventTypeWarning, "VolumeClaimed", fmt.Sprintf("Not tagging volume %s, it is managed by %s", volumeID, owner))
+	return fmt.Errorf("%w: %s is managed by %s", errVolumeClaimed, volumeID, owner)
+}
+
+// getEBSVolumeTags returns the current tags of the volume
+func (client *EBSClient) getEBSVolumeTags(volumeID string) (map[string]string, error) {
+	tags := map[string]string{}
+	err := client.DescribeTagsPages(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(volumeID)}},
+		},
+	}, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorln("Could not describe tags for volumeID:", volumeID, err)
+		return nil, err
+	}
+	return tags, nil
+}
+
+// getEFSVolumeTags returns the current tags of the file system or access point
+func (client *EFSClient) getEFSVolumeTags(volumeID string) (map[string]string, error) {
+	tags := map[string]string{}
+	err := client.ListTagsForResourcePages(&efs.ListTagsForResourceInput{
+		ResourceId: aws.String(volumeID),
+	}, func(page *efs.ListTagsForResourceOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorln("Could not list tags for volumeID:", volumeID, err)
+		return nil, err
+	}
+	return tags, nil
+}
@@ -0,0 +1,113 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_checkOwnership(t *testing.T) {
+	tests := []struct {
+		name          string
+		existing      map[string]string
+		forceTakeover bool
+		wantErr       bool
+	}{
+		{
+			name:     "untagged volume",
+			existing: map[string]string{},
+			wantErr:  false,
+		},
+		{
+			name:     "volume managed by this cluster",
+			existing: map[string]string{"managed-by": "k8s-pvc-tagger/prod"},
+			wantErr:  false,
+		},
+		{
+			name:     "volume managed by another cluster",
+			existing: map[string]string{"managed-by": "k8s-pvc-tagger/staging"},
+			wantErr:  true,
+		},
+		{
+			name:          "volume managed by another cluster with force takeover",
+			existing:      map[string]string{"managed-by": "k8s-pvc-tagger/staging"},
+			forceTakeover: true,
+			wantErr:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterName = "prod"
+			forceTakeover = tt.forceTakeover
+			defer func() {
+				clusterName = ""
+				forceTakeover = false
+			}()
+			err := checkOwnership(&corev1.PersistentVolumeClaim{}, "vol-12345", tt.existing)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkOwnership() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errVolumeClaimed) {
+				t.Errorf("checkOwnership() err = %v, want errVolumeClaimed", err)
+			}
+		})
+	}
+}
+
+func Test_tagVolumeOwnership(t *testing.T) {
+	cloudProvider = cloudProviderFake
+	fakeVolumes = newFakeTagStore()
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	clusterName = "prod"
+	defer func() {
+		cloudProvider = cloudProviderAWS
+		fakeVolumes = newFakeTagStore()
+		managedVolumes = newVolumeStore()
+		deadLetters = newDeadLetterStore()
+		clusterName = ""
+	}()
+	efsClient, _ := newEFSClient()
+	ec2Client, _ := newEC2Client()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("default")
+	pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"})
+
+	fakeVolumes.addTags("vol-other", map[string]string{"managed-by": "k8s-pvc-tagger/staging"})
+	tagVolume(pvc, "vol-other", map[string]string{"foo": "bar", "managed-by": managedByTagValue()}, nil, efsClient, ec2Client)
+	want := map[string]string{"managed-by": "k8s-pvc-tagger/staging"}
+	if got := fakeVolumes.get("vol-other"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tagVolume() tags = %v, want %v", got, want)
+	}
+	if letters := deadLetters.list(); len(letters) != 1 || letters[0].ErrorClass != errorClassPermissionDenied {
+		t.Errorf("tagVolume() dead letters = %v, want one %v dead letter", letters, errorClassPermissionDenied)
+	}
+
+	tagVolume(pvc, "vol-new", map[string]string{"foo": "bar", "managed-by": managedByTagValue()}, nil, efsClient, ec2Client)
+	want = map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"}
+	if got := fakeVolumes.get("vol-new"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tagVolume() tags = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// missingPermissionWarnInterval is how often the warning of a missing
+// permission is repeated while the permission is still missing
+var missingPermissionWarnInterval = time.Hour
+
+// IAM style denials name the missing action, e.g. "User: arn:... is not
+// authorized to perform: elasticfilesystem:TagResource on resource: ..."
+var regexpDeniedAction = regexp.MustCompile(`not authorized to perform: ([\w-]+:\w+)`)
+
+// The IAM action prefix of the services whose signing name is different
+var iamActionPrefixes = map[string]string{
+	"tagging": "tag",
+}
+
+// missingPermission is an IAM action the controller was denied
+type missingPermission struct {
+	Action     string    `json:"action"`
+	Denials    int       `json:"denials"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	lastWarned time.Time
+}
+
+// missingPermissionStore aggregates the denials by IAM action, so that a
+// missing permission is reported once rather than for every volume
+type missingPermissionStore struct {
+	mu          sync.Mutex
+	permissions map[string]*missingPermission
+}
+
+var missingPermissions = newMissingPermissionStore()
+
+func newMissingPermissionStore() *missingPermissionStore {
+	return &missingPermissionStore{permissions: map[string]*missingPermission{}}
+}
+
+// requestError returns the error of the request, including the resources the
+// Tagging API failed to tag while the call itself succeeded
+func requestError(r *request.Request) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	switch output := r.Data.(type) {
+	case *resourcegroupstaggingapi.TagResourcesOutput:
+		return taggingFailure(output.FailedResourcesMap)
+	case *resourcegroupstaggingapi.UntagResourcesOutput:
+		return taggingFailure(output.FailedResourcesMap)
+	}
+	return nil
+}
+
+// deniedAction returns the IAM action of a request that was denied
+func deniedAction(r *request.Request) (string, bool) {
+	err := requestError(r)
+	if err == nil || classifyError(err) != errorClassPermissionDenied {
+		return "", false
+	}
+	if matches := regexpDeniedAction.FindStringSubmatch(err.Error()); matches != nil {
+		return matches[1], true
+	}
+	return requestAction(r), true
+}
+
+// requestAction returns the IAM action of the request, e.g. ec2:CreateTags
+func requestAction(r *request.Request) string {
+	prefix := r.ClientInfo.SigningName
+	if prefix == "" {
+		prefix = r.ClientInfo.ServiceName
+	}
+	if p, ok := iamActionPrefixes[prefix]; ok {
+		prefix = p
+	}
+	name := ""
+	if r.Operation != nil {
+		name = r.Operation.Name
+	}
+	return prefix + ":" + name
+}
+
+// recordDenial counts a denial of the action and returns whether it must be
+// warned about, i.e. the first time or once missingPermissionWarnInterval has passed
+func (s *missingPermissionStore) recordDenial(action string, now time.Time) (missingPermission, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.permissions[action]
+	if !ok {
+		p = &missingPermission{Action: action, FirstSeen: now}
+		s.permissions[action] = p
+	}
+	p.Denials++
+	p.LastSeen = now
+	warn := !ok || now.Sub(p.lastWarned) >= missingPermissionWarnInterval
+	if warn {
+		p.lastWarned = now
+	}
+	return *p, warn
+}
+
+// recordSuccess forgets the action, returning true if it was missing before
+func (s *missingPermissionStore) recordSuccess(action string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.permissions[action]; !ok {
+		return false
+	}
+	delete(s.permissions, action)
+	return true
+}
+
+// list returns the missing permissions, sorted by action
+func (s *missingPermissionStore) list() []missingPermission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []missingPermission{}
+	for _, p := range s.permissions {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Action < list[j].Action })
+	return list
+}
+
+// isMissingPermission returns true if the error is a denial whose aggregated
+// warning is logged by recordMissingPermission, so it isn't logged per volume
+func isMissingPermission(err error) bool {
+	return err != nil && classifyError(err) == errorClassPermissionDenied
+}
+
+// recordMissingPermission is a request handler reporting the denied AWS calls
+// with a single aggregated warning, metric and event per IAM action
+func recordMissingPermission(r *request.Request) {
+	action, denied := deniedAction(r)
+	if !denied {
+		if requestError(r) == nil && missingPermissions.recordSuccess(requestAction(r)) {
+			log.WithFields(log.Fields{"action": requestAction(r)}).Infoln("The missing IAM permission has been granted")
+			promMissingPermissions.With(prometheus.Labels{"action": requestAction(r)}).Set(0)
+		}
+		return
+	}
+	promMissingPermissions.With(prometheus.Labels{"action": action}).Set(1)
+	promPermissionDenialsTotal.With(prometheus.Labels{"action": action}).Inc()
+	p, warn := missingPermissions.recordDenial(action, time.Now())
+	if !warn {
+		return
+	}
+	log.WithFields(log.Fields{"action": action, "denials": p.Denials, "since": p.FirstSeen}).Warnln("Missing IAM permission, add it to the controller's IAM role:", requestError(r))
+	if pod := controllerPodReference(); pod != nil {
+		recordEvent(pod, corev1.EventTypeWarning, "MissingPermission", fmt.Sprintf("The controller's IAM role is missing the %s permission, denied %d times since %s", action, p.Denials, p.FirstSeen.Format(time.RFC3339)))
+	}
+}
+
+// logAWSError logs the error of an AWS call made for a volume, at debug level
+// when it is a missing permission that recordMissingPermission already reports
+func logAWSError(err error, args ...interface{}) {
+	if isMissingPermission(err) {
+		log.Debugln(append(args, err)...)
+		return
+	}
+	log.Errorln(append(args, err)...)
+}
+
+// controllerPodReference returns a reference to the controller's pod, from
+// the POD_NAME and POD_NAMESPACE downward API variables, to record events on
+func controllerPodReference() *corev1.ObjectReference {
+	name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+}
@@ -0,0 +1,167 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newPermissionTestRequest(signingName string, operation string, err error) *request.Request {
+	r := request.New(aws.Config{}, metadata.ClientInfo{SigningName: signingName}, request.Handlers{}, nil, &request.Operation{Name: operation}, nil, nil)
+	r.Error = err
+	return r
+}
+
+func Test_deniedAction(t *testing.T) {
+	tests := []struct {
+		name        string
+		signingName string
+		operation   string
+		err         error
+		data        interface{}
+		wantAction  string
+		wantDenied  bool
+	}{
+		{
+			name:        "IAM denial names the action",
+			signingName: "elasticfilesystem",
+			operation:   "TagResource",
+			err:         awserr.New("AccessDeniedException", "User: arn:aws:sts::123456789012:assumed-role/tagger is not authorized to perform: elasticfilesystem:TagResource on resource: fs-1", nil),
+			wantAction:  "elasticfilesystem:TagResource",
+			wantDenied:  true,
+		},
+		{
+			name:        "EC2 denial without the action",
+			signingName: "ec2",
+			operation:   "CreateTags",
+			err:         awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+			wantAction:  "ec2:CreateTags",
+			wantDenied:  true,
+		},
+		{
+			name:        "Tagging API resource failure",
+			signingName: "tagging",
+			operation:   "TagResources",
+			data: &resourcegroupstaggingapi.TagResourcesOutput{FailedResourcesMap: map[string]*resourcegroupstaggingapi.FailureInfo{
+				"arn:aws:ec2:us-east-1:123456789012:volume/vol-1": {StatusCode: aws.Int64(403), ErrorMessage: aws.String("denied")},
+			}},
+			wantAction: "tag:TagResources",
+			wantDenied: true,
+		},
+		{
+			name:        "throttled",
+			signingName: "ec2",
+			operation:   "CreateTags",
+			err:         awserr.New("RequestLimitExceeded", "slow down", nil),
+		},
+		{
+			name:        "success",
+			signingName: "ec2",
+			operation:   "CreateTags",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newPermissionTestRequest(tt.signingName, tt.operation, tt.err)
+			r.Data = tt.data
+			action, denied := deniedAction(r)
+			if denied != tt.wantDenied || action != tt.wantAction {
+				t.Errorf("deniedAction() = %q, %v, want %q, %v", action, denied, tt.wantAction, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func Test_missingPermissionStore(t *testing.T) {
+	s := newMissingPermissionStore()
+	now := time.Now()
+	steps := []struct {
+		after       time.Duration
+		wantDenials int
+		wantWarn    bool
+	}{
+		{after: 0, wantDenials: 1, wantWarn: true},
+		{after: time.Minute, wantDenials: 2, wantWarn: false},
+		{after: 30 * time.Minute, wantDenials: 3, wantWarn: false},
+		{after: missingPermissionWarnInterval, wantDenials: 4, wantWarn: true},
+		{after: missingPermissionWarnInterval + time.Minute, wantDenials: 5, wantWarn: false},
+	}
+	for _, step := range steps {
+		p, warn := s.recordDenial("ec2:CreateTags", now.Add(step.after))
+		if p.Denials != step.wantDenials || warn != step.wantWarn {
+			t.Errorf("recordDenial() after %s = %d, %v, want %d, %v", step.after, p.Denials, warn, step.wantDenials, step.wantWarn)
+		}
+		if !p.FirstSeen.Equal(now) {
+			t.Errorf("recordDenial() FirstSeen = %s, want %s", p.FirstSeen, now)
+		}
+	}
+	if got := s.list(); len(got) != 1 || got[0].Action != "ec2:CreateTags" {
+		t.Errorf("list() = %v, want ec2:CreateTags", got)
+	}
+	if s.recordSuccess("ec2:DeleteTags") {
+		t.Error("recordSuccess() = true for a permission that wasn't missing")
+	}
+	if !s.recordSuccess("ec2:CreateTags") {
+		t.Error("recordSuccess() = false for a missing permission")
+	}
+	if got := s.list(); len(got) != 0 {
+		t.Errorf("list() = %v, want none", got)
+	}
+	if _, warn := s.recordDenial("ec2:CreateTags", now.Add(missingPermissionWarnInterval+2*time.Minute)); !warn {
+		t.Error("recordDenial() = false after the permission was granted and removed again")
+	}
+}
+
+func Test_recordMissingPermission(t *testing.T) {
+	missingPermissions = newMissingPermissionStore()
+	defer func() { missingPermissions = newMissingPermissionStore() }()
+	gauge := promMissingPermissions.With(prometheus.Labels{"action": "ec2:CreateTags"})
+	denials := testutil.ToFloat64(promPermissionDenialsTotal.With(prometheus.Labels{"action": "ec2:CreateTags"}))
+
+	denied := awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	for i := 0; i < 3; i++ {
+		recordMissingPermission(newPermissionTestRequest("ec2", "CreateTags", denied))
+	}
+	if got := testutil.ToFloat64(gauge); got != 1 {
+		t.Errorf("missing permission gauge = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(promPermissionDenialsTotal.With(prometheus.Labels{"action": "ec2:CreateTags"})) - denials; got != 3 {
+		t.Errorf("permission denials = %v, want 3", got)
+	}
+	if got := missingPermissions.list(); len(got) != 1 || got[0].Denials != 3 {
+		t.Errorf("missingPermissions.list() = %v, want 3 denials of ec2:CreateTags", got)
+	}
+
+	recordMissingPermission(newPermissionTestRequest("ec2", "CreateTags", nil))
+	if got := testutil.ToFloat64(gauge); got != 0 {
+		t.Errorf("missing permission gauge = %v, want 0 once granted", got)
+	}
+	if got := missingPermissions.list(); len(got) != 0 {
+		t.Errorf("missingPermissions.list() = %v, want none once granted", got)
+	}
+}
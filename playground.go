@@ -0,0 +1,127 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// enableTagPlayground serves /debug/tags on the status port, which computes
+// the tags of a PVC manifest without tagging anything
+var enableTagPlayground bool
+
+// maxPlaygroundManifestSize bounds the size of the PVC manifest posted to /debug/tags
+const maxPlaygroundManifestSize = 1 << 20
+
+// playgroundPVCs are the PVCs whose tags are being computed by the playground.
+// Their invalid tags are returned to the caller instead of being reported
+// as Events and metrics, since the PVC might not even exist in the cluster.
+var playgroundPVCs sync.Map
+
+// tagPlaygroundResult is the response of /debug/tags
+type tagPlaygroundResult struct {
+	Provider string            `json:"provider"`
+	Ignored  bool              `json:"ignored"`
+	Tags     map[string]string `json:"tags"`
+	// Provenance is where each tag was set from, e.g. default-tags or annotations
+	Provenance map[string]string `json:"provenance"`
+	// Errors are the tags that were skipped, and why
+	Errors []string `json:"errors,omitempty"`
+}
+
+// playgroundErrors collects the invalid tags of a playground PVC
+type playgroundErrors struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (e *playgroundErrors) add(errs []error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, err := range errs {
+		e.messages = append(e.messages, err.Error())
+	}
+}
+
+// collectPlaygroundErrors returns true if the PVC belongs to the playground,
+// in which case its errors have been collected and must not be reported
+func collectPlaygroundErrors(pvc *corev1.PersistentVolumeClaim, errs []error) bool {
+	collected, ok := playgroundPVCs.Load(pvc)
+	if !ok {
+		return false
+	}
+	collected.(*playgroundErrors).add(errs)
+	return true
+}
+
+// isPlaygroundPVC returns true if the PVC belongs to the playground, whose
+// PVCs must not update the metrics since they aren't in the cluster
+func isPlaygroundPVC(pvc *corev1.PersistentVolumeClaim) bool {
+	_, ok := playgroundPVCs.Load(pvc)
+	return ok
+}
+
+// computePlaygroundTags builds the tags of the PVC, with their provenance
+func computePlaygroundTags(pvc *corev1.PersistentVolumeClaim) tagPlaygroundResult {
+	if pvc.Spec.StorageClassName == nil {
+		storageClassName := ""
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	collected := &playgroundErrors{}
+	playgroundPVCs.Store(pvc, collected)
+	defer playgroundPVCs.Delete(pvc)
+
+	provenance := map[string]string{}
+	tags := buildTagsWithProvenance(pvc, provenance)
+
+	sort.Strings(collected.messages)
+	return tagPlaygroundResult{
+		Provider:   getProvider(pvc),
+		Ignored:    isIgnored(pvc),
+		Tags:       tags,
+		Provenance: provenance,
+		Errors:     collected.messages,
+	}
+}
+
+// tagPlaygroundHandler serves POST /debug/tags. The body is a PVC manifest,
+// in YAML or JSON, e.g. the output of kubectl get pvc -o yaml.
+func tagPlaygroundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method is not allowed")
+		return
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	decoder := yaml.NewYAMLOrJSONDecoder(http.MaxBytesReader(w, r.Body, maxPlaygroundManifestSize), 4096)
+	if err := decoder.Decode(pvc); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "cannot decode the PVC manifest: "+err.Error())
+		return
+	}
+	if pvc.Kind != "" && pvc.Kind != "PersistentVolumeClaim" {
+		writeAPIError(w, http.StatusBadRequest, "manifest is a "+pvc.Kind+", not a PersistentVolumeClaim")
+		return
+	}
+	writeAPIResponse(w, computePlaygroundTags(pvc))
+}
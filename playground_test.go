@@ -0,0 +1,143 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_tagPlaygroundHandler(t *testing.T) {
+	defaultTags = map[string]string{"env": "prod", "team": "platform"}
+	defer func() { defaultTags = map[string]string{} }()
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		want       tagPlaygroundResult
+	}{
+		{
+			name:   "yaml manifest",
+			method: "POST",
+			body: `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+  namespace: payments
+  annotations:
+    volume.beta.kubernetes.io/storage-provisioner: ebs.csi.aws.com
+    k8s-pvc-tagger/tags: '{"team": "payments", "owner": "{{ .Namespace }}", "kubernetes.io/foo": "bar"}'
+    k8s-pvc-tagger/replace: '{"env": "staging"}'
+`,
+			wantStatus: http.StatusOK,
+			want: tagPlaygroundResult{
+				Provider:   providerAWSEBS,
+				Tags:       map[string]string{"env": "staging", "team": "payments", "owner": "payments"},
+				Provenance: map[string]string{"env": "replace", "team": "annotations", "owner": "annotations"},
+				Errors:     []string{`tag "kubernetes.io/foo" is a restricted tag`},
+			},
+		},
+		{
+			name:       "json manifest",
+			method:     "POST",
+			body:       `{"kind": "PersistentVolumeClaim", "metadata": {"name": "data", "annotations": {"k8s-pvc-tagger/remove": "[\"team\"]"}}}`,
+			wantStatus: http.StatusOK,
+			want: tagPlaygroundResult{
+				Tags:       map[string]string{"env": "prod"},
+				Provenance: map[string]string{"env": "default-tags"},
+			},
+		},
+		{
+			name:       "ignored",
+			method:     "POST",
+			body:       `{"metadata": {"name": "data", "annotations": {"k8s-pvc-tagger/ignore": ""}}}`,
+			wantStatus: http.StatusOK,
+			want: tagPlaygroundResult{
+				Ignored:    true,
+				Tags:       map[string]string{},
+				Provenance: map[string]string{},
+			},
+		},
+		{
+			name:       "not a pvc",
+			method:     "POST",
+			body:       `{"kind": "Pod", "metadata": {"name": "data"}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid manifest",
+			method:     "POST",
+			body:       `{"metadata": `,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET",
+			method:     "GET",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/debug/tags", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			tagPlaygroundHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got tagPlaygroundResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("cannot decode response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tagPlaygroundHandler() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_computePlaygroundTagsMetrics(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetNamespace("playground")
+	pvc.SetAnnotations(map[string]string{"aws-ebs-tagger/ignore": ""})
+	ignored := testutil.ToFloat64(promIgnoredLegacyTotal)
+	legacy := testutil.ToFloat64(promLegacyAnnotationsTotal.With(prometheus.Labels{"namespace": "playground", "annotation": "ignore"}))
+
+	if got := computePlaygroundTags(pvc); !got.Ignored {
+		t.Fatalf("computePlaygroundTags() = %+v, want the PVC ignored", got)
+	}
+	if got := testutil.ToFloat64(promIgnoredLegacyTotal); got != ignored {
+		t.Errorf("ignored PVCs = %v, want %v", got, ignored)
+	}
+	if got := testutil.ToFloat64(promLegacyAnnotationsTotal.With(prometheus.Labels{"namespace": "playground", "annotation": "ignore"})); got != legacy {
+		t.Errorf("legacy annotations = %v, want %v", got, legacy)
+	}
+}
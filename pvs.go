@@ -0,0 +1,90 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pvCache reads the PVs from the shared PV informer once it has synced, so
+// that the PV of a PVC costs no API server call however many times it's read
+// while computing the tags. The PVs are read from the API server until then,
+// e.g. by the commands.
+type pvCache struct {
+	sync.RWMutex
+	lister corelisters.PersistentVolumeLister
+}
+
+var persistentVolumes = &pvCache{}
+
+func (c *pvCache) setLister(lister corelisters.PersistentVolumeLister) {
+	c.Lock()
+	defer c.Unlock()
+	c.lister = lister
+}
+
+// get returns the PV, which must not be modified
+func (c *pvCache) get(name string) (*corev1.PersistentVolume, error) {
+	c.RLock()
+	lister := c.lister
+	c.RUnlock()
+	if lister != nil {
+		// A PV that was just bound may not be in the informer's cache yet
+		if pv, err := lister.Get(name); err == nil {
+			return pv, nil
+		}
+	}
+	return k8sClient.CoreV1().PersistentVolumes().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// watchPVs runs the PV informer shared by all the watched namespaces, since
+// PVs are cluster scoped, which backs persistentVolumes and re-tags the volume
+// of a PVC when the reclaim policy of its PV changes
+func watchPVs(ch <-chan struct{}, namespaces []string) {
+	// PVs are cluster scoped, the PVC selectors don't apply to them
+	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	informer := pvInformer.Informer()
+	if err := informer.SetWatchErrorHandler(watchErrorHandler); err != nil {
+		log.Warnln("Could not set the watch error handler:", err)
+	}
+	if reclaimPolicyTagKey != "" {
+		informer.AddEventHandler(newReclaimPolicyHandler(namespaces))
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		informer.Run(ch)
+		close(stopped)
+	}()
+	if cache.WaitForCacheSync(ch, informer.HasSynced) {
+		persistentVolumes.setLister(pvInformer.Lister())
+		log.Debugln("Reading the PVs from the informer")
+	}
+	<-stopped
+	persistentVolumes.setLister(nil)
+}
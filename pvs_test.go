@@ -0,0 +1,81 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_pvCache(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}})
+	k8sClient = client
+	pvGets := func() int {
+		gets := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "get" && action.GetResource().Resource == "persistentvolumes" {
+				gets++
+			}
+		}
+		return gets
+	}
+
+	if _, err := persistentVolumes.get("pv-1"); err != nil || pvGets() != 1 {
+		t.Fatalf("get() before the informer synced err = %v, %d gets, want the PV from the API server", err, pvGets())
+	}
+
+	ch := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchPVs(ch, nil)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasPVLister() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hasPVLister() {
+		t.Fatal("watchPVs() didn't set the lister once synced")
+	}
+
+	client.ClearActions()
+	if pv, err := persistentVolumes.get("pv-1"); err != nil || pv.GetName() != "pv-1" || pvGets() != 0 {
+		t.Errorf("get() = %v, %v, %d gets, want the PV from the informer", pv, err, pvGets())
+	}
+	if _, err := persistentVolumes.get("pv-2"); !k8serrors.IsNotFound(err) || pvGets() != 1 {
+		t.Errorf("get() of a PV missing from the informer err = %v, %d gets, want it read from the API server", err, pvGets())
+	}
+
+	close(ch)
+	<-stopped
+	if hasPVLister() {
+		t.Error("watchPVs() kept the lister once stopped")
+	}
+}
+
+func hasPVLister() bool {
+	persistentVolumes.RLock()
+	defer persistentVolumes.RUnlock()
+	return persistentVolumes.lister != nil
+}
@@ -0,0 +1,78 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// reclaimPolicyTagKey is the tag set to the reclaim policy of the PV, e.g.
+// Retain or Delete, for data retention audits. It's disabled when empty.
+var reclaimPolicyTagKey string
+
+// setReclaimPolicyTag sets the reclaim policy tag of the PVC's PV
+func setReclaimPolicyTag(tags map[string]string, pv *corev1.PersistentVolume) {
+	if reclaimPolicyTagKey == "" || pv.Spec.PersistentVolumeReclaimPolicy == "" {
+		return
+	}
+	tags[reclaimPolicyTagKey] = string(pv.Spec.PersistentVolumeReclaimPolicy)
+}
+
+// isReclaimPolicyChanged returns the PVC bound to the PV if its reclaim policy
+// changed, as long as the PVC is in one of the watched namespaces. An empty
+// namespace watches all of them.
+func isReclaimPolicyChanged(oldPV *corev1.PersistentVolume, newPV *corev1.PersistentVolume, namespaces []string) (*corev1.ObjectReference, bool) {
+	if oldPV.Spec.PersistentVolumeReclaimPolicy == newPV.Spec.PersistentVolumeReclaimPolicy {
+		return nil, false
+	}
+	claim := newPV.Spec.ClaimRef
+	if claim == nil || !(len(namespaces) == 0 || containsString(namespaces, "") || containsString(namespaces, claim.Namespace)) {
+		return nil, false
+	}
+	return claim, true
+}
+
+// newReclaimPolicyHandler re-tags the volume of a PVC when the reclaim policy
+// of its PV changes, e.g. when a PV is patched to Retain before deleting a
+// namespace
+func newReclaimPolicyHandler(namespaces []string) cache.ResourceEventHandlerFuncs {
+	efsClient, _ := newEFSClient()
+	ec2Client, _ := newEC2Client()
+
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldPV := old.(*corev1.PersistentVolume)
+			newPV := new.(*corev1.PersistentVolume)
+			claim, ok := isReclaimPolicyChanged(oldPV, newPV, namespaces)
+			if !ok {
+				return
+			}
+			policy := string(newPV.Spec.PersistentVolumeReclaimPolicy)
+			log.WithFields(log.Fields{"pv": newPV.GetName(), "namespace": claim.Namespace, "pvc": claim.Name, "old": oldPV.Spec.PersistentVolumeReclaimPolicy, "new": policy}).Infoln("PV reclaim policy changed")
+			promReclaimPolicyChangesTotal.With(prometheus.Labels{"policy": policy}).Inc()
+			recordEvent(newPV, corev1.EventTypeNormal, "ReclaimPolicyChanged", fmt.Sprintf("Reclaim policy changed from %s to %s, updating the %s tag of the volume of %s/%s", oldPV.Spec.PersistentVolumeReclaimPolicy, policy, reclaimPolicyTagKey, claim.Namespace, claim.Name))
+			resyncPVC(claim.Namespace, claim.Name, efsClient, ec2Client)
+		},
+	}
+}
@@ -0,0 +1,160 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_isReclaimPolicyChanged(t *testing.T) {
+	newPV := func(policy corev1.PersistentVolumeReclaimPolicy, claim *corev1.ObjectReference) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: policy, ClaimRef: claim}}
+	}
+	claim := &corev1.ObjectReference{Namespace: "payments", Name: "data"}
+
+	tests := []struct {
+		name       string
+		oldPV      *corev1.PersistentVolume
+		newPV      *corev1.PersistentVolume
+		namespaces []string
+		want       bool
+	}{
+		{
+			name:  "changed",
+			oldPV: newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV: newPV(corev1.PersistentVolumeReclaimRetain, claim),
+			want:  true,
+		},
+		{
+			name:  "unchanged",
+			oldPV: newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV: newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			want:  false,
+		},
+		{
+			name:  "unbound",
+			oldPV: newPV(corev1.PersistentVolumeReclaimDelete, nil),
+			newPV: newPV(corev1.PersistentVolumeReclaimRetain, nil),
+			want:  false,
+		},
+		{
+			name:       "watched namespace",
+			oldPV:      newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV:      newPV(corev1.PersistentVolumeReclaimRetain, claim),
+			namespaces: []string{"payments"},
+			want:       true,
+		},
+		{
+			name:       "other namespace",
+			oldPV:      newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV:      newPV(corev1.PersistentVolumeReclaimRetain, claim),
+			namespaces: []string{"default"},
+			want:       false,
+		},
+		{
+			name:       "one of the watched namespaces",
+			oldPV:      newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV:      newPV(corev1.PersistentVolumeReclaimRetain, claim),
+			namespaces: []string{"default", "payments"},
+			want:       true,
+		},
+		{
+			name:       "all namespaces",
+			oldPV:      newPV(corev1.PersistentVolumeReclaimDelete, claim),
+			newPV:      newPV(corev1.PersistentVolumeReclaimRetain, claim),
+			namespaces: []string{""},
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := isReclaimPolicyChanged(tt.oldPV, tt.newPV, tt.namespaces)
+			if ok != tt.want {
+				t.Fatalf("isReclaimPolicyChanged() = %v, want %v", ok, tt.want)
+			}
+			if ok && got != claim {
+				t.Errorf("isReclaimPolicyChanged() claim = %v, want %v", got, claim)
+			}
+		})
+	}
+}
+
+func Test_processPersistentVolumeClaimReclaimPolicy(t *testing.T) {
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-1"},
+			},
+		},
+	})
+
+	tests := []struct {
+		name                string
+		reclaimPolicyTagKey string
+		annotations         map[string]string
+		want                map[string]string
+	}{
+		{
+			name:        "disabled",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": `{"team": "a"}`},
+			want:        map[string]string{"team": "a"},
+		},
+		{
+			name:                "enabled",
+			reclaimPolicyTagKey: "reclaim-policy",
+			annotations:         map[string]string{"k8s-pvc-tagger/tags": `{"team": "a"}`},
+			want:                map[string]string{"team": "a", "reclaim-policy": "Retain"},
+		},
+		{
+			name:                "ignored",
+			reclaimPolicyTagKey: "reclaim-policy",
+			annotations:         map[string]string{"k8s-pvc-tagger/ignore": ""},
+			want:                map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reclaimPolicyTagKey = tt.reclaimPolicyTagKey
+			defer func() { reclaimPolicyTagKey = "" }()
+
+			pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1", StorageClassName: &dummyStorageClassName}}
+			pvc.SetName("data")
+			annotations := map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pvc.SetAnnotations(annotations)
+
+			_, tags, err := processPersistentVolumeClaim(pvc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.want)
+			}
+		})
+	}
+}
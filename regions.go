@@ -0,0 +1,221 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	// multiRegion sends the API calls of a volume to the region of its PV
+	// rather than to the region of the tagger
+	multiRegion bool
+	// defaultRegion is the region of awsSession
+	defaultRegion string
+	// sessionRefreshInterval is how often the credentials of the sessions are
+	// expired so that they are retrieved again, 0 to only retrieve them when
+	// they expire
+	sessionRefreshInterval time.Duration
+)
+
+// pvRegionLabels are the PV labels with the region of its volume
+var pvRegionLabels = []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}
+
+// pvZoneKeys are the PV labels and node affinity keys with the availability zone of its volume
+var pvZoneKeys = []string{"topology.ebs.csi.aws.com/zone", "topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// zoneRegion matches the region of an availability zone, local zone or
+// wavelength zone, e.g. us-east-1 of us-east-1a or us-west-2-lax-1a
+var zoneRegion = regexp.MustCompile(`^([a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-\d+)`)
+
+// awsSessionPool keeps a session, and its EC2 and EFS clients, per region.
+// They are created the first time a volume of the region is tagged.
+type awsSessionPool struct {
+	sync.Mutex
+	sessions   map[string]*session.Session
+	ec2Clients map[string]*EBSClient
+	efsClients map[string]*EFSClient
+	newSession func(region string) *session.Session
+}
+
+var awsSessions = newAWSSessionPool(createAWSSession)
+
+func newAWSSessionPool(newSession func(region string) *session.Session) *awsSessionPool {
+	return &awsSessionPool{
+		sessions:   map[string]*session.Session{},
+		ec2Clients: map[string]*EBSClient{},
+		efsClients: map[string]*EFSClient{},
+		newSession: newSession,
+	}
+}
+
+// session returns the session of the region, creating it if needed
+func (p *awsSessionPool) session(region string) *session.Session {
+	p.Lock()
+	defer p.Unlock()
+	return p.sessionLocked(region)
+}
+
+func (p *awsSessionPool) sessionLocked(region string) *session.Session {
+	sess, ok := p.sessions[region]
+	if !ok {
+		log.WithFields(log.Fields{"region": region}).Infoln("Creating the AWS session of the region")
+		sess = p.newSession(region)
+		p.sessions[region] = sess
+		promAWSSessions.Set(float64(len(p.sessions)))
+	}
+	return sess
+}
+
+func (p *awsSessionPool) ec2(region string) *EBSClient {
+	p.Lock()
+	defer p.Unlock()
+	client, ok := p.ec2Clients[region]
+	if !ok {
+		client = &EBSClient{ec2.New(p.sessionLocked(region))}
+		p.ec2Clients[region] = client
+	}
+	return client
+}
+
+func (p *awsSessionPool) efs(region string) *EFSClient {
+	p.Lock()
+	defer p.Unlock()
+	client, ok := p.efsClients[region]
+	if !ok {
+		client = &EFSClient{efs.New(p.sessionLocked(region))}
+		p.efsClients[region] = client
+	}
+	return client
+}
+
+// regions returns the regions of the pool, sorted
+func (p *awsSessionPool) regions() []string {
+	p.Lock()
+	defer p.Unlock()
+	regions := make([]string, 0, len(p.sessions))
+	for region := range p.sessions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// refresh expires the credentials of every session, so that they are
+// retrieved again on the next call, e.g. after the role's keys were rotated
+func (p *awsSessionPool) refresh() {
+	p.Lock()
+	defer p.Unlock()
+	for _, sess := range p.sessions {
+		if sess.Config.Credentials != nil {
+			sess.Config.Credentials.Expire()
+		}
+	}
+}
+
+func runSessionRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.WithFields(log.Fields{"regions": awsSessions.regions()}).Debugln("Refreshing the AWS credentials")
+			awsSessions.refresh()
+		}
+	}
+}
+
+// getPVRegion returns the region of the PV's volume from its region or zone
+// labels or its node affinity, or an empty string if it's not known
+func getPVRegion(pv *corev1.PersistentVolume) string {
+	for _, label := range pvRegionLabels {
+		if region := pv.GetLabels()[label]; region != "" {
+			return region
+		}
+	}
+	zones := []string{}
+	for _, label := range pvZoneKeys {
+		if zone := pv.GetLabels()[label]; zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				if expr.Operator != corev1.NodeSelectorOpIn || len(expr.Values) == 0 {
+					continue
+				}
+				if containsString(pvRegionLabels, expr.Key) {
+					return expr.Values[0]
+				}
+				if containsString(pvZoneKeys, expr.Key) {
+					zones = append(zones, expr.Values[0])
+				}
+			}
+		}
+	}
+	for _, zone := range zones {
+		if m := zoneRegion.FindStringSubmatch(zone); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// getPVCRegion returns the region of the PVC's volume, or an empty string for
+// the tagger's region, when --multi-region is set. The PV is read from the PV
+// informer, so the region isn't cached on its own.
+func getPVCRegion(pvc *corev1.PersistentVolumeClaim) string {
+	if !multiRegion || pvc.Spec.VolumeName == "" {
+		return ""
+	}
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Could not get the PV, using the default region:", err)
+		return ""
+	}
+	return getPVRegion(pv)
+}
+
+// regionalClients returns the clients of the region, or the given clients
+// for the tagger's region
+func regionalClients(region string, efsClient *EFSClient, ec2Client *EBSClient) (*EFSClient, *EBSClient) {
+	if !multiRegion || region == "" || region == defaultRegion || cloudProvider == cloudProviderFake {
+		return efsClient, ec2Client
+	}
+	return awsSessions.efs(region), awsSessions.ec2(region)
+}
+
+// forRegion returns the EC2 client of the region
+func (client *EBSClient) forRegion(region string) *EBSClient {
+	_, ec2Client := regionalClients(region, nil, client)
+	return ec2Client
+}
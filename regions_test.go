@@ -0,0 +1,153 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_getPVRegion(t *testing.T) {
+	affinity := func(key string, values ...string) *corev1.VolumeNodeAffinity {
+		return &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{Key: key, Operator: corev1.NodeSelectorOpIn, Values: values}},
+		}}}}
+	}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		affinity *corev1.VolumeNodeAffinity
+		want     string
+	}{
+		{name: "no topology", want: ""},
+		{name: "region label", labels: map[string]string{"topology.kubernetes.io/region": "eu-west-1"}, want: "eu-west-1"},
+		{name: "beta region label", labels: map[string]string{"failure-domain.beta.kubernetes.io/region": "eu-west-1"}, want: "eu-west-1"},
+		{name: "region label before zone", labels: map[string]string{"topology.kubernetes.io/region": "eu-west-1", "topology.kubernetes.io/zone": "us-east-1a"}, want: "eu-west-1"},
+		{name: "zone label", labels: map[string]string{"topology.kubernetes.io/zone": "us-west-2b"}, want: "us-west-2"},
+		{name: "local zone", labels: map[string]string{"topology.kubernetes.io/zone": "us-west-2-lax-1a"}, want: "us-west-2"},
+		{name: "gov zone", labels: map[string]string{"topology.kubernetes.io/zone": "us-gov-west-1a"}, want: "us-gov-west-1"},
+		{name: "csi zone affinity", affinity: affinity("topology.ebs.csi.aws.com/zone", "ap-southeast-2c"), want: "ap-southeast-2"},
+		{name: "region affinity", affinity: affinity("topology.kubernetes.io/region", "ca-central-1"), want: "ca-central-1"},
+		{name: "other affinity", affinity: affinity("kubernetes.io/hostname", "ip-10-0-0-1"), want: ""},
+		{name: "invalid zone", labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-1", Labels: tt.labels},
+				Spec:       corev1.PersistentVolumeSpec{NodeAffinity: tt.affinity},
+			}
+			if got := getPVRegion(pv); got != tt.want {
+				t.Errorf("getPVRegion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getPVCRegion(t *testing.T) {
+	origClient := k8sClient
+	defer func() {
+		k8sClient = origClient
+		multiRegion = false
+	}()
+	multiRegion = true
+	pv := func(zone string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1", Labels: map[string]string{"topology.kubernetes.io/zone": zone}}}
+	}
+	client := fake.NewSimpleClientset(pv("eu-west-1a"))
+	k8sClient = client
+	pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"}}
+
+	if got := getPVCRegion(pvc); got != "eu-west-1" {
+		t.Errorf("getPVCRegion() = %q, want eu-west-1", got)
+	}
+	// A PV recreated with the same name isn't given the region of the old one
+	if err := client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("persistentvolumes"), pv("us-west-2b"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := getPVCRegion(pvc); got != "us-west-2" {
+		t.Errorf("getPVCRegion() of the recreated PV = %q, want us-west-2", got)
+	}
+	if got := getPVCRegion(&corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-2"}}); got != "" {
+		t.Errorf("getPVCRegion() of a missing PV = %q, want the default region", got)
+	}
+}
+
+func Test_awsSessionPool(t *testing.T) {
+	created := []string{}
+	pool := newAWSSessionPool(func(region string) *session.Session {
+		created = append(created, region)
+		return session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	})
+
+	east := pool.session("us-east-1")
+	if pool.session("us-east-1") != east {
+		t.Errorf("session() created a second session of the region")
+	}
+	if pool.ec2("eu-west-1") != pool.ec2("eu-west-1") {
+		t.Errorf("ec2() created a second client of the region")
+	}
+	pool.efs("eu-west-1")
+	if !reflect.DeepEqual(created, []string{"us-east-1", "eu-west-1"}) {
+		t.Errorf("created sessions = %v, want [us-east-1 eu-west-1]", created)
+	}
+	if got := pool.regions(); !reflect.DeepEqual(got, []string{"eu-west-1", "us-east-1"}) {
+		t.Errorf("regions() = %v, want [eu-west-1 us-east-1]", got)
+	}
+}
+
+func Test_regionalClients(t *testing.T) {
+	origPool, origMultiRegion, origDefault := awsSessions, multiRegion, defaultRegion
+	defer func() { awsSessions, multiRegion, defaultRegion = origPool, origMultiRegion, origDefault }()
+	awsSessions = newAWSSessionPool(func(region string) *session.Session {
+		return session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	})
+	defaultRegion = "us-east-1"
+	efsClient, ec2Client := &EFSClient{}, &EBSClient{}
+
+	tests := []struct {
+		name        string
+		multiRegion bool
+		region      string
+		wantDefault bool
+	}{
+		{name: "single region", region: "eu-west-1", wantDefault: true},
+		{name: "unknown region", multiRegion: true, region: "", wantDefault: true},
+		{name: "default region", multiRegion: true, region: "us-east-1", wantDefault: true},
+		{name: "other region", multiRegion: true, region: "eu-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			multiRegion = tt.multiRegion
+			gotEFS, gotEC2 := regionalClients(tt.region, efsClient, ec2Client)
+			if isDefault := gotEFS == efsClient && gotEC2 == ec2Client; isDefault != tt.wantDefault {
+				t.Errorf("regionalClients(%q) returned the default clients = %v, want %v", tt.region, isDefault, tt.wantDefault)
+			}
+			if !tt.wantDefault && gotEC2 != awsSessions.ec2(tt.region) {
+				t.Errorf("regionalClients(%q) didn't return the client of the region", tt.region)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// informerResyncPeriod is how often the PVC informer re-delivers every PVC
+	// to the update handler, which recomputes its tags (0 disables)
+	informerResyncPeriod time.Duration
+	// informerResyncJitter spreads the handling of the re-delivered PVCs over
+	// this fraction of the resync period, so they don't all reconcile at once
+	informerResyncJitter = 0.1
+)
+
+var informerResyncs = newPVCTimers(promPendingInformerResyncs)
+
+func validateInformerResync(period time.Duration, jitter float64) error {
+	if period < 0 {
+		return fmt.Errorf("the period must not be negative")
+	}
+	if jitter < 0 || jitter > 1 {
+		return fmt.Errorf("the jitter must be between 0 and 1, got %v", jitter)
+	}
+	return nil
+}
+
+// informerResyncDelay returns a random delay in [0, jitter * period)
+func informerResyncDelay(period time.Duration, jitter float64) time.Duration {
+	max := int64(jitter * float64(period))
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(max))
+}
+
+// scheduleInformerResync handles a PVC re-delivered by the informer resync
+// after a random delay. The PVC is then read from the informer's store, so
+// the resync costs no API server call.
+func scheduleInformerResync(store cache.Store, pvc *corev1.PersistentVolumeClaim, efsClient *EFSClient, ec2Client *EBSClient) {
+	if pvc.Spec.VolumeName == "" || pvc.GetDeletionTimestamp() != nil {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pvc)
+	if err != nil {
+		return
+	}
+	at := time.Now().Add(informerResyncDelay(informerResyncPeriod, informerResyncJitter))
+	informerResyncs.schedule(pvc.GetNamespace(), pvc.GetName(), at, func() {
+		informerResyncs.cancel(pvc.GetNamespace(), pvc.GetName())
+		obj, exists, err := store.GetByKey(key)
+		if err != nil || !exists {
+			return
+		}
+		informerResync(obj.(*corev1.PersistentVolumeClaim), efsClient, ec2Client)
+	})
+}
+
+// informerResync recomputes the tags of the PVC, which can depend on more
+// than the PVC, e.g. the PV annotations or the node labels, and only tags the
+// volume if they changed since it was last reconciled
+func informerResync(pvc *corev1.PersistentVolumeClaim, efsClient *EFSClient, ec2Client *EBSClient) {
+	reconcileTraces.start(pvc, "informer-resync")
+	volumeID, tags, err := processPersistentVolumeClaim(pvc)
+	tracePVC(pvc, log.Fields{"volumeID": volumeID, "tags": tags, "error": err}, "Computed the tags")
+	if err != nil {
+		return
+	}
+	if isTagStateUnchanged(pvc, pvc, volumeID, tags) {
+		promInformerResyncsTotal.With(prometheus.Labels{"result": "unchanged"}).Inc()
+		tracePVC(pvc, nil, "Tags unchanged since the last reconcile, skipping")
+		return
+	}
+	// the tags no longer computed, e.g. a removed PV annotation or node label,
+	// are deleted like the update handler deletes those gone from the old PVC
+	removedTags := buildRemovedTags(pvc)
+	oldTags := map[string]string{}
+	if previous, ok := managedVolumes.get(volumeID); ok {
+		oldTags = previous.Tags
+	}
+	for k := range oldTags {
+		if _, ok := tags[k]; !ok && !containsString(removedTags, k) {
+			removedTags = append(removedTags, k)
+		}
+	}
+	if len(tags) == 0 && len(removedTags) == 0 {
+		promInformerResyncsTotal.With(prometheus.Labels{"result": "unchanged"}).Inc()
+		return
+	}
+	promInformerResyncsTotal.With(prometheus.Labels{"result": "changed"}).Inc()
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("Tags changed since the last reconcile, found by the informer resync")
+	logTagDiff(pvc, volumeID, oldTags, tags, removedTags)
+	tagVolume(pvc, volumeID, tags, removedTags, efsClient, ec2Client)
+}
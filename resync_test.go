@@ -0,0 +1,120 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_validateInformerResync(t *testing.T) {
+	tests := []struct {
+		name    string
+		period  time.Duration
+		jitter  float64
+		wantErr bool
+	}{
+		{name: "disabled", period: 0, jitter: 0.1},
+		{name: "hourly", period: time.Hour, jitter: 0.5},
+		{name: "negative period", period: -time.Minute, jitter: 0.1, wantErr: true},
+		{name: "jitter above 1", period: time.Hour, jitter: 1.5, wantErr: true},
+		{name: "negative jitter", period: time.Hour, jitter: -0.1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateInformerResync(tt.period, tt.jitter); (err != nil) != tt.wantErr {
+				t.Errorf("validateInformerResync() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_informerResyncDelay(t *testing.T) {
+	if got := informerResyncDelay(time.Hour, 0); got != 0 {
+		t.Errorf("informerResyncDelay() without jitter = %v, want 0", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := informerResyncDelay(time.Hour, 0.1); got < 0 || got >= 6*time.Minute {
+			t.Fatalf("informerResyncDelay() = %v, want in [0, 6m)", got)
+		}
+	}
+}
+
+func Test_informerResync(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	informerResyncPeriod, informerResyncJitter = time.Hour, 0
+	defer func() {
+		managedVolumes = newVolumeStore()
+		informerResyncPeriod, informerResyncJitter = 0, 0.1
+	}()
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-1"},
+		}},
+	})
+	fakeStore := newFakeTagStore()
+	efsClient, ec2Client := &EFSClient{&fakeEFS{store: fakeStore}}, &EBSClient{&fakeEC2{store: fakeStore}}
+	storageClass := "gp3"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", Annotations: map[string]string{
+			"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com",
+			"k8s-pvc-tagger/tags":                           `{"team": "a"}`,
+		}},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1", StorageClassName: &storageClass},
+	}
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "data", Tags: map[string]string{"team": "a"}, Synced: true})
+
+	informerResync(pvc, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); len(tags) != 0 {
+		t.Errorf("informerResync() tagged the volume with unchanged tags: %v", tags)
+	}
+
+	pvc.Annotations["k8s-pvc-tagger/tags"] = `{"team": "b"}`
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := store.Add(pvc); err != nil {
+		t.Fatal(err)
+	}
+	scheduleInformerResync(store, pvc, efsClient, ec2Client)
+	deadline := time.Now().Add(time.Second)
+	for !isSyncedWith("vol-1", "b") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	informerResyncs.wait()
+	if tags := fakeStore.get("vol-1"); tags["team"] != "b" {
+		t.Errorf("scheduleInformerResync() tags = %v, want the changed tags", tags)
+	}
+
+	fakeStore.addTags("vol-1", map[string]string{"env": "dev"})
+	managedVolumes.set(managedVolume{VolumeID: "vol-1", Provider: providerAWSEBS, Namespace: "default", PVC: "data", Tags: map[string]string{"team": "b", "env": "dev"}, Synced: true})
+	informerResync(pvc, efsClient, ec2Client)
+	if tags := fakeStore.get("vol-1"); tags["team"] != "b" || tags["env"] != "" {
+		t.Errorf("informerResync() tags = %v, want the tag no longer computed removed", tags)
+	}
+}
+
+func isSyncedWith(volumeID string, team string) bool {
+	v, ok := managedVolumes.get(volumeID)
+	return ok && v.Synced && v.Tags["team"] == team
+}
@@ -0,0 +1,230 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Classes of provider errors, shared by every provider so that the metrics and
+// the retry decisions behave the same whichever cloud the volume is in
+const (
+	errorClassThrottled        = "throttled"
+	errorClassPermissionDenied = "permission-denied"
+	errorClassNotFound         = "not-found"
+	errorClassInvalidTag       = "invalid-tag"
+	errorClassTransient        = "transient"
+)
+
+var (
+	// retrySleep waits between the retries, tests replace it
+	retrySleep = time.Sleep
+	// startRetry runs the retries in the background, tests replace it to wait for them
+	startRetry = func(retry func()) { go retry() }
+)
+
+// classifyError returns the class of a provider error, errors that aren't
+// recognised are assumed to be transient
+func classifyError(err error) string {
+	if errors.Is(err, errVolumeClaimed) {
+		return errorClassPermissionDenied
+	}
+	if class, ok := classifyAWSError(err); ok {
+		return class
+	}
+	return errorClassTransient
+}
+
+// isRetryableErrorClass returns false for errors that won't go away by
+// themselves, those need the PVC, the IAM policy or the volume to be fixed
+func isRetryableErrorClass(class string) bool {
+	return class == errorClassThrottled || class == errorClassTransient
+}
+
+// deadLetter is a volume that could not be tagged after all of its retries
+type deadLetter struct {
+	VolumeID    string    `json:"volumeID"`
+	Namespace   string    `json:"namespace"`
+	PVC         string    `json:"pvc"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"lastError"`
+	ErrorClass  string    `json:"errorClass"`
+	LastAttempt time.Time `json:"lastAttempt"`
+}
+
+// deadLetterStore keeps track of the volumes that are stuck, keyed by volumeID
+type deadLetterStore struct {
+	sync.RWMutex
+	entries map[string]deadLetter
+}
+
+var deadLetters = newDeadLetterStore()
+
+func newDeadLetterStore() *deadLetterStore {
+	return &deadLetterStore{entries: map[string]deadLetter{}}
+}
+
+func (s *deadLetterStore) add(d deadLetter) {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[d.VolumeID] = d
+	promDeadLetterVolumes.Set(float64(len(s.entries)))
+}
+
+func (s *deadLetterStore) delete(volumeID string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, volumeID)
+	promDeadLetterVolumes.Set(float64(len(s.entries)))
+}
+
+func (s *deadLetterStore) deleteByPVC(namespace string, name string) {
+	s.Lock()
+	defer s.Unlock()
+	for id, d := range s.entries {
+		if d.Namespace == namespace && d.PVC == name {
+			delete(s.entries, id)
+		}
+	}
+	promDeadLetterVolumes.Set(float64(len(s.entries)))
+}
+
+// list returns the dead letters sorted by namespace and PVC name
+func (s *deadLetterStore) list() []deadLetter {
+	s.RLock()
+	defer s.RUnlock()
+	entries := []deadLetter{}
+	for _, d := range s.entries {
+		entries = append(entries, d)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].PVC < entries[j].PVC
+	})
+	return entries
+}
+
+// runTagOperation runs the tag operation for the volume. If it fails with a
+// retryable error, it is retried in the background with an exponential backoff
+// and after maxRetries failed retries the volume is moved to the dead letters.
+func runTagOperation(v managedVolume, op func() error) {
+	err := limitTagOperation(v.Provider, op)
+	reconcileTraces.log(v.Namespace, v.PVC, log.Fields{"volumeID": v.VolumeID, "error": err}, "Tag operation done")
+	if err == nil {
+		managedVolumes.setSynced(v.VolumeID, v.Tags)
+		deadLetters.delete(v.VolumeID)
+		tagJournal.end(v.VolumeID, v.Tags)
+		return
+	}
+	class := recordTagError(v, err)
+	if !isRetryableErrorClass(class) {
+		addDeadLetter(v, 1, err, class)
+		return
+	}
+	startRetry(func() { retryTagOperation(v, op, err) })
+}
+
+// retryDelay returns how long to wait before the retry attempt, doubling
+// with every attempt from retryBaseDelay up to retryMaxDelay. The wait is
+// doubled once more when the provider is throttling us.
+func retryDelay(attempt int, class string) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if class == errorClassThrottled {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+func retryTagOperation(v managedVolume, op func() error, err error) {
+	class := classifyError(err)
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		retrySleep(retryDelay(attempt, class))
+		// A newer reconcile owns the volume if its desired tags have changed
+		if current, ok := managedVolumes.get(v.VolumeID); !ok || !reflect.DeepEqual(current.Tags, v.Tags) {
+			log.WithFields(log.Fields{"namespace": v.Namespace, "pvc": v.PVC, "volumeID": v.VolumeID}).Debugln("Desired tags changed, abandoning retry")
+			return
+		}
+		if skipTerminatingNamespace(v.Namespace, "retry") {
+			log.WithFields(log.Fields{"namespace": v.Namespace, "pvc": v.PVC, "volumeID": v.VolumeID}).Debugln("Namespace is terminating, abandoning retry")
+			return
+		}
+		// The namespace's PVCs are resynced when it's resumed
+		if pausedNamespaces.isPaused(v.Namespace) {
+			log.WithFields(log.Fields{"namespace": v.Namespace, "pvc": v.PVC, "volumeID": v.VolumeID}).Debugln("Namespace is paused, abandoning retry")
+			return
+		}
+		log.WithFields(log.Fields{"namespace": v.Namespace, "pvc": v.PVC, "volumeID": v.VolumeID, "attempt": attempt, "errorClass": class}).Infoln("Retrying tag operation")
+		promRetriesTotal.Inc()
+		if err = limitTagOperation(v.Provider, op); err == nil {
+			managedVolumes.setSynced(v.VolumeID, v.Tags)
+			deadLetters.delete(v.VolumeID)
+			tagJournal.end(v.VolumeID, v.Tags)
+			return
+		}
+		class = recordTagError(v, err)
+		if !isRetryableErrorClass(class) {
+			addDeadLetter(v, attempt+1, err, class)
+			return
+		}
+	}
+
+	addDeadLetter(v, maxRetries+1, err, class)
+}
+
+// recordTagError classifies the error of a tag operation and counts it
+func recordTagError(v managedVolume, err error) string {
+	class := classifyError(err)
+	promTagErrorsTotal.With(prometheus.Labels{"provider": v.Provider, "class": class}).Inc()
+	return class
+}
+
+func addDeadLetter(v managedVolume, failures int, err error, class string) {
+	logger := log.WithFields(log.Fields{"namespace": v.Namespace, "pvc": v.PVC, "volumeID": v.VolumeID, "errorClass": class})
+	if class == errorClassPermissionDenied {
+		// The missing permission is reported once by recordMissingPermission
+		logger.Debugln("Giving up tagging volume after", failures, "failures:", err)
+	} else {
+		logger.Errorln("Giving up tagging volume after", failures, "failures:", err)
+	}
+	deadLetters.add(deadLetter{
+		VolumeID:    v.VolumeID,
+		Namespace:   v.Namespace,
+		PVC:         v.PVC,
+		Failures:    failures,
+		LastError:   err.Error(),
+		ErrorClass:  class,
+		LastAttempt: time.Now(),
+	})
+	tagJournal.end(v.VolumeID, v.Tags)
+}
@@ -0,0 +1,208 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func Test_runTagOperation(t *testing.T) {
+	tests := []struct {
+		name            string
+		failures        int32
+		maxRetries      int
+		wantCalls       int32
+		wantDeadLetters int
+	}{
+		{
+			name:            "succeeds first time",
+			failures:        0,
+			maxRetries:      2,
+			wantCalls:       1,
+			wantDeadLetters: 0,
+		},
+		{
+			name:            "succeeds after a retry",
+			failures:        1,
+			maxRetries:      2,
+			wantCalls:       2,
+			wantDeadLetters: 0,
+		},
+		{
+			name:            "fails all retries",
+			failures:        10,
+			maxRetries:      2,
+			wantCalls:       3,
+			wantDeadLetters: 1,
+		},
+		{
+			name:            "no retries",
+			failures:        10,
+			maxRetries:      0,
+			wantCalls:       1,
+			wantDeadLetters: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			managedVolumes = newVolumeStore()
+			deadLetters = newDeadLetterStore()
+			maxRetries = tt.maxRetries
+			retrySleep = func(time.Duration) {}
+			startRetry = func(retry func()) { retry() }
+			v := managedVolume{VolumeID: "vol-12345", Namespace: "my-namespace", PVC: "my-pvc", Tags: map[string]string{"foo": "bar"}}
+			managedVolumes.set(v)
+
+			var calls int32
+			runTagOperation(v, func() error {
+				if atomic.AddInt32(&calls, 1) > tt.failures {
+					return nil
+				}
+				return errors.New("failed")
+			})
+
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("runTagOperation() calls = %v, want %v", got, tt.wantCalls)
+			}
+			if got := len(deadLetters.list()); got != tt.wantDeadLetters {
+				t.Errorf("runTagOperation() dead letters = %v, want %v", got, tt.wantDeadLetters)
+			}
+		})
+	}
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	maxRetries = 5
+	retrySleep = time.Sleep
+	startRetry = func(retry func()) { go retry() }
+}
+
+func Test_retryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		class   string
+		want    time.Duration
+	}{
+		{name: "first attempt", attempt: 1, class: errorClassTransient, want: time.Second},
+		{name: "second attempt", attempt: 2, class: errorClassTransient, want: 2 * time.Second},
+		{name: "third attempt", attempt: 3, class: errorClassTransient, want: 4 * time.Second},
+		{name: "first attempt throttled", attempt: 1, class: errorClassThrottled, want: 2 * time.Second},
+		{name: "second attempt throttled", attempt: 2, class: errorClassThrottled, want: 4 * time.Second},
+		{name: "third attempt throttled", attempt: 3, class: errorClassThrottled, want: 8 * time.Second},
+		{name: "capped", attempt: 10, class: errorClassTransient, want: 10 * time.Second},
+		{name: "capped throttled", attempt: 4, class: errorClassThrottled, want: 10 * time.Second},
+	}
+	retryBaseDelay = time.Second
+	retryMaxDelay = 10 * time.Second
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(tt.attempt, tt.class); got != tt.want {
+				t.Errorf("retryDelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay = 5 * time.Minute
+}
+
+func Test_retryAbandonedWhenTagsChange(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	maxRetries = 2
+	retrySleep = func(time.Duration) {}
+
+	v := managedVolume{VolumeID: "vol-12345", Tags: map[string]string{"foo": "bar"}}
+	managedVolumes.set(managedVolume{VolumeID: "vol-12345", Tags: map[string]string{"foo": "baz"}})
+
+	var calls int32
+	retryTagOperation(v, func() error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("failed")
+	}, errors.New("failed"))
+
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("retryTagOperation() calls = %v, want 0", got)
+	}
+	if got := len(deadLetters.list()); got != 0 {
+		t.Errorf("retryTagOperation() dead letters = %v, want 0", got)
+	}
+	managedVolumes = newVolumeStore()
+	maxRetries = 5
+	retrySleep = time.Sleep
+}
+
+func Test_retryAbandonedWhenNamespacePaused(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	pausedNamespaces = newPausedNamespaceStore()
+	maxRetries = 2
+	retrySleep = func(time.Duration) {}
+
+	v := managedVolume{VolumeID: "vol-12345", Namespace: "my-namespace", PVC: "my-pvc", Tags: map[string]string{"foo": "bar"}}
+	managedVolumes.set(v)
+	pausedNamespaces.pause("my-namespace")
+
+	var calls int32
+	retryTagOperation(v, func() error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("failed")
+	}, errors.New("failed"))
+
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("retryTagOperation() calls = %v, want 0", got)
+	}
+	if got := len(deadLetters.list()); got != 0 {
+		t.Errorf("retryTagOperation() dead letters = %v, want 0", got)
+	}
+	managedVolumes = newVolumeStore()
+	pausedNamespaces = newPausedNamespaceStore()
+	maxRetries = 5
+	retrySleep = time.Sleep
+}
+
+func Test_runTagOperationNotRetryable(t *testing.T) {
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	retrySleep = func(time.Duration) {}
+
+	v := managedVolume{VolumeID: "vol-12345", Provider: providerAWSEBS, Namespace: "my-namespace", PVC: "my-pvc", Tags: map[string]string{"foo": "bar"}}
+	managedVolumes.set(v)
+
+	var calls int32
+	runTagOperation(v, func() error {
+		atomic.AddInt32(&calls, 1)
+		return awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	})
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("runTagOperation() calls = %v, want 1", got)
+	}
+	letters := deadLetters.list()
+	if len(letters) != 1 || letters[0].ErrorClass != errorClassPermissionDenied {
+		t.Errorf("runTagOperation() dead letters = %v, want one %v dead letter", letters, errorClassPermissionDenied)
+	}
+	managedVolumes = newVolumeStore()
+	deadLetters = newDeadLetterStore()
+	retrySleep = time.Sleep
+}
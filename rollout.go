@@ -0,0 +1,130 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	// enforceAfter is when the tagger starts changing the tags of the
+	// volumes, until then it only reports the changes it would make. The
+	// tags are enforced right away when it's zero.
+	enforceAfter time.Time
+	// namespaceEnforceAfter overrides enforceAfter for the namespaces, with
+	// --namespace-enforce-after
+	namespaceEnforceAfter map[string]time.Time
+)
+
+// parseNamespaceEnforceAfter parses the comma separated list of
+// <namespace>=<RFC 3339 time> of --namespace-enforce-after
+func parseNamespaceEnforceAfter(value string) (map[string]time.Time, error) {
+	times := map[string]time.Time{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		namespace, timeString, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(namespace) == "" {
+			return nil, fmt.Errorf("%q is not <namespace>=<time>", item)
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(timeString))
+		if err != nil {
+			return nil, fmt.Errorf("the time of namespace %s must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z: %w", namespace, err)
+		}
+		times[strings.TrimSpace(namespace)] = t
+	}
+	return times, nil
+}
+
+// getEnforcementStart returns when the tags of the namespace's volumes are
+// enforced, if they're only observed at now
+func getEnforcementStart(namespace string, now time.Time) (time.Time, bool) {
+	start, ok := namespaceEnforceAfter[namespace]
+	if !ok {
+		start = enforceAfter
+	}
+	if start.IsZero() || !start.After(now) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+var observations = newPVCTimers(promObservedPVCs)
+
+// wouldChangeTags returns the tags that would be set on a volume with the
+// existing tags, and the keys that would be removed from it
+func wouldChangeTags(existing map[string]string, tags map[string]string, removedTags []string) (map[string]string, []string) {
+	changed := map[string]string{}
+	for k, v := range tags {
+		if current, ok := existing[k]; !ok || current != v {
+			changed[k] = v
+		}
+	}
+	var removed []string
+	for _, k := range removedTags {
+		if _, ok := existing[k]; ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// observeTagChange reports the tags that tagging the volume would change with
+// a WouldChangeTags event, without changing them
+func observeTagChange(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string, start time.Time, efsClient *EFSClient, ec2Client *EBSClient) {
+	logger := log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "enforceAfter": start})
+	efsClient, ec2Client = regionalClients(getPVCRegion(pvc), efsClient, ec2Client)
+	release := apiCallOwners.attribute(pvc.GetNamespace(), volumeID)
+	existing, err := getVolumeTags(getProvider(pvc), volumeID, efsClient, ec2Client)
+	release()
+	if err != nil {
+		logger.Warnln("Could not get the tags of the observed volume:", err)
+		return
+	}
+	changed, removed := wouldChangeTags(existing, tags, removedTags)
+	if len(changed) == 0 && len(removed) == 0 {
+		logger.Debugln("Observed volume is already tagged")
+		return
+	}
+	logger.WithFields(log.Fields{"tags": changed, "removedTags": removed}).Infoln("Would change the tags of the volume")
+	promWouldChangeTotal.With(prometheus.Labels{"namespace": pvc.GetNamespace()}).Inc()
+	keys := make([]string, 0, len(changed))
+	for k := range changed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	message := fmt.Sprintf("Would set the tags %s", strings.Join(keys, ", "))
+	if len(keys) == 0 {
+		message = "Would not set any tag"
+	}
+	if len(removed) > 0 {
+		message += fmt.Sprintf(" and remove the tags %s", strings.Join(removed, ", "))
+	}
+	recordEvent(pvc, corev1.EventTypeNormal, "WouldChangeTags", fmt.Sprintf("%s of volume %s, they are enforced after %s", message, volumeID, start.Format(time.RFC3339)))
+}
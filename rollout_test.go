@@ -0,0 +1,137 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_parseNamespaceEnforceAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]time.Time
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: map[string]time.Time{}},
+		{name: "namespaces", value: "payments=2022-08-01T00:00:00Z, scratch=2022-07-01T00:00:00Z", want: map[string]time.Time{
+			"payments": time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC),
+			"scratch":  time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		{name: "no time", value: "payments", wantErr: true},
+		{name: "no namespace", value: "=2022-08-01T00:00:00Z", wantErr: true},
+		{name: "invalid time", value: "payments=next week", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNamespaceEnforceAfter(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNamespaceEnforceAfter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNamespaceEnforceAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getEnforcementStart(t *testing.T) {
+	now := time.Date(2022, 7, 15, 12, 0, 0, 0, time.UTC)
+	later := now.Add(7 * 24 * time.Hour)
+	defer func() { enforceAfter, namespaceEnforceAfter = time.Time{}, nil }()
+
+	tests := []struct {
+		name         string
+		enforceAfter time.Time
+		namespaces   map[string]time.Time
+		namespace    string
+		wantStart    time.Time
+		wantOk       bool
+	}{
+		{name: "enforced right away", namespace: "default"},
+		{name: "observing", enforceAfter: later, namespace: "default", wantStart: later, wantOk: true},
+		{name: "enforced", enforceAfter: now.Add(-time.Hour), namespace: "default"},
+		{name: "enforced at now", enforceAfter: now, namespace: "default"},
+		{name: "namespace enforced earlier", enforceAfter: later, namespaces: map[string]time.Time{"scratch": now.Add(-time.Hour)}, namespace: "scratch"},
+		{name: "namespace observing longer", namespaces: map[string]time.Time{"payments": later}, namespace: "payments", wantStart: later, wantOk: true},
+		{name: "other namespace", namespaces: map[string]time.Time{"payments": later}, namespace: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforceAfter, namespaceEnforceAfter = tt.enforceAfter, tt.namespaces
+			gotStart, gotOk := getEnforcementStart(tt.namespace, now)
+			if gotOk != tt.wantOk || !gotStart.Equal(tt.wantStart) {
+				t.Errorf("getEnforcementStart() = %v, %v, want %v, %v", gotStart, gotOk, tt.wantStart, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_wouldChangeTags(t *testing.T) {
+	existing := map[string]string{"team": "a", "env": "dev", "old": "x"}
+	changed, removed := wouldChangeTags(existing, map[string]string{"team": "a", "env": "prod", "cost-center": "42"}, []string{"old", "missing"})
+	if want := map[string]string{"env": "prod", "cost-center": "42"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("wouldChangeTags() changed = %v, want %v", changed, want)
+	}
+	if want := []string{"old"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("wouldChangeTags() removed = %v, want %v", removed, want)
+	}
+}
+
+func Test_observeTagChange(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	defer func() { eventRecorder = nil }()
+	store := newFakeTagStore()
+	store.addTags("vol-1", map[string]string{"team": "a", "old": "x"})
+	ec2Client := &EBSClient{&fakeEC2{store: store}}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "data",
+		Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"},
+	}}
+	start := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	observeTagChange(pvc, "vol-1", map[string]string{"team": "b", "env": "prod"}, []string{"old"}, start, nil, ec2Client)
+	select {
+	case event := <-recorder.Events:
+		want := "Normal WouldChangeTags Would set the tags env, team and remove the tags old of volume vol-1, they are enforced after 2022-08-01T00:00:00Z"
+		if event != want {
+			t.Errorf("event = %v, want %v", event, want)
+		}
+	default:
+		t.Errorf("expected a WouldChangeTags event")
+	}
+	if got := store.get("vol-1"); !reflect.DeepEqual(got, map[string]string{"team": "a", "old": "x"}) {
+		t.Errorf("the observed volume was tagged with %v", got)
+	}
+
+	observeTagChange(pvc, "vol-1", map[string]string{"team": "a"}, nil, start, nil, ec2Client)
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("unexpected event %v for a volume already tagged", event)
+	default:
+	}
+}
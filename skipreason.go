@@ -0,0 +1,151 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// writeSkipReasons writes why a PVC's tags are not applied to its skip-reason
+// annotation, so that developers can self-diagnose with kubectl
+var writeSkipReasons bool
+
+const (
+	skipReasonIgnored            = "ignored"
+	skipReasonExempt             = "exempt"
+	skipReasonObserving          = "observing"
+	skipReasonWaitingForConsumer = "waiting-for-consumer"
+	skipReasonInvalidTags        = "invalid-tags"
+)
+
+// getSkipReason returns why the PVC's tags are not, or not all, applied to
+// its volume, or an empty string if nothing is skipped
+func getSkipReason(pvc *corev1.PersistentVolumeClaim, now time.Time) string {
+	if isIgnored(pvc) {
+		return skipReasonIgnored
+	}
+	if value, ok := getPVCAnnotation(pvc, "exempt-until"); ok {
+		if expiry, err := time.Parse(time.RFC3339, value); err == nil && expiry.After(now) {
+			return skipReasonExempt
+		}
+	}
+	if _, ok := getEnforcementStart(pvc.GetNamespace(), now); ok {
+		return skipReasonObserving
+	}
+	if isWaitingForConsumer(pvc, now) {
+		return skipReasonWaitingForConsumer
+	}
+	for _, annotation := range []string{"tags", "replace"} {
+		value, ok := getPVCAnnotation(pvc, annotation)
+		if !ok {
+			continue
+		}
+		tags, errs := parseTags(value)
+		if len(errs) > 0 {
+			return skipReasonInvalidTags
+		}
+		for k, v := range tags {
+			if validateTag(k, v) != nil || (!isValidTagName(k) && !allowAllTags) {
+				return skipReasonInvalidTags
+			}
+		}
+	}
+	return ""
+}
+
+// skipReasonStore remembers the skip reason written to each PVC, since the
+// PVC objects held by the timers don't see their own annotation updates
+type skipReasonStore struct {
+	mu      sync.Mutex
+	reasons map[string]string
+}
+
+func newSkipReasonStore() *skipReasonStore {
+	return &skipReasonStore{reasons: map[string]string{}}
+}
+
+func (s *skipReasonStore) get(namespace string, name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason, ok := s.reasons[namespace+"/"+name]
+	return reason, ok
+}
+
+func (s *skipReasonStore) set(namespace string, name string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reasons[namespace+"/"+name] = reason
+}
+
+func (s *skipReasonStore) delete(namespace string, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reasons, namespace+"/"+name)
+}
+
+var skipReasons = newSkipReasonStore()
+
+// updateSkipReason writes the PVC's skip reason to its skip-reason annotation,
+// or removes the annotation once nothing is skipped. The PVC is only patched
+// when the reason changes.
+func updateSkipReason(pvc *corev1.PersistentVolumeClaim) {
+	if !writeSkipReasons || skipTerminatingNamespace(pvc.GetNamespace(), "annotation") {
+		return
+	}
+	reason := getSkipReason(pvc, time.Now())
+	if written, ok := skipReasons.get(pvc.GetNamespace(), pvc.GetName()); ok && written == reason {
+		return
+	}
+	if pvc.GetAnnotations()[annotationPrefix+"/skip-reason"] == reason {
+		skipReasons.set(pvc.GetNamespace(), pvc.GetName(), reason)
+		return
+	}
+
+	var value interface{}
+	if reason != "" {
+		value = reason
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotationPrefix + "/skip-reason": value},
+		},
+	})
+	if err != nil {
+		log.Errorln("Cannot build the skip-reason patch:", err)
+		return
+	}
+	_, err = k8sClient.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Patch(context.TODO(), pvc.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	if markNamespaceTerminating(pvc.GetNamespace(), "annotation", err) {
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Could not write the skip reason:", err)
+		return
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "reason": reason}).Debugln("Wrote the skip reason")
+	skipReasons.set(pvc.GetNamespace(), pvc.GetName(), reason)
+}
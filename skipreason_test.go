@@ -0,0 +1,153 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_getSkipReason(t *testing.T) {
+	now := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { enforceAfter = time.Time{} }()
+
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		enforceAfter time.Time
+		want         string
+	}{
+		{
+			name:        "tagged",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": `{"team": "a"}`},
+			want:        "",
+		},
+		{
+			name:        "ignored",
+			annotations: map[string]string{"k8s-pvc-tagger/ignore": ""},
+			want:        skipReasonIgnored,
+		},
+		{
+			name:        "exempt",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "2022-08-01T00:00:00Z"},
+			want:        skipReasonExempt,
+		},
+		{
+			name:        "expired exemption",
+			annotations: map[string]string{"k8s-pvc-tagger/exempt-until": "2022-06-01T00:00:00Z"},
+			want:        "",
+		},
+		{
+			name:         "observing",
+			annotations:  map[string]string{"k8s-pvc-tagger/tags": `{"team": "a"}`},
+			enforceAfter: now.Add(time.Hour),
+			want:         skipReasonObserving,
+		},
+		{
+			name:        "waiting for consumer",
+			annotations: map[string]string{"k8s-pvc-tagger/wait-for-consumer": "true"},
+			want:        skipReasonWaitingForConsumer,
+		},
+		{
+			name:        "invalid json",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": `{"team": "a"`},
+			want:        skipReasonInvalidTags,
+		},
+		{
+			name:        "restricted tag",
+			annotations: map[string]string{"k8s-pvc-tagger/replace": `{"kubernetes.io/foo": "a"}`},
+			want:        skipReasonInvalidTags,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient = fake.NewSimpleClientset()
+			enforceAfter = tt.enforceAfter
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("data")
+			pvc.SetNamespace("default")
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetCreationTimestamp(metav1.NewTime(now))
+
+			if got := getSkipReason(pvc, now); got != tt.want {
+				t.Errorf("getSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_updateSkipReason(t *testing.T) {
+	writeSkipReasons = true
+	skipReasons = newSkipReasonStore()
+	defer func() {
+		writeSkipReasons = false
+		skipReasons = newSkipReasonStore()
+	}()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("data")
+	pvc.SetNamespace("default")
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/ignore": ""})
+	client := fake.NewSimpleClientset(pvc.DeepCopy())
+	k8sClient = client
+
+	getAnnotation := func() (string, bool) {
+		got, err := client.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "data", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, ok := got.GetAnnotations()["k8s-pvc-tagger/skip-reason"]
+		return value, ok
+	}
+	patches := func() int {
+		count := 0
+		for _, action := range client.Actions() {
+			if _, ok := action.(k8stesting.PatchAction); ok {
+				count++
+			}
+		}
+		return count
+	}
+
+	updateSkipReason(pvc)
+	if value, _ := getAnnotation(); value != skipReasonIgnored {
+		t.Errorf("skip-reason = %q, want %q", value, skipReasonIgnored)
+	}
+
+	// The reason is only written once, even from a stale PVC object
+	updateSkipReason(pvc)
+	if got := patches(); got != 1 {
+		t.Errorf("got %d patches, want 1", got)
+	}
+
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/skip-reason": skipReasonIgnored})
+	updateSkipReason(pvc)
+	if value, ok := getAnnotation(); ok {
+		t.Errorf("skip-reason = %q, want it removed", value)
+	}
+	if got := patches(); got != 2 {
+		t.Errorf("got %d patches, want 2", got)
+	}
+}
@@ -0,0 +1,422 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// managedVolume is the desired tag state of a volume managed by the tagger
+type managedVolume struct {
+	VolumeID  string
+	Provider  string
+	Namespace string
+	PVC       string
+	// Region is the region of the volume with --multi-region, empty for the
+	// tagger's region
+	Region string
+	Tags   map[string]string
+	// Synced is true once the Tags have been applied to the volume
+	Synced bool
+}
+
+// volumeStore keeps track of the volumes the tagger manages, keyed by volumeID
+type volumeStore struct {
+	sync.RWMutex
+	volumes map[string]managedVolume
+	// claims are the desired tags of every PVC bound to a volume, keyed by
+	// volumeID and then namespace/name. There is more than one claim for
+	// multi-attach volumes, e.g. io2 volumes shared by statically provisioned PVs.
+	claims map[string]map[string]map[string]string
+}
+
+var managedVolumes = newVolumeStore()
+
+func newVolumeStore() *volumeStore {
+	return &volumeStore{volumes: map[string]managedVolume{}, claims: map[string]map[string]map[string]string{}}
+}
+
+func (s *volumeStore) set(v managedVolume) {
+	s.Lock()
+	defer s.Unlock()
+	if previous, ok := s.volumes[v.VolumeID]; ok {
+		deletePVCInfo(previous)
+	}
+	s.volumes[v.VolumeID] = v
+	promPVCInfo.With(pvcInfoLabels(v)).Set(1)
+}
+
+// setSynced marks the volume as synced if its desired tags are still the given tags
+func (s *volumeStore) setSynced(volumeID string, tags map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.volumes[volumeID]
+	if !ok || hashTags(v.Tags) != hashTags(tags) {
+		return
+	}
+	v.Synced = true
+	s.volumes[volumeID] = v
+}
+
+// countNamespace returns the number of volumes of the PVCs of the namespace
+func (s *volumeStore) countNamespace(namespace string) int {
+	s.RLock()
+	defer s.RUnlock()
+	count := 0
+	for _, v := range s.volumes {
+		if v.Namespace == namespace {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *volumeStore) get(volumeID string) (managedVolume, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.volumes[volumeID]
+	return v, ok
+}
+
+// getByPVC returns the volume bound to the given PVC with the PVC's desired
+// tags, which are not the volume's tags when the PVC does not own a
+// multi-attach volume
+func (s *volumeStore) getByPVC(namespace string, name string) (managedVolume, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for id, claims := range s.claims {
+		if tags, ok := claims[namespace+"/"+name]; ok {
+			v := s.volumes[id]
+			v.VolumeID = id
+			v.Namespace = namespace
+			v.PVC = name
+			v.Synced = v.Synced && hashTags(v.Tags) == hashTags(tags)
+			v.Tags = tags
+			return v, true
+		}
+	}
+	for _, v := range s.volumes {
+		if v.Namespace == namespace && v.PVC == name {
+			return v, true
+		}
+	}
+	return managedVolume{}, false
+}
+
+// deleteByPVC removes the volume(s) bound to the given PVC
+func (s *volumeStore) deleteByPVC(namespace string, name string) {
+	s.Lock()
+	defer s.Unlock()
+	for id, v := range s.volumes {
+		if v.Namespace == namespace && v.PVC == name {
+			deletePVCInfo(v)
+			delete(s.volumes, id)
+		}
+	}
+	for id, claims := range s.claims {
+		delete(claims, namespace+"/"+name)
+		if len(claims) == 0 {
+			delete(s.claims, id)
+		}
+	}
+	s.updateConflicts()
+}
+
+// claim records the desired tags of a PVC bound to the volume. It returns the
+// namespace/name of the PVC that owns the volume, the first one in sorted
+// order so that the same PVC is picked whatever the order of the events, and
+// whether the PVCs bound to the volume want different tags.
+func (s *volumeStore) claim(volumeID string, namespace string, name string, tags map[string]string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.claims[volumeID] == nil {
+		s.claims[volumeID] = map[string]map[string]string{}
+	}
+	s.claims[volumeID][namespace+"/"+name] = tags
+	s.updateConflicts()
+	return s.claimOwner(volumeID), s.isConflicting(volumeID)
+}
+
+func (s *volumeStore) claimOwner(volumeID string) string {
+	owner := ""
+	for key := range s.claims[volumeID] {
+		if owner == "" || key < owner {
+			owner = key
+		}
+	}
+	return owner
+}
+
+func (s *volumeStore) isConflicting(volumeID string) bool {
+	hash := ""
+	for _, tags := range s.claims[volumeID] {
+		if hash == "" {
+			hash = hashTags(tags)
+		} else if hash != hashTags(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateConflicts sets the number of multi-attach volumes with conflicting claims
+func (s *volumeStore) updateConflicts() {
+	conflicts := 0
+	for id := range s.claims {
+		if s.isConflicting(id) {
+			conflicts++
+		}
+	}
+	promMultiAttachConflicts.Set(float64(conflicts))
+}
+
+// list returns a copy of the managed volumes for the given provider, or all
+// managed volumes if provider is empty
+func (s *volumeStore) list(provider string) []managedVolume {
+	s.RLock()
+	defer s.RUnlock()
+	var volumes []managedVolume
+	for _, v := range s.volumes {
+		if provider != "" && v.Provider != provider {
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
+
+// snapshot returns the tag hash of every synced volume, keyed by volumeID
+func (s *volumeStore) snapshot() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	state := map[string]string{}
+	for id, v := range s.volumes {
+		if v.Synced {
+			state[id] = hashTags(v.Tags)
+		}
+	}
+	return state
+}
+
+// pvcInfoLabels returns the labels of the k8s_pvc_tagger_pvc_info metric. The
+// namespace and persistentvolumeclaim labels match the ones used by the kubelet
+// volume stats and kube-state-metrics so that they can be joined on.
+func pvcInfoLabels(v managedVolume) prometheus.Labels {
+	return prometheus.Labels{"namespace": v.Namespace, "persistentvolumeclaim": v.PVC, "volume_id": v.VolumeID, "provider": v.Provider}
+}
+
+func deletePVCInfo(v managedVolume) {
+	promPVCInfo.Delete(pvcInfoLabels(v))
+}
+
+// hashTags returns a short, stable hash of the tags
+func hashTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(tags[k]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// previousState is the state snapshot loaded when this instance became the leader
+var previousState = map[string]string{}
+
+// isInPreviousState returns true if the previous leader already applied the same tags to the volume
+func isInPreviousState(volumeID string, tags map[string]string) bool {
+	hash, ok := previousState[volumeID]
+	return ok && hash == hashTags(tags)
+}
+
+// stateSnapshotShardBytes is the maximum size of the data of each ConfigMap
+// of the state snapshot, well under the 1MiB limit of a ConfigMap. A large
+// cluster needs more than one ConfigMap, at about 45 bytes per volume.
+var stateSnapshotShardBytes = 512 * 1024
+
+// stateSnapshotShardsAnnotation is set on the first ConfigMap of the state
+// snapshot to the number of ConfigMaps it's split in
+const stateSnapshotShardsAnnotation = "k8s-pvc-tagger/shards"
+
+// stateSnapshotShardName returns the name of the ConfigMap of the shard, the
+// first one is the --state-configmap and the next ones are suffixed with their index
+func stateSnapshotShardName(name string, shard int) string {
+	if shard == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, shard)
+}
+
+// shardStateSnapshot splits the state, in the order of the volumeIDs, in
+// shards of at most stateSnapshotShardBytes
+func shardStateSnapshot(state map[string]string) []map[string]string {
+	ids := make([]string, 0, len(state))
+	for id := range state {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	shards := []map[string]string{{}}
+	size := 0
+	for _, id := range ids {
+		// The key and value are quoted and separated in the stored object
+		entry := len(id) + len(state[id]) + 6
+		if size > 0 && size+entry > stateSnapshotShardBytes {
+			shards = append(shards, map[string]string{})
+			size = 0
+		}
+		shards[len(shards)-1][id] = state[id]
+		size += entry
+	}
+	return shards
+}
+
+func loadStateSnapshot(namespace string, name string) (map[string]string, error) {
+	cm, err := k8sClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	shards := 1
+	if value, ok := cm.Annotations[stateSnapshotShardsAnnotation]; ok {
+		if shards, err = strconv.Atoi(value); err != nil || shards < 1 {
+			return nil, fmt.Errorf("invalid %s annotation %q on the ConfigMap %s", stateSnapshotShardsAnnotation, value, name)
+		}
+	}
+	state := map[string]string{}
+	for k, v := range cm.Data {
+		state[k] = v
+	}
+	for shard := 1; shard < shards; shard++ {
+		shardName := stateSnapshotShardName(name, shard)
+		cm, err := k8sClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), shardName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not get the ConfigMap %s of the state snapshot: %w", shardName, err)
+		}
+		for k, v := range cm.Data {
+			state[k] = v
+		}
+	}
+	return state, nil
+}
+
+// saveStateSnapshot saves the state to the ConfigMap, split across more
+// ConfigMaps if it doesn't fit in one
+func saveStateSnapshot(namespace string, name string, state map[string]string) error {
+	shards := shardStateSnapshot(state)
+	// The first ConfigMap is saved last, the number of shards it's annotated
+	// with is only updated once all of them are saved
+	for shard := len(shards) - 1; shard >= 0; shard-- {
+		var annotations map[string]string
+		if shard == 0 {
+			annotations = map[string]string{stateSnapshotShardsAnnotation: strconv.Itoa(len(shards))}
+		}
+		if err := saveConfigMapData(namespace, stateSnapshotShardName(name, shard), annotations, shards[shard]); err != nil {
+			return err
+		}
+	}
+	// Empty the ConfigMaps left over from a larger state
+	for shard := len(shards); ; shard++ {
+		cm, err := k8sClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), stateSnapshotShardName(name, shard), metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(cm.Data) == 0 {
+			continue
+		}
+		cm.Data = nil
+		if _, err = k8sClient.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	if len(shards) > 1 {
+		log.WithFields(log.Fields{"volumes": len(state), "configMaps": len(shards)}).Debugln("State snapshot split across ConfigMaps")
+	}
+	promStateSnapshotConfigMaps.Set(float64(len(shards)))
+	return nil
+}
+
+// saveConfigMapData creates or updates the ConfigMap with the data and annotations
+func saveConfigMapData(namespace string, name string, annotations map[string]string, data map[string]string) error {
+	cm, err := k8sClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+			Data: data,
+		}
+		_, err = k8sClient.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	for k, v := range annotations {
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[k] = v
+	}
+	cm.Data = data
+	_, err = k8sClient.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// runStateSnapshotSync periodically persists the state snapshot to a ConfigMap
+// so that a new leader can skip re-tagging volumes that have not changed
+func runStateSnapshotSync(ctx context.Context, namespace string, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := saveStateSnapshot(namespace, name, managedVolumes.snapshot()); err != nil {
+				log.Errorln("Could not save state snapshot:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := saveStateSnapshot(namespace, name, managedVolumes.snapshot()); err != nil {
+				log.Errorln("Could not save state snapshot:", err)
+			}
+		}
+	}
+}
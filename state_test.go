@@ -0,0 +1,199 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_hashTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     map[string]string
+		b     map[string]string
+		equal bool
+	}{
+		{
+			name:  "same tags",
+			a:     map[string]string{"foo": "bar", "something": "else"},
+			b:     map[string]string{"something": "else", "foo": "bar"},
+			equal: true,
+		},
+		{
+			name:  "different value",
+			a:     map[string]string{"foo": "bar"},
+			b:     map[string]string{"foo": "baz"},
+			equal: false,
+		},
+		{
+			name:  "key and value boundaries",
+			a:     map[string]string{"ab": "c"},
+			b:     map[string]string{"a": "bc"},
+			equal: false,
+		},
+		{
+			name:  "empty and nil",
+			a:     map[string]string{},
+			b:     nil,
+			equal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hashTags(tt.a) == hashTags(tt.b); got != tt.equal {
+				t.Errorf("hashTags() equal = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func Test_volumeStoreSnapshot(t *testing.T) {
+	store := newVolumeStore()
+	store.set(managedVolume{VolumeID: "vol-synced", Tags: map[string]string{"foo": "bar"}})
+	store.set(managedVolume{VolumeID: "vol-pending", Tags: map[string]string{"foo": "bar"}})
+	store.setSynced("vol-synced", map[string]string{"foo": "bar"})
+	// stale tags do not mark the volume as synced
+	store.setSynced("vol-pending", map[string]string{"foo": "old"})
+
+	want := map[string]string{"vol-synced": hashTags(map[string]string{"foo": "bar"})}
+	if got := store.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %v, want %v", got, want)
+	}
+}
+
+func Test_stateSnapshotConfigMap(t *testing.T) {
+	k8sClient = fake.NewSimpleClientset()
+
+	state, err := loadStateSnapshot("default", "k8s-pvc-tagger-state")
+	if err != nil {
+		t.Fatalf("loadStateSnapshot() err = %v", err)
+	}
+	if len(state) != 0 {
+		t.Errorf("loadStateSnapshot() = %v, want empty", state)
+	}
+
+	for _, want := range []map[string]string{
+		{"vol-12345": "abc"},
+		{"vol-12345": "def", "fsap-12345": "abc"},
+	} {
+		if err := saveStateSnapshot("default", "k8s-pvc-tagger-state", want); err != nil {
+			t.Fatalf("saveStateSnapshot() err = %v", err)
+		}
+		got, err := loadStateSnapshot("default", "k8s-pvc-tagger-state")
+		if err != nil {
+			t.Fatalf("loadStateSnapshot() err = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("loadStateSnapshot() = %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_stateSnapshotConfigMapShards(t *testing.T) {
+	k8sClient = fake.NewSimpleClientset()
+	// Two volumes per ConfigMap
+	stateSnapshotShardBytes = 60
+	defer func() { stateSnapshotShardBytes = 512 * 1024 }()
+
+	for _, tt := range []struct {
+		state      map[string]string
+		configMaps int
+	}{
+		{
+			state:      map[string]string{"vol-1": "0123456789abcdef", "vol-2": "0123456789abcdef", "vol-3": "0123456789abcdef", "vol-4": "0123456789abcdef", "vol-5": "0123456789abcdef"},
+			configMaps: 3,
+		},
+		{
+			state:      map[string]string{"vol-1": "fedcba9876543210", "vol-2": "fedcba9876543210"},
+			configMaps: 1,
+		},
+	} {
+		if got := len(shardStateSnapshot(tt.state)); got != tt.configMaps {
+			t.Errorf("shardStateSnapshot() shards = %v, want %v", got, tt.configMaps)
+		}
+		if err := saveStateSnapshot("default", "k8s-pvc-tagger-state", tt.state); err != nil {
+			t.Fatalf("saveStateSnapshot() err = %v", err)
+		}
+		got, err := loadStateSnapshot("default", "k8s-pvc-tagger-state")
+		if err != nil {
+			t.Fatalf("loadStateSnapshot() err = %v", err)
+		}
+		if !reflect.DeepEqual(got, tt.state) {
+			t.Errorf("loadStateSnapshot() = %v, want %v", got, tt.state)
+		}
+	}
+
+	// The ConfigMaps left over from the larger state are emptied
+	cm, err := k8sClient.CoreV1().ConfigMaps("default").Get(context.TODO(), "k8s-pvc-tagger-state-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() err = %v", err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("left over ConfigMap data = %v, want empty", cm.Data)
+	}
+}
+
+func Test_pvcInfoMetric(t *testing.T) {
+	store := newVolumeStore()
+	v := managedVolume{VolumeID: "vol-info", Provider: providerAWSEBS, Namespace: "default", PVC: "my-pvc"}
+	store.set(v)
+	if got := testutil.ToFloat64(promPVCInfo.With(pvcInfoLabels(v))); got != 1 {
+		t.Errorf("k8s_pvc_tagger_pvc_info = %v, want 1", got)
+	}
+
+	store.deleteByPVC("default", "my-pvc")
+	if promPVCInfo.Delete(pvcInfoLabels(v)) {
+		t.Errorf("k8s_pvc_tagger_pvc_info was not deleted with the PVC")
+	}
+}
+
+func Test_volumeStoreClaim(t *testing.T) {
+	store := newVolumeStore()
+
+	owner, conflict := store.claim("vol-shared", "ns-b", "data", map[string]string{"foo": "bar"})
+	if owner != "ns-b/data" || conflict {
+		t.Errorf("claim() = %v, %v, want ns-b/data, false", owner, conflict)
+	}
+	owner, conflict = store.claim("vol-shared", "ns-a", "data", map[string]string{"foo": "bar"})
+	if owner != "ns-a/data" || conflict {
+		t.Errorf("claim() = %v, %v, want ns-a/data, false", owner, conflict)
+	}
+	owner, conflict = store.claim("vol-shared", "ns-b", "data", map[string]string{"foo": "baz"})
+	if owner != "ns-a/data" || !conflict {
+		t.Errorf("claim() = %v, %v, want ns-a/data, true", owner, conflict)
+	}
+	if got := testutil.ToFloat64(promMultiAttachConflicts); got != 1 {
+		t.Errorf("k8s_pvc_tagger_multi_attach_conflicts = %v, want 1", got)
+	}
+
+	store.deleteByPVC("ns-a", "data")
+	owner, conflict = store.claim("vol-shared", "ns-b", "data", map[string]string{"foo": "baz"})
+	if owner != "ns-b/data" || conflict {
+		t.Errorf("claim() = %v, %v, want ns-b/data, false", owner, conflict)
+	}
+	if got := testutil.ToFloat64(promMultiAttachConflicts); got != 0 {
+		t.Errorf("k8s_pvc_tagger_multi_attach_conflicts = %v, want 0", got)
+	}
+}
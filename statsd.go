@@ -0,0 +1,162 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsdMaxPacketSize keeps the packets under the usual MTU so that they are
+// not fragmented
+const statsdMaxPacketSize = 1432
+
+var (
+	// statsdAddress is the host:port of the StatsD/DogStatsD agent the metrics
+	// are sent to, in addition to being scraped. It is disabled when empty.
+	statsdAddress  string
+	statsdInterval = 10 * time.Second
+)
+
+// statsdEmitter sends the Prometheus metrics to a DogStatsD agent. Counters
+// are sent as the increase since the last flush and gauges as their value,
+// with the metric's labels as tags.
+type statsdEmitter struct {
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+	// counters are the last values sent of every counter, keyed by name and tags
+	counters map[string]float64
+}
+
+func newStatsdEmitter(gatherer prometheus.Gatherer, conn net.Conn) *statsdEmitter {
+	return &statsdEmitter{gatherer: gatherer, conn: conn, counters: map[string]float64{}}
+}
+
+// lines returns the DogStatsD lines of the gathered metrics
+func (e *statsdEmitter) lines() ([]string, error) {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName() + statsdTags(m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				value := m.GetCounter().GetValue()
+				delta := value - e.counters[name]
+				if delta < 0 {
+					// The counter was reset
+					delta = value
+				}
+				e.counters[name] = value
+				if delta > 0 {
+					lines = append(lines, statsdLine(family.GetName(), delta, "c", m.GetLabel()))
+				}
+			case dto.MetricType_GAUGE:
+				lines = append(lines, statsdLine(family.GetName(), m.GetGauge().GetValue(), "g", m.GetLabel()))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// flush sends the metrics, packing as many lines per packet as possible
+func (e *statsdEmitter) flush() error {
+	lines, err := e.lines()
+	if err != nil {
+		return err
+	}
+	var packet strings.Builder
+	send := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := e.conn.Write([]byte(packet.String()))
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacketSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return send()
+}
+
+func statsdLine(name string, value float64, metricType string, labels []*dto.LabelPair) string {
+	formatted := fmt.Sprintf("%g", value)
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		formatted = fmt.Sprintf("%d", int64(value))
+	}
+	return name + ":" + formatted + "|" + metricType + statsdTags(labels)
+}
+
+// statsdTags returns the labels as DogStatsD tags, e.g. |#namespace:default
+func statsdTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		value := strings.NewReplacer("|", "_", ",", "_", "\n", "_").Replace(l.GetValue())
+		tags = append(tags, l.GetName()+":"+value)
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// runStatsdEmitter sends the metrics to the StatsD agent every interval
+func runStatsdEmitter(ctx context.Context, address string, interval time.Duration) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		log.Errorln("Cannot connect to the StatsD agent:", err)
+		return
+	}
+	defer conn.Close()
+	e := newStatsdEmitter(prometheus.DefaultGatherer, conn)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				log.Warnln("Cannot send metrics to the StatsD agent:", err)
+			}
+		}
+	}
+}
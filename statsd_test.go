@@ -0,0 +1,92 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_statsdEmitter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"storageclass", "namespace"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_entries"})
+	registry.MustRegister(counter, gauge)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	e := newStatsdEmitter(registry, client)
+
+	counter.WithLabelValues("gp3", "default").Add(3)
+	gauge.Set(1.5)
+	got, err := e.lines()
+	if err != nil {
+		t.Fatalf("lines() error = %v", err)
+	}
+	want := []string{"test_entries:1.5|g", "test_total:3|c|#namespace:default,storageclass:gp3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines() = %v, want %v", got, want)
+	}
+
+	// Counters are sent as their increase since the last flush
+	counter.WithLabelValues("gp3", "default").Add(2)
+	got, err = e.lines()
+	if err != nil {
+		t.Fatalf("lines() error = %v", err)
+	}
+	want = []string{"test_entries:1.5|g", "test_total:2|c|#namespace:default,storageclass:gp3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines() = %v, want %v", got, want)
+	}
+
+	// Unchanged counters are not sent
+	done := make(chan string)
+	go func() {
+		buf := make([]byte, statsdMaxPacketSize)
+		n, _ := server.Read(buf)
+		done <- string(buf[:n])
+	}()
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if packet := <-done; packet != "test_entries:1.5|g" {
+		t.Errorf("flush() sent %q, want %q", packet, "test_entries:1.5|g")
+	}
+}
+
+func Test_statsdTags(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"error"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("a|b,c").Inc()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	got := statsdTags(families[0].GetMetric()[0].GetLabel())
+	if got != "|#error:a_b_c" || strings.Contains(got, "\n") {
+		t.Errorf("statsdTags() = %q, want %q", got, "|#error:a_b_c")
+	}
+}
@@ -0,0 +1,106 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// successRatioBuckets is the number of buckets the success ratio window is
+// split into, i.e. its resolution
+const successRatioBuckets = 60
+
+var successRatioWindow = time.Hour
+
+// successBucket counts the tag operations that started in [start, start+bucket)
+type successBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// successWindow counts the successful and failed tag operations over a rolling
+// window, so that alerts can use the success ratio without rate() over
+// counters that are reset on restarts
+type successWindow struct {
+	sync.Mutex
+	bucket  time.Duration
+	buckets []successBucket
+}
+
+var tagSuccesses = newSuccessWindow(successRatioWindow)
+
+func newSuccessWindow(window time.Duration) *successWindow {
+	bucket := window / successRatioBuckets
+	if bucket <= 0 {
+		bucket = time.Second
+	}
+	return &successWindow{bucket: bucket, buckets: make([]successBucket, successRatioBuckets)}
+}
+
+func (w *successWindow) record(success bool, now time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	start := now.Truncate(w.bucket)
+	b := &w.buckets[int(start.UnixNano()/int64(w.bucket))%len(w.buckets)]
+	if !b.start.Equal(start) {
+		*b = successBucket{start: start}
+	}
+	if success {
+		b.successes++
+	} else {
+		b.failures++
+	}
+}
+
+// counts returns the successful and failed operations within the window
+func (w *successWindow) counts(now time.Time) (int, int) {
+	w.Lock()
+	defer w.Unlock()
+	oldest := now.Truncate(w.bucket).Add(-w.bucket * time.Duration(len(w.buckets)-1))
+	successes, failures := 0, 0
+	for _, b := range w.buckets {
+		if b.start.Before(oldest) || b.start.After(now) {
+			continue
+		}
+		successes += b.successes
+		failures += b.failures
+	}
+	return successes, failures
+}
+
+// ratio returns the ratio of successful operations within the window, or 1
+// when there were none
+func (w *successWindow) ratio(now time.Time) float64 {
+	successes, failures := w.counts(now)
+	if successes+failures == 0 {
+		return 1
+	}
+	return float64(successes) / float64(successes+failures)
+}
+
+// recordAction counts a tag operation of a volume of the given storage class
+func recordAction(status string, storageclass string) {
+	promActionsTotal.With(prometheus.Labels{"status": status, "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": status}).Inc()
+	tagSuccesses.record(status == "success", time.Now())
+}
@@ -0,0 +1,84 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_successWindow(t *testing.T) {
+	start := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		successes     []time.Duration
+		failures      []time.Duration
+		at            time.Duration
+		wantSuccesses int
+		wantFailures  int
+		wantRatio     float64
+	}{
+		{
+			name:      "no operations",
+			wantRatio: 1,
+		},
+		{
+			name:          "operations within the window",
+			successes:     []time.Duration{0, time.Minute, 2 * time.Minute},
+			failures:      []time.Duration{30 * time.Second},
+			at:            5 * time.Minute,
+			wantSuccesses: 3,
+			wantFailures:  1,
+			wantRatio:     0.75,
+		},
+		{
+			name:          "operations out of the window",
+			successes:     []time.Duration{0, 90 * time.Minute},
+			failures:      []time.Duration{time.Minute},
+			at:            90 * time.Minute,
+			wantSuccesses: 1,
+			wantRatio:     1,
+		},
+		{
+			name:         "bucket reused after a window",
+			failures:     []time.Duration{0, time.Hour},
+			at:           time.Hour,
+			wantFailures: 1,
+			wantRatio:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newSuccessWindow(time.Hour)
+			for _, d := range tt.successes {
+				w.record(true, start.Add(d))
+			}
+			for _, d := range tt.failures {
+				w.record(false, start.Add(d))
+			}
+			successes, failures := w.counts(start.Add(tt.at))
+			if successes != tt.wantSuccesses || failures != tt.wantFailures {
+				t.Errorf("counts() = %v, %v, want %v, %v", successes, failures, tt.wantSuccesses, tt.wantFailures)
+			}
+			if got := w.ratio(start.Add(tt.at)); got != tt.wantRatio {
+				t.Errorf("ratio() = %v, want %v", got, tt.wantRatio)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// The APIs the volumes can be tagged with
+	taggingAPIService        = "service"
+	taggingAPIResourceGroups = "resourcegroups"
+)
+
+// taggingAPIMaxARNs is the maximum number of ARNs of a TagResources or
+// UntagResources call
+const taggingAPIMaxARNs = 20
+
+var (
+	// taggingAPI is whether the volumes are tagged with the EC2 and EFS APIs, or
+	// with the Resource Groups Tagging API which tags any resource type by ARN
+	taggingAPI = taggingAPIService
+	// taggingAPIBatchWindow is how long a Tagging API call waits for the calls
+	// of other volumes with the same tags, or tag keys, to be sent along (0 disables)
+	taggingAPIBatchWindow = 100 * time.Millisecond
+)
+
+// resourceTagger tags the volumes by ARN with the Resource Groups Tagging API
+type resourceTagger struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	partition string
+	region    string
+	accountID string
+
+	mu sync.Mutex
+	// batches are the calls waiting for more ARNs, keyed by operation and tags
+	batches map[string]*taggingBatch
+}
+
+// taggingBatch is a TagResources or UntagResources call of up to
+// taggingAPIMaxARNs ARNs
+type taggingBatch struct {
+	arns   []string
+	sent   bool
+	done   chan struct{}
+	failed map[string]*resourcegroupstaggingapi.FailureInfo
+	err    error
+}
+
+// resourceGroupsTagger is set when --tagging-api=resourcegroups
+var resourceGroupsTagger *resourceTagger
+
+func validateTaggingAPI(api string) error {
+	if api != taggingAPIService && api != taggingAPIResourceGroups {
+		return fmt.Errorf("must be %s or %s, got %q", taggingAPIService, taggingAPIResourceGroups, api)
+	}
+	return nil
+}
+
+// newResourceTagger looks up the account ID needed to build the volume ARNs
+func newResourceTagger(sess *session.Session, region string) (*resourceTagger, error) {
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the account ID: %w", err)
+	}
+	partition := endpoints.AwsPartitionID
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		partition = p.ID()
+	}
+	return &resourceTagger{
+		ResourceGroupsTaggingAPIAPI: resourcegroupstaggingapi.New(sess),
+		partition:                   partition,
+		region:                      region,
+		accountID:                   aws.StringValue(identity.Account),
+	}, nil
+}
+
+// arn returns the ARN of the EBS volume, EFS access point or EFS file system
+func (t *resourceTagger) arn(volumeID string) string {
+	var resource string
+	switch {
+	case strings.HasPrefix(volumeID, "vol-"):
+		resource = "ec2:" + t.region + ":" + t.accountID + ":volume/" + volumeID
+	case strings.HasPrefix(volumeID, "fsap-"):
+		resource = "elasticfilesystem:" + t.region + ":" + t.accountID + ":access-point/" + volumeID
+	default:
+		resource = "elasticfilesystem:" + t.region + ":" + t.accountID + ":file-system/" + volumeID
+	}
+	return "arn:" + t.partition + ":" + resource
+}
+
+func (t *resourceTagger) tagResource(volumeID string, tags map[string]string) error {
+	key := "tag/" + hashTags(tags)
+	return t.batch(key, t.arn(volumeID), func(arns []string) (map[string]*resourcegroupstaggingapi.FailureInfo, error) {
+		output, err := t.TagResources(&resourcegroupstaggingapi.TagResourcesInput{
+			ResourceARNList: aws.StringSlice(arns),
+			Tags:            aws.StringMap(tags),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return output.FailedResourcesMap, nil
+	})
+}
+
+func (t *resourceTagger) untagResource(volumeID string, keys []string) error {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	key := "untag/" + strings.Join(sorted, "\x00")
+	return t.batch(key, t.arn(volumeID), func(arns []string) (map[string]*resourcegroupstaggingapi.FailureInfo, error) {
+		output, err := t.UntagResources(&resourcegroupstaggingapi.UntagResourcesInput{
+			ResourceARNList: aws.StringSlice(arns),
+			TagKeys:         aws.StringSlice(keys),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return output.FailedResourcesMap, nil
+	})
+}
+
+// batch adds the ARN to the call waiting for more ARNs with the same key, or
+// else starts one, and returns the error of the ARN once the call is sent.
+// The call is sent after taggingAPIBatchWindow, or as soon as it's full.
+func (t *resourceTagger) batch(key string, arn string, call func([]string) (map[string]*resourcegroupstaggingapi.FailureInfo, error)) error {
+	t.mu.Lock()
+	if t.batches == nil {
+		t.batches = map[string]*taggingBatch{}
+	}
+	b, ok := t.batches[key]
+	if !ok {
+		b = &taggingBatch{done: make(chan struct{})}
+		t.batches[key] = b
+		if taggingAPIBatchWindow > 0 {
+			time.AfterFunc(taggingAPIBatchWindow, func() { t.send(key, b, call) })
+		}
+	}
+	if !containsString(b.arns, arn) {
+		b.arns = append(b.arns, arn)
+	}
+	full := len(b.arns) >= taggingAPIMaxARNs || taggingAPIBatchWindow <= 0
+	t.mu.Unlock()
+
+	if full {
+		t.send(key, b, call)
+	}
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+	if info, ok := b.failed[arn]; ok {
+		return taggingFailure(map[string]*resourcegroupstaggingapi.FailureInfo{arn: info})
+	}
+	return nil
+}
+
+// send makes the call of the batch, unless it was already sent
+func (t *resourceTagger) send(key string, b *taggingBatch, call func([]string) (map[string]*resourcegroupstaggingapi.FailureInfo, error)) {
+	t.mu.Lock()
+	if b.sent {
+		t.mu.Unlock()
+		return
+	}
+	b.sent = true
+	if t.batches[key] == b {
+		delete(t.batches, key)
+	}
+	arns := b.arns
+	t.mu.Unlock()
+
+	b.failed, b.err = call(arns)
+	close(b.done)
+}
+
+// taggingFailure returns the error of the resources the Tagging API failed to
+// tag, as an awserr.Error so that it is classified like the EC2 and EFS errors
+func taggingFailure(failed map[string]*resourcegroupstaggingapi.FailureInfo) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	arns := make([]string, 0, len(failed))
+	for arn := range failed {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	info := failed[arns[0]]
+	code := aws.StringValue(info.ErrorCode)
+	if aws.Int64Value(info.StatusCode) == 403 {
+		code = "AccessDeniedException"
+	}
+	return awserr.New(code, fmt.Sprintf("%s: %s", arns[0], aws.StringValue(info.ErrorMessage)), nil)
+}
@@ -0,0 +1,214 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+)
+
+type fakeTaggingAPI struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	sync.Mutex
+	tagged   map[string]map[string]string
+	untagged map[string][]string
+	failed   map[string]*resourcegroupstaggingapi.FailureInfo
+	calls    [][]string
+}
+
+func (f *fakeTaggingAPI) TagResources(input *resourcegroupstaggingapi.TagResourcesInput) (*resourcegroupstaggingapi.TagResourcesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, aws.StringValueSlice(input.ResourceARNList))
+	for _, arn := range input.ResourceARNList {
+		f.tagged[aws.StringValue(arn)] = aws.StringValueMap(input.Tags)
+	}
+	return &resourcegroupstaggingapi.TagResourcesOutput{FailedResourcesMap: f.failed}, nil
+}
+
+func (f *fakeTaggingAPI) UntagResources(input *resourcegroupstaggingapi.UntagResourcesInput) (*resourcegroupstaggingapi.UntagResourcesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, aws.StringValueSlice(input.ResourceARNList))
+	for _, arn := range input.ResourceARNList {
+		f.untagged[aws.StringValue(arn)] = aws.StringValueSlice(input.TagKeys)
+	}
+	return &resourcegroupstaggingapi.UntagResourcesOutput{FailedResourcesMap: f.failed}, nil
+}
+
+func Test_resourceTagger(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition string
+		volumeID  string
+		wantARN   string
+	}{
+		{
+			name:      "EBS volume",
+			partition: "aws",
+			volumeID:  "vol-123",
+			wantARN:   "arn:aws:ec2:us-east-1:123456789012:volume/vol-123",
+		},
+		{
+			name:      "EFS access point",
+			partition: "aws",
+			volumeID:  "fsap-123",
+			wantARN:   "arn:aws:elasticfilesystem:us-east-1:123456789012:access-point/fsap-123",
+		},
+		{
+			name:      "EFS file system",
+			partition: "aws-us-gov",
+			volumeID:  "fs-123",
+			wantARN:   "arn:aws-us-gov:elasticfilesystem:us-east-1:123456789012:file-system/fs-123",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeTaggingAPI{tagged: map[string]map[string]string{}, untagged: map[string][]string{}}
+			tagger := &resourceTagger{ResourceGroupsTaggingAPIAPI: api, partition: tt.partition, region: "us-east-1", accountID: "123456789012"}
+
+			if err := tagger.tagResource(tt.volumeID, map[string]string{"team": "a"}); err != nil {
+				t.Fatalf("tagResource() error = %v", err)
+			}
+			if !reflect.DeepEqual(api.tagged, map[string]map[string]string{tt.wantARN: {"team": "a"}}) {
+				t.Errorf("tagResource() tagged %v, want %v", api.tagged, tt.wantARN)
+			}
+			if err := tagger.untagResource(tt.volumeID, []string{"team"}); err != nil {
+				t.Fatalf("untagResource() error = %v", err)
+			}
+			if !reflect.DeepEqual(api.untagged, map[string][]string{tt.wantARN: {"team"}}) {
+				t.Errorf("untagResource() untagged %v, want %v", api.untagged, tt.wantARN)
+			}
+		})
+	}
+}
+
+func Test_resourceTaggerBatch(t *testing.T) {
+	defer func() { taggingAPIBatchWindow = 100 * time.Millisecond }()
+	taggingAPIBatchWindow = time.Hour
+	failedARN := "arn:aws:ec2:us-east-1:123456789012:volume/vol-3"
+	api := &fakeTaggingAPI{
+		tagged:   map[string]map[string]string{},
+		untagged: map[string][]string{},
+		failed: map[string]*resourcegroupstaggingapi.FailureInfo{
+			failedARN: {ErrorCode: aws.String("InvalidParameterException"), StatusCode: aws.Int64(400)},
+		},
+	}
+	tagger := &resourceTagger{ResourceGroupsTaggingAPIAPI: api, partition: "aws", region: "us-east-1", accountID: "123456789012"}
+
+	// The first 20 volumes fill a call that's sent straight away
+	var wg sync.WaitGroup
+	errs := make([]error, taggingAPIMaxARNs)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = tagger.tagResource(fmt.Sprintf("vol-%d", i), map[string]string{"team": "a"})
+		}(i)
+	}
+	wg.Wait()
+	if len(api.calls) != 1 || len(api.calls[0]) != taggingAPIMaxARNs {
+		t.Fatalf("tagResource() calls = %v, want a single call of %d ARNs", api.calls, taggingAPIMaxARNs)
+	}
+	for i, err := range errs {
+		if gotFailed := err != nil; gotFailed != (i == 3) {
+			t.Errorf("tagResource() of vol-%d error = %v, want only vol-3 to fail", i, err)
+		}
+	}
+	if class := classifyError(errs[3]); class != errorClassInvalidTag {
+		t.Errorf("tagResource() of vol-3 error class = %q, want %q", class, errorClassInvalidTag)
+	}
+
+	// The untag calls with other keys are sent on their own once the window ends
+	taggingAPIBatchWindow = 50 * time.Millisecond
+	api.calls = nil
+	for i, keys := range [][]string{{"team", "env"}, {"env", "team"}, {"team"}} {
+		wg.Add(1)
+		go func(volumeID string, keys []string) {
+			defer wg.Done()
+			if err := tagger.untagResource(volumeID, keys); err != nil {
+				t.Errorf("untagResource() error = %v", err)
+			}
+		}(fmt.Sprintf("vol-%d", i), keys)
+	}
+	wg.Wait()
+	sizes := []int{}
+	for _, call := range api.calls {
+		sizes = append(sizes, len(call))
+	}
+	sort.Ints(sizes)
+	if !reflect.DeepEqual(sizes, []int{1, 2}) {
+		t.Errorf("untagResource() calls = %v, want one per set of keys", api.calls)
+	}
+}
+
+func Test_taggingFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		failed    map[string]*resourcegroupstaggingapi.FailureInfo
+		wantClass string
+	}{
+		{
+			name: "no failure",
+		},
+		{
+			name: "access denied",
+			failed: map[string]*resourcegroupstaggingapi.FailureInfo{
+				"arn:aws:ec2:us-east-1:123456789012:volume/vol-123": {ErrorCode: aws.String("InvalidParameterException"), StatusCode: aws.Int64(403), ErrorMessage: aws.String("You are not authorized to perform this operation")},
+			},
+			wantClass: errorClassPermissionDenied,
+		},
+		{
+			name: "invalid tag",
+			failed: map[string]*resourcegroupstaggingapi.FailureInfo{
+				"arn:aws:ec2:us-east-1:123456789012:volume/vol-123": {ErrorCode: aws.String("InvalidParameterException"), StatusCode: aws.Int64(400)},
+			},
+			wantClass: errorClassInvalidTag,
+		},
+		{
+			name: "internal error",
+			failed: map[string]*resourcegroupstaggingapi.FailureInfo{
+				"arn:aws:ec2:us-east-1:123456789012:volume/vol-123": {ErrorCode: aws.String("InternalServiceException"), StatusCode: aws.Int64(500)},
+			},
+			wantClass: errorClassTransient,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := taggingFailure(tt.failed)
+			if tt.wantClass == "" {
+				if err != nil {
+					t.Errorf("taggingFailure() error = %v, want nil", err)
+				}
+				return
+			}
+			if class, ok := classifyAWSError(err); !ok || class != tt.wantClass {
+				t.Errorf("classifyAWSError(taggingFailure()) = %v, %v, want %v", class, ok, tt.wantClass)
+			}
+		})
+	}
+}
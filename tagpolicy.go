@@ -0,0 +1,237 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	// validateTagPolicy enables checking the tags against the effective tag
+	// policy of the account before they are applied
+	validateTagPolicy          bool
+	tagPolicyRefreshInterval   = time.Hour
+	errTagPolicyNotFound       = errors.New("no effective tag policy")
+	tagPolicyEnforcedResources = map[string]string{
+		providerAWSEBS: "ec2:volume",
+		providerAWSEFS: "elasticfilesystem:access-point",
+	}
+)
+
+// tagPolicyRule is the effective tag policy of a tag key
+type tagPolicyRule struct {
+	// Key is the capitalization of the tag key the policy requires
+	Key         string
+	Values      []string
+	EnforcedFor []string
+}
+
+// tagPolicyStore keeps the effective tag policy keyed by lowercase tag key
+type tagPolicyStore struct {
+	sync.RWMutex
+	rules map[string]tagPolicyRule
+}
+
+var effectiveTagPolicy = &tagPolicyStore{}
+
+func (s *tagPolicyStore) set(rules map[string]tagPolicyRule) {
+	s.Lock()
+	defer s.Unlock()
+	s.rules = rules
+}
+
+// check returns why the tag doesn't comply with the policy, if the policy is
+// enforced for the resource type, in which case the API would reject it
+func (s *tagPolicyStore) check(key string, value string, resourceType string) error {
+	s.RLock()
+	defer s.RUnlock()
+	rule, ok := s.rules[strings.ToLower(key)]
+	if !ok || !isTagPolicyEnforced(rule.EnforcedFor, resourceType) {
+		return nil
+	}
+	if rule.Key != "" && rule.Key != key {
+		return fmt.Errorf("tag %q must be spelled %q by the tag policy", key, rule.Key)
+	}
+	if rule.Values == nil {
+		return nil
+	}
+	for _, allowed := range rule.Values {
+		if matchTagPolicyValue(allowed, value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("value %q of tag %q is not allowed by the tag policy", value, key)
+}
+
+func isTagPolicyEnforced(enforcedFor []string, resourceType string) bool {
+	service := strings.SplitN(resourceType, ":", 2)[0]
+	for _, r := range enforcedFor {
+		if r == resourceType || r == service+":*" || r == service+":ALL_SUPPORTED" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTagPolicyValue matches the value against a tag policy value, which can
+// have a single * wildcard
+func matchTagPolicyValue(pattern string, value string) bool {
+	parts := strings.SplitN(pattern, "*", 2)
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	return len(value) >= len(parts[0])+len(parts[1]) && strings.HasPrefix(value, parts[0]) && strings.HasSuffix(value, parts[1])
+}
+
+// parseTagPolicy parses the content of an effective tag policy. The values
+// can also be wrapped in the @@assign operator of the policy syntax.
+func parseTagPolicy(content string) (map[string]tagPolicyRule, error) {
+	var policy struct {
+		Tags map[string]struct {
+			TagKey      json.RawMessage `json:"tag_key"`
+			TagValue    json.RawMessage `json:"tag_value"`
+			EnforcedFor json.RawMessage `json:"enforced_for"`
+		} `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(content), &policy); err != nil {
+		return nil, fmt.Errorf("cannot parse the tag policy: %w", err)
+	}
+	rules := map[string]tagPolicyRule{}
+	for name, tag := range policy.Tags {
+		key, err := parseTagPolicyValue(tag.TagKey)
+		if err != nil {
+			return nil, err
+		}
+		values, err := parseTagPolicyValue(tag.TagValue)
+		if err != nil {
+			return nil, err
+		}
+		enforcedFor, err := parseTagPolicyValue(tag.EnforcedFor)
+		if err != nil {
+			return nil, err
+		}
+		rule := tagPolicyRule{Values: values, EnforcedFor: enforcedFor}
+		if len(key) > 0 {
+			rule.Key = key[0]
+		}
+		rules[strings.ToLower(name)] = rule
+	}
+	return rules, nil
+}
+
+// parseTagPolicyValue parses a string, a list of strings or an @@assign of either
+func parseTagPolicyValue(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var assign struct {
+		Assign json.RawMessage `json:"@@assign"`
+	}
+	if err := json.Unmarshal(raw, &assign); err == nil && assign.Assign != nil {
+		raw = assign.Assign
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return []string{value}, nil
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, fmt.Errorf("cannot parse the tag policy value %s: %w", raw, err)
+	}
+	return values, nil
+}
+
+func newOrganizationsClient() organizationsiface.OrganizationsAPI {
+	return organizations.New(awsSession)
+}
+
+// loadTagPolicy fetches the effective tag policy of the account
+func loadTagPolicy(client organizationsiface.OrganizationsAPI) (map[string]tagPolicyRule, error) {
+	output, err := client.DescribeEffectivePolicy(&organizations.DescribeEffectivePolicyInput{
+		PolicyType: aws.String(organizations.EffectivePolicyTypeTagPolicy),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && (aerr.Code() == organizations.ErrCodeEffectivePolicyNotFoundException || aerr.Code() == organizations.ErrCodeAWSOrganizationsNotInUseException) {
+		return nil, errTagPolicyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if output.EffectivePolicy == nil {
+		return nil, errTagPolicyNotFound
+	}
+	return parseTagPolicy(aws.StringValue(output.EffectivePolicy.PolicyContent))
+}
+
+// refreshTagPolicy reloads the effective tag policy, keeping the previous one if it fails
+func refreshTagPolicy(client organizationsiface.OrganizationsAPI) {
+	rules, err := loadTagPolicy(client)
+	if errors.Is(err, errTagPolicyNotFound) {
+		log.Debugln("The account has no effective tag policy")
+		effectiveTagPolicy.set(nil)
+		return
+	} else if err != nil {
+		log.Errorln("Could not load the effective tag policy:", err)
+		return
+	}
+	effectiveTagPolicy.set(rules)
+	log.WithFields(log.Fields{"keys": len(rules)}).Debugln("Loaded the effective tag policy")
+}
+
+func runTagPolicyRefresh(ctx context.Context, client organizationsiface.OrganizationsAPI, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshTagPolicy(client)
+		}
+	}
+}
+
+// filterTagPolicy removes, and reports, the tags the effective tag policy
+// would make the cloud provider reject
+func filterTagPolicy(pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	resourceType, ok := tagPolicyEnforcedResources[getProvider(pvc)]
+	if !ok {
+		return
+	}
+	var errs []error
+	for k, v := range tags {
+		if err := effectiveTagPolicy.check(k, v, resourceType); err != nil {
+			errs = append(errs, err)
+			delete(tags, k)
+		}
+	}
+	reportInvalidTags(pvc, errs)
+}
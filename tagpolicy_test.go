@@ -0,0 +1,152 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testTagPolicy = `{
+  "tags": {
+    "costcenter": {
+      "tag_key": "CostCenter",
+      "tag_value": ["100", "200*"],
+      "enforced_for": ["ec2:volume"]
+    },
+    "team": {
+      "tag_key": {"@@assign": "team"},
+      "tag_value": {"@@assign": ["payments", "*-platform"]},
+      "enforced_for": {"@@assign": ["elasticfilesystem:ALL_SUPPORTED"]}
+    },
+    "project": {
+      "tag_key": "Project"
+    }
+  }
+}`
+
+type fakeOrganizations struct {
+	organizationsiface.OrganizationsAPI
+	content string
+	err     error
+}
+
+func (f *fakeOrganizations) DescribeEffectivePolicy(input *organizations.DescribeEffectivePolicyInput) (*organizations.DescribeEffectivePolicyOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &organizations.DescribeEffectivePolicyOutput{EffectivePolicy: &organizations.EffectivePolicy{PolicyContent: aws.String(f.content)}}, nil
+}
+
+func Test_parseTagPolicy(t *testing.T) {
+	got, err := parseTagPolicy(testTagPolicy)
+	if err != nil {
+		t.Fatalf("parseTagPolicy() error = %v", err)
+	}
+	want := map[string]tagPolicyRule{
+		"costcenter": {Key: "CostCenter", Values: []string{"100", "200*"}, EnforcedFor: []string{"ec2:volume"}},
+		"team":       {Key: "team", Values: []string{"payments", "*-platform"}, EnforcedFor: []string{"elasticfilesystem:ALL_SUPPORTED"}},
+		"project":    {Key: "Project"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTagPolicy() = %+v, want %+v", got, want)
+	}
+	if _, err := parseTagPolicy(`{"tags": {"team": {"tag_value": 1}}}`); err == nil {
+		t.Errorf("parseTagPolicy() error = nil, want an error")
+	}
+}
+
+func Test_filterTagPolicy(t *testing.T) {
+	rules, err := parseTagPolicy(testTagPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	effectiveTagPolicy.set(rules)
+	defer effectiveTagPolicy.set(nil)
+
+	tests := []struct {
+		name        string
+		provisioner string
+		tags        map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "compliant EBS tags",
+			provisioner: "ebs.csi.aws.com",
+			tags:        map[string]string{"CostCenter": "200-1", "team": "anything", "project": "foo"},
+			want:        map[string]string{"CostCenter": "200-1", "team": "anything", "project": "foo"},
+		},
+		{
+			name:        "enforced EBS value",
+			provisioner: "ebs.csi.aws.com",
+			tags:        map[string]string{"CostCenter": "300", "other": "bar"},
+			want:        map[string]string{"other": "bar"},
+		},
+		{
+			name:        "enforced EBS capitalization",
+			provisioner: "ebs.csi.aws.com",
+			tags:        map[string]string{"costcenter": "100"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "EFS tags",
+			provisioner: "efs.csi.aws.com",
+			tags:        map[string]string{"CostCenter": "300", "team": "data-platform", "Team": "payments"},
+			want:        map[string]string{"CostCenter": "300", "team": "data-platform"},
+		},
+		{
+			name:        "enforced EFS value",
+			provisioner: "efs.csi.aws.com",
+			tags:        map[string]string{"team": "platform"},
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": tt.provisioner})
+			filterTagPolicy(pvc, tt.tags)
+			if !reflect.DeepEqual(tt.tags, tt.want) {
+				t.Errorf("filterTagPolicy() = %v, want %v", tt.tags, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadTagPolicy(t *testing.T) {
+	rules, err := loadTagPolicy(&fakeOrganizations{content: testTagPolicy})
+	if err != nil || len(rules) != 3 {
+		t.Errorf("loadTagPolicy() = %v, %v, want 3 rules", rules, err)
+	}
+	for _, code := range []string{organizations.ErrCodeEffectivePolicyNotFoundException, organizations.ErrCodeAWSOrganizationsNotInUseException} {
+		if _, err := loadTagPolicy(&fakeOrganizations{err: awserr.New(code, "", nil)}); !errors.Is(err, errTagPolicyNotFound) {
+			t.Errorf("loadTagPolicy() error = %v, want %v", err, errTagPolicyNotFound)
+		}
+	}
+	if _, err := loadTagPolicy(&fakeOrganizations{err: awserr.New("AccessDeniedException", "", nil)}); err == nil || errors.Is(err, errTagPolicyNotFound) {
+		t.Errorf("loadTagPolicy() error = %v, want an access denied error", err)
+	}
+}
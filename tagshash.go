@@ -0,0 +1,72 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagsHashKey is the tag set to the hash of the other tags applied to the
+// volume, so whether a volume's tags drifted can be checked by comparing a
+// single tag instead of all of them. It's disabled when empty.
+var tagsHashKey string
+
+// setTagsHashTag sets the tags hash tag to the hash of the other tags. The tag
+// can't be set from the PVC.
+func setTagsHashTag(tags map[string]string) {
+	if tagsHashKey == "" {
+		return
+	}
+	delete(tags, tagsHashKey)
+	if len(tags) == 0 {
+		return
+	}
+	tags[tagsHashKey] = hashTags(tags)
+}
+
+// isTagsHashCurrent returns whether the existing tags hash tag matches the
+// tags, and false when the tags have no hash
+func isTagsHashCurrent(existing map[string]string, tags map[string]string) bool {
+	hash, ok := tags[tagsHashKey]
+	return tagsHashKey != "" && ok && existing[tagsHashKey] == hash
+}
+
+// listEBSTagsHashes returns the tags hash tag of every EBS volume that has one,
+// keyed by volumeID, with paginated DescribeTags calls instead of a call per volume
+func listEBSTagsHashes(ec2Client *EBSClient) (map[string]string, error) {
+	hashes := map[string]string{}
+	err := ec2Client.DescribeTagsPages(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-type"), Values: []*string{aws.String("volume")}},
+			{Name: aws.String("key"), Values: []*string{aws.String(tagsHashKey)}},
+		},
+	}, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			hashes[aws.StringValue(t.ResourceId)] = aws.StringValue(t.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe the EBS volume tags hashes: %w", err)
+	}
+	return hashes, nil
+}
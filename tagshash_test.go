@@ -0,0 +1,124 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_setTagsHashTag(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		tags map[string]string
+		want map[string]string
+	}{
+		{
+			name: "disabled",
+			tags: map[string]string{"foo": "bar"},
+			want: map[string]string{"foo": "bar"},
+		},
+		{
+			name: "hash of the other tags",
+			key:  "tags-hash",
+			tags: map[string]string{"foo": "bar"},
+			want: map[string]string{"foo": "bar", "tags-hash": hashTags(map[string]string{"foo": "bar"})},
+		},
+		{
+			name: "can't be set from the PVC",
+			key:  "tags-hash",
+			tags: map[string]string{"foo": "bar", "tags-hash": "0123"},
+			want: map[string]string{"foo": "bar", "tags-hash": hashTags(map[string]string{"foo": "bar"})},
+		},
+		{
+			name: "no tags",
+			key:  "tags-hash",
+			tags: map[string]string{},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagsHashKey = tt.key
+			defer func() { tagsHashKey = "" }()
+			setTagsHashTag(tt.tags)
+			if !reflect.DeepEqual(tt.tags, tt.want) {
+				t.Errorf("setTagsHashTag() = %v, want %v", tt.tags, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hasTags_tagsHash(t *testing.T) {
+	clusterName = "prod"
+	tagsHashKey = "tags-hash"
+	defer func() {
+		clusterName = ""
+		tagsHashKey = ""
+	}()
+	tags := map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"}
+	setTagsHashTag(tags)
+
+	tests := []struct {
+		name     string
+		existing map[string]string
+		want     bool
+	}{
+		{
+			name:     "same hash",
+			existing: map[string]string{"managed-by": "k8s-pvc-tagger/prod", "tags-hash": tags["tags-hash"]},
+			want:     true,
+		},
+		{
+			name:     "different hash",
+			existing: map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod", "tags-hash": "0123"},
+			want:     false,
+		},
+		{
+			name:     "no hash",
+			existing: map[string]string{"foo": "bar", "managed-by": "k8s-pvc-tagger/prod"},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasTags(tt.existing, tags); got != tt.want {
+				t.Errorf("hasTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listEBSTagsHashes(t *testing.T) {
+	tagsHashKey = "tags-hash"
+	defer func() { tagsHashKey = "" }()
+	store := newFakeTagStore()
+	store.addTags("vol-hashed", map[string]string{"foo": "bar", "tags-hash": "0123"})
+	store.addTags("vol-unhashed", map[string]string{"foo": "bar"})
+	store.addTags("fs-hashed", map[string]string{"tags-hash": "4567"})
+
+	hashes, err := listEBSTagsHashes(&EBSClient{&fakeEC2{store: store}})
+	if err != nil {
+		t.Fatalf("listEBSTagsHashes() error = %v", err)
+	}
+	if want := map[string]string{"vol-hashed": "0123"}; !reflect.DeepEqual(hashes, want) {
+		t.Errorf("listEBSTagsHashes() = %v, want %v", hashes, want)
+	}
+}
@@ -0,0 +1,90 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TagSource is a place the tags of a PVC are read from. The sources are
+// enabled, and ordered, with --tag-sources; the tags of a source replace the
+// ones of the sources before it. A source that needs the PV, the namespace
+// or anything else looks it up itself, so the disabled sources cost nothing.
+type TagSource interface {
+	Name() string
+	Compute(pvc *corev1.PersistentVolumeClaim) map[string]string
+}
+
+// tagSourceFunc adapts a function to the TagSource interface
+type tagSourceFunc struct {
+	name    string
+	compute func(pvc *corev1.PersistentVolumeClaim) map[string]string
+}
+
+func (s tagSourceFunc) Name() string { return s.name }
+
+func (s tagSourceFunc) Compute(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	return s.compute(pvc)
+}
+
+// tagSourceRegistry are the sources that can be enabled with --tag-sources, by name
+var tagSourceRegistry = map[string]TagSource{}
+
+func registerTagSource(source TagSource) {
+	tagSourceRegistry[source.Name()] = source
+}
+
+func init() {
+	registerTagSource(tagSourceFunc{tagSourceAnnotations, buildAnnotationTags})
+	registerTagSource(tagSourceFunc{tagSourceLabels, buildLabelTags})
+	registerTagSource(tagSourceFunc{tagSourcePVAnnotations, buildPVAnnotationTags})
+}
+
+// getTagSource returns the registered source with the name
+func getTagSource(name string) (TagSource, bool) {
+	source, ok := tagSourceRegistry[name]
+	return source, ok
+}
+
+// tagSourceNames returns the names of the registered sources, sorted
+func tagSourceNames() []string {
+	names := []string{}
+	for name := range tagSourceRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseTagSources parses the comma separated list of --tag-sources
+func parseTagSources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if _, ok := getTagSource(source); !ok {
+			return nil, fmt.Errorf("%q is not one of %s", source, strings.Join(tagSourceNames(), ", "))
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
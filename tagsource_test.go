@@ -0,0 +1,79 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_TagSource(t *testing.T) {
+	registerTagSource(tagSourceFunc{"test-namespace", func(pvc *corev1.PersistentVolumeClaim) map[string]string {
+		return map[string]string{"namespace": pvc.GetNamespace(), "team": "from-namespace"}
+	}})
+	defer delete(tagSourceRegistry, "test-namespace")
+
+	if got, want := tagSourceNames(), []string{"annotations", "labels", "pv-annotations", "test-namespace"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tagSourceNames() = %v, want %v", got, want)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("data")
+	pvc.SetNamespace("payments")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/tags": `{"team": "from-annotation"}`})
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    map[string]string
+	}{
+		{
+			name:    "annotations only",
+			sources: []string{"annotations"},
+			want:    map[string]string{"team": "from-annotation"},
+		},
+		{
+			name:    "later sources take precedence",
+			sources: []string{"annotations", "test-namespace"},
+			want:    map[string]string{"namespace": "payments", "team": "from-namespace"},
+		},
+		{
+			name:    "earlier sources are overwritten",
+			sources: []string{"test-namespace", "annotations"},
+			want:    map[string]string{"namespace": "payments", "team": "from-annotation"},
+		},
+		{
+			name:    "unknown sources are skipped",
+			sources: []string{"unknown", "annotations"},
+			want:    map[string]string{"team": "from-annotation"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagSources = tt.sources
+			defer func() { tagSources = []string{tagSourceAnnotations} }()
+			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
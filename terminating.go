@@ -0,0 +1,141 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+)
+
+// terminatingNamespaceStore keeps track of the namespaces the API server
+// rejected a write to because they are being terminated. Nothing is written to
+// them anymore and the tag operations of their PVCs that haven't started are
+// abandoned; the ones already sent to the cloud provider finish.
+type terminatingNamespaceStore struct {
+	mu         sync.Mutex
+	namespaces map[string]time.Time
+}
+
+var terminatingNamespaces = newTerminatingNamespaceStore()
+
+func newTerminatingNamespaceStore() *terminatingNamespaceStore {
+	return &terminatingNamespaceStore{namespaces: map[string]time.Time{}}
+}
+
+// mark records that the namespace is terminating, returning false if it already was
+func (s *terminatingNamespaceStore) mark(namespace string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namespaces[namespace]; ok {
+		return false
+	}
+	s.namespaces[namespace] = now
+	return true
+}
+
+func (s *terminatingNamespaceStore) isTerminating(namespace string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.namespaces[namespace]
+	return ok
+}
+
+// observePVC forgets the namespace when a PVC is created in it after it was
+// marked: PVCs can't be created in a terminating namespace, so it was recreated
+func (s *terminatingNamespaceStore) observePVC(pvc *corev1.PersistentVolumeClaim) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	marked, ok := s.namespaces[pvc.GetNamespace()]
+	if ok && pvc.GetCreationTimestamp().Time.After(marked) {
+		delete(s.namespaces, pvc.GetNamespace())
+	}
+}
+
+// isNamespaceTerminating returns true if the write was rejected because its namespace is terminating
+func isNamespaceTerminating(err error) bool {
+	if err == nil {
+		return false
+	}
+	if k8serrors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+		return true
+	}
+	// Older API servers only set the reason in the message
+	return k8serrors.IsForbidden(err) && strings.Contains(err.Error(), "because it is being terminated")
+}
+
+// markNamespaceTerminating records that the namespace is terminating if the
+// write failed because of it, and returns whether it did
+func markNamespaceTerminating(namespace string, operation string, err error) bool {
+	if !isNamespaceTerminating(err) {
+		return false
+	}
+	promTerminatingNamespaceSkipsTotal.With(prometheus.Labels{"operation": operation}).Inc()
+	if terminatingNamespaces.mark(namespace, time.Now()) {
+		log.WithFields(log.Fields{"namespace": namespace}).Infoln("Namespace is terminating, no longer writing to it and abandoning the queued tag operations of its PVCs")
+	}
+	return true
+}
+
+// skipTerminatingNamespace returns true, and counts it, if the operation on
+// the namespace must be skipped because the namespace is terminating
+func skipTerminatingNamespace(namespace string, operation string) bool {
+	if !terminatingNamespaces.isTerminating(namespace) {
+		return false
+	}
+	promTerminatingNamespaceSkipsTotal.With(prometheus.Labels{"operation": operation}).Inc()
+	return true
+}
+
+// terminatingNamespaceEventSink drops the events of the terminating
+// namespaces, which the API server rejects, instead of logging every rejection
+type terminatingNamespaceEventSink struct {
+	record.EventSink
+}
+
+func (s terminatingNamespaceEventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	return s.write(event, s.EventSink.Create)
+}
+
+func (s terminatingNamespaceEventSink) Update(event *corev1.Event) (*corev1.Event, error) {
+	return s.write(event, s.EventSink.Update)
+}
+
+func (s terminatingNamespaceEventSink) Patch(event *corev1.Event, data []byte) (*corev1.Event, error) {
+	return s.write(event, func(event *corev1.Event) (*corev1.Event, error) {
+		return s.EventSink.Patch(event, data)
+	})
+}
+
+func (s terminatingNamespaceEventSink) write(event *corev1.Event, write func(*corev1.Event) (*corev1.Event, error)) (*corev1.Event, error) {
+	if skipTerminatingNamespace(event.Namespace, "event") {
+		return event, nil
+	}
+	written, err := write(event)
+	if markNamespaceTerminating(event.Namespace, "event", err) {
+		return event, nil
+	}
+	return written, err
+}
@@ -0,0 +1,170 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newNamespaceTerminatingError(resource string) error {
+	err := k8serrors.NewForbidden(schema.GroupResource{Resource: resource}, "", errors.New("unable to create new content in namespace team-a because it is being terminated"))
+	err.ErrStatus.Details.Causes = []metav1.StatusCause{{Type: corev1.NamespaceTerminatingCause, Message: "namespace team-a is being terminated", Field: "metadata.namespace"}}
+	return err
+}
+
+func Test_isNamespaceTerminating(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "terminating cause", err: newNamespaceTerminatingError("events"), want: true},
+		{
+			name: "terminating message",
+			err:  k8serrors.NewForbidden(schema.GroupResource{Resource: "events"}, "", errors.New("unable to create new content in namespace team-a because it is being terminated")),
+			want: true,
+		},
+		{name: "other forbidden", err: k8serrors.NewForbidden(schema.GroupResource{Resource: "events"}, "", errors.New("RBAC")), want: false},
+		{name: "not found", err: k8serrors.NewNotFound(schema.GroupResource{Resource: "persistentvolumeclaims"}, "data"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNamespaceTerminating(tt.err); got != tt.want {
+				t.Errorf("isNamespaceTerminating() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_terminatingNamespaceStore(t *testing.T) {
+	s := newTerminatingNamespaceStore()
+	marked := time.Now()
+	if !s.mark("team-a", marked) {
+		t.Error("mark() = false, want true the first time")
+	}
+	if s.mark("team-a", marked.Add(time.Second)) {
+		t.Error("mark() = true, want false for an already terminating namespace")
+	}
+
+	old := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "old", CreationTimestamp: metav1.NewTime(marked.Add(-time.Hour))}}
+	s.observePVC(old)
+	if !s.isTerminating("team-a") {
+		t.Error("isTerminating() = false after observing a PVC created before the namespace was marked")
+	}
+	recreated := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "new", CreationTimestamp: metav1.NewTime(marked.Add(time.Minute))}}
+	s.observePVC(recreated)
+	if s.isTerminating("team-a") {
+		t.Error("isTerminating() = true after a PVC was created in the recreated namespace")
+	}
+}
+
+type countingEventSink struct {
+	record.EventSink
+	creates int
+	err     error
+}
+
+func (s *countingEventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	s.creates++
+	return event, s.err
+}
+
+func Test_terminatingNamespaceEventSink(t *testing.T) {
+	terminatingNamespaces = newTerminatingNamespaceStore()
+	defer func() { terminatingNamespaces = newTerminatingNamespaceStore() }()
+	inner := &countingEventSink{err: newNamespaceTerminatingError("events")}
+	sink := terminatingNamespaceEventSink{inner}
+	event := &corev1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "data.1"}}
+
+	if _, err := sink.Create(event); err != nil {
+		t.Errorf("Create() error = %v, want the rejection to be dropped", err)
+	}
+	if !terminatingNamespaces.isTerminating("team-a") {
+		t.Error("Create() didn't mark the namespace as terminating")
+	}
+	if _, err := sink.Create(event); err != nil || inner.creates != 1 {
+		t.Errorf("Create() = %v with %d creates, want the event to be dropped without calling the API server", err, inner.creates)
+	}
+
+	inner.err = errors.New("connection refused")
+	other := &corev1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "data.1"}}
+	if _, err := sink.Create(other); err == nil {
+		t.Error("Create() error = nil, want the errors of other namespaces to be returned")
+	}
+}
+
+func Test_updateSkipReasonTerminatingNamespace(t *testing.T) {
+	writeSkipReasons = true
+	terminatingNamespaces = newTerminatingNamespaceStore()
+	skipReasons = newSkipReasonStore()
+	defer func() {
+		writeSkipReasons = false
+		terminatingNamespaces = newTerminatingNamespaceStore()
+		skipReasons = newSkipReasonStore()
+	}()
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "data", Annotations: map[string]string{"k8s-pvc-tagger/ignore": ""}}}
+	client := fake.NewSimpleClientset(pvc)
+	patches := 0
+	client.PrependReactor("patch", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		return true, nil, newNamespaceTerminatingError("persistentvolumeclaims")
+	})
+	k8sClient = client
+
+	updateSkipReason(pvc)
+	updateSkipReason(pvc)
+	if patches != 1 {
+		t.Errorf("updateSkipReason() patched %d times, want 1 before the namespace is known to be terminating", patches)
+	}
+	if !terminatingNamespaces.isTerminating("team-a") {
+		t.Error("updateSkipReason() didn't mark the namespace as terminating")
+	}
+}
+
+func Test_tagVolumeTerminatingNamespace(t *testing.T) {
+	terminatingNamespaces = newTerminatingNamespaceStore()
+	managedVolumes = newVolumeStore()
+	defer func() {
+		terminatingNamespaces = newTerminatingNamespaceStore()
+		managedVolumes = newVolumeStore()
+	}()
+	terminatingNamespaces.mark("team-a", time.Now())
+	store := newFakeTagStore()
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "data", Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}}}
+
+	tagVolume(pvc, "vol-1", map[string]string{"team": "a"}, nil, &EFSClient{&fakeEFS{store: store}}, &EBSClient{&fakeEC2{store: store}})
+	if tags := store.get("vol-1"); len(tags) != 0 {
+		t.Errorf("tagVolume() tagged the volume of a terminating namespace with %v", tags)
+	}
+	if _, ok := managedVolumes.get("vol-1"); ok {
+		t.Error("tagVolume() queued the volume of a terminating namespace")
+	}
+}
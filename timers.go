@@ -0,0 +1,89 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pvcTimers keeps a timer per PVC, keyed by namespace/name, e.g. to enforce
+// its tags again when its exemption expires, and counts them in gauge
+type pvcTimers struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+	gauge  prometheus.Gauge
+	// running are the callbacks of the fired timers that haven't returned yet
+	running sync.WaitGroup
+}
+
+func newPVCTimers(gauge prometheus.Gauge) *pvcTimers {
+	return &pvcTimers{timers: map[string]*time.Timer{}, gauge: gauge}
+}
+
+// schedule runs f at the given time, replacing the previous timer of the PVC.
+// The timer is removed when it fires, unless it has been replaced since.
+func (s *pvcTimers) schedule(namespace string, name string, at time.Time, f func()) {
+	s.Lock()
+	defer s.Unlock()
+	key := namespace + "/" + name
+	if t, ok := s.timers[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(time.Until(at), func() {
+		s.running.Add(1)
+		defer s.running.Done()
+		s.Lock()
+		if s.timers[key] == t {
+			delete(s.timers, key)
+			s.gauge.Set(float64(len(s.timers)))
+		}
+		s.Unlock()
+		f()
+	})
+	s.timers[key] = t
+	s.gauge.Set(float64(len(s.timers)))
+}
+
+func (s *pvcTimers) cancel(namespace string, name string) {
+	s.Lock()
+	defer s.Unlock()
+	key := namespace + "/" + name
+	if t, ok := s.timers[key]; ok {
+		t.Stop()
+		delete(s.timers, key)
+		s.gauge.Set(float64(len(s.timers)))
+	}
+}
+
+// has returns whether the PVC has a pending timer
+func (s *pvcTimers) has(namespace string, name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.timers[namespace+"/"+name]
+	return ok
+}
+
+// wait waits for the callbacks of the fired timers to return
+func (s *pvcTimers) wait() {
+	s.running.Wait()
+}
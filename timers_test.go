@@ -0,0 +1,59 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_pvcTimers(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_timers"})
+	s := newPVCTimers(gauge)
+	ran := make(chan string, 2)
+
+	s.schedule("default", "foo", time.Now().Add(time.Hour), func() { ran <- "first" })
+	s.schedule("default", "foo", time.Now().Add(10*time.Millisecond), func() { ran <- "second" })
+	select {
+	case got := <-ran:
+		if got != "second" {
+			t.Errorf("schedule() ran the %s timer, want the second", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("schedule() did not run the timer")
+	}
+	s.wait()
+	if s.has("default", "foo") {
+		t.Error("has() = true after the timer ran, want false")
+	}
+	if got := testutil.ToFloat64(gauge); got != 0 {
+		t.Errorf("gauge = %v after the timer ran, want 0", got)
+	}
+
+	s.schedule("default", "bar", time.Now().Add(10*time.Millisecond), func() { ran <- "bar" })
+	s.cancel("default", "bar")
+	select {
+	case got := <-ran:
+		t.Errorf("cancel() ran the %s timer", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
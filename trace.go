@@ -0,0 +1,118 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pvcTrace is the debug tracing of a PVC's reconciles, enabled by its
+// debug-reconciles annotation for a number of reconciles
+type pvcTrace struct {
+	// annotation is the value of the annotation, a new value starts over
+	annotation string
+	reconciles int
+	active     bool
+}
+
+// pvcTraces are the traced PVCs, keyed by namespace/name
+type pvcTraces struct {
+	mu     sync.Mutex
+	traces map[string]*pvcTrace
+	logger *log.Logger
+	once   sync.Once
+}
+
+var reconcileTraces = newPVCTraces()
+
+func newPVCTraces() *pvcTraces {
+	return &pvcTraces{traces: map[string]*pvcTrace{}}
+}
+
+// start counts a reconcile of the PVC and returns whether it is traced
+func (t *pvcTraces) start(pvc *corev1.PersistentVolumeClaim, event string) bool {
+	key := pvc.GetNamespace() + "/" + pvc.GetName()
+	value, ok := getPVCAnnotation(pvc, "debug-reconciles")
+	if !ok {
+		t.delete(pvc.GetNamespace(), pvc.GetName())
+		return false
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "value": value}).Warnln(annotationPrefix + "/debug-reconciles must be a positive number of reconciles")
+		t.delete(pvc.GetNamespace(), pvc.GetName())
+		return false
+	}
+
+	t.mu.Lock()
+	trace, ok := t.traces[key]
+	if !ok || trace.annotation != value {
+		trace = &pvcTrace{annotation: value}
+		t.traces[key] = trace
+	}
+	trace.reconciles++
+	wasActive := trace.active
+	trace.active = trace.reconciles <= limit
+	active, reconciles := trace.active, trace.reconciles
+	t.mu.Unlock()
+
+	if active {
+		t.log(pvc.GetNamespace(), pvc.GetName(), log.Fields{"event": event, "reconcile": reconciles, "of": limit}, "Tracing reconcile")
+	} else if wasActive {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "reconciles": limit}).Infoln("Finished tracing the PVC's reconciles, the " + annotationPrefix + "/debug-reconciles annotation can be removed")
+	}
+	return active
+}
+
+func (t *pvcTraces) isActive(namespace string, name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trace, ok := t.traces[namespace+"/"+name]
+	return ok && trace.active
+}
+
+func (t *pvcTraces) delete(namespace string, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.traces, namespace+"/"+name)
+}
+
+// log logs at the debug level, whatever the log level is, if the PVC is traced
+func (t *pvcTraces) log(namespace string, name string, fields log.Fields, message string) {
+	if !t.isActive(namespace, name) {
+		return
+	}
+	// The logger is created on first use so that it has the configured formatter
+	t.once.Do(func() {
+		t.logger = log.New()
+		t.logger.SetOutput(log.StandardLogger().Out)
+		t.logger.SetFormatter(log.StandardLogger().Formatter)
+		t.logger.SetLevel(log.DebugLevel)
+	})
+	t.logger.WithFields(log.Fields{"namespace": namespace, "pvc": name, "trace": true}).WithFields(fields).Debugln(message)
+}
+
+// tracePVC logs the message if the PVC's reconciles are being traced
+func tracePVC(pvc *corev1.PersistentVolumeClaim, fields log.Fields, message string) {
+	reconcileTraces.log(pvc.GetNamespace(), pvc.GetName(), fields, message)
+}
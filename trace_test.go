@@ -0,0 +1,100 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_pvcTraces(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("data")
+	pvc.SetNamespace("default")
+	traces := newPVCTraces()
+
+	// Not traced without the annotation
+	if traces.start(pvc, "add") {
+		t.Errorf("start() = true without the annotation")
+	}
+
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/debug-reconciles": "2"})
+	for i, want := range []bool{true, true, false, false} {
+		if got := traces.start(pvc, "update"); got != want {
+			t.Errorf("reconcile %d: start() = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// A new value starts over
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/debug-reconciles": "1"})
+	if !traces.start(pvc, "update") || !traces.isActive("default", "data") {
+		t.Errorf("start() = false after changing the annotation")
+	}
+
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/debug-reconciles": "forever"})
+	if traces.start(pvc, "update") || traces.isActive("default", "data") {
+		t.Errorf("start() = true with an invalid annotation")
+	}
+
+	pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/debug-reconciles": "3"})
+	traces.start(pvc, "update")
+	traces.delete("default", "data")
+	if traces.isActive("default", "data") {
+		t.Errorf("isActive() = true after delete")
+	}
+}
+
+func Test_pvcTracesLog(t *testing.T) {
+	level := log.GetLevel()
+	out := log.StandardLogger().Out
+	buf := &bytes.Buffer{}
+	log.SetLevel(log.InfoLevel)
+	log.SetOutput(buf)
+	defer func() {
+		log.SetLevel(level)
+		log.SetOutput(out)
+	}()
+
+	traced := &corev1.PersistentVolumeClaim{}
+	traced.SetName("traced")
+	traced.SetNamespace("default")
+	traced.SetAnnotations(map[string]string{"k8s-pvc-tagger/debug-reconciles": "1"})
+	other := &corev1.PersistentVolumeClaim{}
+	other.SetName("other")
+	other.SetNamespace("default")
+
+	traces := newPVCTraces()
+	traces.start(traced, "add")
+	traces.start(other, "add")
+	traces.log("default", "traced", log.Fields{"volumeID": "vol-1"}, "Tagging the volume")
+	traces.log("default", "other", log.Fields{"volumeID": "vol-2"}, "Tagging the volume")
+
+	// Traced PVCs are logged at the debug level even though the log level is info
+	got := buf.String()
+	if !strings.Contains(got, "Tagging the volume") || !strings.Contains(got, "vol-1") {
+		t.Errorf("the traced PVC was not logged: %s", got)
+	}
+	if strings.Contains(got, "vol-2") {
+		t.Errorf("a PVC without the annotation was logged: %s", got)
+	}
+}
@@ -0,0 +1,85 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var tagExpiries = newPVCTimers(promExpiringTagsPVCs)
+
+// getTagExpiries returns when the tags of the ttl-tags annotation expire.
+// A TTL is an RFC 3339 time rather than a duration, since nothing records
+// when a duration would start: the managed fields of the PVC are reset by any
+// later change of the same field manager.
+func getTagExpiries(pvc *corev1.PersistentVolumeClaim) (map[string]time.Time, []error) {
+	value, ok := getPVCAnnotation(pvc, "ttl-tags")
+	if !ok {
+		return nil, nil
+	}
+	ttls, errs := parseTags(value)
+	expiries := map[string]time.Time{}
+	for k, v := range ttls {
+		if !isValidTagName(k) && !allowAllTags {
+			errs = append(errs, fmt.Errorf("tag %q is a restricted tag and cannot expire", k))
+			continue
+		}
+		if k == managedByTagKey && clusterName != "" {
+			errs = append(errs, fmt.Errorf("tag %q is the ownership tag and cannot expire", k))
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ttl %q of tag %q is not an RFC 3339 time", v, k))
+			continue
+		}
+		expiries[k] = t
+	}
+	return expiries, errs
+}
+
+// expiredTagKeys returns, in sorted order, the keys of the tags that have expired at now
+func expiredTagKeys(pvc *corev1.PersistentVolumeClaim, now time.Time) []string {
+	expiries, errs := getTagExpiries(pvc)
+	reportInvalidTags(pvc, errs)
+	var keys []string
+	for k, expiry := range expiries {
+		if !expiry.After(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nextTagExpiry returns when the next tag expires after now, if any
+func nextTagExpiry(pvc *corev1.PersistentVolumeClaim, now time.Time) (time.Time, bool) {
+	expiries, _ := getTagExpiries(pvc)
+	var next time.Time
+	for _, expiry := range expiries {
+		if expiry.After(now) && (next.IsZero() || expiry.Before(next)) {
+			next = expiry
+		}
+	}
+	return next, !next.IsZero()
+}
@@ -0,0 +1,107 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_tagExpiries(t *testing.T) {
+	created := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		now         time.Time
+		wantExpired []string
+		wantNext    time.Time
+		wantNextOk  bool
+	}{
+		{
+			name:        "no ttl-tags",
+			annotations: map[string]string{},
+			now:         created,
+		},
+		{
+			name:        "expiry time",
+			annotations: map[string]string{"k8s-pvc-tagger/ttl-tags": `{"migration": "2022-07-10T00:00:00Z", "phase": "2022-07-05T00:00:00Z", "other": "2022-07-02T00:00:00Z"}`},
+			now:         created.Add(48 * time.Hour),
+			wantExpired: []string{"other"},
+			wantNext:    time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC),
+			wantNextOk:  true,
+		},
+		{
+			name:        "expiry time with a time zone",
+			annotations: map[string]string{"k8s-pvc-tagger/ttl-tags": `{"migration": "2022-07-05T02:00:00+02:00"}`},
+			now:         created,
+			wantNext:    time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC),
+			wantNextOk:  true,
+		},
+		{
+			name:        "duration isn't an expiry time",
+			annotations: map[string]string{"k8s-pvc-tagger/ttl-tags": `{"migration": "72h"}`},
+			now:         created.Add(96 * time.Hour),
+		},
+		{
+			name:        "invalid ttl",
+			annotations: map[string]string{"k8s-pvc-tagger/ttl-tags": `{"migration": "next week", "kubernetes.io/foo": "2022-07-02T00:00:00Z"}`},
+			now:         created.Add(48 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetCreationTimestamp(metav1.NewTime(created))
+
+			if got := expiredTagKeys(pvc, tt.now); !reflect.DeepEqual(got, tt.wantExpired) {
+				t.Errorf("expiredTagKeys() = %v, want %v", got, tt.wantExpired)
+			}
+			gotNext, gotOk := nextTagExpiry(pvc, tt.now)
+			if gotOk != tt.wantNextOk || !gotNext.Equal(tt.wantNext) {
+				t.Errorf("nextTagExpiry() = %v, %v, want %v, %v", gotNext, gotOk, tt.wantNext, tt.wantNextOk)
+			}
+		})
+	}
+}
+
+func Test_buildRemovedTagsExpired(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-time.Hour)))
+	pvc.SetAnnotations(map[string]string{
+		"k8s-pvc-tagger/tags":     `{"migration": "phase1", "team": "a", "old": "b"}`,
+		"k8s-pvc-tagger/ttl-tags": `{"migration": "` + time.Now().Add(-30*time.Minute).Format(time.RFC3339) + `", "old": "` + time.Now().Add(2*time.Hour).Format(time.RFC3339) + `"}`,
+		"k8s-pvc-tagger/remove":   `["foo", "migration"]`,
+	})
+	if got, want := buildRemovedTags(pvc), []string{"migration", "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buildRemovedTags() = %v, want %v", got, want)
+	}
+	tags := buildTags(pvc)
+	if _, ok := tags["migration"]; ok {
+		t.Errorf("buildTags() = %v, want the expired migration tag removed", tags)
+	}
+	if tags["old"] != "b" || tags["team"] != "a" {
+		t.Errorf("buildTags() = %v, want the old and team tags", tags)
+	}
+}
@@ -0,0 +1,348 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tagChange is how the tags of a PVC's volume would change
+type tagChange struct {
+	Namespace string
+	PVC       string
+	VolumeID  string
+	Added     map[string]string
+	// Changed are the old and new values of the changed tags
+	Changed map[string][2]string
+	Removed []string
+}
+
+func (c tagChange) isEmpty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Removed) == 0
+}
+
+// String returns the changes as +key=value, ~key=old->new and -key, sorted by key
+func (c tagChange) String() string {
+	var changes []string
+	for k, v := range c.Added {
+		changes = append(changes, "+"+k+"="+v)
+	}
+	for k, v := range c.Changed {
+		changes = append(changes, "~"+k+"="+v[0]+"->"+v[1])
+	}
+	for _, k := range c.Removed {
+		changes = append(changes, "-"+k)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i][1:] < changes[j][1:] })
+	return strings.Join(changes, " ")
+}
+
+// tagKeyChanges counts the volumes whose tag would be added, changed or removed
+type tagKeyChanges struct {
+	Added   int
+	Changed int
+	Removed int
+}
+
+// computeTagChange returns how the volume's existing tags would change with
+// the tags and removed tags computed by the current policy
+func computeTagChange(existing map[string]string, tags map[string]string, removedTags []string) tagChange {
+	change := tagChange{Added: map[string]string{}, Changed: map[string][2]string{}}
+	for k, v := range tags {
+		if old, ok := existing[k]; !ok {
+			change.Added[k] = v
+		} else if old != v {
+			change.Changed[k] = [2]string{old, v}
+		}
+	}
+	for _, k := range removedTags {
+		if _, ok := existing[k]; ok {
+			change.Removed = append(change.Removed, k)
+		}
+	}
+	sort.Strings(change.Removed)
+	return change
+}
+
+// listClusterPVCs returns the PVCs of the --watch-namespace namespaces that
+// match the label and field selectors, sorted by namespace and name
+func listClusterPVCs(ctx context.Context, client kubernetes.Interface) ([]corev1.PersistentVolumeClaim, error) {
+	return listNamespacePVCs(ctx, client, metav1.NamespaceAll)
+}
+
+// listNamespacePVCs returns the PVCs of the namespace, or of all the
+// --watch-namespace namespaces when it's empty, that match the selectors,
+// sorted by namespace and name. There are none if the namespace isn't watched.
+func listNamespacePVCs(ctx context.Context, client kubernetes.Interface, namespace string) ([]corev1.PersistentVolumeClaim, error) {
+	namespaces := []string{metav1.NamespaceAll}
+	if watchNamespace != "" {
+		namespaces = strings.Split(watchNamespace, ",")
+	}
+	var pvcs []corev1.PersistentVolumeClaim
+	for _, ns := range namespaces {
+		ns = strings.TrimSpace(ns)
+		if namespace != metav1.NamespaceAll {
+			if ns != metav1.NamespaceAll && ns != namespace {
+				continue
+			}
+			ns = namespace
+		}
+		list, err := client.CoreV1().PersistentVolumeClaims(ns).List(ctx, metav1.ListOptions{LabelSelector: pvcLabelSelector, FieldSelector: pvcFieldSelector})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list the PVCs: %w", err)
+		}
+		pvcs = append(pvcs, list.Items...)
+	}
+	sort.Slice(pvcs, func(i, j int) bool {
+		return pvcs[i].Namespace+"/"+pvcs[i].Name < pvcs[j].Namespace+"/"+pvcs[j].Name
+	})
+	return pvcs, nil
+}
+
+// getVolumeTags returns the current tags of the volume
+func getVolumeTags(provider string, volumeID string, efsClient *EFSClient, ec2Client *EBSClient) (map[string]string, error) {
+	switch provider {
+	case providerAWSEBS:
+		return ec2Client.getEBSVolumeTags(volumeID)
+	case providerAWSEFS:
+		return efsClient.getEFSVolumeTags(volumeID)
+	}
+	return nil, fmt.Errorf("unsupported provider %q", provider)
+}
+
+// validateAgainstCluster computes the tags of every bound PVC with the current
+// policy and writes how the tags of their volumes would change. It returns the
+// number of PVCs that could not be evaluated.
+func validateAgainstCluster(ctx context.Context, client kubernetes.Interface, efsClient *EFSClient, ec2Client *EBSClient, w io.Writer, errW io.Writer) (int, error) {
+	pvcs, err := listClusterPVCs(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+
+	// With the tags hash tag, the EBS volumes whose hash matches are known to
+	// be unchanged without describing their tags
+	hashes := map[string]string{}
+	if tagsHashKey != "" {
+		if hashes, err = listEBSTagsHashes(ec2Client); err != nil {
+			fmt.Fprintln(errW, "Cannot list the tags hashes, comparing every volume's tags:", err)
+			hashes = map[string]string{}
+		}
+	}
+
+	evaluated, changed, failed := 0, 0, 0
+	keys := map[string]*tagKeyChanges{}
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if getProvider(pvc) == "" || pvc.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		volumeID, tags, err := processPersistentVolumeClaim(pvc)
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot compute the tags of %s/%s: %v\n", pvc.Namespace, pvc.Name, err)
+			failed++
+			continue
+		}
+		removedTags := buildRemovedTags(pvc)
+		if hash, ok := hashes[volumeID]; ok && len(removedTags) == 0 && getProvider(pvc) == providerAWSEBS && isTagsHashCurrent(map[string]string{tagsHashKey: hash}, tags) {
+			evaluated++
+			continue
+		}
+		existing, err := getVolumeTags(getProvider(pvc), volumeID, efsClient, ec2Client)
+		if err != nil {
+			fmt.Fprintf(errW, "Cannot get the tags of %s for %s/%s: %v\n", volumeID, pvc.Namespace, pvc.Name, err)
+			failed++
+			continue
+		}
+		evaluated++
+		if owner, ok := existing[managedByTagKey]; ok && clusterName != "" && owner != managedByTagValue() && !forceTakeover {
+			fmt.Fprintf(w, "%s/%s\t%s\tskipped, managed by %s\n", pvc.Namespace, pvc.Name, volumeID, owner)
+			continue
+		}
+		change := computeTagChange(existing, tags, removedTags)
+		if change.isEmpty() {
+			continue
+		}
+		changed++
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\n", pvc.Namespace, pvc.Name, volumeID, change)
+		for k := range change.Added {
+			tagKeyChangesFor(keys, k).Added++
+		}
+		for k := range change.Changed {
+			tagKeyChangesFor(keys, k).Changed++
+		}
+		for _, k := range change.Removed {
+			tagKeyChangesFor(keys, k).Removed++
+		}
+	}
+
+	fmt.Fprintf(w, "%d of %d volumes would change\n", changed, evaluated)
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(w, "%s\t%d added\t%d changed\t%d removed\n", k, keys[k].Added, keys[k].Changed, keys[k].Removed)
+	}
+	return failed, nil
+}
+
+func tagKeyChangesFor(keys map[string]*tagKeyChanges, key string) *tagKeyChanges {
+	if keys[key] == nil {
+		keys[key] = &tagKeyChanges{}
+	}
+	return keys[key]
+}
+
+// runValidateCommand runs the validate subcommand which checks the tag policy
+// flags and, with --against-cluster, reports how the tags of the live volumes
+// would change if the controller ran with them, before deploying them
+func runValidateCommand(args []string, w io.Writer, errW io.Writer) int {
+	fs := newCommandFlagSet("validate", errW)
+	againstCluster := fs.Bool("against-cluster", false, "Compare the tags computed for every live PVC with the current tags of its volume")
+	kubeconfig := fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	kubeContext := fs.String("context", "", "the context to use")
+	region := fs.String("region", os.Getenv("AWS_REGION"), "the region")
+	fs.StringVar(&cloudProvider, "provider", cloudProviderAWS, "The cloud provider the volumes are tagged with (aws, fake)")
+	fs.StringVar(&providerEndpoint, "provider-endpoint", "", "Override the AWS API endpoint, e.g. for LocalStack")
+	fs.BoolVar(&localstack, "localstack", false, "Use static test credentials with the provider-endpoint, for LocalStack")
+	defaultTagsString := fs.String("default-tags", "", "Default tags to add to EBS/EFS volume")
+	volumeTypeDefaultTagsString := fs.String("volume-type-default-tags", "", "A json encoded map of volume type to the default tags of the volumes of that type")
+	fs.StringVar(&tagFormat, "tag-format", "json", "Whether the tags are in json or csv format")
+	fs.StringVar(&annotationPrefix, "annotation-prefix", "k8s-pvc-tagger", "Annotation prefix to check")
+	tagSourcesString := fs.String("tag-sources", tagSourceAnnotations, "Comma separated list of where to read PVC tags from")
+	tagAnnotationAliasesString := fs.String("tag-annotation-aliases", "", "Comma separated list of tag keys that can be set with their own annotation")
+	fs.StringVar(&watchNamespace, "watch-namespace", "", "A specific namespace to evaluate (default is all namespaces)")
+	fs.StringVar(&pvcLabelSelector, "label-selector", "", "Only evaluate PVCs matching this label selector")
+	fs.StringVar(&pvcFieldSelector, "field-selector", "", "Only evaluate PVCs matching this field selector")
+	fs.StringVar(&clusterName, "cluster-name", "", "The name of the cluster, used to set the managed-by tag")
+	fs.BoolVar(&forceTakeover, "force-takeover", false, "Whether or not to tag volumes whose managed-by tag belongs to another cluster")
+	fs.StringVar(&nameTagTemplate, "name-tag-template", "", "A template for the Name tag of the volumes")
+	fs.BoolVar(&allowAllTags, "allow-all-tags", false, "Whether or not to allow any tag, even Kubernetes assigned ones, to be set")
+	fs.StringVar(&backupPlanTagKey, "backup-plan-tag-key", "backup-plan", "The tag key used by AWS Backup / DLM policies to select volumes")
+	allowedBackupPlansString := fs.String("allowed-backup-plans", "", "Comma separated list of backup plan values that can be set via the backup-plan annotation")
+	fs.StringVar(&reclaimPolicyTagKey, "reclaim-policy-tag-key", "", "The tag key set to the reclaim policy of the PVC's PV")
+	fs.StringVar(&tagsHashKey, "tags-hash-key", "", "The tag key set to a hash of the other tags applied to the volume")
+	fs.BoolVar(&drTags, "dr-tags", false, "Whether or not to set the DR tags from the dr-replicate and dr-region annotations of the PVC, its namespace or its StorageClass")
+	fs.StringVar(&drReplicateTagKey, "dr-replicate-tag-key", "dr-replicate", "The tag key DR tooling selects the volumes and snapshots to replicate with")
+	fs.StringVar(&drRegionTagKey, "dr-region-tag-key", "dr-region", "The tag key set to the region the volume is replicated to")
+	fs.BoolVar(&deletionProtection, "deletion-protection", false, "Whether or not to set the deletion protection tag from the deletion-protection annotation of the PVC or its namespace")
+	fs.StringVar(&deletionProtectionTagKey, "deletion-protection-tag-key", "deletion-protection", "The tag key set to true on the volumes of protected PVCs")
+	labelValueReplacementsString := fs.String("label-value-replacements", "", "A json encoded map of strings to replace in label keys and values")
+	fs.BoolVar(&ebsTemplateVars, "ebs-template-vars", false, "Whether or not to describe the PVC's EBS volume for the EBS tag template variables")
+	fs.BoolVar(&volumeTemplateVars, "volume-template-vars", false, "Whether or not to read the PV bound to the PVC for the volume tag template variables")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if defaultTags, err = parseDefaultTags(*defaultTagsString); err != nil {
+		fmt.Fprintln(errW, "default-tags are not valid json key/value pairs:", err)
+		return 2
+	}
+	if volumeTypeDefaultTags, err = parseVolumeTypeDefaultTags(*volumeTypeDefaultTagsString); err != nil {
+		fmt.Fprintln(errW, "volume-type-default-tags are not valid:", err)
+		return 2
+	}
+	if tagSources, err = parseTagSources(*tagSourcesString); err != nil {
+		fmt.Fprintln(errW, "tag-sources is not valid:", err)
+		return 2
+	}
+	if tagAnnotationAliases, err = parseTagAnnotationAliases(*tagAnnotationAliasesString); err != nil {
+		fmt.Fprintln(errW, "tag-annotation-aliases is not valid:", err)
+		return 2
+	}
+	if drTags {
+		if err := validateDRTagKeys(drReplicateTagKey, drRegionTagKey); err != nil {
+			fmt.Fprintln(errW, "dr-replicate-tag-key and dr-region-tag-key are not valid:", err)
+			return 2
+		}
+	}
+	if deletionProtection {
+		if err := validateTag(deletionProtectionTagKey, "true"); err != nil {
+			fmt.Fprintln(errW, "deletion-protection-tag-key is not valid:", err)
+			return 2
+		}
+	}
+	if *labelValueReplacementsString != "" {
+		replacements := map[string]string{}
+		if err := json.Unmarshal([]byte(*labelValueReplacementsString), &replacements); err != nil {
+			fmt.Fprintln(errW, "label-value-replacements are not valid json key/value pairs:", err)
+			return 2
+		}
+		labelValueReplacer = newLabelValueReplacer(replacements)
+	}
+	allowedBackupPlans = nil
+	for _, plan := range strings.Split(*allowedBackupPlansString, ",") {
+		if plan = strings.TrimSpace(plan); plan != "" {
+			allowedBackupPlans = append(allowedBackupPlans, plan)
+		}
+	}
+	if !*againstCluster {
+		fmt.Fprintln(w, "The configuration is valid")
+		return 0
+	}
+
+	// The per-PVC errors are reported on errW, keep the logs for real problems
+	if log.GetLevel() > log.WarnLevel {
+		log.SetLevel(log.WarnLevel)
+	}
+	client, err := BuildClient(*kubeconfig, *kubeContext)
+	if err != nil {
+		fmt.Fprintln(errW, "Cannot connect to the cluster:", err)
+		return 1
+	}
+	k8sClient = client
+	if cloudProvider != cloudProviderFake {
+		if *region == "" {
+			*region, _ = getMetadataRegion()
+		}
+		awsSession = createAWSSession(*region)
+		if ebsTemplateVars || len(volumeTypeDefaultTags) > 0 {
+			volumeAttributes = newEBSVolumeAttributesFromSession(awsSession)
+		}
+	}
+	ec2Client, _ := newEC2Client()
+	if drTags && cloudProvider != cloudProviderFake {
+		drSnapshotSources = newDRSnapshotSourceStore(ec2Client)
+	}
+	efsClient, _ := newEFSClient()
+
+	failed, err := validateAgainstCluster(context.Background(), client, efsClient, ec2Client, w, errW)
+	if err != nil {
+		fmt.Fprintln(errW, err)
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(errW, "%d PVCs could not be evaluated\n", failed)
+		return 1
+	}
+	return 0
+}
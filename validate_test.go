@@ -0,0 +1,163 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_computeTagChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    map[string]string
+		tags        map[string]string
+		removedTags []string
+		want        string
+	}{
+		{
+			name:     "unchanged",
+			existing: map[string]string{"team": "a", "CSIVolumeName": "pvc-1"},
+			tags:     map[string]string{"team": "a"},
+			want:     "",
+		},
+		{
+			name:        "added, changed and removed",
+			existing:    map[string]string{"team": "a", "tier": "gold", "old": "x"},
+			tags:        map[string]string{"team": "b", "backup": "daily"},
+			removedTags: []string{"old", "missing"},
+			want:        "+backup=daily -old ~team=a->b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeTagChange(tt.existing, tt.tags, tt.removedTags)
+			if got.String() != tt.want {
+				t.Errorf("computeTagChange() = %q, want %q", got.String(), tt.want)
+			}
+			if got.isEmpty() != (tt.want == "") {
+				t.Errorf("computeTagChange().isEmpty() = %v, want %v", got.isEmpty(), tt.want == "")
+			}
+		})
+	}
+}
+
+func Test_validateAgainstCluster(t *testing.T) {
+	defaultTags = map[string]string{"team": "storage", "backup": "daily"}
+	clusterName = "prod"
+	defer func() {
+		defaultTags = map[string]string{}
+		clusterName = ""
+	}()
+	store := newFakeTagStore()
+	store.addTags("vol-tagged", map[string]string{"managed-by": "k8s-pvc-tagger/prod", "team": "storage", "backup": "daily"})
+	store.addTags("vol-changed", map[string]string{"managed-by": "k8s-pvc-tagger/prod", "team": "platform", "cost-center": "123"})
+	store.addTags("vol-other", map[string]string{"managed-by": "k8s-pvc-tagger/staging"})
+	ec2Client := &EBSClient{&fakeEC2{store: store}}
+	efsClient := &EFSClient{&fakeEFS{store: store}}
+
+	storageClass := "gp3"
+	newPVC := func(name string, volumeName string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": "ebs.csi.aws.com"}},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName, StorageClassName: &storageClass},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		}
+		for k, v := range annotations {
+			pvc.Annotations[k] = v
+		}
+		return pvc
+	}
+	newPV := func(name string, volumeID string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: volumeID},
+		}}}
+	}
+	pending := newPVC("pending", "", nil)
+	pending.Status.Phase = corev1.ClaimPending
+	client := fake.NewSimpleClientset(
+		newPVC("tagged", "pv-tagged", nil),
+		newPVC("changed", "pv-changed", map[string]string{"k8s-pvc-tagger/remove": `["cost-center"]`}),
+		newPVC("other", "pv-other", nil),
+		newPVC("new", "pv-new", nil),
+		newPVC("missing-pv", "pv-missing", nil),
+		pending,
+		newPV("pv-tagged", "vol-tagged"),
+		newPV("pv-changed", "vol-changed"),
+		newPV("pv-other", "vol-other"),
+		newPV("pv-new", "vol-new"),
+	)
+	k8sClient = client
+
+	var out, errOut bytes.Buffer
+	failed, err := validateAgainstCluster(context.Background(), client, efsClient, ec2Client, &out, &errOut)
+	if err != nil {
+		t.Fatalf("validateAgainstCluster() error = %v", err)
+	}
+	if failed != 1 {
+		t.Errorf("validateAgainstCluster() failed = %v, want 1: %v", failed, errOut.String())
+	}
+	want := "default/changed\tvol-changed\t+backup=daily -cost-center ~team=platform->storage\n" +
+		"default/new\tvol-new\t+backup=daily +managed-by=k8s-pvc-tagger/prod +team=storage\n" +
+		"default/other\tvol-other\tskipped, managed by k8s-pvc-tagger/staging\n" +
+		"2 of 4 volumes would change\n" +
+		"backup\t2 added\t0 changed\t0 removed\n" +
+		"cost-center\t0 added\t0 changed\t1 removed\n" +
+		"managed-by\t1 added\t0 changed\t0 removed\n" +
+		"team\t1 added\t1 changed\t0 removed\n"
+	if out.String() != want {
+		t.Errorf("validateAgainstCluster() output =\n%s\nwant\n%s", out.String(), want)
+	}
+	if !reflect.DeepEqual(store.get("vol-changed"), map[string]string{"managed-by": "k8s-pvc-tagger/prod", "team": "platform", "cost-center": "123"}) {
+		t.Errorf("validateAgainstCluster() changed the tags of vol-changed to %v", store.get("vol-changed"))
+	}
+}
+
+func Test_runValidateCommand(t *testing.T) {
+	defer func() {
+		defaultTags = map[string]string{}
+		tagSources = []string{tagSourceAnnotations}
+		tagAnnotationAliases = nil
+	}()
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{name: "valid", args: []string{"--default-tags", `{"team": "storage"}`, "--tag-sources", "annotations,labels"}, wantCode: 0},
+		{name: "invalid default tags", args: []string{"--default-tags", `team=storage`}, wantCode: 2},
+		{name: "invalid tag source", args: []string{"--tag-sources", "annotations,nodes"}, wantCode: 2},
+		{name: "reserved tag annotation alias", args: []string{"--tag-annotation-aliases", "team,remove"}, wantCode: 2},
+		{name: "invalid volume type default tags", args: []string{"--volume-type-default-tags", `{"gp3": "daily"}`}, wantCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			if code := runValidateCommand(tt.args, &out, &errOut); code != tt.wantCode {
+				t.Errorf("runValidateCommand() = %v, want %v: %s", code, tt.wantCode, errOut.String())
+			}
+		})
+	}
+}
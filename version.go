@@ -0,0 +1,98 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionInfo is the build metadata printed by the version command
+type versionInfo struct {
+	Version         string   `json:"version"`
+	Commit          string   `json:"commit"`
+	BuildTime       string   `json:"buildTime"`
+	GoVersion       string   `json:"goVersion"`
+	Providers       []string `json:"providers"`
+	VolumeProviders []string `json:"volumeProviders"`
+}
+
+func getVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:         buildVersion,
+		Commit:          buildCommit,
+		BuildTime:       buildTime,
+		GoVersion:       runtime.Version(),
+		Providers:       []string{cloudProviderAWS, cloudProviderFake},
+		VolumeProviders: []string{providerAWSEBS, providerAWSEFS},
+	}
+	// The Dockerfile sets the build time in seconds since the epoch
+	if seconds, err := strconv.ParseInt(buildTime, 10, 64); err == nil {
+		info.BuildTime = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+	}
+	// Binaries built with go build from a git checkout know their commit
+	if info.Commit == "" {
+		if bi, ok := runtimedebug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "vcs.revision" {
+					info.Commit = s.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+func printVersion(w io.Writer, output string) error {
+	info := getVersionInfo()
+	switch output {
+	case "json":
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "", "text":
+		_, err := fmt.Fprintf(w, "Version:          %s\nCommit:           %s\nBuild Time:       %s\nGo Version:       %s\nProviders:        %s\nVolume Providers: %s\n",
+			info.Version, info.Commit, info.BuildTime, info.GoVersion, strings.Join(info.Providers, ", "), strings.Join(info.VolumeProviders, ", "))
+		return err
+	}
+	return fmt.Errorf("%q is not one of text, json", output)
+}
+
+// runVersionCommand runs `k8s-pvc-tagger version [--output=text|json]` and returns the exit code
+func runVersionCommand(args []string, w io.Writer, errW io.Writer) int {
+	fs := newCommandFlagSet("version", errW)
+	output := fs.String("output", "text", "The output format, text or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := printVersion(w, *output); err != nil {
+		fmt.Fprintln(errW, err)
+		return 2
+	}
+	return 0
+}
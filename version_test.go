@@ -0,0 +1,94 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_runVersionCommand(t *testing.T) {
+	buildVersion = "v1.2.3"
+	buildCommit = "abc123"
+	buildTime = "1700000000"
+	defer func() {
+		buildVersion = ""
+		buildCommit = ""
+		buildTime = ""
+	}()
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "text",
+			args:     nil,
+			wantCode: 0,
+			want:     []string{"Version:          v1.2.3\n", "Commit:           abc123\n", "Build Time:       2023-11-14T22:13:20Z\n", "Providers:        aws, fake\n"},
+		},
+		{
+			name:     "json",
+			args:     []string{"--output=json"},
+			wantCode: 0,
+			want:     []string{`"version": "v1.2.3"`, `"commit": "abc123"`, `"buildTime": "2023-11-14T22:13:20Z"`},
+		},
+		{
+			name:     "unknown output",
+			args:     []string{"--output=yaml"},
+			wantCode: 2,
+		},
+		{
+			name:     "unknown flag",
+			args:     []string{"--foo"},
+			wantCode: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			if code := runVersionCommand(tt.args, &out, &errOut); code != tt.wantCode {
+				t.Errorf("runVersionCommand() = %v, want %v", code, tt.wantCode)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("runVersionCommand() output = %v, want it to contain %v", out.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_printVersionJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := printVersion(&out, "json"); err != nil {
+		t.Fatalf("printVersion() err = %v", err)
+	}
+	var info versionInfo
+	if err := json.Unmarshal(out.Bytes(), &info); err != nil {
+		t.Fatalf("printVersion() is not valid json: %v", err)
+	}
+	if info.GoVersion == "" || len(info.VolumeProviders) != 2 {
+		t.Errorf("printVersion() = %+v, want the Go version and the volume providers", info)
+	}
+}
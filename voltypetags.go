@@ -0,0 +1,85 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// volumeTypeEFS is the volume type of the EFS volumes in --volume-type-default-tags
+const volumeTypeEFS = "efs"
+
+// volumeTypeDefaultTags are the default tags by volume type, e.g. gp3, io2,
+// st1 or efs, set with --volume-type-default-tags
+var volumeTypeDefaultTags map[string]map[string]string
+
+// parseVolumeTypeDefaultTags parses the json encoded map of volume type to tags
+func parseVolumeTypeDefaultTags(s string) (map[string]map[string]string, error) {
+	tags := map[string]map[string]string{}
+	if s == "" {
+		return tags, nil
+	}
+	if err := json.Unmarshal([]byte(s), &tags); err != nil {
+		return nil, err
+	}
+	for volumeType := range tags {
+		if volumeType == "" {
+			return nil, fmt.Errorf("empty volume type")
+		}
+	}
+	return tags, nil
+}
+
+// volumeTypes returns the volume types with default tags, sorted
+func volumeTypes(tags map[string]map[string]string) []string {
+	types := make([]string, 0, len(tags))
+	for volumeType := range tags {
+		types = append(types, volumeType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// getPVCVolumeType returns the type of the PVC's volume: efs for EFS volumes
+// and the described volume type for EBS volumes, or "" if it is unknown
+func getPVCVolumeType(pvc *corev1.PersistentVolumeClaim) string {
+	switch getProvider(pvc) {
+	case providerAWSEFS:
+		return volumeTypeEFS
+	case providerAWSEBS:
+		return getPVCEBSVolumeVars(pvc).VolumeType
+	}
+	return ""
+}
+
+// getVolumeTypeDefaultTags returns the default tags of the PVC's volume type
+func getVolumeTypeDefaultTags(pvc *corev1.PersistentVolumeClaim) (string, map[string]string) {
+	if len(volumeTypeDefaultTags) == 0 {
+		return "", nil
+	}
+	volumeType := getPVCVolumeType(pvc)
+	if volumeType == "" {
+		return "", nil
+	}
+	return volumeType, volumeTypeDefaultTags[volumeType]
+}
@@ -0,0 +1,162 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseVolumeTypeDefaultTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]map[string]string
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: map[string]map[string]string{}},
+		{
+			name: "volume types",
+			s:    `{"gp3": {"backup": "daily"}, "efs": {"backup": "weekly", "tier": "shared"}}`,
+			want: map[string]map[string]string{"gp3": {"backup": "daily"}, "efs": {"backup": "weekly", "tier": "shared"}},
+		},
+		{name: "flat tags", s: `{"backup": "daily"}`, wantErr: true},
+		{name: "empty volume type", s: `{"": {"backup": "daily"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVolumeTypeDefaultTags(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVolumeTypeDefaultTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVolumeTypeDefaultTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsVolumeTypeDefaultTags(t *testing.T) {
+	volumeTypeDefaultTags = map[string]map[string]string{
+		"gp3": {"backup": "daily", "tier": "general"},
+		"st1": {"backup": "none", "tier": "throughput"},
+		"efs": {"backup": "weekly", "tier": "shared"},
+	}
+	defaultTags = map[string]string{"team": "storage", "tier": "unknown"}
+	volumeAttributes = newEBSVolumeAttributes(&describeVolumesEC2{volumes: map[string]*ec2.Volume{
+		"vol-gp3": {VolumeType: aws.String("gp3")},
+		"vol-io2": {VolumeType: aws.String("io2")},
+	}}, nil)
+	defer func() {
+		volumeTypeDefaultTags = nil
+		defaultTags = map[string]string{}
+		volumeAttributes = nil
+	}()
+	newPV := func(name string, driver string, handle string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle},
+			}},
+		}
+	}
+	k8sClient = fake.NewSimpleClientset(
+		newPV("pv-gp3", "ebs.csi.aws.com", "vol-gp3"),
+		newPV("pv-io2", "ebs.csi.aws.com", "vol-io2"),
+		newPV("pv-efs", "efs.csi.aws.com", "fs-123::fsap-456"),
+	)
+
+	tests := []struct {
+		name           string
+		provisioner    string
+		volumeName     string
+		annotations    map[string]string
+		want           map[string]string
+		wantProvenance string
+	}{
+		{
+			name:           "gp3 volume",
+			provisioner:    "ebs.csi.aws.com",
+			volumeName:     "pv-gp3",
+			want:           map[string]string{"team": "storage", "backup": "daily", "tier": "general"},
+			wantProvenance: "volume-type-default-tags/gp3",
+		},
+		{
+			name:           "efs volume",
+			provisioner:    "efs.csi.aws.com",
+			volumeName:     "pv-efs",
+			want:           map[string]string{"team": "storage", "backup": "weekly", "tier": "shared"},
+			wantProvenance: "volume-type-default-tags/efs",
+		},
+		{
+			name:           "volume type without default tags",
+			provisioner:    "ebs.csi.aws.com",
+			volumeName:     "pv-io2",
+			want:           map[string]string{"team": "storage", "tier": "unknown"},
+			wantProvenance: "default-tags",
+		},
+		{
+			name:           "unbound PVC",
+			provisioner:    "ebs.csi.aws.com",
+			want:           map[string]string{"team": "storage", "tier": "unknown"},
+			wantProvenance: "default-tags",
+		},
+		{
+			name:           "annotation overrides the volume type tags",
+			provisioner:    "ebs.csi.aws.com",
+			volumeName:     "pv-gp3",
+			annotations:    map[string]string{"k8s-pvc-tagger/tags": `{"tier": "critical"}`},
+			want:           map[string]string{"team": "storage", "backup": "daily", "tier": "critical"},
+			wantProvenance: "annotations",
+		},
+		{
+			name:        "ignoring the default tags",
+			provisioner: "ebs.csi.aws.com",
+			volumeName:  "pv-gp3",
+			annotations: map[string]string{"k8s-pvc-tagger/ignore": "default-tags"},
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"volume.beta.kubernetes.io/storage-provisioner": tt.provisioner}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: tt.volumeName}}
+			pvc.SetName("data")
+			pvc.SetNamespace("default")
+			pvc.SetAnnotations(annotations)
+			provenance := map[string]string{}
+			got := buildTagsWithProvenance(pvc, provenance)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTagsWithProvenance() = %v, want %v", got, tt.want)
+			}
+			if tt.wantProvenance != "" && provenance["tier"] != tt.wantProvenance {
+				t.Errorf("provenance of tier = %q, want %q", provenance["tier"], tt.wantProvenance)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// volumeIDRule resolves the cloud resource ID from the volume handle of a CSI
+// driver that isn't supported out of the box, e.g. an in-house driver that
+// wraps EBS volumes
+type volumeIDRule struct {
+	// Driver is the name of the CSI driver, as set in the storage-provisioner annotation
+	Driver string `json:"driver"`
+	// Pattern is matched against the volume handle, the resource ID is the
+	// capture group named "id" or else the first capture group
+	Pattern  string `json:"pattern"`
+	Provider string `json:"provider"`
+
+	re *regexp.Regexp
+}
+
+var volumeIDRules []volumeIDRule
+
+// parseVolumeIDRules parses and validates a json encoded list of volumeIDRules
+func parseVolumeIDRules(rulesString string) ([]volumeIDRule, error) {
+	var rules []volumeIDRule
+	if err := json.Unmarshal([]byte(rulesString), &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].Driver == "" {
+			return nil, fmt.Errorf("rule %d has no driver", i)
+		}
+		if rules[i].Provider != providerAWSEBS && rules[i].Provider != providerAWSEFS {
+			return nil, fmt.Errorf("rule %d has an invalid provider %q", i, rules[i].Provider)
+		}
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d has an invalid pattern: %w", i, err)
+		}
+		if re.NumSubexp() == 0 {
+			return nil, fmt.Errorf("rule %d pattern has no capture group for the resource ID", i)
+		}
+		rules[i].re = re
+	}
+	return rules, nil
+}
+
+// getVolumeIDRule returns the rule for the PVC's CSI driver, if any
+func getVolumeIDRule(pvc *corev1.PersistentVolumeClaim) *volumeIDRule {
+	provisionedBy, ok := pvc.GetAnnotations()["volume.beta.kubernetes.io/storage-provisioner"]
+	if !ok {
+		return nil
+	}
+	for i := range volumeIDRules {
+		if volumeIDRules[i].Driver == provisionedBy {
+			return &volumeIDRules[i]
+		}
+	}
+	return nil
+}
+
+// resolve returns the resource ID from the volume handle, or an empty string
+// if the handle doesn't match the rule's pattern
+func (r *volumeIDRule) resolve(volumeHandle string) string {
+	matches := r.re.FindStringSubmatch(volumeHandle)
+	if matches == nil {
+		return ""
+	}
+	if i := r.re.SubexpIndex("id"); i > 0 {
+		return matches[i]
+	}
+	return matches[1]
+}
@@ -0,0 +1,153 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseVolumeIDRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name:    "valid rule",
+			rules:   `[{"driver": "ebs.example.com", "pattern": "^wrapped-(vol-\\w+)$", "provider": "aws-ebs"}]`,
+			wantErr: false,
+		},
+		{
+			name:    "invalid json",
+			rules:   `{"driver": "ebs.example.com"}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing driver",
+			rules:   `[{"pattern": "^(vol-\\w+)$", "provider": "aws-ebs"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid provider",
+			rules:   `[{"driver": "ebs.example.com", "pattern": "^(vol-\\w+)$", "provider": "gcp"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			rules:   `[{"driver": "ebs.example.com", "pattern": "^(vol-\\w+$", "provider": "aws-ebs"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "no capture group",
+			rules:   `[{"driver": "ebs.example.com", "pattern": "^vol-\\w+$", "provider": "aws-ebs"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseVolumeIDRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseVolumeIDRules() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_processCustomDriverPersistentVolumeClaim(t *testing.T) {
+	rules, err := parseVolumeIDRules(`[
+		{"driver": "ebs.example.com", "pattern": "^wrapped-(vol-\\w+)$", "provider": "aws-ebs"},
+		{"driver": "efs.example.com", "pattern": "^(?P<fs>fs-\\w+)/(?P<id>fsap-\\w+)$", "provider": "aws-efs"}
+	]`)
+	if err != nil {
+		t.Fatalf("parseVolumeIDRules() err = %v", err)
+	}
+	volumeIDRules = rules
+	defer func() { volumeIDRules = nil }()
+
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		volumeHandle   string
+		wantedProvider string
+		wantedVolumeID string
+		wantedErr      bool
+	}{
+		{
+			name:           "custom ebs driver",
+			provisionedBy:  "ebs.example.com",
+			volumeHandle:   "wrapped-vol-12345",
+			wantedProvider: providerAWSEBS,
+			wantedVolumeID: "vol-12345",
+		},
+		{
+			name:           "custom efs driver with named group",
+			provisionedBy:  "efs.example.com",
+			volumeHandle:   "fs-12345/fsap-12345",
+			wantedProvider: providerAWSEFS,
+			wantedVolumeID: "fsap-12345",
+		},
+		{
+			name:           "handle not matching",
+			provisionedBy:  "ebs.example.com",
+			volumeHandle:   "vol-12345",
+			wantedProvider: providerAWSEBS,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "unknown driver",
+			provisionedBy:  "other.example.com",
+			volumeHandle:   "vol-12345",
+			wantedProvider: "",
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.Spec.VolumeName = "pvc-1234"
+			pvc.SetAnnotations(map[string]string{"volume.beta.kubernetes.io/storage-provisioner": tt.provisionedBy})
+			k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: tt.volumeHandle},
+					},
+				},
+			})
+
+			if got := getProvider(pvc); got != tt.wantedProvider {
+				t.Errorf("getProvider() = %v, want %v", got, tt.wantedProvider)
+			}
+			volumeID, _, err := processPersistentVolumeClaim(pvc)
+			if (err != nil) != tt.wantedErr {
+				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The EFS CSI volume handle is [FileSystemId]:[Subpath]:[AccessPointId], the
+// subpath and access point being optional
+const regexpEFSVolumeHandle = `^fs-\w+:([^:]*)(?::(fsap-\w+))?$`
+
+// volumeTemplateVars is whether to read the PV bound to the PVC for the
+// VolumeHandle, VolumeAttributes, AccessPointID and AccessPointPath template variables
+var volumeTemplateVars bool
+
+// volumeVars are the provisioning parameters recorded on the PV
+type volumeVars struct {
+	Handle          string
+	Attributes      map[string]string
+	AccessPointID   string
+	AccessPointPath string
+}
+
+// getPVCVolumeVars returns the provisioning parameters recorded on the PV
+// bound to the PVC, or empty values if it is not bound to a CSI volume
+func getPVCVolumeVars(pvc *corev1.PersistentVolumeClaim) volumeVars {
+	if pvc.Spec.VolumeName == "" {
+		return volumeVars{}
+	}
+	pv, err := persistentVolumes.get(pvc.Spec.VolumeName)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Could not get the PV:", err)
+		return volumeVars{}
+	}
+	return parseVolumeVars(pv)
+}
+
+func parseVolumeVars(pv *corev1.PersistentVolume) volumeVars {
+	if pv.Spec.CSI == nil {
+		return volumeVars{}
+	}
+	vars := volumeVars{
+		Handle:     pv.Spec.CSI.VolumeHandle,
+		Attributes: pv.Spec.CSI.VolumeAttributes,
+	}
+	if pv.Spec.CSI.Driver == "efs.csi.aws.com" {
+		if matches := regexp.MustCompile(regexpEFSVolumeHandle).FindStringSubmatch(pv.Spec.CSI.VolumeHandle); matches != nil {
+			vars.AccessPointPath = matches[1]
+			vars.AccessPointID = matches[2]
+		}
+	}
+	return vars
+}
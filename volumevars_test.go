@@ -0,0 +1,91 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_getPVCVolumeVars(t *testing.T) {
+	newPV := func(name string, source corev1.PersistentVolumeSource) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: source}}
+	}
+	efsAttributes := map[string]string{"storage.kubernetes.io/csiProvisionerIdentity": "1657-efs.csi.aws.com"}
+	k8sClient = fake.NewSimpleClientset(
+		newPV("efs-dynamic", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-123::fsap-456", VolumeAttributes: efsAttributes}}),
+		newPV("efs-static", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-123:/apps/billing:fsap-456"}}),
+		newPV("efs-subpath", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-123:/apps/billing"}}),
+		newPV("ebs", corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-123"}}),
+		newPV("in-tree", corev1.PersistentVolumeSource{AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-123"}}),
+	)
+
+	tests := []struct {
+		name       string
+		volumeName string
+		want       volumeVars
+	}{
+		{
+			name:       "dynamically provisioned EFS access point",
+			volumeName: "efs-dynamic",
+			want:       volumeVars{Handle: "fs-123::fsap-456", Attributes: efsAttributes, AccessPointID: "fsap-456"},
+		},
+		{
+			name:       "static EFS access point with a subpath",
+			volumeName: "efs-static",
+			want:       volumeVars{Handle: "fs-123:/apps/billing:fsap-456", AccessPointID: "fsap-456", AccessPointPath: "/apps/billing"},
+		},
+		{
+			name:       "EFS subpath without an access point",
+			volumeName: "efs-subpath",
+			want:       volumeVars{Handle: "fs-123:/apps/billing", AccessPointPath: "/apps/billing"},
+		},
+		{
+			name:       "EBS",
+			volumeName: "ebs",
+			want:       volumeVars{Handle: "vol-123"},
+		},
+		{
+			name:       "in-tree volume",
+			volumeName: "in-tree",
+			want:       volumeVars{},
+		},
+		{
+			name:       "unknown PV",
+			volumeName: "missing",
+			want:       volumeVars{},
+		},
+		{
+			name: "unbound PVC",
+			want: volumeVars{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{VolumeName: tt.volumeName}}
+			if got := getPVCVolumeVars(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getPVCVolumeVars() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// syncWindow is a daily window, in UTC, during which bulk syncs can run. The
+// end is before the start for windows that span midnight.
+type syncWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+var (
+	syncWindows []syncWindow
+	// controllerStartTime is when this instance became the leader, PVCs created
+	// before it are re-synced in bulk
+	controllerStartTime = time.Now()
+)
+
+// parseSyncWindows parses a comma separated list of HH:MM-HH:MM windows
+func parseSyncWindows(windowsString string) ([]syncWindow, error) {
+	var windows []syncWindow
+	for _, w := range strings.Split(windowsString, ",") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		times := strings.Split(w, "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("window %q is not in the HH:MM-HH:MM format", w)
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, fmt.Errorf("window %q has an invalid start: %w", w, err)
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, fmt.Errorf("window %q has an invalid end: %w", w, err)
+		}
+		windows = append(windows, syncWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inSyncWindow returns true if bulk syncs can run at the given time, which is
+// always the case when no window is configured
+func inSyncWindow(t time.Time) bool {
+	if len(syncWindows) == 0 {
+		return true
+	}
+	t = t.UTC()
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, w := range syncWindows {
+		if w.start <= w.end && now >= w.start && now < w.end {
+			return true
+		}
+		if w.start > w.end && (now >= w.start || now < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBulkResync returns true if the PVC is only seen because the PVCs are being
+// listed on startup, rather than because it was just created
+func isBulkResync(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.GetCreationTimestamp().Time.Before(controllerStartTime)
+}
+
+// deferredResyncStore keeps the resyncs waiting for the next sync window, keyed by namespace/name
+type deferredResyncStore struct {
+	sync.Mutex
+	resyncs map[string]func()
+}
+
+var deferredResyncs = newDeferredResyncStore()
+
+func newDeferredResyncStore() *deferredResyncStore {
+	return &deferredResyncStore{resyncs: map[string]func(){}}
+}
+
+func (s *deferredResyncStore) add(namespace string, name string, resync func()) {
+	s.Lock()
+	defer s.Unlock()
+	s.resyncs[namespace+"/"+name] = resync
+	promDeferredResyncs.Set(float64(len(s.resyncs)))
+}
+
+func (s *deferredResyncStore) delete(namespace string, name string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.resyncs, namespace+"/"+name)
+	promDeferredResyncs.Set(float64(len(s.resyncs)))
+}
+
+// drain removes and returns all of the deferred resyncs, keyed by namespace/name
+func (s *deferredResyncStore) drain() map[string]func() {
+	s.Lock()
+	defer s.Unlock()
+	resyncs := s.resyncs
+	s.resyncs = map[string]func(){}
+	promDeferredResyncs.Set(0)
+	return resyncs
+}
+
+// runDeferredResyncs runs the deferred resyncs once a sync window opens
+func runDeferredResyncs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !inSyncWindow(time.Now()) {
+				continue
+			}
+			resyncs := deferredResyncs.drain()
+			if len(resyncs) > 0 {
+				log.WithFields(log.Fields{"pvcs": len(resyncs)}).Infoln("Sync window open, running deferred resyncs")
+			}
+			for key, resync := range resyncs {
+				ref := strings.SplitN(key, "/", 2)
+				backfills.add(ref[0], ref[1], resync)
+			}
+		}
+	}
+}
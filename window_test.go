@@ -0,0 +1,144 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseSyncWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "single window",
+			windows: "22:00-06:00",
+			want:    1,
+		},
+		{
+			name:    "multiple windows",
+			windows: "01:00-02:00, 12:30-13:00",
+			want:    2,
+		},
+		{
+			name:    "missing end",
+			windows: "22:00",
+			wantErr: true,
+		},
+		{
+			name:    "invalid time",
+			windows: "22:00-25:00",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSyncWindows(tt.windows)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSyncWindows() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("parseSyncWindows() = %v windows, want %v", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_inSyncWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows string
+		time    string
+		want    bool
+	}{
+		{
+			name:    "no windows",
+			windows: "",
+			time:    "12:00",
+			want:    true,
+		},
+		{
+			name:    "inside window",
+			windows: "12:00-13:00",
+			time:    "12:30",
+			want:    true,
+		},
+		{
+			name:    "end of window",
+			windows: "12:00-13:00",
+			time:    "13:00",
+			want:    false,
+		},
+		{
+			name:    "inside window spanning midnight",
+			windows: "22:00-06:00",
+			time:    "01:00",
+			want:    true,
+		},
+		{
+			name:    "outside window spanning midnight",
+			windows: "22:00-06:00",
+			time:    "12:00",
+			want:    false,
+		},
+		{
+			name:    "inside second window",
+			windows: "01:00-02:00,12:00-13:00",
+			time:    "12:15",
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := parseSyncWindows(tt.windows)
+			if err != nil {
+				t.Fatalf("parseSyncWindows() err = %v", err)
+			}
+			syncWindows = windows
+			defer func() { syncWindows = nil }()
+			now, _ := time.Parse("15:04", tt.time)
+			if got := inSyncWindow(now); got != tt.want {
+				t.Errorf("inSyncWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_deferredResyncStore(t *testing.T) {
+	store := newDeferredResyncStore()
+	calls := 0
+	store.add("default", "a", func() { calls++ })
+	store.add("default", "a", func() { calls += 10 })
+	store.add("default", "b", func() { calls += 100 })
+	store.delete("default", "b")
+
+	for _, resync := range store.drain() {
+		resync()
+	}
+	if calls != 10 {
+		t.Errorf("deferredResyncStore ran resyncs = %v, want 10", calls)
+	}
+	if resyncs := store.drain(); len(resyncs) != 0 {
+		t.Errorf("deferredResyncStore.drain() = %v resyncs, want 0", len(resyncs))
+	}
+}